@@ -1,22 +1,59 @@
 package logger
 
 import (
+	"io"
 	"os"
 
 	"github.com/FMotalleb/gin_testfield/logger/scoped"
 	"github.com/sirupsen/logrus"
 )
 
-func SetupLogger(scope string) *logrus.Logger {
-	parentFormatter := []logrus.Formatter{}
-	// if cmd.Params.JsonOutput {
-	parentFormatter = append(parentFormatter, &logrus.JSONFormatter{
-		// PrettyPrint: true,
-	})
-	// }
+// options holds the settings of SetupLogger.
+type options struct {
+	level logrus.Level
+	out   io.Writer
+	json  bool
+}
+
+// Option configures the logger created by SetupLogger.
+type Option func(*options)
+
+// WithLevel sets the minimum level of logged entries (logrus.InfoLevel by default).
+func WithLevel(level logrus.Level) Option {
+	return func(o *options) { o.level = level }
+}
+
+// WithOutput sets the writer the entries are written to (os.Stdout by default).
+func WithOutput(out io.Writer) Option {
+	return func(o *options) { o.out = out }
+}
+
+// WithJSON selects the JSON formatter (the default) or, if disabled, the text formatter
+// (colored only if the output is a terminal).
+func WithJSON(json bool) Option {
+	return func(o *options) { o.json = json }
+}
+
+// SetupLogger creates a logger whose entries carry the given scope. Without options it logs JSON
+// at info level to os.Stdout.
+func SetupLogger(scope string, opts ...Option) *logrus.Logger {
+	o := options{
+		level: logrus.InfoLevel,
+		out:   os.Stdout,
+		json:  true,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var parentFormatter logrus.Formatter = &logrus.TextFormatter{FullTimestamp: true}
+	if o.json {
+		parentFormatter = &logrus.JSONFormatter{
+			// PrettyPrint: true,
+		}
+	}
 	log := logrus.New()
-	// log.SetLevel(cmd.Params.LogLevel)
-	log.SetFormatter(scoped.New(scope, parentFormatter...))
-	log.SetOutput(os.Stdout)
+	log.SetLevel(o.level)
+	log.SetFormatter(scoped.New(scope, parentFormatter))
+	log.SetOutput(o.out)
 	return log
 }
@@ -0,0 +1,53 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestSetupLoggerDefaults(t *testing.T) {
+	log := SetupLogger("test")
+	if log.GetLevel() != logrus.InfoLevel {
+		t.Errorf("level = %s, want info", log.GetLevel())
+	}
+}
+
+func TestSetupLoggerWritesScopedJSON(t *testing.T) {
+	var out bytes.Buffer
+	log := SetupLogger("api", WithOutput(&out))
+	log.WithField("user_id", "a").Info("hello")
+
+	var entry map[string]any
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("entry %q is not JSON: %v", out.String(), err)
+	}
+	if entry["scope"] != "api" || entry["msg"] != "hello" || entry["user_id"] != "a" {
+		t.Errorf("entry = %v, want the scope, message and fields", entry)
+	}
+}
+
+func TestSetupLoggerLevel(t *testing.T) {
+	var out bytes.Buffer
+	log := SetupLogger("api", WithOutput(&out), WithLevel(logrus.WarnLevel))
+	log.Info("dropped")
+	log.Warn("kept")
+
+	if got := out.String(); strings.Contains(got, "dropped") || !strings.Contains(got, "kept") {
+		t.Errorf("output = %q, want only entries at warning level or above", got)
+	}
+}
+
+func TestSetupLoggerText(t *testing.T) {
+	var out bytes.Buffer
+	log := SetupLogger("api", WithOutput(&out), WithJSON(false))
+	log.Info("hello")
+
+	got := out.String()
+	if json.Valid(bytes.TrimSpace(out.Bytes())) || !strings.Contains(got, "scope=api") || !strings.Contains(got, "msg=hello") {
+		t.Errorf("output = %q, want a text entry with the scope", got)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"time"
 
 	ratelimiter "github.com/FMotalleb/gin_testfield/rate_limiter"
+	rllogrus "github.com/FMotalleb/gin_testfield/rate_limiter/logging/logrus"
 	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis"
@@ -32,10 +33,14 @@ func main() {
 		log.Fatalf("Failed to connect to Redis: %v", err)
 	}
 
-	storage := rlstorage.NewRedisStorage(client, time.Second*10, logrus.StandardLogger())
+	// The middleware logs through log/slog by default. The logrus adapter lives in its own package,
+	// so only the services importing it (like this one) depend on logrus
+	logger := rllogrus.New(logrus.StandardLogger())
+	storage := rlstorage.NewRedisStorage(client, time.Second*10, logger)
 
 	rl, e := ratelimiter.
 		NewConfigBuilder().
+		Logger(logger).
 		Limit(10).
 		Timeout(time.Second * 10).
 		WorkerCount(10).
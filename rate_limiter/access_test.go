@@ -0,0 +1,173 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// hasToken reports whether the request carries an Authorization header.
+func hasToken(ctx *gin.Context) bool {
+	return ctx.GetHeader("Authorization") != ""
+}
+
+func TestOnlyAnonymousExemptsAuthenticatedRequests(t *testing.T) {
+	storage := newCountingStorage()
+	router := newRouter(t, newTestConfig().Storage(storage).Limit(1).Headers(true).OnlyAnonymous(hasToken))
+	authenticated := withHeader("Authorization", "Bearer token")
+
+	for i := 0; i < 3; i++ {
+		rec := serve(router, http.MethodGet, "/", authenticated)
+		expectStatus(t, rec, http.StatusOK)
+		if limit := rec.Header().Get("X-RateLimit-Limit"); limit != "" {
+			t.Fatalf("limit header = %q on an authenticated request, want none", limit)
+		}
+	}
+	if calls := storage.calls(); calls != 0 {
+		t.Fatalf("storage called %d times for authenticated requests, want 0", calls)
+	}
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+	expectStatus(t, serve(router, http.MethodGet, "/", authenticated), http.StatusOK)
+}
+
+func TestSkipExemptsRequestsBeforeIDSelection(t *testing.T) {
+	storage := newCountingStorage()
+	isHealthCheck := func(ctx *gin.Context) bool { return ctx.Request.URL.Path == "/healthz" }
+	router := newRouter(t, newTestConfig().Storage(storage).Limit(1).IdSelectorE(tokenSelector).Skip(isHealthCheck), "/healthz")
+
+	for i := 0; i < 3; i++ {
+		expectStatus(t, serve(router, http.MethodGet, "/healthz"), http.StatusOK)
+	}
+	if calls := storage.calls(); calls != 0 {
+		t.Fatalf("storage called %d times for skipped requests, want 0", calls)
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusBadRequest)
+}
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := parseNetworks([]string{"10.0.0.0/8", " 192.0.2.7 ", "::ffff:198.51.100.0/120", "2001:db8::/32", "::ffff:203.0.113.9"})
+	if err != nil {
+		t.Fatalf("parseNetworks() = %v", err)
+	}
+	tests := map[string]bool{
+		"10.1.2.3":     true,
+		"192.0.2.7":    true,
+		"192.0.2.8":    false,
+		"198.51.100.9": true,
+		"2001:db8::1":  true,
+		"2001:db9::1":  false,
+		"203.0.113.9":  true,
+	}
+	for ip, want := range tests {
+		if got := containsIP(networks, netip.MustParseAddr(ip)); got != want {
+			t.Errorf("containsIP(%s) = %t, want %t", ip, got, want)
+		}
+	}
+
+	for _, invalid := range []string{"10.0.0.0/33", "not-an-ip"} {
+		if _, err := parseNetworks([]string{invalid}); err == nil {
+			t.Errorf("parseNetworks(%q) = nil error, want an error", invalid)
+		}
+	}
+}
+
+func TestAllowlistAndDenylist(t *testing.T) {
+	storage := newCountingStorage()
+	router := newRouter(t, newTestConfig().Storage(storage).Limit(1).
+		Allowlist([]string{"10.0.0.0/8"}).
+		Denylist([]string{"10.6.6.6", "203.0.113.0/24"}))
+
+	for i := 0; i < 3; i++ {
+		expectStatus(t, serve(router, http.MethodGet, "/", fromIP("10.1.2.3")), http.StatusOK)
+	}
+	if calls := storage.calls(); calls != 0 {
+		t.Fatalf("storage called %d times for allowlisted requests, want 0", calls)
+	}
+	// The denylist is checked first, even for allowlisted networks
+	expectStatus(t, serve(router, http.MethodGet, "/", fromIP("10.6.6.6")), http.StatusForbidden)
+	expectStatus(t, serve(router, http.MethodGet, "/", fromIP("[::ffff:203.0.113.5]")), http.StatusForbidden)
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+}
+
+func TestInvalidAccessListsFailValidation(t *testing.T) {
+	if err := newTestConfig().Allowlist([]string{"bogus"}).Validate(); err == nil {
+		t.Error("Validate() = nil for an invalid allowlist, want an error")
+	}
+	if err := newTestConfig().Denylist([]string{"1.2.3.4/40"}).Validate(); err == nil {
+		t.Error("Validate() = nil for an invalid denylist, want an error")
+	}
+}
+
+// discardWriter is a response writer dropping everything written to it, reusing its header map.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w discardWriter) Header() http.Header         { return w.header }
+func (w discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardWriter) WriteHeader(int)             {}
+
+// serveRepeatedly returns a function serving the same request from 192.0.2.1 to router.
+func serveRepeatedly(router http.Handler) func() {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	writer := discardWriter{header: make(http.Header)}
+	return func() {
+		clear(writer.header)
+		router.ServeHTTP(writer, req)
+	}
+}
+
+func TestAllowlistedRequestsNeverTouchStorage(t *testing.T) {
+	storage := newCountingStorage()
+	router := newRouter(t, newTestConfig().Storage(storage).Limit(1).Headers(true).Allowlist([]string{"192.0.2.0/24"}))
+
+	for i := 0; i < 100; i++ {
+		rec := serve(router, http.MethodGet, "/")
+		expectStatus(t, rec, http.StatusOK)
+		if limit := rec.Header().Get("X-RateLimit-Limit"); limit != "" {
+			t.Fatalf("limit header = %q on an allowlisted request, want none", limit)
+		}
+	}
+	if calls := storage.calls(); calls != 0 {
+		t.Errorf("storage called %d times for allowlisted requests, want 0", calls)
+	}
+}
+
+func TestAllowlistedRequestsDoNotAllocate(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations are not comparable under the race detector")
+	}
+	// gin allocates resolving the client IP, so the baseline skips requests right after doing so
+	skipped := serveRepeatedly(newRouter(t, newTestConfig().Skip(func(ctx *gin.Context) bool { return ctx.ClientIP() != "" })))
+	allowlisted := serveRepeatedly(newRouter(t, newTestConfig().Allowlist([]string{"192.0.2.0/24"}).Denylist([]string{"10.0.0.0/8"})))
+
+	baseline := testing.AllocsPerRun(100, skipped)
+	if allocs := testing.AllocsPerRun(100, allowlisted); allocs > baseline {
+		t.Errorf("allowlisted requests allocate %v times, want at most %v as skipped requests", allocs, baseline)
+	}
+}
+
+func BenchmarkAllowlistedRequest(b *testing.B) {
+	serve := serveRepeatedly(newRouter(b, newTestConfig().Allowlist([]string{"192.0.2.0/24"})))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		serve()
+	}
+}
+
+func BenchmarkLimitedRequest(b *testing.B) {
+	// Every request past the first is checked against the storage and rejected, nothing is queued
+	serve := serveRepeatedly(newRouter(b, newTestConfig().Limit(1)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		serve()
+	}
+}
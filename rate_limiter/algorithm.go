@@ -0,0 +1,128 @@
+package ratelimiter
+
+import (
+	"math"
+	"time"
+
+	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
+)
+
+// Algorithm selects how the middleware counts the requests of a client.
+type Algorithm uint8
+
+const (
+	// Counter increments a counter per client and decrements it once the timeout of each
+	// request has passed (default). It works with every storage.
+	Counter Algorithm = iota
+	// SlidingWindow keeps a log of request timestamps per client and counts only the requests
+	// within the trailing timeout, so bursts at window edges are not possible. It requires a
+	// storage implementing rlstorage.SlidingWindowStorage, other storages fall back to Counter.
+	SlidingWindow
+	// GCRA (generic cell rate algorithm) keeps a theoretical arrival time (TAT) per client, advanced by an
+	// emission interval per request, and rejects requests that would push it more than a burst of intervals
+	// ahead, spacing requests out smoothly after a burst instead of resetting at window edges. It requires a
+	// storage implementing rlstorage.GCRAStorage, other storages fall back to Counter. See EmissionInterval and Burst.
+	GCRA
+)
+
+// slidingWindow returns the sliding window storage if the SlidingWindow algorithm is selected
+// and supported by the storage.
+func (cfg *Config) slidingWindow() (rlstorage.SlidingWindowStorage, bool) {
+	if cfg.algorithm != SlidingWindow {
+		return nil, false
+	}
+	storage, ok := rlstorage.As[rlstorage.SlidingWindowStorage](cfg.storage)
+	return storage, ok
+}
+
+// checkSlidingWindow checks and records the request in the sliding window log of the given ID.
+// Entries leave the window on their own, so nothing is queued for release.
+func checkSlidingWindow(cfg *Config, storage rlstorage.SlidingWindowStorage, id string, threshold, cost uint16, res result) result {
+	var recorded bool
+	recorded, res.count, res.resetAt, res.err = storage.CheckAndRecord(id, cfg.clock(), cfg.timeout, threshold, cost)
+	if res.err != nil {
+		return res
+	}
+	if !recorded {
+		return reject(cfg, id, res)
+	}
+	res.cost = cost
+	return res
+}
+
+// tokenBucket returns the bucket storage if the token bucket mode is enabled and supported by the storage.
+func (cfg *Config) tokenBucket() (rlstorage.BucketStorage, bool) {
+	if cfg.bucketRate <= 0 {
+		return nil, false
+	}
+	storage, ok := rlstorage.As[rlstorage.BucketStorage](cfg.storage)
+	return storage, ok
+}
+
+// checkTokenBucket takes a token per unit of cost from the bucket of the given ID, all at once:
+// a rejected request takes no token. The result reports the burst as the limit and the tokens in use as the count.
+func checkTokenBucket(cfg *Config, storage rlstorage.BucketStorage, id string, cost uint16, res result) result {
+	res.limit = cfg.bucketBurst
+	taken, tokens := true, float64(cfg.bucketBurst) // Requests without a cost take nothing
+	if cost > 0 {
+		taken, tokens, res.err = storage.TakeTokens(id, cost, cfg.bucketRate, cfg.bucketBurst)
+	}
+	res.count = cfg.bucketBurst - uint16(min(math.Floor(tokens), float64(cfg.bucketBurst)))
+	if res.err != nil {
+		return res
+	}
+	if !taken {
+		// The tokens become available once the missing ones have been refilled
+		res.resetAt = cfg.clock().Add(time.Duration((float64(cost) - tokens) / cfg.bucketRate * float64(time.Second)))
+		return reject(cfg, id, res)
+	}
+	res.cost = cost
+	return res
+}
+
+// gcra returns the GCRA storage if the GCRA algorithm is selected and supported by the storage.
+func (cfg *Config) gcra() (rlstorage.GCRAStorage, bool) {
+	if cfg.algorithm != GCRA {
+		return nil, false
+	}
+	storage, ok := rlstorage.As[rlstorage.GCRAStorage](cfg.storage)
+	return storage, ok
+}
+
+// gcraParams returns the emission interval and burst of the GCRA for the given limit.
+func (cfg *Config) gcraParams(limit uint16) (time.Duration, uint16) {
+	emission, burst := cfg.emissionInterval, cfg.gcraBurst
+	if emission == 0 {
+		emission = max(cfg.timeout/time.Duration(limit), time.Nanosecond)
+	}
+	if burst == 0 {
+		burst = limit
+	}
+	return emission, burst
+}
+
+// checkGCRA advances the theoretical arrival time of the given ID by an emission interval per unit of cost.
+// The result reports the burst as the limit and the intervals the TAT lies ahead of now as the count.
+// The TAT catches up with time on its own, so nothing is queued for release.
+func checkGCRA(cfg *Config, storage rlstorage.GCRAStorage, id string, limit, cost uint16, res result) result {
+	emission, burst := cfg.gcraParams(limit)
+	tolerance := emission * time.Duration(burst)
+	now := cfg.clock()
+	var allowed bool
+	var tat time.Time
+	allowed, tat, res.err = storage.UpdateTAT(id, now, emission, tolerance, cost)
+	res.limit = burst
+	ahead := math.Ceil(float64(tat.Sub(now)) / float64(emission))
+	res.count = uint16(min(max(ahead, 0), float64(burst)))
+	if res.err != nil {
+		return res
+	}
+	if !allowed {
+		// The request fits once the TAT is back within the tolerance
+		res.resetAt = tat.Add(time.Duration(cost)*emission - tolerance)
+		return reject(cfg, id, res)
+	}
+	res.resetAt = tat
+	res.cost = cost
+	return res
+}
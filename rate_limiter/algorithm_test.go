@@ -0,0 +1,267 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
+	"github.com/gin-gonic/gin"
+)
+
+func TestSlidingWindowCountsTrailingTimeout(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	router := newRouter(t, newTestConfig().Limit(2).Timeout(time.Minute).Algorithm(SlidingWindow).Clock(clock.Now))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	clock.Advance(30 * time.Second)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	clock.Advance(10 * time.Second)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+	clock.Advance(21 * time.Second)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+}
+
+func TestSlidingWindowFallsBackToCounter(t *testing.T) {
+	logger := newRecordingLogger()
+	router := newRouter(t, newTestConfig().Logger(logger).Limit(1).Algorithm(SlidingWindow).Storage(newCountingStorage()))
+
+	if !logger.warned("falling back to `Counter`") {
+		t.Error("no fallback warning for a storage without sliding window support")
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+}
+
+func TestSlidingWindowValidation(t *testing.T) {
+	if err := newTestConfig().Algorithm(SlidingWindow).SamplingRate(2).Validate(); err == nil {
+		t.Error("Validate() = nil for SlidingWindow with SamplingRate, want an error")
+	}
+}
+
+func TestSlidingWindowPreventsWindowEdgeBursts(t *testing.T) {
+	const limit = 5
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC) // The start of a fixed window
+	// admitted serves a burst of 2×limit requests straddling the end of the window, half of them
+	// a millisecond before it and half a millisecond after it, and returns how many were allowed.
+	admitted := func(t *testing.T, configure func(cfg *Config, clock *fakeClock) *Config) int {
+		clock := newFakeClock(start)
+		router := newRouter(t, configure(newTestConfig().Limit(limit).Timeout(time.Minute).QueueSize(2*limit), clock))
+		allowed := 0
+		for _, at := range []time.Duration{time.Minute - time.Millisecond, time.Minute + time.Millisecond} {
+			clock.Set(start.Add(at))
+			for i := 0; i < limit; i++ {
+				if serve(router, http.MethodGet, "/").Code == http.StatusOK {
+					allowed++
+				}
+			}
+		}
+		return allowed
+	}
+
+	counter := admitted(t, func(cfg *Config, clock *fakeClock) *Config {
+		return cfg.Clock(clock.Now).Storage(rlstorage.NewFixedWindowStorageWithClock(time.Minute, clock.Now, discardLogger()))
+	})
+	if counter != 2*limit {
+		t.Errorf("Counter over fixed windows allowed %d requests within 2ms, want 2×limit (%d)", counter, 2*limit)
+	}
+	sliding := admitted(t, func(cfg *Config, clock *fakeClock) *Config {
+		return cfg.Clock(clock.Now).Algorithm(SlidingWindow)
+	})
+	if sliding != limit {
+		t.Errorf("SlidingWindow allowed %d requests within 2ms, want the limit (%d)", sliding, limit)
+	}
+}
+
+func TestTokenBucketRefillsOverTime(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	// A single worker and no queue wait: requests would be overloaded if they were queued for release
+	router := newRouter(t, newTestConfig().TokenBucket(2, 3).Clock(clock.Now).WorkerCount(1).QueueTimeout(time.Millisecond))
+
+	for i := 0; i < 3; i++ {
+		expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+
+	clock.Advance(time.Second)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+}
+
+func TestRejectedWeightedRequestTakesNoToken(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	router := newRouter(t, newTestConfig().TokenBucket(0.001, 5).Clock(clock.Now).Cost(func(c *gin.Context) uint16 {
+		if c.FullPath() == "/heavy" {
+			return 4
+		}
+		return 1
+	}), "/heavy", "/light")
+
+	expectStatus(t, serve(router, http.MethodGet, "/heavy"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/heavy"), http.StatusTooManyRequests)
+	// The rejected request left the last token in the bucket
+	expectStatus(t, serve(router, http.MethodGet, "/light"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/light"), http.StatusTooManyRequests)
+}
+
+func TestTokenBucketThroughWrapperStorage(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	logger := newRecordingLogger()
+	primary := rlstorage.NewHashMapStorageWithClock(clock.Now, logger)
+	storage := rlstorage.NewReadReplicaStorage(primary, rlstorage.NewHashMapStorageWithClock(clock.Now, logger))
+	router := newRouter(t, newTestConfig().Logger(logger).TokenBucket(0.001, 1).Storage(storage).Clock(clock.Now))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+	if warnings := logger.warningsWith("TokenBucket"); len(warnings) != 0 {
+		t.Errorf("warnings = %v, want the token bucket served by the wrapped storage", warnings)
+	}
+
+	// A wrapper over a storage without token buckets falls back instead of failing every request
+	logger = newRecordingLogger()
+	newRouter(t, newTestConfig().Logger(logger).TokenBucket(0.001, 1).Storage(rlstorage.NewReadReplicaStorage(newCountingStorage())))
+	if len(logger.warningsWith("TokenBucket")) == 0 {
+		t.Error("no fallback warning for a wrapper over a storage without token bucket support")
+	}
+}
+
+func TestTokenBucketFallsBackWithoutBucketStorage(t *testing.T) {
+	logger := newRecordingLogger()
+	router := newRouter(t, newTestConfig().Logger(logger).Limit(1).TokenBucket(100, 100).Storage(newCountingStorage()))
+
+	if len(logger.warningsWith("TokenBucket")) == 0 {
+		t.Error("no fallback warning for a storage without token bucket support")
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+}
+
+func TestTokenBucketValidation(t *testing.T) {
+	if err := newTestConfig().TokenBucket(1, 1).Algorithm(SlidingWindow).Validate(); err == nil {
+		t.Error("Validate() = nil for TokenBucket with SlidingWindow, want an error")
+	}
+}
+
+func TestGCRASpacesRequestsAfterBurst(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	// A single worker and no queue wait: requests would be overloaded if they were queued for release
+	router := newRouter(t, newTestConfig().Limit(2).Timeout(2*time.Second).Tolerance(0).Algorithm(GCRA).Clock(clock.Now).
+		WorkerCount(1).QueueTimeout(time.Millisecond))
+
+	// The emission interval is derived from the timeout and the limit (1s), the burst is the limit
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+	clock.Advance(time.Second)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+}
+
+func TestGCRASmoothsWhereTheCounterBursts(t *testing.T) {
+	admitted := func(algorithm Algorithm) []int {
+		start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		clock := newFakeClock(start)
+		released := make(chan struct{}, 16)
+		cfg := clock.drive(newTestConfig().Limit(4).Timeout(4 * time.Second).Tolerance(0).Algorithm(algorithm).
+			WorkerCount(4).QueueTimeout(time.Millisecond).
+			OnRelease(func(string, map[string]string) { released <- struct{}{} }))
+		router := newRouter(t, cfg)
+
+		// Four requests every second for eight seconds. The counter queues its entries for release,
+		// so the entries due at each tick are awaited before sending the next requests
+		var admissions []time.Time
+		var pattern []int
+		for tick := 0; tick < 8; tick++ {
+			for _, at := range admissions {
+				if algorithm != Counter || !at.Add(4*time.Second).Equal(clock.Now()) {
+					continue
+				}
+				select {
+				case <-released:
+				case <-time.After(time.Second):
+					t.Fatalf("the entry admitted at %s was not released", at.Sub(start))
+				}
+			}
+			count := 0
+			for i := 0; i < 4; i++ {
+				if serve(router, http.MethodGet, "/").Code == http.StatusOK {
+					admissions = append(admissions, clock.Now())
+					count++
+				}
+			}
+			pattern = append(pattern, count)
+			clock.Advance(time.Second)
+		}
+		return pattern
+	}
+
+	// Over the same schedule, the counter admits a full limit once per timeout
+	// while the GCRA admits the burst, then one request per emission interval
+	if got, want := admitted(Counter), []int{4, 0, 0, 0, 4, 0, 0, 0}; !slices.Equal(got, want) {
+		t.Errorf("Counter admitted %v per second, want %v", got, want)
+	}
+	if got, want := admitted(GCRA), []int{4, 1, 1, 1, 1, 1, 1, 1}; !slices.Equal(got, want) {
+		t.Errorf("GCRA admitted %v per second, want %v", got, want)
+	}
+}
+
+func TestGCRARetryAfterFollowsTheEmissionInterval(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	router := newRouter(t, newTestConfig().Limit(2).Timeout(20*time.Second).Tolerance(0).Algorithm(GCRA).Clock(clock.Now))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	// The next request conforms one emission interval (10s) later, not after the whole timeout
+	for _, want := range []string{"10", "6"} {
+		rec := serve(router, http.MethodGet, "/")
+		expectStatus(t, rec, http.StatusTooManyRequests)
+		if got := rec.Header().Get("Retry-After"); got != want {
+			t.Errorf("Retry-After = %q, want %q", got, want)
+		}
+		clock.Advance(4 * time.Second)
+	}
+}
+
+func TestGCRAEmissionIntervalAndBurst(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	router := newRouter(t, newTestConfig().Limit(100).Algorithm(GCRA).EmissionInterval(100*time.Millisecond).Burst(1).Clock(clock.Now))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+	clock.Advance(100 * time.Millisecond)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+}
+
+func TestGCRAFallsBackToCounter(t *testing.T) {
+	logger := newRecordingLogger()
+	router := newRouter(t, newTestConfig().Logger(logger).Limit(1).Algorithm(GCRA).Storage(newCountingStorage()))
+
+	if !logger.warned("the storage does not support the `GCRA` algorithm") {
+		t.Error("no fallback warning for a storage without GCRA support")
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+}
+
+func TestGCRAParams(t *testing.T) {
+	cfg := newTestConfig().Timeout(time.Minute)
+	if emission, burst := cfg.gcraParams(60); emission != time.Second || burst != 60 {
+		t.Errorf("gcraParams(60) = %s, %d, want 1s, 60 derived from the timeout and the limit", emission, burst)
+	}
+	cfg.EmissionInterval(time.Millisecond).Burst(5)
+	if emission, burst := cfg.gcraParams(60); emission != time.Millisecond || burst != 5 {
+		t.Errorf("gcraParams(60) = %s, %d, want the configured 1ms, 5", emission, burst)
+	}
+}
+
+func TestGCRAValidation(t *testing.T) {
+	if err := newTestConfig().Algorithm(GCRA).TokenBucket(1, 1).Validate(); err == nil {
+		t.Error("Validate() = nil for GCRA with TokenBucket, want an error")
+	}
+	if err := newTestConfig().EmissionInterval(-time.Second).Validate(); err == nil {
+		t.Error("Validate() = nil for a negative emission interval, want an error")
+	}
+}
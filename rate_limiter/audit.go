@@ -0,0 +1,68 @@
+package ratelimiter
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// auditBufferSize is the number of audit events buffered for the sink before new events are dropped.
+const auditBufferSize = 1024
+
+// AuditEvent describes a single limit decision, as delivered to the audit sink.
+// Events posted to a Webhook are encoded using the JSON field names below.
+type AuditEvent struct {
+	Time    time.Time `json:"time"`    // The time the decision was made at
+	Key     string    `json:"key"`     // The rate limiting key of the request
+	Outcome string    `json:"outcome"` // The decision: "allowed", "limited" or "overloaded"
+	Count   uint16    `json:"count"`   // The client's count once the request was accounted for
+	Limit   uint16    `json:"limit"`   // The limit applied to the request
+}
+
+// auditor delivers audit events to the sink from its own goroutine, so a slow sink
+// never blocks the request path.
+type auditor struct {
+	events  chan AuditEvent  // The buffered events waiting for the sink
+	sink    func(AuditEvent) // The function the events are delivered to
+	dropped atomic.Uint64    // The number of events dropped because the buffer was full
+}
+
+// newAuditor creates an auditor delivering events to the given sink.
+func newAuditor(sink func(AuditEvent)) *auditor {
+	return &auditor{
+		events: make(chan AuditEvent, auditBufferSize),
+		sink:   sink,
+	}
+}
+
+// record queues the given event for the sink, dropping (and counting) it if the buffer is full.
+func (a *auditor) record(event AuditEvent) {
+	select {
+	case a.events <- event:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// run delivers the queued events to the sink until stop is closed.
+func (a *auditor) run(stop <-chan struct{}) {
+	for {
+		select {
+		case event := <-a.events:
+			a.sink(event)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// String returns the name of the decision as reported in audit events.
+func (d decision) String() string {
+	switch d {
+	case limited:
+		return "limited"
+	case overloaded:
+		return "overloaded"
+	default:
+		return "allowed"
+	}
+}
@@ -0,0 +1,60 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAuditSinkReceivesDecisions(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	events := make(chan AuditEvent, 2)
+	router := newRouter(t, newTestConfig().Limit(1).Clock(clock.Now).AuditSink(func(event AuditEvent) {
+		events <- event
+	}))
+
+	serve(router, http.MethodGet, "/")
+	serve(router, http.MethodGet, "/")
+	want := []AuditEvent{
+		{Time: clock.Now(), Key: "192.0.2.1", Outcome: "allowed", Count: 1, Limit: 1},
+		{Time: clock.Now(), Key: "192.0.2.1", Outcome: "limited", Count: 1, Limit: 1},
+	}
+	for _, expected := range want {
+		select {
+		case event := <-events:
+			if event != expected {
+				t.Errorf("event = %+v, want %+v", event, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %+v not delivered", expected)
+		}
+	}
+}
+
+func TestSlowAuditSinkNeverBlocksRequests(t *testing.T) {
+	const requests = auditBufferSize + 100
+	delivering := make(chan struct{})
+	unblock := make(chan struct{})
+	defer close(unblock)
+	cfg := newTestConfig().Limit(1).AuditSink(func(AuditEvent) {
+		select {
+		case delivering <- struct{}{}:
+		default:
+		}
+		<-unblock
+	})
+	router := newRouter(t, cfg)
+
+	serve(router, http.MethodGet, "/")
+	<-delivering // The sink is stuck on the first event
+	start := time.Now()
+	for i := 1; i < requests; i++ {
+		serve(router, http.MethodGet, "/")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("requests took %v behind a stuck sink", elapsed)
+	}
+	if dropped := cfg.AuditDropped(); dropped != requests-1-auditBufferSize {
+		t.Errorf("AuditDropped() = %d, want %d", dropped, requests-1-auditBufferSize)
+	}
+}
@@ -0,0 +1,46 @@
+package cleanup
+
+import (
+	"time"
+
+	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
+)
+
+// IdleWorker periodically sweeps ids that have been idle for longer than maxIdle.
+type IdleWorker struct {
+	sweeper  rlstorage.IdleSweeper
+	maxIdle  time.Duration
+	stopChan chan struct{}
+}
+
+// NewIdleWorker creates a worker sweeping ids idle for longer than maxIdle.
+// Sweeps run every maxIdle/2, so an idle id is removed at most 1.5*maxIdle after its last access.
+func NewIdleWorker(sweeper rlstorage.IdleSweeper, maxIdle time.Duration) *IdleWorker {
+	return &IdleWorker{
+		sweeper:  sweeper,
+		maxIdle:  maxIdle,
+		stopChan: make(chan struct{}),
+	}
+}
+
+func (iw *IdleWorker) Start() {
+	go iw.run()
+}
+
+func (iw *IdleWorker) Stop() {
+	close(iw.stopChan)
+}
+
+func (iw *IdleWorker) run() {
+	ticker := time.NewTicker(max(iw.maxIdle/2, time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			iw.sweeper.SweepIdle(iw.maxIdle)
+		case <-iw.stopChan:
+			return
+		}
+	}
+}
@@ -2,6 +2,8 @@
 package cleanup
 
 import (
+	"math/rand/v2"
+	"sync"
 	"time"
 
 	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
@@ -10,7 +12,10 @@ import (
 type CleanupWorker struct {
 	storage  rlstorage.RLStorage
 	rotation time.Duration
+	jitter   time.Duration
+	trigger  <-chan struct{}
 	stopChan chan struct{}
+	stopOnce sync.Once
 }
 
 func NewWorker(storage rlstorage.RLStorage, rotation time.Duration) *CleanupWorker {
@@ -21,24 +26,65 @@ func NewWorker(storage rlstorage.RLStorage, rotation time.Duration) *CleanupWork
 	}
 }
 
+// WithTrigger sets a channel that triggers a cleanup on demand whenever a value is sent to it,
+// in addition to the ticker. A rotation of 0 disables the ticker, leaving only the trigger.
+func (cw *CleanupWorker) WithTrigger(trigger <-chan struct{}) *CleanupWorker {
+	cw.trigger = trigger
+	return cw
+}
+
+// WithJitter randomizes the first tick within ±jitter of the rotation, so instances sharing the same
+// rotation do not all wipe a shared storage at the same moment. Later ticks follow every rotation.
+func (cw *CleanupWorker) WithJitter(jitter time.Duration) *CleanupWorker {
+	cw.jitter = jitter
+	return cw
+}
+
 func (cw *CleanupWorker) Start() {
 	go cw.run()
 }
 
+// Stop stops the worker, no cleanup runs afterwards. It is safe to call more than once.
 func (cw *CleanupWorker) Stop() {
-	close(cw.stopChan)
+	cw.stopOnce.Do(func() { close(cw.stopChan) })
 }
 
 func (cw *CleanupWorker) run() {
-	ticker := time.NewTicker(cw.rotation)
-	defer ticker.Stop()
+	var tick <-chan time.Time
+	var ticker *time.Ticker
+	if cw.rotation > 0 {
+		first := time.NewTimer(cw.firstTick())
+		defer first.Stop()
+		tick = first.C
+	}
+	trigger := cw.trigger
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-tick:
+			cw.storage.FreeAll()
+			if ticker == nil {
+				ticker = time.NewTicker(cw.rotation)
+				defer ticker.Stop()
+				tick = ticker.C
+			}
+		case _, ok := <-trigger:
+			if !ok {
+				trigger = nil // A closed trigger never fires again
+				continue
+			}
 			cw.storage.FreeAll()
 		case <-cw.stopChan:
 			return
 		}
 	}
 }
+
+// firstTick returns the delay of the first tick: the rotation shifted by a random offset within ±jitter.
+func (cw *CleanupWorker) firstTick() time.Duration {
+	if cw.jitter <= 0 {
+		return cw.rotation
+	}
+	offset := time.Duration(rand.Int64N(int64(2*cw.jitter)+1)) - cw.jitter
+	return max(cw.rotation+offset, time.Millisecond)
+}
@@ -0,0 +1,137 @@
+package cleanup
+
+import (
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	rllog "github.com/FMotalleb/gin_testfield/rate_limiter/logging"
+	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
+)
+
+// freeAllCounter wraps a storage, counting its FreeAll calls.
+type freeAllCounter struct {
+	rlstorage.RLStorage
+	calls atomic.Int64
+}
+
+func newFreeAllCounter() *freeAllCounter {
+	logger := rllog.NewSlog(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	return &freeAllCounter{RLStorage: rlstorage.NewHashMapStorage(logger)}
+}
+
+func (s *freeAllCounter) FreeAll() error {
+	s.calls.Add(1)
+	return s.RLStorage.FreeAll()
+}
+
+// waitFor polls condition until it holds, failing the test after a second.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within a second")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestTriggerRunsCleanup(t *testing.T) {
+	storage := newFreeAllCounter()
+	storage.Increase("a")
+	trigger := make(chan struct{})
+	worker := NewWorker(storage, 0).WithTrigger(trigger)
+	worker.Start()
+	defer worker.Stop()
+
+	trigger <- struct{}{}
+	waitFor(t, func() bool { return storage.calls.Load() == 1 })
+	if count, _ := storage.Get("a"); count != 0 {
+		t.Fatalf("count after a triggered cleanup = %d, want 0", count)
+	}
+	trigger <- struct{}{}
+	waitFor(t, func() bool { return storage.calls.Load() == 2 })
+}
+
+func TestClosedTriggerStopsTriggering(t *testing.T) {
+	storage := newFreeAllCounter()
+	trigger := make(chan struct{})
+	worker := NewWorker(storage, 0).WithTrigger(trigger)
+	worker.Start()
+	defer worker.Stop()
+
+	close(trigger)
+	time.Sleep(20 * time.Millisecond)
+	if calls := storage.calls.Load(); calls != 0 {
+		t.Fatalf("a closed trigger ran %d cleanups, want none", calls)
+	}
+}
+
+func TestRotationRunsCleanup(t *testing.T) {
+	storage := newFreeAllCounter()
+	worker := NewWorker(storage, 10*time.Millisecond)
+	worker.Start()
+	defer worker.Stop()
+
+	waitFor(t, func() bool { return storage.calls.Load() >= 2 })
+}
+
+func TestStopStopsCleanup(t *testing.T) {
+	storage := newFreeAllCounter()
+	trigger := make(chan struct{}, 1)
+	worker := NewWorker(storage, time.Hour).WithTrigger(trigger)
+	worker.Start()
+	worker.Stop()
+	worker.Stop() // Stopping twice is safe
+
+	time.Sleep(10 * time.Millisecond)
+	trigger <- struct{}{}
+	time.Sleep(20 * time.Millisecond)
+	if calls := storage.calls.Load(); calls != 0 {
+		t.Fatalf("a stopped worker ran %d cleanups, want none", calls)
+	}
+}
+
+func TestFirstTickWithoutJitterIsRotation(t *testing.T) {
+	worker := NewWorker(newFreeAllCounter(), time.Minute)
+	if first := worker.firstTick(); first != time.Minute {
+		t.Fatalf("firstTick() without jitter = %s, want the rotation", first)
+	}
+}
+
+func TestFirstTickIsJitteredWithinBounds(t *testing.T) {
+	worker := NewWorker(newFreeAllCounter(), time.Minute).WithJitter(6 * time.Second)
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		first := worker.firstTick()
+		if first < 54*time.Second || first > 66*time.Second {
+			t.Fatalf("firstTick() = %s, want within ±6s of a minute", first)
+		}
+		seen[first] = true
+	}
+	if len(seen) < 2 {
+		t.Fatal("firstTick() returned the same delay every time, want it spread")
+	}
+}
+
+func TestFirstTickIsAtLeastAMillisecond(t *testing.T) {
+	worker := NewWorker(newFreeAllCounter(), time.Millisecond).WithJitter(time.Hour)
+	for i := 0; i < 100; i++ {
+		if first := worker.firstTick(); first < time.Millisecond {
+			t.Fatalf("firstTick() = %s, want at least a millisecond", first)
+		}
+	}
+}
+
+func TestJitterOnlyShiftsFirstTick(t *testing.T) {
+	storage := newFreeAllCounter()
+	worker := NewWorker(storage, 20*time.Millisecond).WithJitter(10 * time.Millisecond)
+	worker.Start()
+	defer worker.Stop()
+
+	// The first tick runs within 30ms and the later ones every 20ms
+	waitFor(t, func() bool { return storage.calls.Load() >= 3 })
+}
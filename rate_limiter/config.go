@@ -1,39 +1,237 @@
 package ratelimiter
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/FMotalleb/gin_testfield/rate_limiter/cleanup"
+	rllog "github.com/FMotalleb/gin_testfield/rate_limiter/logging"
 	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
 	"github.com/gin-gonic/gin"
-	"github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Config is a struct that allows building a rate limiting middleware
 // with configurable options.
 type Config struct {
-	limit               uint16              // The maximum number of requests allowed within the timeout duration
-	workerCount         uint16              // The number of worker goroutines to handle rate limiting
-	timeout             time.Duration       // The duration for which the rate limit is enforced
-	tolerance           time.Duration       // The tolerance duration that will be skipped if an entry should be deleted within that window
-	idSelector          IDSelector          // A function that selects the unique identifier for a request
-	storage             rlstorage.RLStorage // The storage backend used for rate limiting data
-	queue               chan rateEntry      // A channel to queue rate limiting entries for release
-	handler             gin.HandlerFunc     // The handler function to be executed if the rate limit is exceeded
-	logger              *logrus.Logger      // The logger instance for logging messages
-	fullCleanupRotation time.Duration       // FullCleanup rotation time to clean whole storage to cover possible memory leak scenario
-}
-
-func (cfg *Config) addToReleaseQueue(id string) {
-	// Adds a rate limiting entry to the release queue with the given ID
+	limit                 uint16                      // The maximum number of requests allowed within the timeout duration
+	workerCount           uint16                      // The number of worker goroutines to handle rate limiting
+	timeout               time.Duration               // The duration for which the rate limit is enforced
+	tolerance             time.Duration               // The tolerance duration that will be skipped if an entry should be deleted within that window
+	idSelector            IDSelector                  // A function that selects the unique identifier for a request
+	storage               rlstorage.RLStorage         // The storage backend used for rate limiting data
+	keyPrefix             string                      // The prefix the storage keys are namespaced under, applied at Build (empty keeps the storage default)
+	queue                 chan rateEntry              // A channel to queue rate limiting entries for release
+	handler               gin.HandlerFunc             // The handler function to be executed if the rate limit is exceeded
+	overloadHandler       gin.HandlerFunc             // The handler function to be executed if the limiter itself is saturated
+	queueTimeout          time.Duration               // The maximum time a request waits for the release queue before being treated as overload (0 waits indefinitely)
+	logger                Logger                      // The logger instance for logging messages
+	fullCleanupRotation   time.Duration               // FullCleanup rotation time to clean whole storage to cover possible memory leak scenario
+	cleanupJitter         float64                     // The fraction of the rotation the first full cleanup is randomly shifted by
+	limitRamp             time.Duration               // The duration over which a lowered limit (via SetLimit) is phased in
+	previousLimit         uint16                      // The effective limit at the time of the last SetLimit call
+	limitChangedAt        time.Time                   // The time of the last SetLimit call
+	limitLock             sync.RWMutex                // A lock guarding runtime limit changes
+	metadataSelector      MetadataSelector            // An optional function that selects metadata to attach to each rate entry
+	onRelease             ReleaseHook                 // An optional hook executed by workers after an entry has been released
+	statusWeight          StatusWeight                // An optional function that weighs a request by its response status
+	penaltyMultiplier     PenaltyMultiplier           // An optional function that scales the release timeout by the client's violation count
+	headers               bool                        // Whether rate limit headers are emitted on responses
+	headerNames           HeaderNames                 // The names of the emitted rate limit headers
+	exactHeaderCase       bool                        // Whether header names are written as given, bypassing canonicalization
+	samplingRate          uint16                      // Only 1 in samplingRate requests is written to the storage
+	cost                  CostFunc                    // An optional function that returns the number of units a request costs
+	perMethod             bool                        // Whether each request method is counted separately
+	treatHeadAsGet        bool                        // Whether HEAD requests are counted as GET requests
+	cleanupTrigger        <-chan struct{}             // An optional channel triggering a full cleanup on demand
+	rejectGrace           uint16                      // The number of requests above the limit that are allowed with a warning
+	clock                 func() time.Time            // The function used to read the current time
+	timer                 timerFunc                   // An optional function starting timers that follow the clock (nil starts real timers)
+	forensics             *forensics                  // An optional forensic logger for repeat offenders
+	suspicious            func(*gin.Context) bool     // An optional detector flagging requests with suspicious headers
+	suspiciousLimit       uint16                      // The stricter limit applied to suspicious requests (0 bans them)
+	rejectionScope        string                      // The scope reported in rejection details (empty disables the details)
+	maxIdle               time.Duration               // The duration after which idle ids are swept from the storage (0 disables sweeping)
+	selfProfiling         bool                        // Whether the middleware measures the time spent in its own body
+	registerer            prometheus.Registerer       // An optional registerer for the Prometheus metrics of the middleware
+	metrics               *metrics                    // The Prometheus collectors, created at Build if a registerer is set
+	tracer                trace.Tracer                // An optional OpenTelemetry tracer the decisions are traced with (nil disables tracing)
+	idSelectorE           IDSelectorE                 // An optional selector that can reject requests at selection time, overriding idSelector
+	invalidIDHandler      gin.HandlerFunc             // The handler function to be executed if idSelectorE rejects a request
+	rejectionLogThreshold uint16                      // The number of rejections logged individually per client and window
+	rejectionLogWindow    time.Duration               // The window over which rejection logs are suppressed (0 disables rejection logs)
+	rejectionLogger       *rejectionLogger            // The rejection logger, created at Build if enabled
+	storageErrorHandler   StorageErrorHandler         // The handler function to be executed if the storage fails while checking a request
+	messages              map[string]string           // The localized rejection messages keyed by lowercased language tag (nil disables localization)
+	checkLocks            keyLocks                    // Serializes the non-atomic read and increase of the same id within this process
+	schedule              []ScheduleEntry             // The daily time ranges with their own limits, evaluated in order
+	policy                string                      // The name of the policy reported in the policy header (empty disables the header)
+	stop                  chan struct{}               // Closed by Shutdown to stop the goroutines started by the middleware
+	stopOnce              sync.Once                   // Guards closing the stop channel
+	workers               sync.WaitGroup              // Tracks the running release workers
+	cleanupWorker         *cleanup.CleanupWorker      // The full cleanup worker, started at Build if enabled
+	idleWorker            *cleanup.IdleWorker         // The idle sweeping worker, started at Build if enabled
+	algorithm             Algorithm                   // The algorithm counting the requests of a client
+	draining              chan struct{}               // Closed by Close to release queued entries right away and stop accepting new ones
+	drainOnce             sync.Once                   // Guards closing the draining channel
+	lifecycle             sync.RWMutex                // Read-held while queuing an entry (or starting a worker), locked to wait for them once closed
+	isAuthenticated       func(*gin.Context) bool     // An optional predicate exempting authenticated requests from limiting
+	bucketRate            float64                     // The token bucket refill rate in tokens per second (0 disables the token bucket mode)
+	bucketBurst           uint16                      // The token bucket capacity
+	emissionInterval      time.Duration               // The GCRA emission interval (0 derives it from the timeout and the limit)
+	gcraBurst             uint16                      // The GCRA burst (0 uses the limit)
+	auditSink             func(AuditEvent)            // An optional sink receiving every limit decision asynchronously
+	auditor               *auditor                    // The audit event dispatcher, created at Build if an audit sink is set
+	claimsKey             string                      // The gin context key of the verified token claims carrying a per-request limit
+	limitClaim            string                      // The name of the numeric claim holding the per-request limit (empty disables it)
+	routeLimits           []routeLimit                // The per-route limit overrides, in registration order
+	methodLimits          map[string]uint16           // The per-method limit overrides, by upper case method
+	readLimit             uint16                      // The limit of read requests if reads and writes are counted separately
+	writeLimit            uint16                      // The limit of write requests if reads and writes are counted separately
+	separateReadWrite     bool                        // Whether reads and writes are counted separately
+	skip                  func(*gin.Context) bool     // The predicate exempting requests from limiting
+	allowlist             []netip.Prefix              // The networks of the clients bypassing limiting
+	denylist              []netip.Prefix              // The networks of the clients rejected regardless of their count
+	deniedHandler         gin.HandlerFunc             // The handler function to be executed for denylisted clients
+	accessListErr         error                       // The error found while parsing the allowlist or denylist, reported by Validate
+	lazyWorkers           bool                        // Whether workers are started on demand rather than at Build
+	workerIdleTimeout     time.Duration               // How long a worker started on demand waits for an entry before exiting
+	autoWorkerClients     uint16                      // The expected number of concurrent clients the workers are sized for at Build (0 disables auto-sizing)
+	running               atomic.Int32                // The number of running workers
+	statusCode            int                         // The status code the default handler rejects requests with
+	histogramInterval     time.Duration               // The interval of the count histogram export (0 disables it)
+	histogramExport       func([]uint64)              // The hook receiving the count histogram periodically
+	dimensions            []dimension                 // The additional dimensions every request is checked against, in registration order
+	violationReport       ViolationReport             // Which violated dimensions are reported when several are violated at once
+	trailers              bool                        // Whether the rate limit headers of allowed requests are sent as trailers
+	staggerer             *staggerer                  // Spaces out the release times of each client's entries (nil releases every entry after the timeout)
+	webhookURL            string                      // The endpoint decision events are posted to (empty disables the webhook)
+	webhookBatchSize      int                         // The number of events that triggers a webhook delivery
+	webhookInterval       time.Duration               // The interval after which a partial batch is delivered to the webhook
+	webhook               *webhook                    // The webhook dispatcher, created at Build if a webhook URL is set
+	onAllowed             DecisionHook                // An optional hook executed for every allowed request
+	onBlocked             DecisionHook                // An optional hook executed for every blocked (limited or overloaded) request
+	deduper               *deduper                    // Remembers recently counted requests so identical repetitions are not counted again (nil disables it)
+	priority              func(*gin.Context) Priority // An optional function classifying requests into priority tiers
+	priorityMultipliers   map[Priority]float64        // The limit multipliers of the priority tiers
+	limitResolver         func(*gin.Context) uint16   // An optional function resolving the limit of each request (e.g. from the customer's plan)
+	lifetime              context.Context             // An optional context whose cancellation drains and shuts the middleware down
+	dropWhenQueueFull     bool                        // Whether requests are treated as overloaded right away if the release queue is full
+}
+
+func (cfg *Config) addToReleaseQueue(id string, weight uint16, metadata map[string]string) bool {
+	// Adds a rate limiting entry to the release queue with the given ID, weight, metadata
 	// and a release time calculated based on the timeout duration.
-	cfg.queue <- rateEntry{
+	// Returns false if the entry could not be queued within the queue timeout, or the middleware was closed or shut down.
+	entry := rateEntry{
 		userID:      id,
-		releaseTime: time.Now().Add(cfg.timeout),
+		releaseTime: cfg.clock().Add(cfg.releaseTimeout(id)),
+		weight:      weight,
+		metadata:    metadata,
+	}
+	if cfg.staggerer != nil {
+		entry.releaseTime = cfg.staggerer.schedule(id, entry.releaseTime, weight)
+	}
+	if !cfg.enqueue(entry) {
+		if cfg.staggerer != nil {
+			cfg.staggerer.released(id, entry.releaseTime)
+		}
+		return false
+	}
+	return true
+}
+
+// enqueue adds the given entry to the release queue, starting a worker on demand in lazy mode.
+// It returns false if the entry could not be queued within the queue timeout, or the middleware was closed or shut down.
+// It holds the lifecycle lock for reading, so once closed the middleware can wait for the entries being queued (see awaitEnqueues).
+func (cfg *Config) enqueue(entry rateEntry) bool {
+	cfg.lifecycle.RLock()
+	defer cfg.lifecycle.RUnlock()
+	if cfg.closed() {
+		return false
+	}
+	if cfg.lazyWorkers {
+		select {
+		case cfg.queue <- entry:
+			return true
+		default:
+			if cfg.spawnWorker(entry) {
+				return true
+			}
+		}
+	}
+	if cfg.dropWhenQueueFull {
+		select {
+		case cfg.queue <- entry:
+			return true
+		default:
+			return false
+		}
 	}
+	if cfg.queueTimeout <= 0 {
+		select {
+		case cfg.queue <- entry:
+			return true
+		case <-cfg.draining:
+			return false
+		case <-cfg.stop:
+			return false
+		}
+	}
+
+	timer := time.NewTimer(cfg.queueTimeout)
+	defer timer.Stop()
+	select {
+	case cfg.queue <- entry:
+		return true
+	case <-timer.C:
+		return false
+	case <-cfg.draining:
+		return false
+	case <-cfg.stop:
+		return false
+	}
+}
+
+// releaseTimeout returns the duration after which an entry of the given ID is released.
+// It is the timeout duration scaled by the penalty multiplier of the client's violations (if set).
+func (cfg *Config) releaseTimeout(id string) time.Duration {
+	if cfg.penaltyMultiplier == nil {
+		return cfg.timeout
+	}
+	violations, err := cfg.violations(id)
+	if err != nil {
+		cfg.logger.Warn("failed to read violations, releasing without penalty", "user_id", id, "error", err)
+	}
+	multiplier := cfg.penaltyMultiplier(violations)
+	if multiplier < 1 {
+		// Penalties only slow down recovery, they never speed it up
+		multiplier = 1
+	}
+	return time.Duration(float64(cfg.timeout) * multiplier)
 }
 
+// storageTTL returns the TTL derived for the counters of storages implementing rlstorage.TTLStorage:
+// the timeout plus the tolerance, so a counter outlives the releases of its entries.
+func storageTTL(timeout, tolerance time.Duration) time.Duration {
+	return timeout + tolerance
+}
+
+// minTimeout is the smallest supported timeout duration.
+const minTimeout = time.Microsecond
+
 // NewConfigBuilder creates a new RateLimitBuilder with default options.
 //
 //	limit: 60 requests
@@ -41,28 +239,62 @@ func (cfg *Config) addToReleaseQueue(id string) {
 //	timeout: 1 minute
 //	idSelector: defaultIdSelector (selects the client IP address)
 //	handler: defaultHandler (returns [429]"too many requests")
+//	statusCode: 429 (used by the default handler)
+//	overloadHandler: defaultOverloadHandler (returns [503]"service overloaded")
+//	invalidIDHandler: defaultInvalidIDHandler (returns [400]"unidentifiable client")
+//	deniedHandler: defaultDeniedHandler (returns [403]"client denied")
+//	skip: neverSkip (every request is limited)
+//	storageErrorHandler: defaultStorageErrorHandler (hands storage timeouts to the overloadHandler, and attaches
+//	  other errors to the context, failing open)
+//	queueTimeout: 0 (requests wait for the release queue indefinitely)
+//	workerIdleTimeout: 30 seconds (only used with LazyWorkers)
 //	queue: a new unbuffered channel for rateEntry
-//	storage: an in-memory HashMap storage
-//	logger: the standard logger instance
+//	storage: an in-memory HashMap storage, reading the clock of the config
+//	logger: the default log/slog logger (adapted with rllog.NewSlog), rather than logrus, so services standardized on
+//	  log/slog do not pull logrus in; log through logrus with the adapter of the logging/logrus package (rllogrus.New)
+//	rejectionLogThreshold: 10 rejection logs per client and rejectionLogWindow
+//	rejectionLogWindow: 1 minute
+//	samplingRate: 1 (every request is written to the storage)
+//	headerNames: DefaultHeaderNames (emitting headers is disabled by default)
+//	clock: time.Now
+//	priorityMultipliers: normal 1, high 2, low 0.5
 //	fullCleanupRotation: 24 hours (use 0 value explicitly to disable the cleanup rotation)
+//	cleanupJitter: 0.1 (the first cleanup runs within ±10% of the rotation)
 func NewConfigBuilder() *Config {
-	logger := logrus.StandardLogger()
-	return &Config{
-		limit:               60,
-		workerCount:         20,
-		tolerance:           time.Second * 2,
-		timeout:             time.Minute,
-		idSelector:          defaultIdSelector,
-		handler:             defaultHandler,
-		queue:               make(chan rateEntry),
-		storage:             rlstorage.NewHashMapStorage(logger),
-		logger:              logger,
-		fullCleanupRotation: time.Hour * 24,
-	}
-}
-
-// Logger sets the logger for the middleware.
-func (cfg *Config) Logger(logger *logrus.Logger) *Config {
+	logger := rllog.NewSlog(slog.Default())
+	cfg := &Config{
+		limit:                 60,
+		workerCount:           20,
+		tolerance:             time.Second * 2,
+		timeout:               time.Minute,
+		idSelector:            defaultIdSelector,
+		handler:               defaultHandler,
+		statusCode:            http.StatusTooManyRequests,
+		overloadHandler:       defaultOverloadHandler,
+		invalidIDHandler:      defaultInvalidIDHandler,
+		deniedHandler:         defaultDeniedHandler,
+		skip:                  neverSkip,
+		queue:                 make(chan rateEntry),
+		stop:                  make(chan struct{}),
+		draining:              make(chan struct{}),
+		logger:                logger,
+		fullCleanupRotation:   time.Hour * 24,
+		cleanupJitter:         0.1,
+		headerNames:           DefaultHeaderNames,
+		samplingRate:          1,
+		rejectionLogThreshold: 10,
+		rejectionLogWindow:    time.Minute,
+		clock:                 time.Now,
+		workerIdleTimeout:     defaultWorkerIdleTimeout,
+		priorityMultipliers:   maps.Clone(defaultPriorityMultipliers),
+	}
+	cfg.storage = rlstorage.NewHashMapStorageWithClock(func() time.Time { return cfg.clock() }, logger)
+	cfg.storageErrorHandler = cfg.defaultStorageErrorHandler
+	return cfg
+}
+
+// Logger sets the logger for the middleware. Use rllog.NewSlog or rllogrus.New to adapt a log/slog or logrus logger.
+func (cfg *Config) Logger(logger Logger) *Config {
 	cfg.logger = logger
 	return cfg
 }
@@ -73,19 +305,617 @@ func (cfg *Config) Limit(limit uint16) *Config {
 	return cfg
 }
 
+// LimitRamp sets the duration over which a limit lowered at runtime (via SetLimit) is phased in.
+// During the ramp the effective limit decreases linearly from the previous limit to the new one,
+// so clients already close to the old limit are not rejected all at once.
+// A value of 0 (default) applies lowered limits immediately.
+func (cfg *Config) LimitRamp(ramp time.Duration) *Config {
+	cfg.limitRamp = ramp
+	return cfg
+}
+
+// Algorithm sets the algorithm counting the requests of a client (Counter by default).
+// SlidingWindow requires a storage implementing rlstorage.SlidingWindowStorage and GCRA a storage implementing
+// rlstorage.GCRAStorage, other storages fall back to Counter with a warning at Build. Neither can be combined
+// with StatusWeight or SamplingRate.
+func (cfg *Config) Algorithm(algorithm Algorithm) *Config {
+	cfg.algorithm = algorithm
+	return cfg
+}
+
+// TokenBucket switches the limiter to a token bucket per client, refilled at refillRate tokens per
+// second up to burst tokens, allowing sustained throughput with controlled bursts. Each request takes
+// one token per unit of its cost (units taken before the bucket runs dry are not returned), and
+// nothing is queued for release. The limit and timeout settings do not apply to allowed requests.
+//
+// It requires a storage implementing rlstorage.BucketStorage, other storages fall back to the
+// configured Algorithm with a warning at Build. It cannot be combined with SlidingWindow,
+// StatusWeight or SamplingRate.
+func (cfg *Config) TokenBucket(refillRate float64, burst uint16) *Config {
+	cfg.bucketRate = refillRate
+	cfg.bucketBurst = burst
+	return cfg
+}
+
+// EmissionInterval sets the interval at which the GCRA algorithm lets requests through once a client
+// used its burst (e.g. 100ms for a sustained rate of 10 requests per second). A value of 0 (default)
+// derives it from the timeout divided by the limit that applies to the request.
+func (cfg *Config) EmissionInterval(interval time.Duration) *Config {
+	cfg.emissionInterval = interval
+	return cfg
+}
+
+// Burst sets the number of requests the GCRA algorithm lets through at once from an idle client.
+// A value of 0 (default) uses the limit that applies to the request.
+func (cfg *Config) Burst(burst uint16) *Config {
+	cfg.gcraBurst = burst
+	return cfg
+}
+
+// LimitResolver sets a function consulted per request to determine its limit (e.g. free=10, pro=1000
+// depending on the customer's plan), overriding the static, scheduled, read/write, route and claim limits.
+// It is called after the IdSelector, the selected (scoped) ID being available to the resolver under IDKey.
+// A resolved limit of 0 bans the request. Priority multipliers and the suspicious limit still apply.
+func (cfg *Config) LimitResolver(resolver func(*gin.Context) uint16) *Config {
+	cfg.limitResolver = resolver
+	return cfg
+}
+
+// ClaimLimit reads the per-request limit from the numeric claim of a verified token, e.g. API keys
+// carrying `rate_limit: 1000`. The claims are read from the gin context under claimsKey, where an
+// upstream auth middleware stored them after verifying the token (as a map with string keys, such as
+// map[string]any or jwt.MapClaims). Requests without claims, without the claim, or with a claim that
+// is not a positive number fall back to the static (or scheduled) limit. Claims above 65535 are capped.
+func (cfg *Config) ClaimLimit(claimsKey, claim string) *Config {
+	cfg.claimsKey = claimsKey
+	cfg.limitClaim = claim
+	return cfg
+}
+
+// RouteLimit overrides the limit for the routes matching the given pattern, e.g. "/auth/login" or
+// "/public/*", so a single middleware can enforce different limits per endpoint. Patterns are matched
+// against the gin route template (gin.Context.FullPath) of the request: a `:name` or `*` segment matches
+// any single segment, and a trailing `*name` segment (as in gin catch-all routes) matches the rest.
+// If several patterns match, the most specific (most literal segments) wins.
+//
+// Requests matching a pattern are counted separately per pattern, so traffic on one route does not
+// eat into the budget of another. Requests matching no pattern use the global limit.
+func (cfg *Config) RouteLimit(pattern string, limit uint16) *Config {
+	cfg.routeLimits = append(cfg.routeLimits, newRouteLimit(pattern, limit))
+	return cfg
+}
+
+// Dimension adds a limit applied to every request in addition to the limit of the selected client ID,
+// keyed by the given selector (e.g. per API key and per tenant at once). Keys of the dimension are
+// scoped by its name, so dimensions never share counters. A request is rejected if any dimension is
+// over its limit, in which case it is charged to none of them; see ReportViolations for how violations
+// of several dimensions are reported.
+//
+// Dimensions cannot be combined with StatusWeight.
+func (cfg *Config) Dimension(name string, selector IDSelector, limit uint16) *Config {
+	cfg.dimensions = append(cfg.dimensions, dimension{name: name, selector: selector, limit: limit})
+	return cfg
+}
+
+// ReportViolations sets which dimensions are reported in the headers (and whose limit is stored in
+// the rejection details) when a request violates several dimensions at once: the most restrictive one
+// (the default), the first one, or all of them (adding a limit and remaining value per dimension).
+// The reported dimension names are sent in the HeaderNames.Dimension header.
+func (cfg *Config) ReportViolations(report ViolationReport) *Config {
+	cfg.violationReport = report
+	return cfg
+}
+
+// Schedule sets daily time ranges with their own limits, e.g. a higher limit during business hours.
+// The ranges are evaluated per request against the current time of the clock, the first range
+// containing it applies. Outside every range, the static limit applies.
+func (cfg *Config) Schedule(schedule []ScheduleEntry) *Config {
+	cfg.schedule = schedule
+	return cfg
+}
+
+// SetLimit changes the rate limit of a running middleware.
+// Raised limits apply immediately, lowered limits are phased in over the LimitRamp duration.
+func (cfg *Config) SetLimit(limit uint16) error {
+	if limit == 0 {
+		return errors.New("`Limit` value cannot be 0")
+	}
+
+	// The limit in effect is read under the same lock it is replaced under, so concurrent changes
+	// ramp from the limit the previous change left in effect
+	cfg.limitLock.Lock()
+	defer cfg.limitLock.Unlock()
+	cfg.previousLimit = cfg.rampedLimit()
+	cfg.limitChangedAt = cfg.clock()
+	cfg.limit = limit
+	return nil
+}
+
+// effectiveLimit returns the limit currently in effect, taking a running LimitRamp into account.
+func (cfg *Config) effectiveLimit() uint16 {
+	cfg.limitLock.RLock()
+	defer cfg.limitLock.RUnlock()
+	return cfg.rampedLimit()
+}
+
+// rampedLimit returns the limit currently in effect, taking a running LimitRamp into account.
+// The limit lock must be held.
+func (cfg *Config) rampedLimit() uint16 {
+	if cfg.limitRamp <= 0 || cfg.previousLimit <= cfg.limit {
+		return cfg.limit
+	}
+
+	elapsed := cfg.clock().Sub(cfg.limitChangedAt)
+	if elapsed >= cfg.limitRamp {
+		return cfg.limit
+	}
+	// Linearly interpolate between the previous and the new limit
+	drop := float64(cfg.previousLimit-cfg.limit) * float64(elapsed) / float64(cfg.limitRamp)
+	return cfg.previousLimit - uint16(drop)
+}
+
 // Handler sets the handler function to be executed if the rate limit is exceeded.
 func (cfg *Config) Handler(handler gin.HandlerFunc) *Config {
 	cfg.handler = handler
 	return cfg
 }
 
+// RejectionJSON sets the handler of rate limited requests to one responding with the given object serialized
+// as JSON (see JSONHandler), with the status code set by StatusCode. It is a shorthand for Handler(JSONHandler(obj)).
+func (cfg *Config) RejectionJSON(obj interface{}) *Config {
+	return cfg.Handler(JSONHandler(obj))
+}
+
+// StatusCode sets the status code the default handler rejects requests with (429 by default),
+// e.g. 503 for clients that misbehave on 429. Custom handlers are not affected, except JSONHandler (see RejectionJSON).
+func (cfg *Config) StatusCode(status int) *Config {
+	cfg.statusCode = status
+	return cfg
+}
+
+// RejectionDetails enables including backpressure fields (limit, window_seconds and the given scope,
+// describing what the rate limiting key represents, e.g. "client-ip") in rejections. The default
+// handler then responds with a structured JSON body, custom handlers can read the details from
+// the gin context under RejectionDetailsKey. An empty scope disables the details (default).
+func (cfg *Config) RejectionDetails(scope string) *Config {
+	cfg.rejectionScope = scope
+	return cfg
+}
+
+// MetricsRegisterer sets the Prometheus registerer the metrics of the middleware are registered with at Build:
+//
+//	ratelimiter_requests_allowed_total{route}: requests allowed by the limiter
+//	ratelimiter_requests_blocked_total{route, reason}: requests blocked by the limiter, the reason being one of
+//	  "limited", "overloaded", "denied", "invalid_id" or "storage_error", carrying the trace of the request
+//	  as an exemplar if a Tracer is set
+//	ratelimiter_active_keys: client keys tracked by the storage (see Len), read on every scrape
+//	ratelimiter_storage_evictions_total: client keys evicted by the storage, if it implements rlstorage.EvictionCounter
+//	ratelimiter_middleware_duration_seconds: the middleware overhead, if SelfProfiling is enabled
+//
+// The route label is the gin route template of the request (gin.Context.FullPath), empty for unmatched routes.
+// Requests bypassing the limiter (Skip, Allowlist, OnlyAnonymous) are not counted.
+func (cfg *Config) MetricsRegisterer(registerer prometheus.Registerer) *Config {
+	cfg.registerer = registerer
+	return cfg
+}
+
+// SelfProfiling enables measuring the time spent in the middleware itself per request (excluding
+// downstream handlers), to quantify the limiter's overhead in production. Durations are observed
+// by the `ratelimiter_middleware_duration_seconds` histogram if a MetricsRegisterer is set,
+// otherwise they are logged at debug level. Behavior is not affected otherwise.
+func (cfg *Config) SelfProfiling(enabled bool) *Config {
+	cfg.selfProfiling = enabled
+	return cfg
+}
+
+// RejectionLogSuppression configures the logging of rejected requests: each client gets up to threshold
+// rejections logged individually per window, after which its further rejections are collapsed into
+// a single summary ("client X: 5000 rejections in last 1m0s") emitted at the end of the window.
+// This keeps abusive clients from flooding the logs. A window of 0 disables rejection logs.
+func (cfg *Config) RejectionLogSuppression(threshold uint16, window time.Duration) *Config {
+	cfg.rejectionLogThreshold = threshold
+	cfg.rejectionLogWindow = window
+	return cfg
+}
+
+// ExportHistogram passes the distribution of the current counts across keys (see Config.CountHistogram)
+// to the given hook once per interval, e.g. to feed security analytics. It requires a storage
+// implementing rlstorage.Snapshotter, otherwise a warning is logged at Build and nothing is exported.
+func (cfg *Config) ExportHistogram(interval time.Duration, export func(histogram []uint64)) *Config {
+	cfg.histogramInterval = interval
+	cfg.histogramExport = export
+	return cfg
+}
+
+// AuditSink sets a function receiving every limit decision (e.g. to append it to an event log for compliance),
+// decoupled from the storage. Events are delivered asynchronously from a single goroutine through a buffer of
+// 1024 events; when the buffer is full, events are dropped rather than blocking requests (see AuditDropped).
+func (cfg *Config) AuditSink(sink func(event AuditEvent)) *Config {
+	cfg.auditSink = sink
+	return cfg
+}
+
+// AuditDropped returns the number of audit events dropped because the audit sink fell behind.
+func (cfg *Config) AuditDropped() uint64 {
+	if cfg.auditor == nil {
+		return 0
+	}
+	return cfg.auditor.dropped.Load()
+}
+
+// Webhook posts every limit decision to the given URL, e.g. for centralized abuse monitoring. Events are
+// buffered and posted asynchronously from a single goroutine as a JSON array of AuditEvent, whenever
+// batchSize events are collected or flushInterval elapses with a partial batch pending.
+//
+// Failed deliveries (errors and non-2xx responses) are retried up to 4 times with exponential backoff
+// starting at 250ms. Events are dropped rather than blocking requests when the buffer of 4096 events
+// is full, or once a batch could not be delivered (see WebhookDropped).
+func (cfg *Config) Webhook(url string, batchSize int, flushInterval time.Duration) *Config {
+	cfg.webhookURL = url
+	cfg.webhookBatchSize = batchSize
+	cfg.webhookInterval = flushInterval
+	return cfg
+}
+
+// WebhookDropped returns the number of decision events dropped by the webhook.
+func (cfg *Config) WebhookDropped() uint64 {
+	if cfg.webhook == nil {
+		return 0
+	}
+	return cfg.webhook.dropped.Load()
+}
+
+// OverloadHandler sets the handler function to be executed if the limiter is saturated
+// (e.g. the release queue is full) rather than the client being over its limit.
+func (cfg *Config) OverloadHandler(handler gin.HandlerFunc) *Config {
+	cfg.overloadHandler = handler
+	return cfg
+}
+
+// QueueSize sets the capacity of the release queue (0, the default, makes it unbuffered). With a buffered
+// queue, requests hand their release entry over without waiting for a free worker as long as the buffer
+// has room, which smooths latency spikes under bursts. The tradeoff is memory (each buffered entry holds
+// its ID and metadata) and delayed releases: buffered entries wait until a worker picks them up, so their
+// counts stay charged for longer than the timeout while every worker is busy. See DropWhenQueueFull for
+// what happens once the buffer is full.
+//
+// A buffered queue cannot be combined with LazyWorkers, as workers are only started on demand when the
+// queue is full.
+func (cfg *Config) QueueSize(size int) *Config {
+	if size >= 0 {
+		cfg.queue = make(chan rateEntry, size)
+	}
+	return cfg
+}
+
+// DropWhenQueueFull treats requests as overloaded (rolling their increment back, see OverloadHandler)
+// right away when the release queue is full, instead of blocking them until there is room (or until the
+// QueueTimeout elapses). This bounds the latency the limiter adds, at the cost of rejecting requests.
+func (cfg *Config) DropWhenQueueFull(enabled bool) *Config {
+	cfg.dropWhenQueueFull = enabled
+	return cfg
+}
+
+// QueueTimeout sets the maximum time a request waits for a free release worker.
+// Requests that cannot be queued in time are rejected using the overload handler.
+// A value of 0 (default) makes requests wait indefinitely.
+func (cfg *Config) QueueTimeout(timeout time.Duration) *Config {
+	cfg.queueTimeout = timeout
+	return cfg
+}
+
+// Metadata sets a function that selects a small metadata map (e.g. route, cost) to attach
+// to each rate entry. The metadata travels with the entry through the release queue and
+// is handed to the OnRelease hook. It is bounded to maxMetadataEntries entries with values
+// truncated to maxMetadataValueLength bytes.
+//
+// The OnRelease hook is the only consumer of the metadata: it is neither stored in the storage
+// nor seen by the full cleanup or the limit decision (decision hooks receive the request itself).
+func (cfg *Config) Metadata(selector MetadataSelector) *Config {
+	cfg.metadataSelector = selector
+	return cfg
+}
+
+// OnAllowed sets a hook that is executed for every request the middleware allows, right before the
+// next handler, receiving the selected ID and the client's current count (e.g. for fraud scoring).
+// A panic inside the hook is recovered and logged. The default is nil (no hook).
+func (cfg *Config) OnAllowed(hook DecisionHook) *Config {
+	cfg.onAllowed = hook
+	return cfg
+}
+
+// OnBlocked sets a hook that is executed for every request the middleware blocks (limited or overloaded),
+// right before the rejecting handler, receiving the selected ID and the client's current count.
+// A panic inside the hook is recovered and logged. The default is nil (no hook).
+func (cfg *Config) OnBlocked(hook DecisionHook) *Config {
+	cfg.onBlocked = hook
+	return cfg
+}
+
+// OnRelease sets a hook that is executed by the worker goroutines after an entry
+// has been released from the storage, receiving the entry's ID and metadata.
+func (cfg *Config) OnRelease(hook ReleaseHook) *Config {
+	cfg.onRelease = hook
+	return cfg
+}
+
+// StatusWeight sets a function that determines how many units a request counts as,
+// based on its response status. Every request is charged its cost (a single unit unless
+// set using Cost) before the handler runs, so the limit is still enforced up front; once
+// the response status is known the charge is adjusted to the returned weight. A weight of 0 refunds the
+// request entirely (e.g. for a 304 Not Modified), greater weights charge extra units.
+//
+// Because the final weight is only known after the handler returns, the release of
+// weighted requests is queued after the response has been written.
+func (cfg *Config) StatusWeight(weight StatusWeight) *Config {
+	cfg.statusWeight = weight
+	return cfg
+}
+
+// PenaltyMultiplier sets a function that scales the release timeout of a client by its
+// violation count, holding the slots of repeat offenders longer and slowing their recovery.
+// Multipliers below 1 are treated as 1.
+//
+// Violations (rejected requests) are tracked in the violation keyspace of the storage, which must
+// implement rlstorage.ViolationTracker (Validate fails otherwise), and are kept until the storage
+// drops them (full cleanup rotation or the backend's TTL).
+func (cfg *Config) PenaltyMultiplier(multiplier PenaltyMultiplier) *Config {
+	cfg.penaltyMultiplier = multiplier
+	return cfg
+}
+
+// Headers enables or disables emitting rate limit headers (limit and remaining requests) on responses.
+func (cfg *Config) Headers(enabled bool) *Config {
+	cfg.headers = enabled
+	return cfg
+}
+
+// HeaderNames sets the names of the emitted rate limit headers.
+func (cfg *Config) HeaderNames(names HeaderNames) *Config {
+	cfg.headerNames = names
+	return cfg
+}
+
+// Policy sets the name of the policy (e.g. the route or tier) enforced by this middleware, reported
+// in the `X-RateLimit-Policy` header when headers are enabled. With several limiters in a chain the
+// header names the one that rejected the request, or the last one if the request was allowed.
+// Requests matching a RouteLimit are reported under the pattern of the route instead (e.g. "/api/:id").
+// An empty name (default) disables the header.
+func (cfg *Config) Policy(name string) *Config {
+	cfg.policy = name
+	return cfg
+}
+
+// PriorityFunc sets a function classifying requests into priority tiers (e.g. from a header set by an
+// upstream classifier). Requests classified as PriorityBypass skip limiting entirely, the limit of the
+// other tiers is scaled by their multiplier (see PriorityMultiplier): high priority requests get twice
+// the limit, low priority ones half the limit, by default. All tiers of a client share its counter.
+func (cfg *Config) PriorityFunc(priority func(*gin.Context) Priority) *Config {
+	cfg.priority = priority
+	return cfg
+}
+
+// PriorityMultiplier sets the factor the limit of requests of the given priority tier is scaled by.
+// The multiplier of PriorityBypass is ignored, as those requests skip limiting.
+func (cfg *Config) PriorityMultiplier(priority Priority, multiplier float64) *Config {
+	cfg.priorityMultipliers[priority] = multiplier
+	return cfg
+}
+
+// Dedup counts byte-identical requests of a client (same method, path with query, and body) as a single
+// request while they repeat within window, e.g. for clients retrying idempotent requests aggressively.
+// The first request is counted as usual, repetitions within the window are allowed without being charged
+// while the client is under its limit. Once it reaches the limit, repetitions are charged (and rejected)
+// like any other request, so retrying cannot get a client past its limit. Repetitions of a rejected request
+// are not deduplicated.
+//
+// Bodies are read (up to maxBodyBytes) to be hashed and restored for the next handlers; requests with
+// larger bodies are never deduplicated. A window of 0 (the default) disables deduplication.
+func (cfg *Config) Dedup(window time.Duration, maxBodyBytes int64) *Config {
+	cfg.deduper = nil
+	if window > 0 {
+		cfg.deduper = newDeduper(window, max(maxBodyBytes, 0))
+	}
+	return cfg
+}
+
+// StaggerRelease spaces out the releases of each client's entries at least spacing apart (per unit),
+// e.g. Timeout / Limit. Without it, a burst that fills a client's budget is released all at once after
+// the timeout, so the client recovers its whole budget in one spike and can burst again right away.
+// Staggered entries of a burst are released one spacing after another instead, so the budget recovers
+// gradually. Releases are only ever delayed, so a client never gets more than the limit in a window.
+//
+// Note that delayed entries hold their worker while waiting, so bursty traffic may need more workers.
+// A spacing of 0 (the default) disables staggering.
+func (cfg *Config) StaggerRelease(spacing time.Duration) *Config {
+	cfg.staggerer = nil
+	if spacing > 0 {
+		cfg.staggerer = newStaggerer(spacing)
+	}
+	return cfg
+}
+
+// Trailers makes the middleware send the rate limit headers of allowed requests as HTTP trailers:
+// the header names are announced in the `Trailer` header before the handler runs, and their values
+// are set once it returns. This keeps the budget visible to clients of streaming (chunked) responses,
+// whose headers are flushed before the handler finishes. Rejected requests still get regular headers.
+//
+// Trailers require Headers to be enabled and cannot be combined with ExactHeaderCase. Client support
+// varies: HTTP/1.1 trailers are only sent with chunked responses (no Content-Length), gRPC and HTTP/2
+// clients generally read them, while many browsers, proxies and HTTP client libraries silently drop them.
+func (cfg *Config) Trailers(enabled bool) *Config {
+	cfg.trailers = enabled
+	return cfg
+}
+
+// ExactHeaderCase makes the middleware write rate limit header names exactly as configured
+// (e.g. lowercase HTTP/2 style "x-ratelimit-limit") instead of canonicalizing them.
+// Note that HTTP/1.x transports transmit the key as-is, while HTTP/2 always lowercases it.
+func (cfg *Config) ExactHeaderCase(exact bool) *Config {
+	cfg.exactHeaderCase = exact
+	return cfg
+}
+
+// SamplingRate enables approximate counting: only 1 in n requests (chosen at random) is written to
+// the storage, and the limit is internally divided by n, cutting storage writes n times.
+//
+// The tradeoff is accuracy: the number of requests a client gets through before being limited
+// varies around the configured limit (the relative error grows as limit/n gets smaller), and
+// small limits lose resolution since the internal limit is rounded down (to at least 1).
+// It is only meant for very high traffic where exact counts are not critical. Default is 1 (exact).
+func (cfg *Config) SamplingRate(n uint16) *Config {
+	cfg.samplingRate = n
+	return cfg
+}
+
+// RejectGrace sets a forgiveness band above the limit: requests are only rejected once a client
+// exceeds `limit + grace`, while requests within the band are allowed but marked as over the limit
+// (zero remaining requests and a warning header, if headers are enabled).
+//
+// Unlike raising the limit, the grace band is meant to absorb off-by-one client behavior while
+// still signaling the client to back off. Default is 0 (reject as soon as the limit is reached).
+func (cfg *Config) RejectGrace(grace uint16) *Config {
+	cfg.rejectGrace = grace
+	return cfg
+}
+
+// Cost sets a function that returns the number of units a request costs against the limit
+// (e.g. ContentLengthCost), instead of every request counting as a single unit.
+// A request is rejected if its cost would push the client's count over the limit. Storages implementing
+// rlstorage.IncreaserBy are increased by the cost in a single operation, others unit by unit.
+func (cfg *Config) Cost(cost CostFunc) *Config {
+	cfg.cost = cost
+	return cfg
+}
+
+// PerMethod enables or disables counting each request method separately,
+// by scoping the selected ID with the request method.
+func (cfg *Config) PerMethod(enabled bool) *Config {
+	cfg.perMethod = enabled
+	return cfg
+}
+
+// TreatHeadAsGet makes HEAD requests count as GET requests wherever the request method matters
+// (e.g. with PerMethod enabled, HEAD and GET requests share a counter).
+func (cfg *Config) TreatHeadAsGet(enabled bool) *Config {
+	cfg.treatHeadAsGet = enabled
+	return cfg
+}
+
+// MethodLimit overrides the limit for requests with the given method (e.g. a stricter limit for POST and
+// DELETE), replacing the static, scheduled and read/write limits, while route limits and claim limits still
+// take precedence. With TreatHeadAsGet, HEAD requests use the limit of GET.
+//
+// By default every method shares the counter of the client, so a request is charged against the same
+// count but compared with the limit of its method. Enable PerMethod to track each method independently.
+func (cfg *Config) MethodLimit(method string, limit uint16) *Config {
+	if cfg.methodLimits == nil {
+		cfg.methodLimits = make(map[string]uint16)
+	}
+	cfg.methodLimits[strings.ToUpper(method)] = limit
+	return cfg
+}
+
+// SeparateReadWrite counts read requests (GET, HEAD, OPTIONS and TRACE) and write requests (every other
+// method) separately, against the given limits, so they have independent budgets even on the same route.
+// The limits replace the static and scheduled limits, while route limits and claim limits still take precedence.
+func (cfg *Config) SeparateReadWrite(readLimit, writeLimit uint16) *Config {
+	cfg.separateReadWrite = true
+	cfg.readLimit = readLimit
+	cfg.writeLimit = writeLimit
+	return cfg
+}
+
+// methodClass returns the class ("read" or "write") of the request method.
+func methodClass(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return "read"
+	default:
+		return "write"
+	}
+}
+
+// requestMethod returns the method of the request, mapping HEAD to GET if TreatHeadAsGet is enabled.
+func (cfg *Config) requestMethod(ctx *gin.Context) string {
+	method := ctx.Request.Method
+	if cfg.treatHeadAsGet && method == http.MethodHead {
+		return http.MethodGet
+	}
+	return method
+}
+
+// ForensicLogAfter enables a one-time detailed log (including request headers) for clients reaching
+// the given number of violations, to support abuse investigations. The given headers are redacted
+// in addition to the always-redacted Authorization, Proxy-Authorization and Cookie headers.
+// Forensic logs are themselves rate limited (forensicLogsPerCycle per forensicLogInterval) to avoid log floods.
+//
+// Violations are tracked in the storage the same way as for PenaltyMultiplier.
+func (cfg *Config) ForensicLogAfter(violations uint16, redactHeaders []string) *Config {
+	cfg.forensics = newForensics(violations, redactHeaders)
+	return cfg
+}
+
+// OnSuspiciousHeaders sets a detector (e.g. SuspiciousForwardedFor) that flags requests with suspicious
+// headers, such as a spoofed `X-Forwarded-For`. Flagged requests are held to the SuspiciousLimit,
+// which bans them outright by default.
+func (cfg *Config) OnSuspiciousHeaders(detector func(*gin.Context) bool) *Config {
+	cfg.suspicious = detector
+	return cfg
+}
+
+// SuspiciousLimit sets the stricter limit applied to requests flagged by OnSuspiciousHeaders.
+// A limit of 0 (default) rejects flagged requests outright.
+func (cfg *Config) SuspiciousLimit(limit uint16) *Config {
+	cfg.suspiciousLimit = limit
+	return cfg
+}
+
+// tracksViolations reports whether violations have to be recorded in the storage.
+func (cfg *Config) tracksViolations() bool {
+	return cfg.penaltyMultiplier != nil || cfg.forensics != nil
+}
+
 // WorkerCount sets the number of worker goroutines for the middleware.
+//
+// Every allowed request is held by a worker until its release, about one timeout later, so the pool
+// handles at most workerCount requests per timeout. Once every worker is busy, requests wait for
+// the release queue (see QueueTimeout), which shows up as latency. To avoid this, workerCount should be
+// at least limit × the number of clients expected to be active within a timeout (see AutoWorkers).
+// Build logs a warning if it is lower than a quarter of the limit, which a few clients can already exhaust.
 func (cfg *Config) WorkerCount(workers uint16) *Config {
 	cfg.workerCount = workers
 	return cfg
 }
 
+// AutoWorkers sizes the worker pool at Build for the given number of clients expected to be active
+// within a timeout, as limit × expectedClients (capped at 65535), overriding WorkerCount. Since every
+// worker holds one request for a timeout, the timeout itself cancels out of the sizing.
+// A value of 0 (default) keeps the WorkerCount.
+func (cfg *Config) AutoWorkers(expectedClients uint16) *Config {
+	cfg.autoWorkerClients = expectedClients
+	return cfg
+}
+
+// LazyWorkers starts the worker goroutines on demand, whenever an entry is queued while every running
+// worker is busy, up to WorkerCount workers, instead of starting them all at Build. Workers started
+// on demand exit after being idle for the WorkerIdleTimeout, so low-traffic services keep few goroutines around.
+func (cfg *Config) LazyWorkers(enabled bool) *Config {
+	cfg.lazyWorkers = enabled
+	return cfg
+}
+
+// WorkerIdleTimeout sets how long a worker started on demand (see LazyWorkers) waits for an entry
+// before exiting (30 seconds by default). Shorter timeouts scale the pool down faster after a burst,
+// at the cost of starting workers more often.
+func (cfg *Config) WorkerIdleTimeout(timeout time.Duration) *Config {
+	cfg.workerIdleTimeout = timeout
+	return cfg
+}
+
 // Timeout sets the timeout duration for the rate limit.
+// Sub-second windows (down to minTimeout) are supported, in which case the Tolerance
+// has to be lowered below the timeout as well. Redis storages round TTLs up to whole milliseconds.
 func (cfg *Config) Timeout(timeout time.Duration) *Config {
 	cfg.timeout = timeout
 	return cfg
@@ -97,28 +927,183 @@ func (cfg *Config) IdSelector(idSelector IDSelector) *Config {
 	return cfg
 }
 
+// Skip sets a predicate exempting requests from limiting entirely (e.g. health checks, internal service
+// traffic or admins): when it returns true, the middleware calls the next handler right away, without
+// touching the storage or the release queue. Skip runs before the IdSelector. The default never skips.
+func (cfg *Config) Skip(skip func(*gin.Context) bool) *Config {
+	cfg.skip = skip
+	return cfg
+}
+
+// Allowlist sets the individual IPs and CIDR ranges (IPv4 or IPv6) of clients that bypass limiting
+// entirely, e.g. a monitoring subnet. It is checked against the client IP (gin.Context.ClientIP)
+// before the counter logic, but after the Denylist. Invalid entries are reported by Validate.
+func (cfg *Config) Allowlist(entries []string) *Config {
+	networks, err := parseNetworks(entries)
+	if err != nil {
+		cfg.accessListErr = fmt.Errorf("invalid `Allowlist` entry: %w", err)
+	}
+	cfg.allowlist = networks
+	return cfg
+}
+
+// Denylist sets the individual IPs and CIDR ranges (IPv4 or IPv6) of clients that are rejected
+// regardless of their request count, using the DeniedHandler ([403]"Forbidden" by default).
+// It is checked against the client IP (gin.Context.ClientIP) before the counter logic.
+// Invalid entries are reported by Validate.
+func (cfg *Config) Denylist(entries []string) *Config {
+	networks, err := parseNetworks(entries)
+	if err != nil {
+		cfg.accessListErr = fmt.Errorf("invalid `Denylist` entry: %w", err)
+	}
+	cfg.denylist = networks
+	return cfg
+}
+
+// DeniedHandler sets the handler function to be executed for denylisted clients.
+func (cfg *Config) DeniedHandler(handler gin.HandlerFunc) *Config {
+	cfg.deniedHandler = handler
+	return cfg
+}
+
+// OnlyAnonymous limits unauthenticated requests only: requests for which isAuthenticated returns true
+// skip the limiter entirely (they are neither counted nor given rate limit headers), e.g. because they
+// are subject to their own quotas elsewhere. The predicate typically reads what an auth middleware
+// running before the limiter stored in the gin context.
+func (cfg *Config) OnlyAnonymous(isAuthenticated func(*gin.Context) bool) *Config {
+	cfg.isAuthenticated = isAuthenticated
+	return cfg
+}
+
+// IdSelectorE sets a selector that can reject a request at selection time by returning an error.
+// When set, it is used instead of the IdSelector; rejected requests get the error attached to
+// the gin context and are passed to the InvalidIDHandler.
+func (cfg *Config) IdSelectorE(idSelector IDSelectorE) *Config {
+	cfg.idSelectorE = idSelector
+	return cfg
+}
+
+// InvalidIDHandler sets the handler function to be executed if the IdSelectorE rejects a request.
+func (cfg *Config) InvalidIDHandler(handler gin.HandlerFunc) *Config {
+	cfg.invalidIDHandler = handler
+	return cfg
+}
+
+// Messages sets the rejection messages sent by the default handler, keyed by language tag (e.g. "en", "pt-BR").
+// The message best matching the request's Accept-Language header is used, falling back to the entry
+// keyed by DefaultMessageLanguage ("*") and then to "too many requests".
+// The chosen message is also stored in the gin context under RejectionMessageKey for custom handlers.
+func (cfg *Config) Messages(messages map[string]string) *Config {
+	cfg.messages = make(map[string]string, len(messages))
+	for language, message := range messages {
+		cfg.messages[strings.ToLower(language)] = message
+	}
+	return cfg
+}
+
+// OnStorageError sets the handler function to be executed if the storage fails while a request is checked,
+// so a storage outage can be told apart from a client that never made a request.
+// The request fails open (proceeds uncharged) unless the handler aborts it, e.g. with a [503] to fail closed
+// (see FailClosedOn, which can fail closed on specific errors such as rlstorage.ErrOutOfMemory only).
+// By default, storage timeouts are handed to the OverloadHandler, and other errors fail open.
+func (cfg *Config) OnStorageError(handler StorageErrorHandler) *Config {
+	cfg.storageErrorHandler = handler
+	return cfg
+}
+
+// FailClosed sets whether requests are rejected with a [503]"Service Unavailable" status code when the
+// storage fails (e.g. Redis is unreachable), instead of failing open (the default). Enabling it is a
+// shorthand for OnStorageError(FailClosedOn()), disabling it restores the default handler.
+func (cfg *Config) FailClosed(enabled bool) *Config {
+	cfg.storageErrorHandler = cfg.defaultStorageErrorHandler
+	if enabled {
+		cfg.storageErrorHandler = FailClosedOn()
+	}
+	return cfg
+}
+
+// selectID selects the unique identifier of the request, using the IdSelectorE if set.
+func (cfg *Config) selectID(ctx *gin.Context) (string, error) {
+	if cfg.idSelectorE != nil {
+		return cfg.idSelectorE(ctx)
+	}
+	return cfg.idSelector(ctx), nil
+}
+
 // Tolerance sets the tolerance duration that will be skipped if an entry should be deleted in that window.
 func (cfg *Config) Tolerance(tolerance time.Duration) *Config {
 	cfg.tolerance = tolerance
 	return cfg
 }
 
+// Clock sets the function used to read the current time (time.Now by default).
+// It is meant for tests driving the limiter with a fake clock. The default storage follows the clock,
+// other storages must be given it themselves (see rlstorage.NewHashMapStorageWithClock).
+func (cfg *Config) Clock(clock func() time.Time) *Config {
+	cfg.clock = clock
+	return cfg
+}
+
 // Storage sets the storage backend used for rate data.
+// The TTL of storages implementing rlstorage.TTLStorage is derived from the timeout at Build if it is unset
+// (see storageTTL), and Build warns if it is shorter than the timeout. The wrapper storages (such as
+// rlstorage.NewReadReplicaStorage) forward the TTL to the storages they wrap, and support the optional
+// interfaces (such as the atomic checks or token buckets) the storages they wrap support (see rlstorage.As).
 func (cfg *Config) Storage(storage rlstorage.RLStorage) *Config {
 	cfg.storage = storage
 	return cfg
 }
 
+// KeyPrefix sets the prefix the keys of the storage are namespaced under (e.g. "ratelimit:"), applied to
+// storages implementing rlstorage.KeyPrefixer (such as the Redis storages, which use "rl:" by default) at
+// Build. The full cleanup only deletes the keys under the prefix, so it should not be shared with other data.
+// Other storages ignore the prefix with a warning at Build, while the wrapper storages forward it to the storages they wrap.
+func (cfg *Config) KeyPrefix(prefix string) *Config {
+	cfg.keyPrefix = prefix
+	return cfg
+}
+
 // FullCleanupRotation sets the duration for the full cleanup rotation of the rate limiting storage.
 // This duration determines how often the fullCleanupWorker will remove all entries from the storage.
 //
 // The full cleanup rotation helps prevent potential memory leaks by periodically freeing up resources
 // occupied by stale entries in the storage.
+//
+// The rotation must not be shorter than the timeout: a cleanup wipes every counter, so a rotation
+// shorter than the timeout resets clients before their window naturally expires, effectively
+// lowering the enforced window. A rotation equal to the timeout is accepted with a warning.
 func (cfg *Config) FullCleanupRotation(rotation time.Duration) *Config {
 	cfg.fullCleanupRotation = rotation
 	return cfg
 }
 
+// CleanupJitter randomly shifts the first full cleanup within ±fraction of the FullCleanupRotation
+// (e.g. 0.1 for ±10%, the default), so instances started together do not flush a shared storage
+// (such as Redis) at the same moment. Later cleanups follow every rotation. 0 disables the jitter.
+func (cfg *Config) CleanupJitter(fraction float64) *Config {
+	cfg.cleanupJitter = fraction
+	return cfg
+}
+
+// CleanupTrigger sets a channel that triggers a full cleanup of the storage whenever a value is sent to it,
+// in addition to the FullCleanupRotation ticker. This enables event-driven resets (e.g. on a config-change
+// event broadcast across a cluster) without polling. The trigger keeps working if the rotation is disabled.
+func (cfg *Config) CleanupTrigger(trigger <-chan struct{}) *Config {
+	cfg.cleanupTrigger = trigger
+	return cfg
+}
+
+// MaxIdle sets the duration after which the counters of ids that were not accessed are swept from
+// the storage, independent of the full cleanup rotation. This targets counts leaked by lost
+// releases (e.g. after a crash) without the blunt reset of FreeAll.
+//
+// It requires a storage implementing rlstorage.IdleSweeper (such as the hashmap storage)
+// and must not be shorter than the timeout. A value of 0 (default) disables sweeping.
+func (cfg *Config) MaxIdle(maxIdle time.Duration) *Config {
+	cfg.maxIdle = maxIdle
+	return cfg
+}
+
 // DisableFullCleanup disables the full cleanup rotation for the rate limiting storage.
 // When disabled, the fullCleanupWorker goroutine will not be started, and the storage
 // will not be periodically cleared.
@@ -130,17 +1115,178 @@ func (rlb *Config) DisableFullCleanup() *Config {
 	return rlb
 }
 
-// Build validates the configuration values and creates a new rate limiting middleware handler.
-// It returns the handler function (gin.HandlerFunc) and an error (if any).
+// Validate checks the configuration values without building the middleware,
+// so no workers or storage connections are started. It returns the first error found, or nil.
 //
 // The method performs the following validations:
 //   - Ensures that the tolerance duration is not equal or greater than the timeout duration.
-//   - Ensures that the idSelector, handler, and storage are not nil.
+//   - Ensures that the idSelector, handler, clock, skip, overloadHandler, invalidIDHandler, deniedHandler, storageErrorHandler, and storage are not nil.
+//   - Ensures that the allowlist and denylist entries are valid IPs or CIDR ranges.
 //   - Ensures that the limit is not 0.
-//   - Ensures that the timeout is greater than 1 second.
+//   - Ensures that the status code is a valid HTTP status code (100 to 599).
+//   - Ensures that the timeout is not less than minTimeout (a microsecond).
 //   - Ensures that the tolerance is not less than 0.
-//   - Ensures that the fullCleanupRotation duration is not equal or less than the timeout duration.
+//   - Ensures that the queueTimeout is not less than 0.
+//   - Ensures that the limitRamp is not less than 0.
+//   - Ensures that the schedule ranges lie within a day and that their limits are not 0.
+//   - Ensures that the route limits and method limits are not 0.
+//   - Ensures that the read and write limits are not 0 if they are counted separately.
+//   - Ensures that the fullCleanupRotation duration (if enabled) is not less than the timeout duration.
+//   - Ensures that the cleanupJitter is within [0, 1).
 //   - Ensures that the workerCount is not 0.
+//   - Ensures that the samplingRate is not 0.
+//   - Ensures that the SlidingWindow algorithm is not combined with StatusWeight or a samplingRate above 1.
+//   - Ensures that the GCRA algorithm is not combined with StatusWeight, a samplingRate above 1 or TokenBucket,
+//     and that its emission interval is not less than 0.
+//   - Ensures that the token bucket refill rate is not less than 0, that its burst is not 0 if enabled,
+//     and that it is not combined with SlidingWindow, StatusWeight or a samplingRate above 1.
+//   - Ensures that the header names are valid HTTP header field names (including the policy header if a policy is set).
+//   - Ensures that the forensic log threshold (if enabled) is not 0.
+//   - Ensures that the rejection log window is not less than 0.
+//   - Ensures that the histogram export interval is not less than 0, and that its hook is set if enabled.
+//   - Ensures that the maxIdle duration is not less than 0, nor less than the timeout duration if enabled.
+//   - Ensures that the priority multipliers are positive numbers.
+func (cfg *Config) Validate() error {
+	// Check if the tolerance duration is greater than the timeout duration
+	if cfg.tolerance >= cfg.timeout {
+		// If true, return an error indicating that the tolerance value cannot be greater than or equal to the timeout
+		return errors.New("tolerance value cannot be greater than or equal to timeout")
+	}
+
+	// Use a switch statement to validate the configuration values
+	switch {
+	case cfg.idSelector == nil:
+		return errors.New("`IdSelector` value cannot be nil")
+	case cfg.handler == nil:
+		return errors.New("`Handler` value cannot be nil")
+	case cfg.clock == nil:
+		return errors.New("`Clock` value cannot be nil")
+	case cfg.skip == nil:
+		return errors.New("`Skip` value cannot be nil")
+	case cfg.deniedHandler == nil:
+		return errors.New("`DeniedHandler` value cannot be nil")
+	case cfg.accessListErr != nil:
+		return cfg.accessListErr
+	case cfg.overloadHandler == nil:
+		return errors.New("`OverloadHandler` value cannot be nil")
+	case cfg.invalidIDHandler == nil:
+		return errors.New("`InvalidIDHandler` value cannot be nil")
+	case cfg.storageErrorHandler == nil:
+		return errors.New("`OnStorageError` value cannot be nil")
+	case cfg.storage == nil:
+		return errors.New("`Storage` value cannot be nil")
+	case cfg.tracksViolations() && !cfg.hasViolationTracker():
+		return errors.New("`PenaltyMultiplier` and `ForensicLogAfter` require a storage tracking violations (rlstorage.ViolationTracker)")
+	case cfg.limit == 0:
+		return errors.New("`Limit` value cannot be 0")
+	case cfg.statusCode < 100 || cfg.statusCode > 599:
+		return fmt.Errorf("`StatusCode` %d is not a valid HTTP status code", cfg.statusCode)
+	case cfg.timeout < minTimeout:
+		return errors.New("`Timeout` cannot be less than a time.Microsecond")
+	case cfg.tolerance < 0:
+		return errors.New("`Tolerance` value cannot be less than zero")
+	case cfg.limitRamp < 0:
+		return errors.New("`LimitRamp` value cannot be less than zero")
+	case cfg.queueTimeout < 0:
+		return errors.New("`QueueTimeout` value cannot be less than zero")
+	case cfg.timeout < cfg.tolerance:
+		return errors.New("`Tolerance` value cannot be less than `Timeout`")
+	case cfg.cleanupJitter < 0 || cfg.cleanupJitter >= 1:
+		return errors.New("`CleanupJitter` must be within [0, 1)")
+	case cfg.workerCount == 0:
+		return errors.New("`WorkerCount` cannot be 0")
+	case cfg.samplingRate == 0:
+		return errors.New("`SamplingRate` cannot be 0")
+	case cfg.forensics != nil && cfg.forensics.threshold == 0:
+		return errors.New("`ForensicLogAfter` violations cannot be 0")
+	case cfg.rejectionLogWindow < 0:
+		return errors.New("`RejectionLogSuppression` window cannot be less than zero")
+	case cfg.webhookURL != "" && (cfg.webhookBatchSize <= 0 || cfg.webhookInterval <= 0):
+		return errors.New("`Webhook` batch size and flush interval must be greater than zero")
+	case cfg.histogramInterval < 0:
+		return errors.New("`ExportHistogram` interval cannot be less than zero")
+	case cfg.histogramInterval > 0 && cfg.histogramExport == nil:
+		return errors.New("`ExportHistogram` hook cannot be nil")
+	case cfg.maxIdle < 0:
+		return errors.New("`MaxIdle` value cannot be less than zero")
+	case cfg.maxIdle > 0 && cfg.maxIdle < cfg.timeout:
+		return errors.New("`MaxIdle` cannot be less than `Timeout`")
+	case cfg.algorithm == SlidingWindow && (cfg.statusWeight != nil || cfg.samplingRate > 1):
+		return errors.New("`SlidingWindow` algorithm cannot be combined with `StatusWeight` or `SamplingRate`")
+	case cfg.algorithm == GCRA && (cfg.statusWeight != nil || cfg.samplingRate > 1 || cfg.bucketRate > 0):
+		return errors.New("`GCRA` algorithm cannot be combined with `StatusWeight`, `SamplingRate` or `TokenBucket`")
+	case cfg.emissionInterval < 0:
+		return errors.New("`EmissionInterval` value cannot be less than zero")
+	case cfg.bucketRate < 0:
+		return errors.New("`TokenBucket` refill rate cannot be less than zero")
+	case cfg.bucketRate > 0 && cfg.bucketBurst == 0:
+		return errors.New("`TokenBucket` burst cannot be 0")
+	case cfg.bucketRate > 0 && (cfg.algorithm == SlidingWindow || cfg.statusWeight != nil || cfg.samplingRate > 1):
+		return errors.New("`TokenBucket` cannot be combined with `SlidingWindow`, `StatusWeight` or `SamplingRate`")
+	case cfg.separateReadWrite && (cfg.readLimit == 0 || cfg.writeLimit == 0):
+		return errors.New("`SeparateReadWrite` limits cannot be 0")
+	case !cfg.headerNames.valid():
+		return errors.New("`HeaderNames` must be valid HTTP header field names")
+	case cfg.lazyWorkers && cap(cfg.queue) > 0:
+		return errors.New("`QueueSize` cannot be combined with `LazyWorkers`")
+	case cfg.lazyWorkers && cfg.workerIdleTimeout <= 0:
+		return errors.New("`WorkerIdleTimeout` must be greater than zero with `LazyWorkers`")
+	case cfg.trailers && (!cfg.headers || cfg.exactHeaderCase):
+		return errors.New("`Trailers` require `Headers` and cannot be combined with `ExactHeaderCase`")
+	case len(cfg.dimensions) > 0 && !validHeaderName(cfg.headerNames.Dimension):
+		return errors.New("`HeaderNames.Dimension` must be a valid HTTP header field name when dimensions are set")
+	case len(cfg.dimensions) > 0 && cfg.statusWeight != nil:
+		return errors.New("`Dimension` cannot be combined with `StatusWeight`")
+	case cfg.violationReport > ReportAll:
+		return errors.New("`ReportViolations` must be one of `ReportMostRestrictive`, `ReportFirst` or `ReportAll`")
+	case cfg.policy != "" && !validHeaderName(cfg.headerNames.Policy):
+		return errors.New("`HeaderNames.Policy` must be a valid HTTP header field name when a `Policy` is set")
+	case cfg.fullCleanupRotation > 0 && cfg.fullCleanupRotation < cfg.timeout:
+		return fmt.Errorf(
+			"`FullCleanupRotation` must be at least `Timeout` (%s), otherwise counters are wiped before their window expires; use `DisableFullCleanup` to turn it off",
+			cfg.timeout,
+		)
+	}
+	if cfg.webhookURL != "" {
+		if _, err := url.ParseRequestURI(cfg.webhookURL); err != nil {
+			return fmt.Errorf("invalid `Webhook` URL: %w", err)
+		}
+	}
+	for priority, multiplier := range cfg.priorityMultipliers {
+		if priority != PriorityBypass && (multiplier <= 0 || math.IsNaN(multiplier) || math.IsInf(multiplier, 0)) {
+			return fmt.Errorf("`PriorityMultiplier` of the %s priority must be a positive number", priority)
+		}
+	}
+	for _, route := range cfg.routeLimits {
+		if route.limit == 0 {
+			return fmt.Errorf("`RouteLimit` of %q cannot be 0", route.pattern)
+		}
+	}
+	for method, limit := range cfg.methodLimits {
+		if limit == 0 {
+			return fmt.Errorf("`MethodLimit` of %s cannot be 0", method)
+		}
+	}
+	for _, dim := range cfg.dimensions {
+		switch {
+		case dim.name == "" || dim.name == DefaultDimension:
+			return fmt.Errorf("`Dimension` name %q is reserved", dim.name)
+		case dim.selector == nil:
+			return fmt.Errorf("`Dimension` selector of %q cannot be nil", dim.name)
+		case dim.limit == 0:
+			return fmt.Errorf("`Dimension` limit of %q cannot be 0", dim.name)
+		}
+	}
+	for _, entry := range cfg.schedule {
+		if err := entry.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Build validates the configuration values (see Validate) and creates a new rate limiting middleware handler.
+// It returns the handler function (gin.HandlerFunc) and an error (if any).
 //
 // If all validations pass, it creates a new rate limiting middleware handler using the RateLimitWith function.
 // If any validation fails, it returns an appropriate error message.
@@ -153,43 +1299,213 @@ func (rlb *Config) DisableFullCleanup() *Config {
 //	h (gin.HandlerFunc): The rate limiting middleware handler.
 //	e (error): An error if any validation fails, or nil if the configuration is valid.
 func (cfg *Config) Build() (h gin.HandlerFunc, e error) {
-	// Check if the tolerance duration is greater than the timeout duration
-	if cfg.tolerance >= cfg.timeout {
-		// If true, return an error indicating that the tolerance value cannot be greater than or equal to the timeout
-		e = errors.New("tolerance value cannot be greater than or equal to timeout")
+	if cfg.autoWorkerClients > 0 {
+		cfg.workerCount = autoWorkerCount(cfg.effectiveLimit(), cfg.autoWorkerClients)
+	}
+	if e = cfg.Validate(); e != nil {
 		return
 	}
 
-	// Use a switch statement to validate the configuration values
-	switch {
-	case cfg.idSelector == nil:
-		e = errors.New("`IdSelector` value cannot be nil")
-	case cfg.handler == nil:
-		e = errors.New("`Handler` value cannot be nil")
-	case cfg.storage == nil:
-		e = errors.New("`Storage` value cannot be nil")
-	case cfg.limit == 0:
-		e = errors.New("`Limit` value cannot be 0")
-	case cfg.timeout <= time.Second:
-		e = errors.New("`Timeout` cannot be less than a time.Second")
-	case cfg.tolerance < 0:
-		e = errors.New("`Tolerance` value cannot be less than zero")
-	case cfg.timeout < cfg.tolerance:
-		e = errors.New("`Tolerance` value cannot be less than `Timeout`")
-	case cfg.workerCount == 0:
-		e = errors.New("`WorkerCount` cannot be 0")
-	case cfg.fullCleanupRotation <= cfg.timeout:
-		e = errors.New("`FullCleanupRotation` cannot be less than `Timeout`")
-	default:
-		// If all configurations are valid, create and return a new rate limiting middleware handler
-		h = RateLimitWith(cfg)
-		// Start a goroutine to run the fullCleanupWorker function if rotation was set above 0
-		if cfg.fullCleanupRotation > 0 {
-			cleanup.
-				NewWorker(cfg.storage, cfg.timeout).
-				Start()
+	if cfg.keyPrefix != "" {
+		if prefixer, ok := cfg.storage.(rlstorage.KeyPrefixer); ok {
+			prefixer.SetKeyPrefix(cfg.keyPrefix)
+		} else {
+			cfg.logger.Warn("`KeyPrefix` is set but the storage does not support key prefixes")
+		}
+	}
+	if ttlStorage, ok := cfg.storage.(rlstorage.TTLStorage); ok {
+		switch ttl := ttlStorage.TTL(); {
+		case ttl == 0:
+			ttlStorage.SetTTL(storageTTL(cfg.timeout, cfg.tolerance))
+		case ttl < cfg.timeout:
+			cfg.logger.Warn(fmt.Sprintf("the storage TTL (%s) is shorter than `Timeout` (%s), counters may expire before their window ends", ttl, cfg.timeout))
+		}
+	}
+	if cfg.tracer != nil {
+		if traced, ok := cfg.storage.(rlstorage.TracedStorage); ok {
+			traced.SetTracer(cfg.tracer)
+		}
+	}
+	if cfg.registerer != nil {
+		if cfg.metrics, e = newMetrics(cfg.registerer, cfg.Len, cfg.storage); e != nil {
+			return
+		}
+	}
+	if cfg.rejectionLogWindow > 0 {
+		cfg.rejectionLogger = newRejectionLogger(cfg.rejectionLogThreshold, cfg.rejectionLogWindow, cfg.logger)
+		go cfg.rejectionLogger.run(cfg.stop)
+	}
+	if cfg.histogramInterval > 0 {
+		if _, ok := rlstorage.As[rlstorage.Snapshotter](cfg.storage); ok {
+			go cfg.runHistogramExport(cfg.stop)
+		} else {
+			cfg.logger.Warn("`ExportHistogram` is set but the storage does not support snapshots")
+		}
+	}
+	if cfg.auditSink != nil {
+		cfg.auditor = newAuditor(cfg.auditSink)
+		go cfg.auditor.run(cfg.stop)
+	}
+	if cfg.deduper != nil {
+		go cfg.deduper.run(cfg.clock, cfg.stop)
+	}
+	if cfg.lifetime != nil {
+		go cfg.closeOnDone()
+	}
+	if cfg.webhookURL != "" {
+		cfg.webhook = newWebhook(cfg.webhookURL, cfg.webhookBatchSize, cfg.webhookInterval, cfg.logger)
+		go cfg.webhook.run(cfg.stop)
+	}
+	if _, ok := cfg.tokenBucket(); cfg.bucketRate > 0 && !ok {
+		cfg.logger.Warn("the storage does not support the `TokenBucket` mode, falling back to the configured algorithm")
+	}
+	if _, ok := cfg.slidingWindow(); cfg.algorithm == SlidingWindow && !ok {
+		cfg.logger.Warn("the storage does not support the `SlidingWindow` algorithm, falling back to `Counter`")
+	}
+	if _, ok := cfg.gcra(); cfg.algorithm == GCRA && !ok {
+		cfg.logger.Warn("the storage does not support the `GCRA` algorithm, falling back to `Counter`")
+	}
+	if _, bucket := cfg.tokenBucket(); !bucket && uint32(cfg.workerCount)*lowWorkerRatio < uint32(cfg.effectiveLimit()) {
+		cfg.logger.Warn(fmt.Sprintf("`WorkerCount` (%d) is far lower than `Limit` (%d), requests may wait for the release queue", cfg.workerCount, cfg.effectiveLimit()))
+	}
+	if cfg.fullCleanupRotation == cfg.timeout {
+		cfg.logger.Warn(fmt.Sprintf("`FullCleanupRotation` equals `Timeout` (%s), counters may be wiped right before their window expires", cfg.timeout))
+	}
+	// If all configurations are valid, create and return a new rate limiting middleware handler
+	h = RateLimitWith(cfg)
+	// Start a goroutine to run the fullCleanupWorker function if rotation was set above 0 or a trigger is set
+	if cfg.fullCleanupRotation > 0 || cfg.cleanupTrigger != nil {
+		cfg.cleanupWorker = cleanup.
+			NewWorker(cfg.storage, cfg.fullCleanupRotation).
+			WithJitter(time.Duration(float64(cfg.fullCleanupRotation) * cfg.cleanupJitter)).
+			WithTrigger(cfg.cleanupTrigger)
+		cfg.cleanupWorker.Start()
+	}
+	// Start a goroutine sweeping idle ids if MaxIdle was set above 0
+	if cfg.maxIdle > 0 {
+		if sweeper, ok := rlstorage.As[rlstorage.IdleSweeper](cfg.storage); ok {
+			cfg.idleWorker = cleanup.NewIdleWorker(sweeper, cfg.maxIdle)
+			cfg.idleWorker.Start()
+		} else {
+			cfg.logger.Warn("`MaxIdle` is set but the storage does not support sweeping idle ids")
 		}
 	}
 
 	return
 }
+
+// Context ties the lifetime of the middleware to ctx (e.g. the context cancelled on SIGTERM): once ctx
+// is done, the middleware is drained and shut down as by Close, so the release workers apply their
+// pending decrements right away and exit instead of blocking forever, and later requests pass through
+// without being limited. Wait for the drain with Close
+// (which returns once the workers exited) if the process is about to exit.
+func (cfg *Config) Context(ctx context.Context) *Config {
+	cfg.lifetime = ctx
+	return cfg
+}
+
+// closeOnDone closes the middleware once the lifetime context is done, unless it was shut down before.
+func (cfg *Config) closeOnDone() {
+	select {
+	case <-cfg.lifetime.Done():
+		if err := cfg.Close(context.Background()); err != nil {
+			cfg.logger.Warn("failed to drain the middleware", "error", err)
+		}
+	case <-cfg.stop:
+	}
+}
+
+// Shutdown stops the goroutines started by Build (the release workers, the cleanup and idle
+// workers and the rejection logger) and waits for the release workers to exit, e.g. on graceful
+// server shutdown or between tests. It is safe to call more than once.
+//
+// Pending releases are dropped: in-memory counts stay charged (the storage is usually discarded
+// along with the middleware), while storages with TTLs expire them on their own.
+// Requests handled after Shutdown pass through without being limited: the server is shutting down and no
+// worker is left to release their units, so rejecting them as overloaded would only fail requests it can serve.
+func (cfg *Config) Shutdown() {
+	cfg.stopWorkers()
+	cfg.workers.Wait()
+}
+
+// closed reports whether the middleware was closed or shut down.
+func (cfg *Config) closed() bool {
+	select {
+	case <-cfg.draining:
+		return true
+	case <-cfg.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// awaitEnqueues waits for the requests that were queuing an entry (or starting a worker) when the middleware
+// was closed or shut down. Once it returns, no entry is queued and no worker is started anymore.
+func (cfg *Config) awaitEnqueues() {
+	cfg.lifecycle.Lock()
+	defer cfg.lifecycle.Unlock()
+}
+
+// releaseQueued releases the entries left in the release queue, e.g. queued while the workers were draining it.
+func (cfg *Config) releaseQueued() {
+	log := cfg.logger.With("scope", "rate-limiter")
+	for {
+		select {
+		case toFree := <-cfg.queue:
+			release(cfg, log, toFree)
+		default:
+			return
+		}
+	}
+}
+
+// stopWorkers signals every goroutine started by Build to stop, without waiting for them.
+func (cfg *Config) stopWorkers() {
+	cfg.stopOnce.Do(func() {
+		cfg.logger.Info("shutting down RateLimiter")
+		close(cfg.stop)
+		if cfg.cleanupWorker != nil {
+			cfg.cleanupWorker.Stop()
+		}
+		if cfg.idleWorker != nil {
+			cfg.idleWorker.Stop()
+		}
+	})
+	cfg.awaitEnqueues()
+}
+
+// StopCleanup stops the full cleanup rotation (and the CleanupTrigger) started by Build, leaving the rest
+// of the middleware running, e.g. before replacing the configuration on a hot reload. Storage entries are
+// no longer wiped afterwards. It is a no-op if no cleanup worker was started.
+func (cfg *Config) StopCleanup() {
+	if cfg.cleanupWorker != nil {
+		cfg.cleanupWorker.Stop()
+	}
+}
+
+// Close drains the middleware before shutting it down (see Shutdown): the release workers release
+// the entries they hold right away instead of waiting for their timeout, so no counts are left charged,
+// and then exit. If ctx is done before the drain completes, the remaining entries are abandoned and
+// ctx.Err() is returned right away, without waiting for the workers to notice. Requests handled after
+// Close pass through without being limited, as after Shutdown.
+func (cfg *Config) Close(ctx context.Context) error {
+	cfg.drainOnce.Do(func() { close(cfg.draining) })
+	cfg.awaitEnqueues()
+	drained := make(chan struct{})
+	go func() {
+		cfg.workers.Wait()
+		// Entries queued while the last workers were exiting are released here
+		cfg.releaseQueued()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		cfg.stopWorkers()
+		return nil
+	case <-ctx.Done():
+		cfg.stopWorkers()
+		return ctx.Err()
+	}
+}
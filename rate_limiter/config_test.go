@@ -0,0 +1,612 @@
+package ratelimiter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
+)
+
+func TestDefaultLoggerUsesSlogDefault(t *testing.T) {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	defer slog.SetDefault(previous)
+
+	NewConfigBuilder().logger.Warn("release queue is full", "user_id", "client")
+	if !strings.Contains(buf.String(), `msg="release queue is full" user_id=client`) {
+		t.Errorf("default logger wrote %q, want the warning through slog.Default", buf.String())
+	}
+}
+
+func TestSetLimitRampsLoweredLimit(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	cfg := newTestConfig().Limit(100).LimitRamp(10 * time.Second).Clock(clock.Now)
+	build(t, cfg)
+
+	if err := cfg.SetLimit(20); err != nil {
+		t.Fatalf("SetLimit() failed: %v", err)
+	}
+	steps := []struct {
+		elapsed time.Duration
+		want    uint16
+	}{
+		{0, 100},
+		{5 * time.Second, 60},
+		{10 * time.Second, 20},
+		{time.Minute, 20},
+	}
+	start := clock.Now()
+	for _, step := range steps {
+		clock.Set(start.Add(step.elapsed))
+		if got := cfg.effectiveLimit(); got != step.want {
+			t.Errorf("effective limit %s after SetLimit = %d, want %d", step.elapsed, got, step.want)
+		}
+	}
+}
+
+func TestConcurrentSetLimitRampsFromTheLimitInEffect(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	cfg := newTestConfig().Limit(100).LimitRamp(10 * time.Second).Clock(clock.Now)
+	router := newRouter(t, cfg)
+	if err := cfg.SetLimit(20); err != nil {
+		t.Fatalf("SetLimit() failed: %v", err)
+	}
+	clock.Advance(5 * time.Second)
+
+	// Halfway through the ramp, repeated changes to the same limit restart it from the limit in effect (60)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := cfg.SetLimit(20); err != nil {
+				t.Errorf("SetLimit() failed: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			serve(router, http.MethodGet, "/")
+		}()
+	}
+	wg.Wait()
+	if got := cfg.effectiveLimit(); got != 60 {
+		t.Errorf("effective limit = %d after concurrent changes, want 60", got)
+	}
+	clock.Advance(10 * time.Second)
+	if got := cfg.effectiveLimit(); got != 20 {
+		t.Errorf("effective limit = %d once the ramp is over, want 20", got)
+	}
+}
+
+func TestBuildSizesWorkersForTheLimitInEffect(t *testing.T) {
+	cfg := newTestConfig().Limit(100).LimitRamp(time.Minute).AutoWorkers(10)
+	if err := cfg.SetLimit(4); err != nil {
+		t.Fatalf("SetLimit() failed: %v", err)
+	}
+	build(t, cfg)
+	// The lowered limit is still being phased in, so the workers are sized for the previous one
+	if cfg.workerCount != 1000 {
+		t.Errorf("workerCount = %d, want 1000 (the limit in effect × expected clients)", cfg.workerCount)
+	}
+}
+
+func TestSetLimitWithoutRampAppliesImmediately(t *testing.T) {
+	cfg := newTestConfig().Limit(100)
+	build(t, cfg)
+
+	if err := cfg.SetLimit(20); err != nil {
+		t.Fatalf("SetLimit() failed: %v", err)
+	}
+	if got := cfg.effectiveLimit(); got != 20 {
+		t.Fatalf("effective limit = %d, want 20", got)
+	}
+}
+
+func TestSetLimitRaisedLimitAppliesImmediately(t *testing.T) {
+	cfg := newTestConfig().Limit(20).LimitRamp(time.Minute)
+	build(t, cfg)
+
+	if err := cfg.SetLimit(100); err != nil {
+		t.Fatalf("SetLimit() failed: %v", err)
+	}
+	if got := cfg.effectiveLimit(); got != 100 {
+		t.Fatalf("effective limit = %d, want 100", got)
+	}
+}
+
+func TestSetLimitRejectsZero(t *testing.T) {
+	cfg := newTestConfig()
+	if err := cfg.SetLimit(0); err == nil {
+		t.Fatal("SetLimit(0) succeeded, want an error")
+	}
+}
+
+func TestLimitRampRejectsLoweringClientsAtOnce(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	cfg := newTestConfig().Limit(10).LimitRamp(10 * time.Second).Clock(clock.Now)
+	router := newRouter(t, cfg)
+	for i := 0; i < 5; i++ {
+		expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	}
+
+	if err := cfg.SetLimit(2); err != nil {
+		t.Fatalf("SetLimit() failed: %v", err)
+	}
+	// Right after lowering, the client holding 5 units is still below the ramping limit
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	clock.Advance(10 * time.Second)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+}
+
+func TestPenaltyMultiplierScalesReleaseTimeout(t *testing.T) {
+	cfg := newTestConfig().
+		Limit(1).
+		Timeout(time.Minute).
+		PenaltyMultiplier(func(violations uint16) float64 { return 1 + float64(violations) })
+	router := newRouter(t, cfg)
+
+	if got := cfg.releaseTimeout("192.0.2.1"); got != time.Minute {
+		t.Fatalf("release timeout without violations = %s, want 1m", got)
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+	if got := cfg.releaseTimeout("192.0.2.1"); got != 3*time.Minute {
+		t.Fatalf("release timeout after 2 violations = %s, want 3m", got)
+	}
+	if got := cfg.releaseTimeout("192.0.2.2"); got != time.Minute {
+		t.Fatalf("release timeout of another client = %s, want 1m", got)
+	}
+}
+
+func TestViolationsRequireViolationTracker(t *testing.T) {
+	// The counting storage only exposes the plain operations of the storage it wraps
+	if err := newTestConfig().Storage(newCountingStorage()).PenaltyMultiplier(func(uint16) float64 { return 2 }).Validate(); err == nil {
+		t.Error("Validate() = nil for PenaltyMultiplier without a violation tracker, want an error")
+	}
+	if err := newTestConfig().Storage(newCountingStorage()).ForensicLogAfter(1, nil).Validate(); err == nil {
+		t.Error("Validate() = nil for ForensicLogAfter without a violation tracker, want an error")
+	}
+	if err := newTestConfig().PenaltyMultiplier(func(uint16) float64 { return 2 }).Validate(); err != nil {
+		t.Errorf("Validate() of PenaltyMultiplier with the default storage failed: %v", err)
+	}
+}
+
+func TestPenaltyMultiplierNeverSpeedsUpRelease(t *testing.T) {
+	cfg := newTestConfig().Timeout(time.Minute).PenaltyMultiplier(func(uint16) float64 { return 0.1 })
+	build(t, cfg)
+
+	if got := cfg.releaseTimeout("192.0.2.1"); got != time.Minute {
+		t.Fatalf("release timeout = %s, want 1m", got)
+	}
+}
+
+func TestFullCleanupRotationBoundaries(t *testing.T) {
+	tests := []struct {
+		rotation time.Duration
+		valid    bool
+	}{
+		{time.Minute - time.Nanosecond, false},
+		{time.Minute, true},
+		{time.Minute + time.Nanosecond, true},
+		{0, true}, // Disabled
+	}
+	for _, test := range tests {
+		err := newTestConfig().Timeout(time.Minute).FullCleanupRotation(test.rotation).Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("Validate() with a rotation of %s = %v, want valid %t", test.rotation, err, test.valid)
+		}
+	}
+}
+
+func TestFullCleanupRotationEqualToTimeoutWarns(t *testing.T) {
+	for _, test := range []struct {
+		rotation time.Duration
+		warns    bool
+	}{
+		{time.Minute, true},
+		{2 * time.Minute, false},
+	} {
+		logger := newRecordingLogger()
+		build(t, NewConfigBuilder().Logger(logger).Timeout(time.Minute).FullCleanupRotation(test.rotation))
+		if warned := logger.warned("`FullCleanupRotation` equals `Timeout`"); warned != test.warns {
+			t.Errorf("Build() with a rotation of %s warned %t, want %t", test.rotation, warned, test.warns)
+		}
+	}
+}
+
+func TestValidateAcceptsDefaults(t *testing.T) {
+	cfg := newTestConfig()
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Validate() of the defaults failed: %v", err)
+	}
+	if running := cfg.running.Load(); running != 0 {
+		t.Fatalf("Validate() started %d workers", running)
+	}
+}
+
+func TestValidateRejectsInvalidConfigs(t *testing.T) {
+	tests := map[string]func(cfg *Config){
+		"tolerance equal to timeout":    func(cfg *Config) { cfg.Timeout(time.Second).Tolerance(time.Second) },
+		"nil id selector":               func(cfg *Config) { cfg.IdSelector(nil) },
+		"nil handler":                   func(cfg *Config) { cfg.Handler(nil) },
+		"nil clock":                     func(cfg *Config) { cfg.Clock(nil) },
+		"nil skip":                      func(cfg *Config) { cfg.Skip(nil) },
+		"nil denied handler":            func(cfg *Config) { cfg.DeniedHandler(nil) },
+		"invalid allowlist":             func(cfg *Config) { cfg.Allowlist([]string{"not-an-ip"}) },
+		"invalid denylist":              func(cfg *Config) { cfg.Denylist([]string{"10.0.0.0/33"}) },
+		"nil overload handler":          func(cfg *Config) { cfg.OverloadHandler(nil) },
+		"nil invalid id handler":        func(cfg *Config) { cfg.InvalidIDHandler(nil) },
+		"nil storage error handler":     func(cfg *Config) { cfg.OnStorageError(nil) },
+		"nil storage":                   func(cfg *Config) { cfg.Storage(nil) },
+		"zero limit":                    func(cfg *Config) { cfg.Limit(0) },
+		"status code below 100":         func(cfg *Config) { cfg.StatusCode(99) },
+		"status code above 599":         func(cfg *Config) { cfg.StatusCode(600) },
+		"timeout below a microsecond":   func(cfg *Config) { cfg.Timeout(time.Nanosecond).Tolerance(-time.Nanosecond) },
+		"negative tolerance":            func(cfg *Config) { cfg.Tolerance(-time.Second) },
+		"negative limit ramp":           func(cfg *Config) { cfg.LimitRamp(-time.Second) },
+		"negative queue timeout":        func(cfg *Config) { cfg.QueueTimeout(-time.Second) },
+		"cleanup jitter of 1":           func(cfg *Config) { cfg.CleanupJitter(1) },
+		"negative cleanup jitter":       func(cfg *Config) { cfg.CleanupJitter(-0.1) },
+		"zero workers":                  func(cfg *Config) { cfg.WorkerCount(0) },
+		"zero sampling rate":            func(cfg *Config) { cfg.SamplingRate(0) },
+		"zero forensic threshold":       func(cfg *Config) { cfg.ForensicLogAfter(0, nil) },
+		"negative rejection log window": func(cfg *Config) { cfg.RejectionLogSuppression(1, -time.Second) },
+		"zero webhook batch size":       func(cfg *Config) { cfg.Webhook("http://example.com", 0, time.Second) },
+		"invalid webhook url":           func(cfg *Config) { cfg.Webhook("not a url", 1, time.Second) },
+		"negative histogram interval":   func(cfg *Config) { cfg.ExportHistogram(-time.Second, func([]uint64) {}) },
+		"nil histogram hook":            func(cfg *Config) { cfg.ExportHistogram(time.Second, nil) },
+		"negative max idle":             func(cfg *Config) { cfg.MaxIdle(-time.Second) },
+		"max idle below timeout":        func(cfg *Config) { cfg.MaxIdle(time.Second) },
+		"sliding window with sampling":  func(cfg *Config) { cfg.Algorithm(SlidingWindow).SamplingRate(2) },
+		"gcra with token bucket":        func(cfg *Config) { cfg.Algorithm(GCRA).TokenBucket(1, 1) },
+		"negative emission interval":    func(cfg *Config) { cfg.EmissionInterval(-time.Second) },
+		"negative refill rate":          func(cfg *Config) { cfg.TokenBucket(-1, 1) },
+		"zero token bucket burst":       func(cfg *Config) { cfg.TokenBucket(1, 0) },
+		"token bucket with sampling":    func(cfg *Config) { cfg.TokenBucket(1, 1).SamplingRate(2) },
+		"zero read limit":               func(cfg *Config) { cfg.SeparateReadWrite(0, 1) },
+		"invalid header name":           func(cfg *Config) { cfg.HeaderNames(HeaderNames{Limit: "a b", Remaining: "b", Warning: "c"}) },
+		"queue size with lazy workers":  func(cfg *Config) { cfg.QueueSize(1).LazyWorkers(true) },
+		"trailers without headers":      func(cfg *Config) { cfg.Trailers(true) },
+		"dimension with status weight": func(cfg *Config) {
+			cfg.Dimension("tenant", PathSelector(), 1).StatusWeight(func(int) uint16 { return 1 })
+		},
+		"invalid violation report": func(cfg *Config) { cfg.ReportViolations(ReportAll + 1) },
+		"policy with invalid header name": func(cfg *Config) {
+			cfg.Policy("default").HeaderNames(HeaderNames{Limit: "a", Remaining: "b", Warning: "c"})
+		},
+		"cleanup rotation below timeout": func(cfg *Config) { cfg.FullCleanupRotation(time.Second) },
+		"invalid priority multiplier":    func(cfg *Config) { cfg.PriorityMultiplier(PriorityHigh, 0) },
+		"zero route limit":               func(cfg *Config) { cfg.RouteLimit("/login", 0) },
+		"zero method limit":              func(cfg *Config) { cfg.MethodLimit("POST", 0) },
+		"reserved dimension name":        func(cfg *Config) { cfg.Dimension(DefaultDimension, PathSelector(), 1) },
+		"nil dimension selector":         func(cfg *Config) { cfg.Dimension("tenant", nil, 1) },
+		"zero dimension limit":           func(cfg *Config) { cfg.Dimension("tenant", PathSelector(), 0) },
+		"schedule beyond a day":          func(cfg *Config) { cfg.Schedule([]ScheduleEntry{{Start: 0, End: 25 * time.Hour, Limit: 1}}) },
+		"zero schedule limit":            func(cfg *Config) { cfg.Schedule([]ScheduleEntry{{Start: 0, End: time.Hour}}) },
+	}
+	for name, configure := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg := newTestConfig()
+			configure(cfg)
+			if err := cfg.Validate(); err == nil {
+				t.Fatal("Validate() succeeded, want an error")
+			}
+			if running := cfg.running.Load(); running != 0 {
+				t.Fatalf("Validate() started %d workers", running)
+			}
+		})
+	}
+}
+
+func TestBuildReturnsValidateError(t *testing.T) {
+	cfg := newTestConfig().Limit(0)
+	if _, err := cfg.Build(); err == nil || err.Error() != cfg.Validate().Error() {
+		t.Fatalf("Build() = %v, want the error of Validate()", err)
+	}
+}
+
+func TestDefaultStorageFollowsClock(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	router := newRouter(t, newTestConfig().Clock(clock.Now).TokenBucket(1, 1))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+	clock.Advance(time.Second)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+}
+
+func TestShutdownStopsWorkersHoldingEntries(t *testing.T) {
+	cfg := newTestConfig().Timeout(time.Hour).WorkerCount(2)
+	router := newRouter(t, cfg)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+
+	done := make(chan struct{})
+	go func() {
+		cfg.Shutdown()
+		cfg.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Shutdown() waited for the release timeout")
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+}
+
+func TestCloseReleasesHeldEntries(t *testing.T) {
+	storage := newCountingStorage()
+	cfg := newTestConfig().Storage(storage).Timeout(time.Hour).WorkerCount(4)
+	router := newRouter(t, cfg)
+	for i := 0; i < 3; i++ {
+		expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := cfg.Close(ctx); err != nil {
+		t.Fatalf("Close() = %v, want the queue drained", err)
+	}
+	if count, _ := storage.Get("192.0.2.1"); count != 0 {
+		t.Errorf("count = %d after Close, want every entry released", count)
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+}
+
+// stuckStorage is a storage whose Decrease blocks until unblock is closed.
+type stuckStorage struct {
+	*countingStorage
+	unblock chan struct{}
+}
+
+func (s stuckStorage) Decrease(id string) error {
+	<-s.unblock
+	return s.countingStorage.Decrease(id)
+}
+
+func TestCloseAbandonsDrainOnDoneContext(t *testing.T) {
+	storage := stuckStorage{newCountingStorage(), make(chan struct{})}
+	defer close(storage.unblock)
+	cfg := newTestConfig().Storage(storage).Timeout(time.Hour)
+	router := newRouter(t, cfg)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := cfg.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Close() = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestSeparateReadWriteBudgets(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(100).SeparateReadWrite(3, 1))
+
+	expectStatus(t, serve(router, http.MethodPost, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodDelete, "/"), http.StatusTooManyRequests)
+	// Reads keep their own budget once writes are exhausted
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodHead, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodOptions, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+}
+
+func TestSeparateReadWriteValidation(t *testing.T) {
+	if err := newTestConfig().SeparateReadWrite(1, 0).Validate(); err == nil {
+		t.Error("Validate() = nil for a zero write limit, want an error")
+	}
+}
+
+func TestLifetimeContextDrainsMiddleware(t *testing.T) {
+	tests := map[string]func(*Config) *Config{
+		"eager workers":  func(cfg *Config) *Config { return cfg.WorkerCount(4).QueueSize(8) },
+		"lazy workers":   func(cfg *Config) *Config { return cfg.WorkerCount(4).LazyWorkers(true) },
+		"unbuffered":     func(cfg *Config) *Config { return cfg.WorkerCount(4) },
+		"queue timeouts": func(cfg *Config) *Config { return cfg.WorkerCount(4).QueueTimeout(time.Millisecond) },
+	}
+	for name, configure := range tests {
+		t.Run(name, func(t *testing.T) {
+			storage := newCountingStorage()
+			lifetime, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			cfg := configure(newTestConfig().Storage(storage).Limit(1000).Timeout(time.Hour).Context(lifetime))
+			router := newRouter(t, cfg)
+
+			// Clients keep sending requests while the lifetime context is cancelled, and a few more after it
+			const clients = 16
+			var wg sync.WaitGroup
+			statuses := make(chan int, 1024)
+			for i := 0; i < clients; i++ {
+				wg.Add(1)
+				go func(ip string) {
+					defer wg.Done()
+					for after := 0; after < 3; {
+						select {
+						case <-cfg.stop:
+							after++
+						default:
+						}
+						statuses <- serve(router, http.MethodGet, "/", fromIP(ip)).Code
+					}
+				}(fmt.Sprintf("192.0.2.%d", i+1))
+			}
+			go func() {
+				wg.Wait()
+				close(statuses)
+			}()
+
+			time.Sleep(10 * time.Millisecond)
+			cancel()
+			for status := range statuses {
+				// Requests are either queued for release, rejected as overloaded by a queue timeout, or passed through once closed
+				if status != http.StatusOK && status != http.StatusServiceUnavailable {
+					t.Fatalf("status = %d during the shutdown, want 200 or 503", status)
+				}
+			}
+
+			workersDone := make(chan struct{})
+			go func() {
+				cfg.workers.Wait()
+				close(workersDone)
+			}()
+			select {
+			case <-workersDone:
+			case <-time.After(time.Second):
+				t.Fatal("the workers did not exit once the lifetime context was cancelled")
+			}
+			if running := cfg.running.Load(); running != 0 {
+				t.Errorf("%d workers running after the shutdown, want 0", running)
+			}
+			if increases, decreases := storage.increases.Load(), storage.decreases.Load(); increases != decreases {
+				t.Errorf("%d units charged and %d released, want every unit released", increases, decreases)
+			}
+			for i := 0; i < clients; i++ {
+				if count, _ := storage.Get(fmt.Sprintf("192.0.2.%d", i+1)); count != 0 {
+					t.Errorf("count of client %d = %d after the shutdown, want 0", i+1, count)
+				}
+			}
+			// Once shut down, requests pass through without being counted
+			increases := storage.increases.Load()
+			expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+			if storage.increases.Load() != increases {
+				t.Error("a request was counted after the shutdown")
+			}
+		})
+	}
+}
+
+func TestStopCleanupKeepsMiddlewareRunning(t *testing.T) {
+	storage := rlstorage.NewHashMapStorage(discardLogger())
+	trigger := make(chan struct{}, 1)
+	cfg := newTestConfig().Limit(1).Storage(storage).CleanupTrigger(trigger)
+	router := newRouter(t, cfg)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+
+	cfg.StopCleanup()
+	cfg.StopCleanup() // Stopping twice is safe
+	time.Sleep(10 * time.Millisecond)
+	trigger <- struct{}{}
+	time.Sleep(20 * time.Millisecond)
+	if count, _ := storage.Get("192.0.2.1"); count != 1 {
+		t.Fatalf("count after a trigger on a stopped cleanup = %d, want 1", count)
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+	expectStatus(t, serve(router, http.MethodGet, "/", fromIP("198.51.100.1")), http.StatusOK)
+}
+
+func TestStopCleanupWithoutCleanupIsNoop(t *testing.T) {
+	cfg := newTestConfig()
+	build(t, cfg)
+
+	cfg.StopCleanup()
+	if cfg.cleanupWorker != nil {
+		t.Fatal("Build() started a cleanup worker with the cleanup disabled")
+	}
+}
+
+// freeAllCountingStorage wraps a storage, counting its FreeAll calls.
+type freeAllCountingStorage struct {
+	rlstorage.RLStorage
+	freeAlls atomic.Int64
+}
+
+func (s *freeAllCountingStorage) FreeAll() error {
+	s.freeAlls.Add(1)
+	return s.RLStorage.FreeAll()
+}
+
+func TestFullCleanupFollowsRotationRatherThanTimeout(t *testing.T) {
+	storage := &freeAllCountingStorage{RLStorage: rlstorage.NewHashMapStorage(discardLogger())}
+	build(t, NewConfigBuilder().Logger(discardLogger()).Storage(storage).
+		Timeout(10*time.Millisecond).Tolerance(0).FullCleanupRotation(150*time.Millisecond).CleanupJitter(0))
+
+	time.Sleep(60 * time.Millisecond)
+	if calls := storage.freeAlls.Load(); calls != 0 {
+		t.Fatalf("%d cleanups ran within a few timeouts, want none before the rotation", calls)
+	}
+	deadline := time.Now().Add(time.Second)
+	for storage.freeAlls.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no cleanup ran after the rotation")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestKeyPrefixAppliesToStorage(t *testing.T) {
+	server, client := newMiniredis(t)
+	router := newRouter(t, newTestConfig().Storage(rlstorage.NewRedisStorage(client, time.Minute, discardLogger())).KeyPrefix("api:"))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	for _, key := range server.Keys() {
+		if !strings.HasPrefix(key, "api:") {
+			t.Errorf("key %q is not under the configured prefix", key)
+		}
+	}
+	if len(server.Keys()) == 0 {
+		t.Fatal("no key written to Redis")
+	}
+}
+
+func TestKeyPrefixWarnsOnUnsupportedStorage(t *testing.T) {
+	logger := newRecordingLogger()
+	build(t, newTestConfig().Logger(logger).KeyPrefix("api:"))
+
+	if !logger.warned("`KeyPrefix` is set but the storage does not support key prefixes") {
+		t.Fatal("Build() did not warn about the ignored key prefix")
+	}
+}
+
+func TestBuildDerivesUnsetStorageTTL(t *testing.T) {
+	for name, wrap := range map[string]func(rlstorage.RLStorage) rlstorage.RLStorage{
+		"redis":   func(storage rlstorage.RLStorage) rlstorage.RLStorage { return storage },
+		"replica": func(storage rlstorage.RLStorage) rlstorage.RLStorage { return rlstorage.NewReadReplicaStorage(storage) },
+		"oom": func(storage rlstorage.RLStorage) rlstorage.RLStorage {
+			return rlstorage.NewOOMFallbackStorage(storage, rlstorage.NewHashMapStorage(discardLogger()), time.Minute, nil)
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server, client := newMiniredis(t)
+			redisStorage := rlstorage.NewRedisStorage(client, 0, discardLogger())
+			router := newRouter(t, newTestConfig().Storage(wrap(redisStorage)).Timeout(time.Minute).Tolerance(time.Second))
+
+			if ttl := redisStorage.(rlstorage.TTLStorage).TTL(); ttl != time.Minute+time.Second {
+				t.Fatalf("TTL() after Build = %s, want the timeout plus the tolerance", ttl)
+			}
+			expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+			for _, key := range server.Keys() {
+				if ttl := server.TTL(key); ttl <= 0 {
+					t.Errorf("key %q has no TTL", key)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildWarnsAboutShortStorageTTL(t *testing.T) {
+	_, client := newMiniredis(t)
+	for _, test := range []struct {
+		ttl   time.Duration
+		warns bool
+	}{
+		{time.Second, true},
+		{time.Minute, false},
+	} {
+		logger := newRecordingLogger()
+		storage := rlstorage.NewReadReplicaStorage(rlstorage.NewRedisStorage(client, test.ttl, discardLogger()))
+		build(t, newTestConfig().Logger(logger).Storage(storage).Timeout(time.Minute))
+		if warned := logger.warned("is shorter than `Timeout`"); warned != test.warns {
+			t.Errorf("Build() with a storage TTL of %s warned %t, want %t", test.ttl, warned, test.warns)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package ratelimiter
+
+import rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
+
+// TransferCount moves the accumulated count of fromID onto toID, e.g. when an anonymous session
+// becomes a logged-in user, so the client does not get a fresh budget by logging in.
+// It returns the number of units moved, and the storage error that interrupted the transfer, if any.
+//
+// Storages implementing rlstorage.Transferer move the count atomically, other storages fall back
+// to a (non-atomic) read, free and increase. The moved units are released from toID after the timeout.
+func (cfg *Config) TransferCount(fromID, toID string) (uint16, error) {
+	moved, err := cfg.transfer(fromID, toID)
+	if moved > 0 && !cfg.addToReleaseQueue(toID, moved, nil) {
+		cfg.logger.Warn("failed to queue the release of transferred units", "user_id", toID, "units", moved)
+	}
+	return moved, err
+}
+
+// transfer moves the count of fromID onto toID and returns the number of units that reached toID.
+func (cfg *Config) transfer(fromID, toID string) (uint16, error) {
+	if transferer, ok := rlstorage.As[rlstorage.Transferer](cfg.storage); ok {
+		return transferer.Transfer(fromID, toID)
+	}
+	count, err := cfg.storage.Get(fromID)
+	if err != nil {
+		return 0, err
+	}
+	if err := cfg.storage.Free(fromID); err != nil {
+		return 0, err
+	}
+	for moved := uint16(0); moved < count; moved++ {
+		if err := cfg.storage.Increase(toID); err != nil {
+			return moved, err
+		}
+	}
+	return count, nil
+}
+
+// Reset clears the count of the given ID, so a client throttled by mistake is allowed again right away
+// without flushing every client via FreeAll. Its token bucket, sliding window log, GCRA arrival time and
+// violation count are cleared as well. Entries of the client still waiting in the release queue are
+// released as usual, decreasing the fresh count, so until they are released the client may be handed
+// up to a full extra limit of budget.
+//
+// The ID is the storage key the middleware uses for the client: the value returned by the configured
+// IdSelector (or IdSelectorE) for its requests, followed by keySeparator ("|") and the route pattern,
+// the method class or the method if RouteLimit, SeparateReadWrite or PerMethod are used, in that order
+// (e.g. "203.0.113.7|/api/*|write").
+func (cfg *Config) Reset(id string) error {
+	return cfg.storage.Free(id)
+}
+
+// Remaining returns how many more units the given ID may use before reaching the limit (clamped at 0),
+// without charging it, e.g. to serve a quota endpoint. An unknown ID has the full limit remaining.
+// The ID is computed as documented on Reset.
+//
+// It compares against the current static limit (see SetLimit): limits that depend on the request,
+// such as route, claim, scheduled or resolved limits, are not applied.
+func (cfg *Config) Remaining(id string) (uint16, error) {
+	count, err := cfg.storage.Get(id)
+	if err != nil {
+		return 0, err
+	}
+	return result{limit: cfg.effectiveLimit(), count: cfg.estimateCount(count)}.remaining(), nil
+}
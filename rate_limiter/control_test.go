@@ -0,0 +1,154 @@
+package ratelimiter
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
+)
+
+func TestTransferCountMovesCount(t *testing.T) {
+	for name, storage := range map[string]rlstorage.RLStorage{
+		"atomic":   rlstorage.NewHashMapStorage(discardLogger()),
+		"fallback": newCountingStorage(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg := newTestConfig().Limit(5).Storage(storage)
+			router := newRouter(t, cfg)
+			for i := 0; i < 3; i++ {
+				expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+			}
+
+			moved, err := cfg.TransferCount("192.0.2.1", "user-1")
+			if err != nil || moved != 3 {
+				t.Fatalf("TransferCount() = %d, %v, want 3 units moved", moved, err)
+			}
+			if count, _ := storage.Get("192.0.2.1"); count != 0 {
+				t.Fatalf("count of the source after the transfer = %d, want 0", count)
+			}
+			if count, _ := storage.Get("user-1"); count != 3 {
+				t.Fatalf("count of the destination after the transfer = %d, want 3", count)
+			}
+		})
+	}
+}
+
+func TestTransferCountOfUnknownIDMovesNothing(t *testing.T) {
+	cfg := newTestConfig()
+	build(t, cfg)
+
+	if moved, err := cfg.TransferCount("unknown", "user-1"); err != nil || moved != 0 {
+		t.Fatalf("TransferCount() = %d, %v, want nothing moved", moved, err)
+	}
+}
+
+func TestResetAllowsClientAgain(t *testing.T) {
+	cfg := newTestConfig().Limit(1)
+	router := newRouter(t, cfg)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/", fromIP("198.51.100.1")), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+
+	if err := cfg.Reset("192.0.2.1"); err != nil {
+		t.Fatalf("Reset() failed: %v", err)
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	// Other clients keep their count
+	expectStatus(t, serve(router, http.MethodGet, "/", fromIP("198.51.100.1")), http.StatusTooManyRequests)
+}
+
+func TestResetUsesRouteScopedKey(t *testing.T) {
+	cfg := newTestConfig().Limit(10).RouteLimit("/login", 1)
+	router := newRouter(t, cfg, "/login")
+	expectStatus(t, serve(router, http.MethodGet, "/login"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/login"), http.StatusTooManyRequests)
+
+	if err := cfg.Reset("192.0.2.1"); err != nil {
+		t.Fatalf("Reset() failed: %v", err)
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/login"), http.StatusTooManyRequests)
+	if err := cfg.Reset("192.0.2.1|/login"); err != nil {
+		t.Fatalf("Reset() failed: %v", err)
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/login"), http.StatusOK)
+}
+
+func TestResetClearsAlgorithmState(t *testing.T) {
+	tests := map[string]func(cfg *Config) *Config{
+		"token bucket":   func(cfg *Config) *Config { return cfg.TokenBucket(0.001, 1) },
+		"gcra":           func(cfg *Config) *Config { return cfg.Algorithm(GCRA).Tolerance(0) },
+		"sliding window": func(cfg *Config) *Config { return cfg.Algorithm(SlidingWindow) },
+	}
+	for name, algorithm := range tests {
+		t.Run(name, func(t *testing.T) {
+			clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+			cfg := algorithm(newTestConfig().Limit(1).Timeout(time.Hour).Clock(clock.Now))
+			router := newRouter(t, cfg)
+			expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+			expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+
+			if err := cfg.Reset("192.0.2.1"); err != nil {
+				t.Fatalf("Reset() failed: %v", err)
+			}
+			expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+		})
+	}
+}
+
+func TestResetOfUnknownIDSucceeds(t *testing.T) {
+	cfg := newTestConfig()
+	build(t, cfg)
+
+	if err := cfg.Reset("unknown"); err != nil {
+		t.Fatalf("Reset() of an unknown ID failed: %v", err)
+	}
+}
+
+func TestRemainingReportsBudgetLeft(t *testing.T) {
+	cfg := newTestConfig().Limit(3)
+	router := newRouter(t, cfg)
+
+	if remaining, err := cfg.Remaining("192.0.2.1"); err != nil || remaining != 3 {
+		t.Fatalf("Remaining() of an unknown ID = %d, %v, want the full limit", remaining, err)
+	}
+	for want := uint16(2); ; want-- {
+		expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+		remaining, err := cfg.Remaining("192.0.2.1")
+		if err != nil || remaining != want {
+			t.Fatalf("Remaining() = %d, %v, want %d", remaining, err, want)
+		}
+		if want == 0 {
+			break
+		}
+	}
+	// Querying does not charge the client, and the remaining budget is clamped at 0
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+	if remaining, err := cfg.Remaining("192.0.2.1"); err != nil || remaining != 0 {
+		t.Fatalf("Remaining() of a limited client = %d, %v, want 0", remaining, err)
+	}
+}
+
+func TestRemainingFollowsSetLimit(t *testing.T) {
+	cfg := newTestConfig().Limit(5)
+	router := newRouter(t, cfg)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+
+	if err := cfg.SetLimit(1); err != nil {
+		t.Fatalf("SetLimit() failed: %v", err)
+	}
+	if remaining, err := cfg.Remaining("192.0.2.1"); err != nil || remaining != 0 {
+		t.Fatalf("Remaining() over a lowered limit = %d, %v, want 0", remaining, err)
+	}
+}
+
+func TestRemainingReturnsStorageError(t *testing.T) {
+	cfg := newTestConfig().Storage(failingStorage{})
+	build(t, cfg)
+
+	if _, err := cfg.Remaining("192.0.2.1"); !errors.Is(err, errStorageDown) {
+		t.Fatalf("Remaining() over a failing storage = %v, want %v", err, errStorageDown)
+	}
+}
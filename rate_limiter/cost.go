@@ -0,0 +1,28 @@
+package ratelimiter
+
+import (
+	"math"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CostFunc is a function type that returns the number of units a request costs against the rate limit.
+type CostFunc func(*gin.Context) uint16
+
+// ContentLengthCost returns a CostFunc that weighs requests by their payload size,
+// charging a unit per started bytesPerUnit bytes of `Content-Length`.
+// Requests without a body (or with an unknown length) cost a single unit,
+// and the cost is capped at math.MaxUint16 units. A bytesPerUnit of 0 or less is treated as 1.
+func ContentLengthCost(bytesPerUnit int64) CostFunc {
+	if bytesPerUnit <= 0 {
+		bytesPerUnit = 1
+	}
+	return func(ctx *gin.Context) uint16 {
+		length := ctx.Request.ContentLength
+		if length <= 0 {
+			return 1
+		}
+		units := (length + bytesPerUnit - 1) / bytesPerUnit
+		return uint16(min(units, math.MaxUint16))
+	}
+}
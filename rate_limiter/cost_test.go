@@ -0,0 +1,131 @@
+package ratelimiter
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis"
+)
+
+func TestContentLengthCost(t *testing.T) {
+	tests := []struct {
+		bytesPerUnit  int64
+		contentLength int64
+		want          uint16
+	}{
+		{1024, -1, 1}, // Unknown length
+		{1024, 0, 1},
+		{1024, 1, 1},
+		{1024, 1024, 1},
+		{1024, 1025, 2},
+		{1024, 10 * 1024, 10},
+		{1, math.MaxInt64, math.MaxUint16},
+		{0, 3, 3},  // Treated as 1 byte per unit
+		{-5, 3, 3}, // Treated as 1 byte per unit
+	}
+	for _, test := range tests {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodPost, "/", nil)
+		ctx.Request.ContentLength = test.contentLength
+		if got := ContentLengthCost(test.bytesPerUnit)(ctx); got != test.want {
+			t.Errorf("ContentLengthCost(%d) of %d bytes = %d, want %d", test.bytesPerUnit, test.contentLength, got, test.want)
+		}
+	}
+}
+
+func TestContentLengthCostChargesUploads(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(10).Cost(ContentLengthCost(100)))
+	upload := func(size int) func(*http.Request) {
+		return func(req *http.Request) {
+			req.Body = io.NopCloser(strings.NewReader(strings.Repeat("x", size)))
+			req.ContentLength = int64(size)
+		}
+	}
+
+	expectStatus(t, serve(router, http.MethodPost, "/", upload(650)), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodPost, "/", upload(400)), http.StatusTooManyRequests)
+	expectStatus(t, serve(router, http.MethodPost, "/", upload(300)), http.StatusOK)
+}
+
+// increaserByStorage is a countingStorage also exposing the IncreaserBy capability of its storage.
+type increaserByStorage struct {
+	*countingStorage
+	increasesBy atomic.Int64
+}
+
+func (s *increaserByStorage) IncreaseBy(id string, n uint16) error {
+	s.increasesBy.Add(1)
+	return s.RLStorage.(rlstorage.IncreaserBy).IncreaseBy(id, n)
+}
+
+// fixedCost costs every request the given number of units.
+func fixedCost(units uint16) CostFunc {
+	return func(*gin.Context) uint16 { return units }
+}
+
+func TestWeightedRequestIncreasesInSingleCall(t *testing.T) {
+	storage := &increaserByStorage{countingStorage: newCountingStorage()}
+	router := newRouter(t, newTestConfig().Storage(storage).Limit(10).Cost(fixedCost(5)))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	if calls, increases := storage.increasesBy.Load(), storage.increases.Load(); calls != 1 || increases != 0 {
+		t.Errorf("IncreaseBy called %d times and Increase %d times, want a single IncreaseBy", calls, increases)
+	}
+	if count, _ := storage.Get("192.0.2.1"); count != 5 {
+		t.Errorf("count = %d, want 5", count)
+	}
+}
+
+func TestWeightedRequestFallsBackToIncrease(t *testing.T) {
+	storage := newCountingStorage()
+	router := newRouter(t, newTestConfig().Storage(storage).Limit(10).Cost(fixedCost(5)))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+	if increases := storage.increases.Load(); increases != 10 {
+		t.Errorf("Increase called %d times, want once per unit", increases)
+	}
+}
+
+func TestWeightedRequestsShareQuotaAcrossInstances(t *testing.T) {
+	server, _ := newMiniredis(t)
+	routers := make([]*gin.Engine, 2)
+	for i := range routers {
+		// Every instance has a client of its own, as separate processes would
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		t.Cleanup(func() { client.Close() })
+		storage := rlstorage.NewRedisStorage(client, time.Minute, discardLogger())
+		routers[i] = newRouter(t, newTestConfig().Storage(storage).Limit(5).Cost(fixedCost(3)).WorkerCount(100))
+	}
+
+	const requests = 20
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(router *gin.Engine) {
+			defer wg.Done()
+			if serve(router, http.MethodGet, "/").Code == http.StatusOK {
+				allowed.Add(1)
+			}
+		}(routers[i%len(routers)])
+	}
+	wg.Wait()
+
+	if got := allowed.Load(); got != 1 {
+		t.Fatalf("%d weighted requests allowed across the instances, want 1 (a cost of 3 against a limit of 5)", got)
+	}
+	if count, err := server.Get("rl:count:192.0.2.1"); err != nil || count != "3" {
+		t.Fatalf("shared count = %q (%v), want 3", count, err)
+	}
+}
@@ -0,0 +1,97 @@
+package ratelimiter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dedupKey identifies a request by the hash of its client ID, method, path and body.
+type dedupKey [sha256.Size]byte
+
+// deduper remembers recently counted requests, so byte-identical repetitions within the window
+// are not counted again.
+type deduper struct {
+	window   time.Duration          // How long a counted request is remembered
+	maxBody  int64                  // The largest body (in bytes) hashed, larger requests are never deduplicated
+	lock     sync.Mutex             // A mutex lock to ensure thread-safe access to the remembered requests
+	requests map[dedupKey]time.Time // The expiry time of each remembered request
+}
+
+// newDeduper creates a deduper remembering counted requests for the given window.
+func newDeduper(window time.Duration, maxBody int64) *deduper {
+	return &deduper{
+		window:   window,
+		maxBody:  maxBody,
+		requests: make(map[dedupKey]time.Time),
+	}
+}
+
+// key hashes the given ID with the method, path and body of the request. The body is restored for the
+// next handlers. It reports false if the body could not be read or is larger than the hashed maximum.
+func (d *deduper) key(ctx *gin.Context, id string) (dedupKey, bool) {
+	hash := sha256.New()
+	for _, part := range []string{id, ctx.Request.Method, ctx.Request.URL.RequestURI()} {
+		io.WriteString(hash, part)
+		hash.Write([]byte{0})
+	}
+	if ctx.Request.Body != nil && ctx.Request.Body != http.NoBody {
+		body, err := io.ReadAll(io.LimitReader(ctx.Request.Body, d.maxBody+1))
+		ctx.Request.Body = readCloser{io.MultiReader(bytes.NewReader(body), ctx.Request.Body), ctx.Request.Body}
+		if err != nil || int64(len(body)) > d.maxBody {
+			return dedupKey{}, false
+		}
+		hash.Write(body)
+	}
+	var key dedupKey
+	hash.Sum(key[:0])
+	return key, true
+}
+
+// seen reports whether the request with the given key was counted within the window.
+func (d *deduper) seen(key dedupKey, now time.Time) bool {
+	defer d.lock.Unlock()
+	d.lock.Lock()
+	expiry, ok := d.requests[key]
+	return ok && now.Before(expiry)
+}
+
+// remember records that the request with the given key was counted at now.
+func (d *deduper) remember(key dedupKey, now time.Time) {
+	defer d.lock.Unlock()
+	d.lock.Lock()
+	d.requests[key] = now.Add(d.window)
+}
+
+// run forgets expired requests once per window, until stop is closed.
+func (d *deduper) run(clock func() time.Time, stop <-chan struct{}) {
+	ticker := time.NewTicker(d.window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			now := clock()
+			d.lock.Lock()
+			for key, expiry := range d.requests {
+				if !now.Before(expiry) {
+					delete(d.requests, key)
+				}
+			}
+			d.lock.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// readCloser combines a reader with the closer of the body it was derived from.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,85 @@
+package ratelimiter
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// withBody sets the body of the request.
+func withBody(body string) func(*http.Request) {
+	return func(req *http.Request) {
+		req.Body = io.NopCloser(strings.NewReader(body))
+	}
+}
+
+func TestDedupRepeatsAreFreeUnderLimit(t *testing.T) {
+	storage := newCountingStorage()
+	router := newRouter(t, newTestConfig().Storage(storage).Limit(3).Dedup(time.Minute, 1024).WorkerCount(8))
+
+	for i := 0; i < 5; i++ {
+		expectStatus(t, serve(router, http.MethodPost, "/", withBody("retry")), http.StatusOK)
+	}
+	expectStatus(t, serve(router, http.MethodPost, "/", withBody("other")), http.StatusOK)
+	if count, _ := storage.Get("192.0.2.1"); count != 2 {
+		t.Errorf("count = %d, want the repeated request counted once", count)
+	}
+}
+
+func TestDedupRepeatsAreChargedAtLimit(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(2).Dedup(time.Minute, 1024).WorkerCount(8))
+
+	expectStatus(t, serve(router, http.MethodPost, "/", withBody("retry")), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodPost, "/", withBody("other")), http.StatusOK)
+	for i := 0; i < 3; i++ {
+		expectStatus(t, serve(router, http.MethodPost, "/", withBody("retry")), http.StatusTooManyRequests)
+	}
+}
+
+func TestDedupDistinguishesClientsAndBodies(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(1).Dedup(time.Minute, 1024).WorkerCount(8))
+
+	expectStatus(t, serve(router, http.MethodPost, "/", withBody("a")), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodPost, "/", withBody("b")), http.StatusTooManyRequests)
+	expectStatus(t, serve(router, http.MethodPost, "/", withBody("a"), fromIP("192.0.2.2")), http.StatusOK)
+}
+
+func TestDedupWindowExpires(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	storage := newCountingStorage()
+	router := newRouter(t, newTestConfig().Storage(storage).Limit(5).Clock(clock.Now).Dedup(time.Second, 1024).WorkerCount(8))
+
+	serve(router, http.MethodGet, "/")
+	serve(router, http.MethodGet, "/")
+	clock.Advance(time.Second)
+	serve(router, http.MethodGet, "/")
+	if count, _ := storage.Get("192.0.2.1"); count != 2 {
+		t.Errorf("count = %d, want the request counted again after the window", count)
+	}
+}
+
+func TestDedupSkipsLargeBodiesAndRestoresThem(t *testing.T) {
+	storage := newCountingStorage()
+	var bodies []string
+	router := gin.New()
+	router.Use(build(t, newTestConfig().Storage(storage).Limit(5).Dedup(time.Minute, 4).WorkerCount(8)))
+	router.POST("/", func(ctx *gin.Context) {
+		body, _ := io.ReadAll(ctx.Request.Body)
+		bodies = append(bodies, string(body))
+	})
+
+	serve(router, http.MethodPost, "/", withBody("too large"))
+	serve(router, http.MethodPost, "/", withBody("too large"))
+	if count, _ := storage.Get("192.0.2.1"); count != 2 {
+		t.Errorf("count = %d, want requests with large bodies never deduplicated", count)
+	}
+	for _, body := range bodies {
+		if body != "too large" {
+			t.Errorf("body read by the handler = %q, want it restored", body)
+		}
+	}
+}
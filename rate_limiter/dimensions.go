@@ -0,0 +1,166 @@
+package ratelimiter
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultDimension is the name under which the limit of the selected client ID is reported
+// when additional dimensions are configured.
+const DefaultDimension = "default"
+
+// ViolationReport selects which dimensions are reported when a request violates several at once.
+type ViolationReport uint8
+
+const (
+	// ReportMostRestrictive reports the violated dimension with the fewest remaining requests
+	// (the first one on ties). This is the default.
+	ReportMostRestrictive ViolationReport = iota
+	// ReportFirst reports the first violated dimension, in the order the dimensions were added
+	// (the default dimension comes first).
+	ReportFirst
+	// ReportAll reports every violated dimension, in the order the dimensions were added.
+	ReportAll
+)
+
+// dimension is an additional limit applied to every request, keyed by its own selector.
+type dimension struct {
+	name     string     // The name of the dimension, scoping its keys and reported in the headers
+	selector IDSelector // The function selecting the key of the request within the dimension
+	limit    uint16     // The limit of the dimension
+}
+
+// dimensionResult holds the result of checking a request against a single dimension.
+type dimensionResult struct {
+	name string
+	result
+}
+
+// remaining returns the number of requests remaining for the client within the result's limit.
+func (res result) remaining() uint16 {
+	if res.count < res.limit {
+		return res.limit - res.count
+	}
+	return 0
+}
+
+// chargedDimension is a dimension whose units were charged while checking a request, pending their release.
+type chargedDimension struct {
+	index  int    // The index of the dimension within the results
+	key    string // The key the units were charged to
+	stored uint16 // The count of the key once charged
+}
+
+// checkDimensions checks the request against the default dimension (the selected client ID with the given
+// limit) and every additional dimension, and returns the result describing the request together with the
+// reported dimensions.
+//
+// Dimensions are charged in order until one of them rejects the request, the remaining dimensions are
+// only compared against their count (without charging them) so every violated dimension can be reported.
+// Releases are only queued once every dimension allowed the request: on a rejection, the units charged to
+// the dimensions checked before are rolled back right away, so a rejected request costs nothing. Units taken
+// by algorithms that do not release them (TokenBucket, SlidingWindow and GCRA) cannot be rolled back.
+func (cfg *Config) checkDimensions(checkCtx context.Context, ctx *gin.Context, id string, limit, cost uint16, metadata map[string]string) (result, []dimensionResult) {
+	results := make([]dimensionResult, 0, len(cfg.dimensions)+1)
+	charged := make([]chargedDimension, 0, len(cfg.dimensions)+1)
+	rejected := false
+	for i := -1; i < len(cfg.dimensions); i++ {
+		name, key, dimLimit := DefaultDimension, id, limit
+		if i >= 0 {
+			dim := cfg.dimensions[i]
+			name, key, dimLimit = dim.name, dim.name+keySeparator+dim.selector(ctx), dim.limit
+		}
+		var res result
+		if rejected {
+			res = peek(checkCtx, cfg, key, dimLimit, cost)
+		} else {
+			var stored uint16
+			var release bool
+			res, stored, release = charge(checkCtx, cfg, key, dimLimit, cost)
+			rejected = res.decision != allowed
+			if release {
+				charged = append(charged, chargedDimension{index: len(results), key: key, stored: stored})
+			}
+		}
+		results = append(results, dimensionResult{name, res})
+	}
+	for _, dim := range charged {
+		res := &results[dim.index].result
+		if rejected {
+			*res = cfg.rollback(dim.key, *res, dim.stored)
+			continue
+		}
+		// An entry that cannot be queued makes the request overloaded, rolling back the dimensions after it
+		*res = cfg.queueRelease(dim.key, *res, dim.stored, metadata)
+		rejected = res.decision != allowed
+	}
+
+	reported := cfg.violationReport.pick(results)
+	merged := reported[0].result
+	for _, dim := range results {
+		if merged.err == nil {
+			merged.err = dim.err
+		}
+	}
+	return merged, reported
+}
+
+// pick returns the results reported under the given mode. Without violated dimensions,
+// the most restrictive dimension is reported, so the headers show the tightest budget.
+func (report ViolationReport) pick(results []dimensionResult) []dimensionResult {
+	var violated []dimensionResult
+	for _, res := range results {
+		if res.decision != allowed {
+			violated = append(violated, res)
+		}
+	}
+	switch {
+	case len(violated) == 0:
+		return []dimensionResult{mostRestrictive(results)}
+	case report == ReportFirst:
+		return violated[:1]
+	case report == ReportAll:
+		return violated
+	}
+	return []dimensionResult{mostRestrictive(violated)}
+}
+
+// mostRestrictive returns the result with the fewest remaining requests (the first one on ties).
+func mostRestrictive(results []dimensionResult) dimensionResult {
+	tightest := results[0]
+	for _, res := range results[1:] {
+		if res.remaining() < tightest.remaining() {
+			tightest = res
+		}
+	}
+	return tightest
+}
+
+// peek compares the count of the given ID against the limit without charging the request.
+func peek(ctx context.Context, cfg *Config, id string, limit, cost uint16) result {
+	res := result{limit: limit}
+	count, err := rlstorage.GetContext(ctx, cfg.storage, id)
+	res.count, res.err = cfg.estimateCount(count), err
+	if limit == 0 || uint32(count)+uint32(cost) > uint32(cfg.threshold(limit)) {
+		res.decision = limited
+	}
+	return res
+}
+
+// writeDimensionHeaders writes the names of the reported dimensions and, if every violated dimension
+// is reported, adds the limit and remaining values of the dimensions after the first one.
+func (cfg *Config) writeDimensionHeaders(ctx *gin.Context, reported []dimensionResult) {
+	names := make([]string, len(reported))
+	for i, res := range reported {
+		names[i] = res.name
+		if i > 0 {
+			cfg.addHeader(ctx, cfg.headerNames.Limit, strconv.FormatUint(uint64(res.limit), 10))
+			cfg.addHeader(ctx, cfg.headerNames.Remaining, strconv.FormatUint(uint64(res.remaining()), 10))
+		}
+	}
+	cfg.setHeader(ctx, cfg.headerNames.Dimension, strings.Join(names, ", "))
+}
@@ -0,0 +1,83 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// tenantSelector keys requests by their X-Tenant header.
+func tenantSelector(ctx *gin.Context) string {
+	return ctx.GetHeader("X-Tenant")
+}
+
+// expectStored fails the test if the stored count of the given key is not want.
+func expectStored(t *testing.T, storage rlstorage.RLStorage, key string, want uint16) {
+	t.Helper()
+	if count, err := storage.Get(key); err != nil || count != want {
+		t.Errorf("count of %q = %d, %v, want %d", key, count, err, want)
+	}
+}
+
+func TestDimensionRejectionRollsBackPrimary(t *testing.T) {
+	storage := rlstorage.NewHashMapStorage(discardLogger())
+	router := newRouter(t, newTestConfig().Storage(storage).Limit(10).Dimension("tenant", tenantSelector, 1))
+	tenant := withHeader("X-Tenant", "acme")
+
+	expectStatus(t, serve(router, http.MethodGet, "/", tenant, fromIP("192.0.2.1")), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/", tenant, fromIP("192.0.2.2")), http.StatusTooManyRequests)
+
+	expectStored(t, storage, "192.0.2.1", 1)
+	expectStored(t, storage, "192.0.2.2", 0)
+	expectStored(t, storage, "tenant"+keySeparator+"acme", 1)
+}
+
+func TestDimensionRejectionRollsBackEarlierDimensions(t *testing.T) {
+	storage := rlstorage.NewHashMapStorage(discardLogger())
+	router := newRouter(t, newTestConfig().Storage(storage).Limit(10).
+		Dimension("tenant", tenantSelector, 10).
+		Dimension("path", PathSelector(), 1))
+	tenant := withHeader("X-Tenant", "acme")
+
+	expectStatus(t, serve(router, http.MethodGet, "/", tenant, fromIP("192.0.2.1")), http.StatusOK)
+	for i := 0; i < 3; i++ {
+		expectStatus(t, serve(router, http.MethodGet, "/", tenant, fromIP("192.0.2.2")), http.StatusTooManyRequests)
+	}
+
+	expectStored(t, storage, "192.0.2.2", 0)
+	expectStored(t, storage, "tenant"+keySeparator+"acme", 1)
+	expectStored(t, storage, "path"+keySeparator+"/", 1)
+}
+
+func TestDimensionViolationsAreReported(t *testing.T) {
+	tests := []struct {
+		report     ViolationReport
+		dimensions []string
+		limits     []string
+	}{
+		{ReportMostRestrictive, []string{"tenant"}, []string{"2"}}, // Both have nothing left, the first wins the tie
+		{ReportFirst, []string{"tenant"}, []string{"2"}},
+		{ReportAll, []string{"tenant, path"}, []string{"2", "1"}},
+	}
+	for _, test := range tests {
+		router := newRouter(t, newTestConfig().Limit(10).Headers(true).ReportViolations(test.report).
+			Dimension("tenant", tenantSelector, 2).
+			Dimension("path", PathSelector(), 1), "/other")
+		tenant := withHeader("X-Tenant", "acme")
+		expectStatus(t, serve(router, http.MethodGet, "/", tenant), http.StatusOK)
+		expectStatus(t, serve(router, http.MethodGet, "/other", tenant), http.StatusOK)
+
+		// Both the tenant and the path are used up
+		rec := serve(router, http.MethodGet, "/", tenant)
+		expectStatus(t, rec, http.StatusTooManyRequests)
+		if got := rec.Header().Values("X-RateLimit-Dimension"); !reflect.DeepEqual(got, test.dimensions) {
+			t.Errorf("report %d: dimension header = %q, want %q", test.report, got, test.dimensions)
+		}
+		if got := rec.Header().Values("X-RateLimit-Limit"); !reflect.DeepEqual(got, test.limits) {
+			t.Errorf("report %d: limit header = %q, want %q", test.report, got, test.limits)
+		}
+	}
+}
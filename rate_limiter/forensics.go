@@ -0,0 +1,79 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	forensicLogInterval  = time.Minute // The interval over which forensic logs are rate limited
+	forensicLogsPerCycle = 10          // The maximum number of forensic logs emitted per interval
+	redactedValue        = "[REDACTED]"
+)
+
+// sensitiveHeaders are always redacted from forensic logs.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// forensics emits a one-time detailed log for clients crossing a violation threshold.
+type forensics struct {
+	threshold   uint16              // The violation count at which the forensic log is emitted
+	redact      map[string]struct{} // The canonical names of the headers to redact
+	lock        sync.Mutex          // A mutex lock guarding the log rate limiting state
+	cycleStart  time.Time           // The start of the current rate limiting interval
+	cycleLogged uint16              // The number of forensic logs emitted in the current interval
+}
+
+// newForensics creates a forensics logger for the given threshold and headers to redact.
+func newForensics(threshold uint16, redactHeaders []string) *forensics {
+	redact := make(map[string]struct{}, len(redactHeaders)+len(sensitiveHeaders))
+	for _, header := range append(redactHeaders, sensitiveHeaders...) {
+		redact[http.CanonicalHeaderKey(header)] = struct{}{}
+	}
+	return &forensics{
+		threshold: threshold,
+		redact:    redact,
+	}
+}
+
+// allow reports whether another forensic log may be emitted at the given time.
+func (f *forensics) allow(now time.Time) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if now.Sub(f.cycleStart) >= forensicLogInterval {
+		f.cycleStart = now
+		f.cycleLogged = 0
+	}
+	if f.cycleLogged >= forensicLogsPerCycle {
+		return false
+	}
+	f.cycleLogged++
+	return true
+}
+
+// record emits the forensic log if the client just reached the violation threshold.
+func (f *forensics) record(cfg *Config, ctx *gin.Context, id string, violations uint16) {
+	if violations != f.threshold || !f.allow(cfg.clock()) {
+		return
+	}
+
+	headers := make(map[string][]string, len(ctx.Request.Header))
+	for name, values := range ctx.Request.Header {
+		if _, ok := f.redact[name]; ok {
+			values = []string{redactedValue}
+		}
+		headers[name] = values
+	}
+	cfg.logger.Warn("client crossed the violation threshold",
+		"scope", "rate-limiter",
+		"user_id", id,
+		"violations", violations,
+		"client_ip", ctx.ClientIP(),
+		"method", ctx.Request.Method,
+		"path", ctx.Request.URL.Path,
+		"user_agent", ctx.Request.UserAgent(),
+		"headers", headers,
+	)
+}
@@ -0,0 +1,53 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestForensicLogFiresOnceAtThreshold(t *testing.T) {
+	logger := newRecordingLogger()
+	router := newRouter(t, newTestConfig().Logger(logger).Limit(1).ForensicLogAfter(2, []string{"X-Api-Key"}))
+	headers := []func(*http.Request){
+		withHeader("X-Api-Key", "secret-key"),
+		withHeader("Authorization", "Bearer token"),
+		withHeader("X-Trace", "visible"),
+	}
+
+	expectStatus(t, serve(router, http.MethodGet, "/", headers...), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/", headers...), http.StatusTooManyRequests)
+	if logger.warned("violation threshold") {
+		t.Fatal("the forensic log fired before the threshold")
+	}
+	for i := 0; i < 3; i++ {
+		expectStatus(t, serve(router, http.MethodGet, "/", headers...), http.StatusTooManyRequests)
+	}
+
+	logs := logger.warningsWith("violation threshold")
+	if len(logs) != 1 {
+		t.Fatalf("the forensic log fired %d times, want once", len(logs))
+	}
+	headerLog, _ := logs[0].attr("headers").(map[string][]string)
+	for name, want := range map[string]string{"X-Api-Key": redactedValue, "Authorization": redactedValue, "X-Trace": "visible"} {
+		if got := headerLog[name]; len(got) != 1 || got[0] != want {
+			t.Errorf("logged header %s = %v, want [%s]", name, got, want)
+		}
+	}
+}
+
+func TestForensicLogsAreRateLimited(t *testing.T) {
+	f := newForensics(1, nil)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < forensicLogsPerCycle; i++ {
+		if !f.allow(now) {
+			t.Fatalf("log %d of the cycle was suppressed", i+1)
+		}
+	}
+	if f.allow(now.Add(time.Second)) {
+		t.Fatal("a log beyond the cycle budget was allowed")
+	}
+	if !f.allow(now.Add(forensicLogInterval)) {
+		t.Fatal("the first log of the next cycle was suppressed")
+	}
+}
@@ -0,0 +1,121 @@
+package ratelimiter
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RetryAfterKey is the gin context key under which the middleware stores the duration
+// (time.Duration) after which a rejected client may retry, before calling the handler:
+// until the reset time reported by the storage or the algorithm (e.g. the GCRA), if any, the timeout otherwise.
+const RetryAfterKey = "ratelimit_retry_after"
+
+// statusCodeKey is the gin context key under which the middleware stores the status code
+// the default handler rejects requests with.
+const statusCodeKey = "ratelimit_status_code"
+
+// IDKey is the gin context key under which the middleware stores the selected (scoped) ID of the request
+// (string) before resolving its limit, if a LimitResolver is set.
+const IDKey = "ratelimit_id"
+
+// RejectionDetailsKey is the gin context key under which the middleware stores the RejectionDetails
+// of a rejected request (if enabled using Config.RejectionDetails), before calling the handler.
+const RejectionDetailsKey = "ratelimit_rejection_details"
+
+// RejectionDetails holds the optional backpressure fields included in the rejection body,
+// letting sophisticated clients self-tune.
+type RejectionDetails struct {
+	Limit         uint16  `json:"limit"`          // The limit applied to the request
+	WindowSeconds float64 `json:"window_seconds"` // The length of the rate limiting window in seconds
+	Scope         string  `json:"scope"`          // What the rate limiting key represents (e.g. "client-ip")
+}
+
+// rejectionBody is the structured body sent by the default handler if rejection details are enabled.
+type rejectionBody struct {
+	Error string `json:"error"`
+	RejectionDetails
+}
+
+// RetryAfter returns the retry duration stored by the middleware in the given context.
+// It returns 0 if no retry duration was stored.
+func RetryAfter(ctx *gin.Context) time.Duration {
+	retryAfter, _ := ctx.Value(RetryAfterKey).(time.Duration)
+	return retryAfter
+}
+
+// retryAfterSeconds formats the given retry duration as a whole number of seconds,
+// rounded up so clients never retry too early.
+func retryAfterSeconds(retryAfter time.Duration) string {
+	return strconv.FormatInt(int64((retryAfter+time.Second-1)/time.Second), 10)
+}
+
+// rejectionStatus returns the status code the middleware stored in the given context for the
+// rejection handler (see Config.StatusCode), 429 Too Many Requests if none was stored.
+func rejectionStatus(ctx *gin.Context) int {
+	if configured, ok := ctx.Value(statusCodeKey).(int); ok {
+		return configured
+	}
+	return http.StatusTooManyRequests
+}
+
+// JSONHandler returns a handler that rejects over-limit clients with the given object serialized as JSON
+// (e.g. an error envelope such as `{"error":{"code":"rate_limited"}}`) instead of the plain-text message,
+// using the status code set by Config.StatusCode (429 by default) and the `Retry-After` header.
+// The object is serialized on every rejection, so it must be safe for concurrent use.
+func JSONHandler(obj interface{}) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if retryAfter := RetryAfter(ctx); retryAfter > 0 {
+			ctx.Header("Retry-After", retryAfterSeconds(retryAfter))
+		}
+		ctx.AbortWithStatusJSON(rejectionStatus(ctx), obj)
+	}
+}
+
+// RedirectHandler returns a handler that redirects over-limit clients to the given URL
+// (e.g. a waiting-room page) instead of rejecting them.
+//
+// The URL may contain the following placeholders:
+//
+//	{retry_after}: the number of seconds after which the client may retry
+//	{retry_at}: the unix timestamp (seconds) at which the client may retry
+//
+// The status must be a redirect (3xx) status code, other values fall back to 302 Found.
+func RedirectHandler(url string, status int) gin.HandlerFunc {
+	if status < 300 || status > 399 {
+		status = http.StatusFound
+	}
+	return func(ctx *gin.Context) {
+		retryAfter := RetryAfter(ctx)
+		location := strings.NewReplacer(
+			"{retry_after}", strconv.FormatInt(int64(retryAfter.Round(time.Second)/time.Second), 10),
+			"{retry_at}", strconv.FormatInt(time.Now().Add(retryAfter).Unix(), 10),
+		).Replace(url)
+		ctx.Redirect(status, location)
+		ctx.Abort()
+	}
+}
+
+// FailClosedOn returns a StorageErrorHandler that fails closed, aborting the request with a
+// [503]"Service Unavailable" status code, if the storage error matches any of the given targets
+// (using errors.Is), e.g. rlstorage.ErrOutOfMemory. Other storage errors fail open.
+// Without targets, every storage error fails closed.
+func FailClosedOn(targets ...error) StorageErrorHandler {
+	return func(ctx *gin.Context, err error) {
+		if len(targets) == 0 {
+			ctx.AbortWithError(http.StatusServiceUnavailable, err)
+			return
+		}
+		for _, target := range targets {
+			if errors.Is(err, target) {
+				ctx.AbortWithError(http.StatusServiceUnavailable, err)
+				return
+			}
+		}
+		failOpen(ctx, err)
+	}
+}
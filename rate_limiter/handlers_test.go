@@ -0,0 +1,230 @@
+package ratelimiter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRedirectHandlerRedirectsOverLimitClients(t *testing.T) {
+	router := newRouter(t, newTestConfig().
+		Limit(1).
+		Timeout(90*time.Second).
+		Handler(RedirectHandler("https://example.com/queue?retry={retry_after}", http.StatusSeeOther)))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	recorder := serve(router, http.MethodGet, "/")
+	expectStatus(t, recorder, http.StatusSeeOther)
+	if location := recorder.Header().Get("Location"); location != "https://example.com/queue?retry=90" {
+		t.Fatalf("Location = %q, want the templated waiting-room URL", location)
+	}
+}
+
+func TestRedirectHandlerTemplatesRetryTime(t *testing.T) {
+	router := newRouter(t, newTestConfig().
+		Limit(1).
+		Timeout(time.Minute).
+		Handler(RedirectHandler("/queue?at={retry_at}", 0)))
+
+	serve(router, http.MethodGet, "/")
+	before := time.Now()
+	recorder := serve(router, http.MethodGet, "/")
+	// Non-redirect statuses fall back to 302 Found
+	expectStatus(t, recorder, http.StatusFound)
+	location := recorder.Header().Get("Location")
+	at, err := strconv.ParseInt(location[len("/queue?at="):], 10, 64)
+	if err != nil {
+		t.Fatalf("Location = %q, want a unix timestamp", location)
+	}
+	if want := before.Add(time.Minute).Unix(); at < want-1 || at > want+1 {
+		t.Fatalf("retry_at = %d, want about %d", at, want)
+	}
+}
+
+func TestRejectionDetailsAreIncludedInBody(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(3).Timeout(90*time.Second).RejectionDetails("client-ip"))
+	for i := 0; i < 3; i++ {
+		serve(router, http.MethodGet, "/")
+	}
+
+	recorder := serve(router, http.MethodGet, "/")
+	expectStatus(t, recorder, http.StatusTooManyRequests)
+	var body map[string]any
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("the body %q is not JSON: %v", recorder.Body.String(), err)
+	}
+	want := map[string]any{"error": defaultRejectionMessage, "limit": 3.0, "window_seconds": 90.0, "scope": "client-ip"}
+	if !reflect.DeepEqual(body, want) {
+		t.Fatalf("body = %v, want %v", body, want)
+	}
+}
+
+func TestRejectionDetailsAreOptIn(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(1))
+	serve(router, http.MethodGet, "/")
+
+	recorder := serve(router, http.MethodGet, "/")
+	expectStatus(t, recorder, http.StatusTooManyRequests)
+	if strings.Contains(recorder.Body.String(), "window_seconds") {
+		t.Fatalf("the body %q carries rejection details without opting in", recorder.Body.String())
+	}
+}
+
+func TestRetryAfterSecondsRoundsUp(t *testing.T) {
+	tests := map[time.Duration]string{
+		time.Minute:                   "60",
+		1500 * time.Millisecond:       "2",
+		time.Millisecond:              "1",
+		time.Minute + time.Nanosecond: "61",
+	}
+	for retryAfter, want := range tests {
+		if got := retryAfterSeconds(retryAfter); got != want {
+			t.Errorf("retryAfterSeconds(%v) = %q, want %q", retryAfter, got, want)
+		}
+	}
+}
+
+func TestDefaultHandlerSendsRetryAfter(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(1).Timeout(90*time.Second))
+
+	if got := serve(router, http.MethodGet, "/").Header().Values("Retry-After"); got != nil {
+		t.Errorf("Retry-After = %q on an allowed request, want none", got)
+	}
+	rec := serve(router, http.MethodGet, "/")
+	expectStatus(t, rec, http.StatusTooManyRequests)
+	if got := rec.Header().Get("Retry-After"); got != "90" {
+		t.Errorf("Retry-After = %q, want %q", got, "90")
+	}
+}
+
+func TestStatusCodeAppliesToDefaultHandler(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(1).StatusCode(http.StatusServiceUnavailable))
+
+	serve(router, http.MethodGet, "/")
+	rec := serve(router, http.MethodGet, "/")
+	expectStatus(t, rec, http.StatusServiceUnavailable)
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After header with a custom status code")
+	}
+}
+
+func TestRejectionJSONRespondsWithJSONBody(t *testing.T) {
+	type envelope struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	var body envelope
+	body.Error.Code = "rate_limited"
+	router := newRouter(t, newTestConfig().Limit(1).Timeout(90*time.Second).RejectionJSON(body))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	rec := serve(router, http.MethodGet, "/")
+	expectStatus(t, rec, http.StatusTooManyRequests)
+	if contentType := rec.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "application/json") {
+		t.Errorf("Content-Type = %q, want application/json", contentType)
+	}
+	if got, want := strings.TrimSpace(rec.Body.String()), `{"error":{"code":"rate_limited"}}`; got != want {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "90" {
+		t.Errorf("Retry-After = %q, want %q", got, "90")
+	}
+}
+
+func TestRejectionJSONUsesStatusCode(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(1).StatusCode(http.StatusServiceUnavailable).
+		RejectionJSON(gin.H{"error": "busy"}))
+
+	serve(router, http.MethodGet, "/")
+	rec := serve(router, http.MethodGet, "/")
+	expectStatus(t, rec, http.StatusServiceUnavailable)
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body["error"] != "busy" {
+		t.Errorf("body = %s (%v), want the configured object", rec.Body.String(), err)
+	}
+}
+
+func TestJSONHandlerWithoutMiddlewareRejectsWith429(t *testing.T) {
+	ctx := testContext(httptest.NewRequest(http.MethodGet, "/", nil))
+	JSONHandler(gin.H{"error": "limited"})(ctx)
+
+	if status := ctx.Writer.Status(); status != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want %d", status, http.StatusTooManyRequests)
+	}
+	if !ctx.IsAborted() {
+		t.Error("JSONHandler() did not abort the request")
+	}
+}
+
+// hookCall is a call of a decision hook.
+type hookCall struct {
+	id      string
+	current uint16
+}
+
+func TestOnAllowedRunsBeforeNextHandler(t *testing.T) {
+	calls := make(chan hookCall, 2)
+	cfg := newTestConfig().Limit(2).WorkerCount(4).OnAllowed(func(ctx *gin.Context, id string, current uint16) {
+		ctx.Set("hooked", true)
+		calls <- hookCall{id, current}
+	})
+	router := gin.New()
+	router.Use(build(t, cfg))
+	router.GET("/", func(ctx *gin.Context) {
+		if !ctx.GetBool("hooked") {
+			t.Error("the handler ran before the OnAllowed hook")
+		}
+	})
+
+	serve(router, http.MethodGet, "/")
+	serve(router, http.MethodGet, "/")
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+	close(calls)
+	var got []hookCall
+	for call := range calls {
+		got = append(got, call)
+	}
+	if want := []hookCall{{"192.0.2.1", 1}, {"192.0.2.1", 2}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("OnAllowed calls = %v, want %v", got, want)
+	}
+}
+
+func TestOnBlockedRunsForLimitedAndOverloadedRequests(t *testing.T) {
+	var calls []hookCall
+	// The only worker holds the first entry, so requests of other clients cannot be queued for release
+	cfg := newTestConfig().Limit(1).Timeout(time.Hour).WorkerCount(1).QueueTimeout(10 * time.Millisecond).
+		OnBlocked(func(_ *gin.Context, id string, current uint16) {
+			calls = append(calls, hookCall{id, current})
+		})
+	router := newRouter(t, cfg)
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+	expectStatus(t, serve(router, http.MethodGet, "/", fromIP("192.0.2.2")), http.StatusServiceUnavailable)
+	if want := []hookCall{{"192.0.2.1", 1}, {"192.0.2.2", 0}}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("OnBlocked calls = %v, want %v", calls, want)
+	}
+}
+
+func TestPanickingDecisionHookIsRecovered(t *testing.T) {
+	logger := newRecordingLogger()
+	panicking := func(*gin.Context, string, uint16) { panic("boom") }
+	router := newRouter(t, newTestConfig().Logger(logger).Limit(1).WorkerCount(4).OnAllowed(panicking).OnBlocked(panicking))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+	for _, hook := range []string{"OnAllowed", "OnBlocked"} {
+		errors := logger.errorsWith("panic in the " + hook + " hook")
+		if len(errors) != 1 || errors[0].attr("user_id") != "192.0.2.1" {
+			t.Errorf("%s panic logged as %v, want one error naming the client", hook, errors)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package ratelimiter
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tokenChars are the characters allowed in an HTTP header field name (RFC 7230 token).
+const tokenChars = "!#$%&'*+-.^_`|~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// HeaderNames holds the names of the rate limit headers emitted by the middleware.
+type HeaderNames struct {
+	Limit     string // The header carrying the limit applied to the request
+	Remaining string // The header carrying the number of requests remaining for the client
+	Warning   string // The header marking requests allowed within the reject grace band
+	Policy    string // The header naming the policy that produced the decision (if a policy name is set)
+	Dimension string // The header naming the reported dimension(s) (if additional dimensions are configured)
+}
+
+// DefaultHeaderNames are the header names used unless configured otherwise.
+var DefaultHeaderNames = HeaderNames{
+	Limit:     "X-RateLimit-Limit",
+	Remaining: "X-RateLimit-Remaining",
+	Warning:   "X-RateLimit-Warning",
+	Policy:    "X-RateLimit-Policy",
+	Dimension: "X-RateLimit-Dimension",
+}
+
+// graceWarning is the value of the warning header sent for requests allowed within the reject grace band.
+const graceWarning = "limit exceeded"
+
+// valid reports whether all header names are valid HTTP header field names.
+func (names HeaderNames) valid() bool {
+	return validHeaderName(names.Limit) &&
+		validHeaderName(names.Remaining) &&
+		validHeaderName(names.Warning)
+}
+
+// validHeaderName reports whether the given name is a valid HTTP header field name.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !strings.ContainsRune(tokenChars, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// policyName returns the name reported in the policy header: the pattern of the matched route limit,
+// if any, or the configured policy. It is empty, disabling the header, if no policy is configured.
+func (cfg *Config) policyName(route routeLimit, routed bool) string {
+	if cfg.policy != "" && routed {
+		return route.pattern
+	}
+	return cfg.policy
+}
+
+// writeHeaders writes the rate limit headers describing the given result, naming the given policy.
+func (cfg *Config) writeHeaders(ctx *gin.Context, res result, policy string) {
+	cfg.setHeader(ctx, cfg.headerNames.Limit, strconv.FormatUint(uint64(res.limit), 10))
+	cfg.setHeader(ctx, cfg.headerNames.Remaining, strconv.FormatUint(uint64(res.remaining()), 10))
+	if res.decision == allowed && res.count > res.limit {
+		cfg.setHeader(ctx, cfg.headerNames.Warning, graceWarning)
+	}
+	if policy != "" {
+		cfg.setHeader(ctx, cfg.headerNames.Policy, policy)
+	}
+}
+
+// declareTrailers announces the rate limit headers as trailers. It must run before the handler
+// writes the response headers, the values are written by writeHeaders once the handler returns.
+func (cfg *Config) declareTrailers(ctx *gin.Context, policy string, dimensions bool) {
+	names := []string{cfg.headerNames.Limit, cfg.headerNames.Remaining, cfg.headerNames.Warning}
+	if policy != "" {
+		names = append(names, cfg.headerNames.Policy)
+	}
+	if dimensions {
+		names = append(names, cfg.headerNames.Dimension)
+	}
+	ctx.Writer.Header().Add("Trailer", strings.Join(names, ", "))
+}
+
+// setHeader sets a response header, preserving the exact casing of its name if configured.
+func (cfg *Config) setHeader(ctx *gin.Context, name, value string) {
+	if cfg.exactHeaderCase {
+		ctx.Writer.Header()[name] = []string{value}
+		return
+	}
+	ctx.Header(name, value)
+}
+
+// addHeader adds a value to a response header, preserving the exact casing of its name if configured.
+func (cfg *Config) addHeader(ctx *gin.Context, name, value string) {
+	if cfg.exactHeaderCase {
+		ctx.Writer.Header()[name] = append(ctx.Writer.Header()[name], value)
+		return
+	}
+	ctx.Writer.Header().Add(name, value)
+}
@@ -0,0 +1,150 @@
+package ratelimiter
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// lowercaseHeaderNames are HTTP/2 style header names.
+var lowercaseHeaderNames = HeaderNames{
+	Limit:     "x-ratelimit-limit",
+	Remaining: "x-ratelimit-remaining",
+	Warning:   "x-ratelimit-warning",
+	Policy:    "x-ratelimit-policy",
+	Dimension: "x-ratelimit-dimension",
+}
+
+func TestExactHeaderCasePreservesNames(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(5).Headers(true).HeaderNames(lowercaseHeaderNames).ExactHeaderCase(true))
+
+	recorder := serve(router, http.MethodGet, "/")
+	expectStatus(t, recorder, http.StatusOK)
+	header := recorder.Header()
+	if got := header["x-ratelimit-limit"]; len(got) != 1 || got[0] != "5" {
+		t.Fatalf("x-ratelimit-limit = %v, want [5] (headers %v)", got, header)
+	}
+	if got := header["x-ratelimit-remaining"]; len(got) != 1 || got[0] != "4" {
+		t.Fatalf("x-ratelimit-remaining = %v, want [4] (headers %v)", got, header)
+	}
+	if _, canonical := header["X-Ratelimit-Limit"]; canonical {
+		t.Fatalf("the header name was canonicalized (headers %v)", header)
+	}
+}
+
+func TestHeaderNamesAreCanonicalizedByDefault(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(5).Headers(true).HeaderNames(lowercaseHeaderNames))
+
+	header := serve(router, http.MethodGet, "/").Header()
+	if got := header["X-Ratelimit-Limit"]; len(got) != 1 || got[0] != "5" {
+		t.Fatalf("X-Ratelimit-Limit = %v, want [5] (headers %v)", got, header)
+	}
+}
+
+func TestInvalidHeaderNamesAreRejected(t *testing.T) {
+	names := DefaultHeaderNames
+	names.Limit = "x-ratelimit limit"
+	if err := newTestConfig().Headers(true).HeaderNames(names).Validate(); err == nil {
+		t.Fatal("Validate() accepted a header name with a space")
+	}
+	names.Limit = ""
+	if err := newTestConfig().Headers(true).HeaderNames(names).Validate(); err == nil {
+		t.Fatal("Validate() accepted an empty header name")
+	}
+}
+
+func TestRejectGraceWarnsBeforeRejecting(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(2).RejectGrace(2).Headers(true))
+
+	for i := 0; i < 2; i++ {
+		recorder := serve(router, http.MethodGet, "/")
+		expectStatus(t, recorder, http.StatusOK)
+		if warning := recorder.Header().Get("X-RateLimit-Warning"); warning != "" {
+			t.Fatalf("request %d within the limit carries a warning %q", i+1, warning)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		recorder := serve(router, http.MethodGet, "/")
+		expectStatus(t, recorder, http.StatusOK)
+		if warning := recorder.Header().Get("X-RateLimit-Warning"); warning != graceWarning {
+			t.Fatalf("request %d within the grace band carries the warning %q, want %q", i+3, warning, graceWarning)
+		}
+		if remaining := recorder.Header().Get("X-RateLimit-Remaining"); remaining != "0" {
+			t.Fatalf("remaining within the grace band = %q, want 0", remaining)
+		}
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+}
+
+func TestPolicyHeaderNamesPolicy(t *testing.T) {
+	router := newRouter(t, newTestConfig().Headers(true).Policy("default"))
+	if got := serve(router, http.MethodGet, "/").Header().Get("X-RateLimit-Policy"); got != "default" {
+		t.Errorf("policy header = %q, want %q", got, "default")
+	}
+
+	router = newRouter(t, newTestConfig().Headers(true))
+	if got := serve(router, http.MethodGet, "/").Header().Values("X-RateLimit-Policy"); got != nil {
+		t.Errorf("policy header = %q without a policy, want none", got)
+	}
+}
+
+func TestPolicyHeaderNamesMatchedRoute(t *testing.T) {
+	router := newRouter(t, newTestConfig().Headers(true).Policy("default").RouteLimit("/api/:id", 5), "/api/:id", "/other")
+
+	if got := serve(router, http.MethodGet, "/api/42").Header().Get("X-RateLimit-Policy"); got != "/api/:id" {
+		t.Errorf("policy header = %q for a routed request, want the route pattern", got)
+	}
+	if got := serve(router, http.MethodGet, "/other").Header().Get("X-RateLimit-Policy"); got != "default" {
+		t.Errorf("policy header = %q for an unrouted request, want the policy", got)
+	}
+}
+
+func TestPolicyTrailerNamesMatchedRoute(t *testing.T) {
+	router := newRouter(t, newTestConfig().Headers(true).Trailers(true).Policy("default").RouteLimit("/api/:id", 5), "/api/:id")
+
+	response := serve(router, http.MethodGet, "/api/42").Result()
+	if got := response.Trailer.Get("X-RateLimit-Policy"); got != "/api/:id" {
+		t.Errorf("policy trailer = %q, want the route pattern", got)
+	}
+}
+
+func TestTrailersCarryRateLimitState(t *testing.T) {
+	server := httptest.NewServer(newRouter(t, newTestConfig().Limit(5).Headers(true).Trailers(true)))
+	t.Cleanup(server.Close)
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer response.Body.Close()
+	if got := response.Header.Get("X-RateLimit-Limit"); got != "" {
+		t.Errorf("limit header = %q, want it sent as a trailer only", got)
+	}
+	if _, declared := response.Trailer["X-Ratelimit-Remaining"]; !declared {
+		t.Errorf("the remaining trailer is not declared (trailers %v)", response.Trailer)
+	}
+	if _, err := io.ReadAll(response.Body); err != nil {
+		t.Fatalf("reading the body failed: %v", err)
+	}
+	if got := response.Trailer.Get("X-RateLimit-Limit"); got != "5" {
+		t.Errorf("limit trailer = %q, want 5", got)
+	}
+	if got := response.Trailer.Get("X-RateLimit-Remaining"); got != "4" {
+		t.Errorf("remaining trailer = %q, want 4", got)
+	}
+}
+
+func TestRejectedRequestsSendHeadersNotTrailers(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(1).Headers(true).Trailers(true))
+	serve(router, http.MethodGet, "/")
+
+	recorder := serve(router, http.MethodGet, "/")
+	expectStatus(t, recorder, http.StatusTooManyRequests)
+	if got := recorder.Header().Get("X-RateLimit-Remaining"); got != "0" {
+		t.Errorf("remaining header = %q on a rejected request, want 0", got)
+	}
+	if got := recorder.Header().Values("Trailer"); got != nil {
+		t.Errorf("a rejected request declares trailers %v", got)
+	}
+}
@@ -0,0 +1,74 @@
+package ratelimiter
+
+import (
+	"errors"
+	"time"
+
+	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
+)
+
+// CountHistogram returns the distribution of the given counts across keys: the element at index i
+// is the number of keys with a count of i+1, for counts from 1 up to limit. Keys at or above the limit
+// (maxed out) all land in the last element, keys with a count of 0 are left out.
+func CountHistogram(counts map[string]uint16, limit uint16) []uint64 {
+	if limit == 0 {
+		return nil
+	}
+	histogram := make([]uint64, limit)
+	for _, count := range counts {
+		if count == 0 {
+			continue
+		}
+		histogram[min(count, limit)-1]++
+	}
+	return histogram
+}
+
+// CountHistogram computes the distribution of the current counts across keys (see the CountHistogram
+// function) from a snapshot of the storage, against the static limit. Many keys suddenly maxing out
+// can hint at an attack. It requires a storage implementing rlstorage.Snapshotter.
+func (cfg *Config) CountHistogram() ([]uint64, error) {
+	snapshotter, ok := rlstorage.As[rlstorage.Snapshotter](cfg.storage)
+	if !ok {
+		return nil, errors.New("the storage does not support snapshots")
+	}
+	counts, err := snapshotter.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return CountHistogram(counts, cfg.effectiveLimit()), nil
+}
+
+// runHistogramExport passes the count histogram to the export hook once per interval, until stop is closed.
+func (cfg *Config) runHistogramExport(stop <-chan struct{}) {
+	ticker := time.NewTicker(cfg.histogramInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			histogram, err := cfg.CountHistogram()
+			if err != nil {
+				cfg.logger.Warn("failed to compute the count histogram", "error", err)
+				continue
+			}
+			cfg.histogramExport(histogram)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Len returns the number of client keys currently tracked by the storage, e.g. to alert when it spikes,
+// which usually signals an attack. It requires a storage implementing rlstorage.KeyCounter or
+// rlstorage.Snapshotter.
+func (cfg *Config) Len() (int, error) {
+	if counter, ok := rlstorage.As[rlstorage.KeyCounter](cfg.storage); ok {
+		return counter.Len()
+	}
+	if snapshotter, ok := rlstorage.As[rlstorage.Snapshotter](cfg.storage); ok {
+		counts, err := snapshotter.Snapshot()
+		return len(counts), err
+	}
+	return 0, errors.New("the storage does not support counting keys")
+}
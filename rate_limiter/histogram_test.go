@@ -0,0 +1,91 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
+)
+
+func TestCountHistogram(t *testing.T) {
+	counts := map[string]uint16{"a": 1, "b": 1, "c": 2, "d": 3, "e": 9, "f": 0}
+	if got, want := CountHistogram(counts, 3), []uint64{2, 1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("CountHistogram() = %v, want %v", got, want)
+	}
+	if got := CountHistogram(counts, 0); got != nil {
+		t.Errorf("CountHistogram() with a zero limit = %v, want nil", got)
+	}
+}
+
+func TestConfigCountHistogram(t *testing.T) {
+	cfg := newTestConfig().Limit(2).WorkerCount(4)
+	router := newRouter(t, cfg)
+	serve(router, http.MethodGet, "/", fromIP("192.0.2.1"))
+	serve(router, http.MethodGet, "/", fromIP("192.0.2.2"))
+	serve(router, http.MethodGet, "/", fromIP("192.0.2.2"))
+
+	histogram, err := cfg.CountHistogram()
+	if err != nil || !reflect.DeepEqual(histogram, []uint64{1, 1}) {
+		t.Errorf("CountHistogram() = %v, %v, want [1 1]", histogram, err)
+	}
+	if _, err := newTestConfig().Storage(newCountingStorage()).CountHistogram(); err == nil {
+		t.Error("CountHistogram() = nil error for a storage without snapshots, want an error")
+	}
+}
+
+func TestExportHistogramRunsPeriodically(t *testing.T) {
+	exported := make(chan []uint64, 1)
+	router := newRouter(t, newTestConfig().Limit(2).ExportHistogram(10*time.Millisecond, func(histogram []uint64) {
+		select {
+		case exported <- histogram:
+		default:
+		}
+	}))
+	serve(router, http.MethodGet, "/")
+
+	select {
+	case histogram := <-exported:
+		if len(histogram) != 2 {
+			t.Errorf("exported histogram = %v, want 2 buckets", histogram)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no histogram exported")
+	}
+}
+
+// snapshotStorage exposes only the Snapshotter capability of a HashMap storage.
+type snapshotStorage struct {
+	rlstorage.RLStorage
+}
+
+func (s snapshotStorage) Snapshot() (map[string]uint16, error) {
+	return s.RLStorage.(rlstorage.Snapshotter).Snapshot()
+}
+
+func TestConfigLen(t *testing.T) {
+	storages := map[string]rlstorage.RLStorage{
+		"key counter": rlstorage.NewHashMapStorage(discardLogger()),
+		"snapshotter": snapshotStorage{rlstorage.NewHashMapStorage(discardLogger())},
+	}
+	for name, storage := range storages {
+		t.Run(name, func(t *testing.T) {
+			cfg := newTestConfig().Storage(storage)
+			for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.1"} {
+				if err := storage.Increase(ip); err != nil {
+					t.Fatalf("Increase() error = %v", err)
+				}
+			}
+			if keys, err := cfg.Len(); err != nil || keys != 2 {
+				t.Errorf("Len() = %d, %v, want 2", keys, err)
+			}
+		})
+	}
+}
+
+func TestConfigLenWithoutSupport(t *testing.T) {
+	if _, err := newTestConfig().Storage(newCountingStorage()).Len(); err == nil {
+		t.Error("Len() succeeded on a storage that cannot count keys")
+	}
+}
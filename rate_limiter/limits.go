@@ -0,0 +1,112 @@
+package ratelimiter
+
+import (
+	"math"
+	"net/netip"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// resolveLimit returns the limit that applies to the given request, matching the given route limit (if found).
+// Resolved limits (see LimitResolver) take precedence over token claims, which take precedence over route limits, which take precedence over method limits, which take precedence
+// over the read and write limits (if counted separately), which take precedence over the scheduled and static limits.
+// The resolved limit is then scaled by the multiplier of the given priority tier, the suspicious limit
+// capping it regardless. A limit of 0 bans the request outright.
+func (cfg *Config) resolveLimit(ctx *gin.Context, route routeLimit, routed bool, priority Priority) uint16 {
+	limit := cfg.scheduledLimit()
+	if cfg.separateReadWrite {
+		limit = cfg.writeLimit
+		if methodClass(ctx.Request.Method) == "read" {
+			limit = cfg.readLimit
+		}
+	}
+	if methodLimit, ok := cfg.methodLimits[cfg.requestMethod(ctx)]; ok {
+		limit = methodLimit
+	}
+	if routed {
+		limit = route.limit
+	}
+	if claimed, ok := cfg.claimedLimit(ctx); ok {
+		limit = claimed
+	}
+	if cfg.limitResolver != nil {
+		limit = cfg.limitResolver(ctx)
+	}
+	limit = cfg.scaleLimit(limit, priority)
+	if cfg.suspicious != nil && cfg.suspicious(ctx) {
+		limit = min(limit, cfg.suspiciousLimit)
+	}
+	return limit
+}
+
+// claimedLimit returns the limit carried by the configured claim of the request's token claims, if any.
+func (cfg *Config) claimedLimit(ctx *gin.Context) (uint16, bool) {
+	if cfg.limitClaim == "" {
+		return 0, false
+	}
+	claims, ok := ctx.Get(cfg.claimsKey)
+	if !ok {
+		return 0, false
+	}
+	// Claims come in various named map types (e.g. jwt.MapClaims), so they are read via reflection
+	value := reflect.ValueOf(claims)
+	if value.Kind() != reflect.Map || value.Type().Key().Kind() != reflect.String {
+		return 0, false
+	}
+	claim := value.MapIndex(reflect.ValueOf(cfg.limitClaim).Convert(value.Type().Key()))
+	if !claim.IsValid() {
+		return 0, false
+	}
+	if claim.Kind() == reflect.Interface {
+		claim = claim.Elem()
+	}
+	var limit float64
+	switch {
+	case claim.CanInt():
+		limit = float64(claim.Int())
+	case claim.CanUint():
+		limit = float64(claim.Uint())
+	case claim.CanFloat():
+		limit = claim.Float() // JSON numbers decode as float64
+	case claim.Kind() == reflect.String:
+		// Numeric strings, including json.Number
+		parsed, err := strconv.ParseFloat(claim.String(), 64)
+		if err != nil {
+			return 0, false
+		}
+		limit = parsed
+	default:
+		return 0, false
+	}
+	if !(limit >= 1) {
+		return 0, false // Not a positive number (or NaN)
+	}
+	return uint16(min(limit, math.MaxUint16)), true
+}
+
+// SuspiciousForwardedFor returns a detector (see Config.OnSuspiciousHeaders) that flags requests
+// whose `X-Forwarded-For` header is malformed, or claims a private, loopback or unspecified client
+// address while the request itself comes from a public (untrusted) peer.
+func SuspiciousForwardedFor() func(*gin.Context) bool {
+	return func(ctx *gin.Context) bool {
+		header := ctx.GetHeader("X-Forwarded-For")
+		if header == "" {
+			return false
+		}
+		peer, err := netip.ParseAddr(NormalizeIP(ctx.Request.RemoteAddr))
+		trustedPeer := err == nil && (peer.IsPrivate() || peer.IsLoopback())
+		for _, hop := range strings.Split(header, ",") {
+			addr, err := netip.ParseAddr(NormalizeIP(hop))
+			if err != nil {
+				return true // Malformed entry
+			}
+			if !trustedPeer && (addr.IsPrivate() || addr.IsLoopback() || addr.IsUnspecified()) {
+				return true // Internal address claimed by an untrusted source
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,173 @@
+package ratelimiter
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestSuspiciousForwardedFor(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		want       bool
+	}{
+		{"no header", "203.0.113.1:1234", "", false},
+		{"public client", "203.0.113.1:1234", "198.51.100.7", false},
+		{"malformed entry", "203.0.113.1:1234", "198.51.100.7, not-an-ip", true},
+		{"private client from public peer", "203.0.113.1:1234", "10.0.0.5", true},
+		{"loopback client from public peer", "203.0.113.1:1234", "127.0.0.1", true},
+		{"unspecified client from public peer", "203.0.113.1:1234", "0.0.0.0", true},
+		{"private client from private peer", "10.0.0.1:1234", "10.0.0.5", false},
+	}
+	detect := SuspiciousForwardedFor()
+	for _, test := range tests {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		ctx.Request.RemoteAddr = test.remoteAddr
+		if test.header != "" {
+			ctx.Request.Header.Set("X-Forwarded-For", test.header)
+		}
+		if got := detect(ctx); got != test.want {
+			t.Errorf("%s: suspicious = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSuspiciousRequestsAreBannedByDefault(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(10).OnSuspiciousHeaders(SuspiciousForwardedFor()))
+	spoofed := []func(*http.Request){fromIP("203.0.113.1"), withHeader("X-Forwarded-For", "10.0.0.5")}
+
+	expectStatus(t, serve(router, http.MethodGet, "/", spoofed...), http.StatusTooManyRequests)
+	expectStatus(t, serve(router, http.MethodGet, "/", fromIP("203.0.113.1")), http.StatusOK)
+}
+
+func TestSuspiciousRequestsGetStricterLimit(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(10).OnSuspiciousHeaders(SuspiciousForwardedFor()).SuspiciousLimit(1))
+	spoofed := []func(*http.Request){fromIP("203.0.113.1"), withHeader("X-Forwarded-For", "198.51.100.7, garbage")}
+
+	expectStatus(t, serve(router, http.MethodGet, "/", spoofed...), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/", spoofed...), http.StatusTooManyRequests)
+}
+
+// mapClaims mimics the named claims map types of JWT libraries.
+type mapClaims map[string]any
+
+func TestClaimedLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims any
+		want   uint16
+		ok     bool
+	}{
+		{"int", map[string]any{"rate_limit": 1000}, 1000, true},
+		{"json number", map[string]any{"rate_limit": json.Number("25")}, 25, true},
+		{"float", mapClaims{"rate_limit": 7.9}, 7, true},
+		{"numeric string", map[string]string{"rate_limit": "12"}, 12, true},
+		{"uint", map[string]uint{"rate_limit": 3}, 3, true},
+		{"capped", map[string]any{"rate_limit": 1e9}, math.MaxUint16, true},
+		{"missing claim", map[string]any{"sub": "a"}, 0, false},
+		{"zero", map[string]any{"rate_limit": 0}, 0, false},
+		{"negative", map[string]any{"rate_limit": -5}, 0, false},
+		{"NaN", map[string]any{"rate_limit": math.NaN()}, 0, false},
+		{"not a number", map[string]any{"rate_limit": "many"}, 0, false},
+		{"not a map", "rate_limit=5", 0, false},
+		{"non-string keys", map[int]any{1: 5}, 0, false},
+	}
+	cfg := newTestConfig().ClaimLimit("claims", "rate_limit")
+	for _, test := range tests {
+		ctx := testContext(httptest.NewRequest(http.MethodGet, "/", nil))
+		ctx.Set("claims", test.claims)
+		if got, ok := cfg.claimedLimit(ctx); got != test.want || ok != test.ok {
+			t.Errorf("%s: claimedLimit() = %d, %t, want %d, %t", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestClaimLimitAppliesPerRequest(t *testing.T) {
+	router := gin.New()
+	router.Use(func(ctx *gin.Context) {
+		if limit := ctx.GetHeader("X-Claimed-Limit"); limit != "" {
+			ctx.Set("claims", map[string]any{"rate_limit": json.Number(limit)})
+		}
+	}, build(t, newTestConfig().Limit(1).ClaimLimit("claims", "rate_limit")))
+	router.GET("/", func(ctx *gin.Context) { ctx.String(http.StatusOK, "ok") })
+
+	claimed := withHeader("X-Claimed-Limit", "3")
+	for i := 0; i < 3; i++ {
+		expectStatus(t, serve(router, http.MethodGet, "/", claimed, fromIP("192.0.2.2")), http.StatusOK)
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/", claimed, fromIP("192.0.2.2")), http.StatusTooManyRequests)
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+}
+
+// planLimits are the limits of the plans of the customers, by client IP.
+var planLimits = map[string]uint16{"192.0.2.1": 2, "192.0.2.2": 4, "192.0.2.3": 0}
+
+func TestLimitResolverSetsLimitPerClient(t *testing.T) {
+	var ids []string
+	cfg := newTestConfig().Limit(1).RouteLimit("/", 10).WorkerCount(16).LimitResolver(func(ctx *gin.Context) uint16 {
+		ids = append(ids, ctx.GetString(IDKey))
+		return planLimits[ctx.ClientIP()]
+	})
+	router := newRouter(t, cfg)
+
+	if got := allowedRequests(t, router); got != 2 {
+		t.Errorf("free plan allowed %d requests, want 2", got)
+	}
+	if got := allowedRequests(t, router, fromIP("192.0.2.2")); got != 4 {
+		t.Errorf("pro plan allowed %d requests, want 4", got)
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/", fromIP("192.0.2.3")), http.StatusTooManyRequests)
+	if ids[0] != "192.0.2.1"+keySeparator+"/" {
+		t.Errorf("resolver saw the ID %q, want the scoped ID", ids[0])
+	}
+}
+
+func TestResolvedLimitIsScaledByPriority(t *testing.T) {
+	cfg := newTestConfig().PriorityFunc(headerPriority).WorkerCount(16).LimitResolver(func(*gin.Context) uint16 { return 2 })
+	if got := allowedRequests(t, newRouter(t, cfg), withHeader("X-Priority", "high")); got != 4 {
+		t.Errorf("allowed %d high priority requests, want the resolved limit doubled", got)
+	}
+}
+
+func TestMethodLimitSharesClientCounter(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(10).MethodLimit("post", 2))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	// The POST is charged against the same count, but compared with its own limit
+	expectStatus(t, serve(router, http.MethodPost, "/"), http.StatusTooManyRequests)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+}
+
+func TestMethodLimitPerMethod(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(10).MethodLimit(http.MethodPost, 1).PerMethod(true))
+
+	expectStatus(t, serve(router, http.MethodPost, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodPost, "/"), http.StatusTooManyRequests)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+}
+
+func TestMethodLimitPrecedence(t *testing.T) {
+	// Method limits take precedence over the read and write limits
+	router := newRouter(t, newTestConfig().Limit(10).SeparateReadWrite(10, 10).MethodLimit(http.MethodDelete, 1))
+	expectStatus(t, serve(router, http.MethodDelete, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodDelete, "/"), http.StatusTooManyRequests)
+	expectStatus(t, serve(router, http.MethodPost, "/"), http.StatusOK)
+
+	// Route limits take precedence over method limits
+	router = newRouter(t, newTestConfig().Limit(10).MethodLimit(http.MethodPost, 1).RouteLimit("/upload", 3), "/upload")
+	for i := 0; i < 3; i++ {
+		expectStatus(t, serve(router, http.MethodPost, "/upload"), http.StatusOK)
+	}
+	expectStatus(t, serve(router, http.MethodPost, "/upload"), http.StatusTooManyRequests)
+}
@@ -0,0 +1,24 @@
+package ratelimiter
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// keyLockStripes is the number of mutexes ids are spread over by keyLocks.
+const keyLockStripes = 256
+
+// keyLocks serializes operations on the same id using a fixed set of striped mutexes,
+// so memory stays bounded regardless of the number of ids (unrelated ids may share a stripe).
+type keyLocks struct {
+	stripes [keyLockStripes]sync.Mutex
+}
+
+// lock locks the stripe of the given id and returns the function unlocking it.
+func (k *keyLocks) lock(id string) func() {
+	hash := fnv.New32a()
+	hash.Write([]byte(id))
+	stripe := &k.stripes[hash.Sum32()%keyLockStripes]
+	stripe.Lock()
+	return stripe.Unlock
+}
@@ -0,0 +1,62 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrentRequestsNeverExceedLimit(t *testing.T) {
+	const (
+		limit    = 100
+		requests = 1000
+	)
+	storage := newCountingStorage() // Only the separate read and write, so the check path relies on keyLocks
+	router := newRouter(t, newTestConfig().Storage(storage).Limit(limit).Timeout(time.Minute).QueueSize(requests))
+
+	var allowed, rejected atomic.Int64
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			switch serve(router, http.MethodGet, "/").Code {
+			case http.StatusOK:
+				allowed.Add(1)
+			case http.StatusTooManyRequests:
+				rejected.Add(1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if allowed.Load() != limit || rejected.Load() != requests-limit {
+		t.Errorf("allowed %d and rejected %d of %d concurrent requests, want exactly %d allowed",
+			allowed.Load(), rejected.Load(), requests, limit)
+	}
+	if count, _ := storage.Get("192.0.2.1"); count != limit {
+		t.Errorf("count = %d, want %d", count, limit)
+	}
+}
+
+func TestKeyLocksSerializeSameID(t *testing.T) {
+	var locks keyLocks
+	unlock := locks.lock("a")
+	acquired := make(chan struct{})
+	go func() {
+		defer locks.lock("a")()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("the same id was locked twice at once")
+	case <-time.After(20 * time.Millisecond):
+	}
+	unlock()
+	<-acquired
+}
@@ -0,0 +1,30 @@
+// Package rllog defines the minimal logging interface used by the rate limiter and its storages,
+// with an adapter for log/slog. Logrus loggers are adapted by the rllogrus subpackage.
+package rllog
+
+import "log/slog"
+
+// Logger is the minimal structured logger used by the rate limiter. The args are alternating
+// key-value pairs, as in log/slog (e.g. Warn("failed to release entry", "user_id", id, "error", err)).
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+	// With returns a logger attaching the given key-value pairs to every entry.
+	With(args ...any) Logger
+}
+
+// slogLogger adapts a log/slog logger to Logger.
+type slogLogger struct {
+	*slog.Logger
+}
+
+// NewSlog adapts the given log/slog logger to Logger.
+func NewSlog(logger *slog.Logger) Logger {
+	return slogLogger{Logger: logger}
+}
+
+func (l slogLogger) With(args ...any) Logger {
+	return slogLogger{Logger: l.Logger.With(args...)}
+}
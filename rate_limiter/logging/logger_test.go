@@ -0,0 +1,49 @@
+package rllog
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func newBufferLogger(level slog.Level) (Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	handler := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			if attr.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return attr
+		},
+	})
+	return NewSlog(slog.New(handler)), &buf
+}
+
+func TestSlogLoggerLogsArgs(t *testing.T) {
+	logger, buf := newBufferLogger(slog.LevelDebug)
+
+	logger.Warn("failed to release entry", "user_id", "client")
+	if got, want := buf.String(), "level=WARN msg=\"failed to release entry\" user_id=client\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
+
+func TestSlogLoggerSkipsDisabledLevels(t *testing.T) {
+	logger, buf := newBufferLogger(slog.LevelInfo)
+
+	logger.Debug("hidden")
+	if buf.Len() != 0 {
+		t.Errorf("logged %q at info level", buf.String())
+	}
+}
+
+func TestSlogWithAttachesArgs(t *testing.T) {
+	logger, buf := newBufferLogger(slog.LevelInfo)
+
+	logger.With("storage", "redis").Info("connected")
+	if !strings.Contains(buf.String(), "storage=redis") {
+		t.Errorf("output = %q, want storage=redis", buf.String())
+	}
+}
@@ -0,0 +1,58 @@
+// Package rllogrus adapts logrus loggers to the rllog.Logger interface of the rate limiter,
+// so only services logging with logrus depend on it.
+package rllogrus
+
+import (
+	rllog "github.com/FMotalleb/gin_testfield/rate_limiter/logging"
+	"github.com/sirupsen/logrus"
+)
+
+// badKey is the key used for a value without a (string) key, as in log/slog.
+const badKey = "!BADKEY"
+
+// logger adapts a logrus entry to rllog.Logger.
+type logger struct {
+	entry *logrus.Entry
+}
+
+// New adapts the given logrus logger to rllog.Logger.
+func New(l *logrus.Logger) rllog.Logger {
+	return logger{entry: logrus.NewEntry(l)}
+}
+
+func (l logger) Debug(msg string, args ...any) { l.log(logrus.DebugLevel, msg, args) }
+func (l logger) Info(msg string, args ...any)  { l.log(logrus.InfoLevel, msg, args) }
+func (l logger) Warn(msg string, args ...any)  { l.log(logrus.WarnLevel, msg, args) }
+func (l logger) Error(msg string, args ...any) { l.log(logrus.ErrorLevel, msg, args) }
+
+func (l logger) With(args ...any) rllog.Logger {
+	return logger{entry: l.entry.WithFields(fields(args))}
+}
+
+// log logs the given message with the given key-value pairs, if the level is enabled.
+func (l logger) log(level logrus.Level, msg string, args []any) {
+	if !l.entry.Logger.IsLevelEnabled(level) {
+		return
+	}
+	entry := l.entry
+	if len(args) > 0 {
+		entry = entry.WithFields(fields(args))
+	}
+	entry.Log(level, msg)
+}
+
+// fields converts the given key-value pairs to logrus fields.
+func fields(args []any) logrus.Fields {
+	fields := make(logrus.Fields, len(args)/2)
+	for len(args) > 0 {
+		key, ok := args[0].(string)
+		if !ok || len(args) == 1 {
+			fields[badKey] = args[0]
+			args = args[1:]
+			continue
+		}
+		fields[key] = args[1]
+		args = args[2:]
+	}
+	return fields
+}
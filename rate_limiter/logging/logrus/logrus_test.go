@@ -0,0 +1,71 @@
+package rllogrus
+
+import (
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestLoggerLogsFieldsAtLevel(t *testing.T) {
+	l, hook := test.NewNullLogger()
+	l.SetLevel(logrus.DebugLevel)
+	logger := New(l)
+
+	logger.Warn("failed to release entry", "user_id", "client", "count", 3)
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatal("no entry logged")
+	}
+	if entry.Level != logrus.WarnLevel || entry.Message != "failed to release entry" {
+		t.Errorf("entry = %v %q, want warning %q", entry.Level, entry.Message, "failed to release entry")
+	}
+	if entry.Data["user_id"] != "client" || entry.Data["count"] != 3 {
+		t.Errorf("fields = %v, want user_id=client count=3", entry.Data)
+	}
+}
+
+func TestLoggerKeepsValuesWithoutKey(t *testing.T) {
+	l, hook := test.NewNullLogger()
+	New(l).Error("failed", 42, "key", "value", "dangling")
+
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatal("no entry logged")
+	}
+	if entry.Data["key"] != "value" {
+		t.Errorf("key = %v, want value", entry.Data["key"])
+	}
+	if entry.Data[badKey] != "dangling" {
+		t.Errorf("%s = %v, want the last value without key", badKey, entry.Data[badKey])
+	}
+}
+
+func TestLoggerSkipsDisabledLevels(t *testing.T) {
+	l, hook := test.NewNullLogger()
+	l.SetLevel(logrus.InfoLevel)
+	logger := New(l)
+
+	logger.Debug("hidden", "key", "value")
+	if len(hook.AllEntries()) != 0 {
+		t.Errorf("logged %d debug entries at info level", len(hook.AllEntries()))
+	}
+	logger.Info("shown")
+	if len(hook.AllEntries()) != 1 {
+		t.Errorf("logged %d entries, want 1", len(hook.AllEntries()))
+	}
+}
+
+func TestWithAttachesFields(t *testing.T) {
+	l, hook := test.NewNullLogger()
+	logger := New(l).With("storage", "redis")
+
+	logger.Info("connected", "addr", "localhost")
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatal("no entry logged")
+	}
+	if entry.Data["storage"] != "redis" || entry.Data["addr"] != "localhost" {
+		t.Errorf("fields = %v, want storage=redis addr=localhost", entry.Data)
+	}
+}
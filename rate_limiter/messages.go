@@ -0,0 +1,80 @@
+package ratelimiter
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RejectionMessageKey is the gin context key under which the middleware stores the localized
+// rejection message (if enabled using Config.Messages), before calling the handler.
+const RejectionMessageKey = "ratelimit_rejection_message"
+
+// DefaultMessageLanguage is the key of the Config.Messages entry used when no language
+// of the Accept-Language header has a message.
+const DefaultMessageLanguage = "*"
+
+// defaultRejectionMessage is the rejection message used if no localized message applies.
+const defaultRejectionMessage = "too many requests"
+
+// languagePreference is a single language range of an Accept-Language header.
+type languagePreference struct {
+	tag     string  // The language range, lowercased (e.g. "pt-br" or "*")
+	quality float64 // The quality value of the range (q)
+}
+
+// rejectionMessage returns the message best matching the Accept-Language header of the request.
+//
+// Languages are tried in order of preference, each matching its exact tag first and then its
+// shorter prefixes ("pt-BR" falls back to "pt"). If none matches, the DefaultMessageLanguage
+// entry is used, or the built-in "too many requests" message if there is none.
+func (cfg *Config) rejectionMessage(ctx *gin.Context) string {
+	for _, preference := range parseAcceptLanguage(ctx.GetHeader("Accept-Language")) {
+		for tag := preference.tag; tag != ""; {
+			if message, ok := cfg.messages[tag]; ok {
+				return message
+			}
+			separator := strings.LastIndexByte(tag, '-')
+			if separator < 0 {
+				break
+			}
+			tag = tag[:separator]
+		}
+	}
+	if message, ok := cfg.messages[DefaultMessageLanguage]; ok {
+		return message
+	}
+	return defaultRejectionMessage
+}
+
+// parseAcceptLanguage parses the language ranges of an Accept-Language header,
+// sorted by descending quality. Ranges with a quality of 0 (not acceptable) are dropped.
+func parseAcceptLanguage(header string) []languagePreference {
+	var preferences []languagePreference
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(key, "q") {
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if quality <= 0 {
+			continue
+		}
+		preferences = append(preferences, languagePreference{tag: tag, quality: quality})
+	}
+	sort.SliceStable(preferences, func(i, j int) bool {
+		return preferences[i].quality > preferences[j].quality
+	})
+	return preferences
+}
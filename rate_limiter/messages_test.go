@@ -0,0 +1,60 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRejectionMessageMatchesAcceptLanguage(t *testing.T) {
+	cfg := newTestConfig().Messages(map[string]string{
+		"en":                   "too many requests",
+		"pt":                   "muitas requisições",
+		"pt-BR":                "muitas solicitações",
+		DefaultMessageLanguage: "slow down",
+	})
+	tests := []struct {
+		header, want string
+	}{
+		{"pt-BR", "muitas solicitações"},
+		{"PT-br", "muitas solicitações"},
+		{"pt-PT", "muitas requisições"},
+		{"de, en;q=0.5", "too many requests"},
+		{"en;q=0.3, pt;q=0.8", "muitas requisições"},
+		{"pt;q=0, en;q=0.1", "too many requests"},
+		{"de", "slow down"},
+		{"", "slow down"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Language", test.header)
+		if got := cfg.rejectionMessage(testContext(req)); got != test.want {
+			t.Errorf("rejectionMessage(%q) = %q, want %q", test.header, got, test.want)
+		}
+	}
+}
+
+func TestRejectionMessageFallsBackToBuiltIn(t *testing.T) {
+	cfg := newTestConfig().Messages(map[string]string{"pt": "muitas requisições"})
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Language", "de")
+	if got := cfg.rejectionMessage(testContext(req)); got != defaultRejectionMessage {
+		t.Errorf("rejectionMessage() = %q, want %q", got, defaultRejectionMessage)
+	}
+}
+
+func TestRejectionMessageIsPassedToHandler(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(1).Messages(map[string]string{"pt": "muitas requisições"}).Handler(func(ctx *gin.Context) {
+		ctx.String(http.StatusTooManyRequests, ctx.GetString(RejectionMessageKey))
+		ctx.Abort()
+	}))
+
+	serve(router, http.MethodGet, "/")
+	rec := serve(router, http.MethodGet, "/", withHeader("Accept-Language", "pt-BR"))
+	expectStatus(t, rec, http.StatusTooManyRequests)
+	if rec.Body.String() != "muitas requisições" {
+		t.Errorf("body = %q, want the localized message", rec.Body.String())
+	}
+}
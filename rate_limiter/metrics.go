@@ -0,0 +1,98 @@
+package ratelimiter
+
+import (
+	"math"
+
+	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The reasons a request is blocked for, used as the `reason` label of the blocked requests counter.
+const (
+	reasonLimited      = "limited"       // The client exceeded its rate limit
+	reasonOverloaded   = "overloaded"    // The release queue was saturated
+	reasonDenied       = "denied"        // The client is denylisted
+	reasonInvalidID    = "invalid_id"    // The client could not be identified
+	reasonStorageError = "storage_error" // The storage failed and the request was failed closed
+)
+
+// metrics holds the Prometheus collectors of the middleware.
+type metrics struct {
+	duration prometheus.Histogram   // The time spent in the middleware body per request
+	allowed  *prometheus.CounterVec // The requests allowed by the limiter, by route
+	blocked  *prometheus.CounterVec // The requests blocked by the limiter, by route and reason
+}
+
+// newMetrics creates the Prometheus collectors of the middleware and registers them with the given registerer.
+// The active keys gauge reads the number of keys tracked by the storage through activeKeys on every scrape.
+// If the storage is an rlstorage.EvictionCounter, its evictions are exported as well.
+func newMetrics(registerer prometheus.Registerer, activeKeys func() (int, error), storage rlstorage.RLStorage) (*metrics, error) {
+	m := &metrics{
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "ratelimiter_middleware_duration_seconds",
+			Help:    "Time spent in the rate limiter middleware itself per request, excluding downstream handlers.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10), // 10µs to ~2.6s
+		}),
+		allowed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ratelimiter_requests_allowed_total",
+			Help: "Requests allowed by the rate limiter, by matched route.",
+		}, []string{"route"}),
+		blocked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ratelimiter_requests_blocked_total",
+			Help: "Requests blocked by the rate limiter, by matched route and rejection reason.",
+		}, []string{"route", "reason"}),
+	}
+	active := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "ratelimiter_active_keys",
+		Help: "Client keys currently tracked by the storage (NaN if the storage cannot count them).",
+	}, func() float64 {
+		count, err := activeKeys()
+		if err != nil {
+			return math.NaN()
+		}
+		return float64(count)
+	})
+	collectors := []prometheus.Collector{m.duration, m.allowed, m.blocked, active}
+	if counter, ok := rlstorage.As[rlstorage.EvictionCounter](storage); ok {
+		collectors = append(collectors, prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "ratelimiter_storage_evictions_total",
+			Help: "Client keys evicted by the storage to stay within its budget.",
+		}, func() float64 {
+			return float64(counter.Evictions())
+		}))
+	}
+	for _, collector := range collectors {
+		if err := registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// observeAllowed counts a request allowed by the limiter, if metrics are enabled.
+func (cfg *Config) observeAllowed(ctx *gin.Context) {
+	if cfg.metrics != nil {
+		cfg.metrics.allowed.WithLabelValues(ctx.FullPath()).Inc()
+	}
+}
+
+// observeBlocked counts a request blocked by the limiter for the given reason, if metrics are enabled.
+// If tracing is enabled (see Tracer) and the request context carries a recording span, its trace and span IDs
+// are attached as an exemplar, so a spike of blocked requests can be followed to the traces behind it.
+func (cfg *Config) observeBlocked(ctx *gin.Context, reason string) {
+	if cfg.metrics == nil {
+		return
+	}
+	counter := cfg.metrics.blocked.WithLabelValues(ctx.FullPath(), reason)
+	span := trace.SpanFromContext(ctx.Request.Context())
+	if adder, ok := counter.(prometheus.ExemplarAdder); ok && cfg.tracer != nil && span.IsRecording() && span.SpanContext().IsValid() {
+		adder.AddWithExemplar(1, prometheus.Labels{
+			"trace_id": span.SpanContext().TraceID().String(),
+			"span_id":  span.SpanContext().SpanID().String(),
+		})
+		return
+	}
+	counter.Inc()
+}
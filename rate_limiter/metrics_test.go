@@ -0,0 +1,193 @@
+package ratelimiter
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"reflect"
+	"testing"
+
+	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// gatherFamily gathers the series of the metric family with the given name from the registry.
+func gatherFamily(t *testing.T, registry *prometheus.Registry, name string) []*dto.Metric {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()
+		}
+	}
+	t.Fatalf("%s not gathered", name)
+	return nil
+}
+
+// blockedCounter gathers the blocked requests counters of the registry.
+func blockedCounter(t *testing.T, registry *prometheus.Registry) []*dto.Metric {
+	t.Helper()
+	return gatherFamily(t, registry, "ratelimiter_requests_blocked_total")
+}
+
+// labelValues returns the labels of a series by name.
+func labelValues(metric *dto.Metric) map[string]string {
+	labels := map[string]string{}
+	for _, pair := range metric.GetLabel() {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	return labels
+}
+
+func TestBlockedCounterCarriesTraceExemplar(t *testing.T) {
+	provider := sdktrace.NewTracerProvider()
+	t.Cleanup(func() { _ = provider.Shutdown(context.Background()) })
+	registry := prometheus.NewRegistry()
+	router := newRouter(t, newTestConfig().Limit(1).MetricsRegisterer(registry).Tracer(provider))
+
+	var traceID, spanID string
+	traced := func(req *http.Request) {
+		ctx, span := provider.Tracer("test").Start(req.Context(), "request")
+		traceID, spanID = span.SpanContext().TraceID().String(), span.SpanContext().SpanID().String()
+		*req = *req.WithContext(ctx)
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/", traced), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/", traced), http.StatusTooManyRequests)
+
+	metrics := blockedCounter(t, registry)
+	if len(metrics) != 1 {
+		t.Fatalf("got %d blocked series, want 1", len(metrics))
+	}
+	exemplar := metrics[0].GetCounter().GetExemplar()
+	if exemplar == nil {
+		t.Fatal("blocked counter has no exemplar")
+	}
+	labels := map[string]string{}
+	for _, pair := range exemplar.GetLabel() {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	if labels["trace_id"] != traceID || labels["span_id"] != spanID {
+		t.Errorf("exemplar labels = %v, want trace_id %s and span_id %s", labels, traceID, spanID)
+	}
+}
+
+func TestBlockedCounterWithoutTracerHasNoExemplar(t *testing.T) {
+	provider := sdktrace.NewTracerProvider()
+	t.Cleanup(func() { _ = provider.Shutdown(context.Background()) })
+	registry := prometheus.NewRegistry()
+	router := newRouter(t, newTestConfig().Limit(1).MetricsRegisterer(registry))
+
+	// The request carries a recording span of the application, but tracing is disabled on the limiter
+	traced := func(req *http.Request) {
+		ctx, _ := provider.Tracer("test").Start(req.Context(), "request")
+		*req = *req.WithContext(ctx)
+	}
+	serve(router, http.MethodGet, "/", traced)
+	expectStatus(t, serve(router, http.MethodGet, "/", traced), http.StatusTooManyRequests)
+
+	metrics := blockedCounter(t, registry)
+	if len(metrics) != 1 || metrics[0].GetCounter().GetValue() != 1 {
+		t.Fatalf("blocked series = %v, want a single blocked request", metrics)
+	}
+	if metrics[0].GetCounter().GetExemplar() != nil {
+		t.Error("blocked counter has an exemplar with tracing disabled")
+	}
+}
+
+func TestBlockedCounterWithoutSpanHasNoExemplar(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	router := newRouter(t, newTestConfig().Limit(1).MetricsRegisterer(registry))
+	serve(router, http.MethodGet, "/")
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+
+	metrics := blockedCounter(t, registry)
+	if len(metrics) != 1 {
+		t.Fatalf("got %d blocked series, want 1", len(metrics))
+	}
+	if metrics[0].GetCounter().GetValue() != 1 {
+		t.Errorf("blocked = %v, want 1", metrics[0].GetCounter().GetValue())
+	}
+	if metrics[0].GetCounter().GetExemplar() != nil {
+		t.Error("blocked counter has an exemplar without a recording span")
+	}
+}
+
+func TestRequestCountersByRouteAndReason(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	cfg := newTestConfig().Limit(1).MetricsRegisterer(registry).Denylist([]string{"198.51.100.0/24"}).WorkerCount(4)
+	router := newRouter(t, cfg, "/a", "/b")
+
+	expectStatus(t, serve(router, http.MethodGet, "/a"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/b", fromIP("192.0.2.2")), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/a"), http.StatusTooManyRequests)
+	expectStatus(t, serve(router, http.MethodGet, "/b", fromIP("198.51.100.1")), http.StatusForbidden)
+
+	allowed := map[string]float64{}
+	for _, metric := range gatherFamily(t, registry, "ratelimiter_requests_allowed_total") {
+		allowed[labelValues(metric)["route"]] = metric.GetCounter().GetValue()
+	}
+	if allowed["/a"] != 1 || allowed["/b"] != 1 || len(allowed) != 2 {
+		t.Errorf("allowed requests = %v, want one per route", allowed)
+	}
+	blocked := map[string]float64{}
+	for _, metric := range blockedCounter(t, registry) {
+		labels := labelValues(metric)
+		blocked[labels["route"]+" "+labels["reason"]] = metric.GetCounter().GetValue()
+	}
+	want := map[string]float64{"/a " + reasonLimited: 1, "/b " + reasonDenied: 1}
+	if !reflect.DeepEqual(blocked, want) {
+		t.Errorf("blocked requests = %v, want %v", blocked, want)
+	}
+}
+
+func TestActiveKeysGauge(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	router := newRouter(t, newTestConfig().Limit(5).MetricsRegisterer(registry).WorkerCount(4))
+	serve(router, http.MethodGet, "/")
+	serve(router, http.MethodGet, "/")
+	serve(router, http.MethodGet, "/", fromIP("192.0.2.2"))
+
+	if got := gatherFamily(t, registry, "ratelimiter_active_keys")[0].GetGauge().GetValue(); got != 2 {
+		t.Errorf("active keys = %v, want 2", got)
+	}
+}
+
+func TestActiveKeysGaugeIsNaNWithoutKeyCounting(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	newRouter(t, newTestConfig().Storage(newCountingStorage()).MetricsRegisterer(registry))
+
+	if got := gatherFamily(t, registry, "ratelimiter_active_keys")[0].GetGauge().GetValue(); !math.IsNaN(got) {
+		t.Errorf("active keys = %v on a storage that cannot count keys, want NaN", got)
+	}
+}
+
+func TestEvictionsCounterOfBoundedStorage(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	router := newRouter(t, newTestConfig().Storage(rlstorage.NewBoundedStorage(1, discardLogger())).MetricsRegisterer(registry).WorkerCount(4))
+	serve(router, http.MethodGet, "/")
+	serve(router, http.MethodGet, "/", fromIP("192.0.2.2"))
+
+	if got := gatherFamily(t, registry, "ratelimiter_storage_evictions_total")[0].GetCounter().GetValue(); got != 1 {
+		t.Errorf("evictions = %v, want 1", got)
+	}
+}
+
+func TestEvictionsCounterRequiresEvictingStorage(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	newRouter(t, newTestConfig().MetricsRegisterer(registry))
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() == "ratelimiter_storage_evictions_total" {
+			t.Fatal("evictions exported for a storage that never evicts")
+		}
+	}
+}
@@ -0,0 +1,431 @@
+package ratelimiter
+
+import (
+	"context"
+	"time"
+
+	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Option configures a Config, mirroring one of its builder methods: every builder method has a With…
+// option of the same name (WithoutFullCleanup for DisableFullCleanup). Options compose better than
+// the fluent builder when the configuration is assembled conditionally, e.g. as a slice.
+type Option func(cfg *Config)
+
+// New builds the middleware from the defaults of NewConfigBuilder with the given options applied.
+// It shares the validation of Build, so New(WithLimit(10)) is equivalent to NewConfigBuilder().Limit(10).Build().
+func New(opts ...Option) (gin.HandlerFunc, error) {
+	return NewConfigBuilder().Apply(opts...).Build()
+}
+
+// Apply applies the given options to the configuration in order, so options and builder methods can be mixed.
+func (cfg *Config) Apply(opts ...Option) *Config {
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return cfg
+}
+
+// WithLogger sets the logger for the middleware (see Config.Logger).
+func WithLogger(logger Logger) Option {
+	return func(cfg *Config) { cfg.Logger(logger) }
+}
+
+// WithLimit sets the rate limit for the middleware (see Config.Limit).
+func WithLimit(limit uint16) Option {
+	return func(cfg *Config) { cfg.Limit(limit) }
+}
+
+// WithTimeout sets the timeout duration for rate limiting (see Config.Timeout).
+func WithTimeout(timeout time.Duration) Option {
+	return func(cfg *Config) { cfg.Timeout(timeout) }
+}
+
+// WithTolerance sets the tolerance duration for rate limiting (see Config.Tolerance).
+func WithTolerance(tolerance time.Duration) Option {
+	return func(cfg *Config) { cfg.Tolerance(tolerance) }
+}
+
+// WithStorage sets the storage backend used for rate data (see Config.Storage).
+func WithStorage(storage rlstorage.RLStorage) Option {
+	return func(cfg *Config) { cfg.Storage(storage) }
+}
+
+// WithWorkerCount sets the number of release workers (see Config.WorkerCount).
+func WithWorkerCount(workers uint16) Option {
+	return func(cfg *Config) { cfg.WorkerCount(workers) }
+}
+
+// WithIdSelector sets the function selecting the client id of a request (see Config.IdSelector).
+func WithIdSelector(idSelector IDSelector) Option {
+	return func(cfg *Config) { cfg.IdSelector(idSelector) }
+}
+
+// WithHandler sets the handler of rate limited requests (see Config.Handler).
+func WithHandler(handler gin.HandlerFunc) Option {
+	return func(cfg *Config) { cfg.Handler(handler) }
+}
+
+// WithRejectionJSON sets a handler rejecting rate limited requests with the given JSON body (see Config.RejectionJSON).
+func WithRejectionJSON(obj interface{}) Option {
+	return func(cfg *Config) { cfg.RejectionJSON(obj) }
+}
+
+// WithStatusCode sets the status code of the default handler (see Config.StatusCode).
+func WithStatusCode(status int) Option {
+	return func(cfg *Config) { cfg.StatusCode(status) }
+}
+
+// WithHeaders enables or disables the rate limit headers (see Config.Headers).
+func WithHeaders(enabled bool) Option {
+	return func(cfg *Config) { cfg.Headers(enabled) }
+}
+
+// WithSkip sets the function deciding which requests bypass the limiter (see Config.Skip).
+func WithSkip(skip func(*gin.Context) bool) Option {
+	return func(cfg *Config) { cfg.Skip(skip) }
+}
+
+// WithAlgorithm sets the algorithm counting the requests of a client (see Config.Algorithm).
+func WithAlgorithm(algorithm Algorithm) Option {
+	return func(cfg *Config) { cfg.Algorithm(algorithm) }
+}
+
+// WithQueueTimeout sets how long a request waits for the release queue (see Config.QueueTimeout).
+func WithQueueTimeout(timeout time.Duration) Option {
+	return func(cfg *Config) { cfg.QueueTimeout(timeout) }
+}
+
+// WithFullCleanupRotation sets the full cleanup rotation of the storage (see Config.FullCleanupRotation).
+func WithFullCleanupRotation(rotation time.Duration) Option {
+	return func(cfg *Config) { cfg.FullCleanupRotation(rotation) }
+}
+
+// WithLimitRamp sets the duration over which a limit lowered at runtime is phased in (see Config.LimitRamp).
+func WithLimitRamp(ramp time.Duration) Option {
+	return func(cfg *Config) { cfg.LimitRamp(ramp) }
+}
+
+// WithTokenBucket switches the limiter to a token bucket per client (see Config.TokenBucket).
+func WithTokenBucket(refillRate float64, burst uint16) Option {
+	return func(cfg *Config) { cfg.TokenBucket(refillRate, burst) }
+}
+
+// WithEmissionInterval sets the interval at which the GCRA algorithm lets requests through once a client used its burst (see Config.EmissionInterval).
+func WithEmissionInterval(interval time.Duration) Option {
+	return func(cfg *Config) { cfg.EmissionInterval(interval) }
+}
+
+// WithBurst sets the number of requests the GCRA algorithm lets through at once from an idle client (see Config.Burst).
+func WithBurst(burst uint16) Option {
+	return func(cfg *Config) { cfg.Burst(burst) }
+}
+
+// WithLimitResolver sets the function resolving the limit of each request (see Config.LimitResolver).
+func WithLimitResolver(resolver func(*gin.Context) uint16) Option {
+	return func(cfg *Config) { cfg.LimitResolver(resolver) }
+}
+
+// WithClaimLimit reads the per-request limit from a numeric claim of a verified token (see Config.ClaimLimit).
+func WithClaimLimit(claimsKey, claim string) Option {
+	return func(cfg *Config) { cfg.ClaimLimit(claimsKey, claim) }
+}
+
+// WithRouteLimit overrides the limit for the routes matching the given pattern (see Config.RouteLimit).
+func WithRouteLimit(pattern string, limit uint16) Option {
+	return func(cfg *Config) { cfg.RouteLimit(pattern, limit) }
+}
+
+// WithDimension adds a limit applied in addition to the limit of the selected client ID (see Config.Dimension).
+func WithDimension(name string, selector IDSelector, limit uint16) Option {
+	return func(cfg *Config) { cfg.Dimension(name, selector, limit) }
+}
+
+// WithReportViolations sets which violated dimensions are reported (see Config.ReportViolations).
+func WithReportViolations(report ViolationReport) Option {
+	return func(cfg *Config) { cfg.ReportViolations(report) }
+}
+
+// WithSchedule sets daily time ranges with their own limits (see Config.Schedule).
+func WithSchedule(schedule []ScheduleEntry) Option {
+	return func(cfg *Config) { cfg.Schedule(schedule) }
+}
+
+// WithRejectionDetails enables the backpressure fields of the rejection body (see Config.RejectionDetails).
+func WithRejectionDetails(scope string) Option {
+	return func(cfg *Config) { cfg.RejectionDetails(scope) }
+}
+
+// WithMetricsRegisterer sets the Prometheus registerer the metrics are registered with (see Config.MetricsRegisterer).
+func WithMetricsRegisterer(registerer prometheus.Registerer) Option {
+	return func(cfg *Config) { cfg.MetricsRegisterer(registerer) }
+}
+
+// WithSelfProfiling enables measuring the time spent in the middleware itself (see Config.SelfProfiling).
+func WithSelfProfiling(enabled bool) Option {
+	return func(cfg *Config) { cfg.SelfProfiling(enabled) }
+}
+
+// WithRejectionLogSuppression configures the logging of rejected requests (see Config.RejectionLogSuppression).
+func WithRejectionLogSuppression(threshold uint16, window time.Duration) Option {
+	return func(cfg *Config) { cfg.RejectionLogSuppression(threshold, window) }
+}
+
+// WithExportHistogram passes the distribution of the current counts to the given hook once per interval (see Config.ExportHistogram).
+func WithExportHistogram(interval time.Duration, export func(histogram []uint64)) Option {
+	return func(cfg *Config) { cfg.ExportHistogram(interval, export) }
+}
+
+// WithAuditSink sets the function receiving every limit decision (see Config.AuditSink).
+func WithAuditSink(sink func(event AuditEvent)) Option {
+	return func(cfg *Config) { cfg.AuditSink(sink) }
+}
+
+// WithWebhook posts every limit decision to the given URL (see Config.Webhook).
+func WithWebhook(url string, batchSize int, flushInterval time.Duration) Option {
+	return func(cfg *Config) { cfg.Webhook(url, batchSize, flushInterval) }
+}
+
+// WithOverloadHandler sets the handler of requests rejected because the limiter is saturated (see Config.OverloadHandler).
+func WithOverloadHandler(handler gin.HandlerFunc) Option {
+	return func(cfg *Config) { cfg.OverloadHandler(handler) }
+}
+
+// WithQueueSize sets the capacity of the release queue (see Config.QueueSize).
+func WithQueueSize(size int) Option {
+	return func(cfg *Config) { cfg.QueueSize(size) }
+}
+
+// WithDropWhenQueueFull treats requests as overloaded right away when the release queue is full (see Config.DropWhenQueueFull).
+func WithDropWhenQueueFull(enabled bool) Option {
+	return func(cfg *Config) { cfg.DropWhenQueueFull(enabled) }
+}
+
+// WithMetadata sets the function selecting the metadata of the entries (see Config.Metadata).
+func WithMetadata(selector MetadataSelector) Option {
+	return func(cfg *Config) { cfg.Metadata(selector) }
+}
+
+// WithOnAllowed sets the hook executed for every allowed request (see Config.OnAllowed).
+func WithOnAllowed(hook DecisionHook) Option {
+	return func(cfg *Config) { cfg.OnAllowed(hook) }
+}
+
+// WithOnBlocked sets the hook executed for every blocked request (see Config.OnBlocked).
+func WithOnBlocked(hook DecisionHook) Option {
+	return func(cfg *Config) { cfg.OnBlocked(hook) }
+}
+
+// WithOnRelease sets the hook executed after an entry has been released (see Config.OnRelease).
+func WithOnRelease(hook ReleaseHook) Option {
+	return func(cfg *Config) { cfg.OnRelease(hook) }
+}
+
+// WithStatusWeight sets the function weighting requests by their response status (see Config.StatusWeight).
+func WithStatusWeight(weight StatusWeight) Option {
+	return func(cfg *Config) { cfg.StatusWeight(weight) }
+}
+
+// WithPenaltyMultiplier sets the function scaling the release timeout by the violation count (see Config.PenaltyMultiplier).
+func WithPenaltyMultiplier(multiplier PenaltyMultiplier) Option {
+	return func(cfg *Config) { cfg.PenaltyMultiplier(multiplier) }
+}
+
+// WithHeaderNames sets the names of the emitted rate limit headers (see Config.HeaderNames).
+func WithHeaderNames(names HeaderNames) Option {
+	return func(cfg *Config) { cfg.HeaderNames(names) }
+}
+
+// WithPolicy sets the name of the policy reported in the policy header (see Config.Policy).
+func WithPolicy(name string) Option {
+	return func(cfg *Config) { cfg.Policy(name) }
+}
+
+// WithPriorityFunc sets the function classifying requests into priority tiers (see Config.PriorityFunc).
+func WithPriorityFunc(priority func(*gin.Context) Priority) Option {
+	return func(cfg *Config) { cfg.PriorityFunc(priority) }
+}
+
+// WithPriorityMultiplier sets the factor the limit of the given priority tier is scaled by (see Config.PriorityMultiplier).
+func WithPriorityMultiplier(priority Priority, multiplier float64) Option {
+	return func(cfg *Config) { cfg.PriorityMultiplier(priority, multiplier) }
+}
+
+// WithDedup counts byte-identical requests repeated within window as a single request (see Config.Dedup).
+func WithDedup(window time.Duration, maxBodyBytes int64) Option {
+	return func(cfg *Config) { cfg.Dedup(window, maxBodyBytes) }
+}
+
+// WithStaggerRelease spaces out the releases of each client's entries (see Config.StaggerRelease).
+func WithStaggerRelease(spacing time.Duration) Option {
+	return func(cfg *Config) { cfg.StaggerRelease(spacing) }
+}
+
+// WithTrailers sends the rate limit headers of allowed requests as HTTP trailers (see Config.Trailers).
+func WithTrailers(enabled bool) Option {
+	return func(cfg *Config) { cfg.Trailers(enabled) }
+}
+
+// WithExactHeaderCase writes the rate limit header names exactly as configured (see Config.ExactHeaderCase).
+func WithExactHeaderCase(exact bool) Option {
+	return func(cfg *Config) { cfg.ExactHeaderCase(exact) }
+}
+
+// WithSamplingRate enables approximate counting, writing 1 in n requests to the storage (see Config.SamplingRate).
+func WithSamplingRate(n uint16) Option {
+	return func(cfg *Config) { cfg.SamplingRate(n) }
+}
+
+// WithRejectGrace sets a forgiveness band above the limit (see Config.RejectGrace).
+func WithRejectGrace(grace uint16) Option {
+	return func(cfg *Config) { cfg.RejectGrace(grace) }
+}
+
+// WithCost sets the function returning the number of units a request costs (see Config.Cost).
+func WithCost(cost CostFunc) Option {
+	return func(cfg *Config) { cfg.Cost(cost) }
+}
+
+// WithPerMethod enables or disables counting each request method separately (see Config.PerMethod).
+func WithPerMethod(enabled bool) Option {
+	return func(cfg *Config) { cfg.PerMethod(enabled) }
+}
+
+// WithTreatHeadAsGet makes HEAD requests count as GET requests (see Config.TreatHeadAsGet).
+func WithTreatHeadAsGet(enabled bool) Option {
+	return func(cfg *Config) { cfg.TreatHeadAsGet(enabled) }
+}
+
+// WithMethodLimit overrides the limit for requests with the given method (see Config.MethodLimit).
+func WithMethodLimit(method string, limit uint16) Option {
+	return func(cfg *Config) { cfg.MethodLimit(method, limit) }
+}
+
+// WithSeparateReadWrite counts read and write requests separately, against the given limits (see Config.SeparateReadWrite).
+func WithSeparateReadWrite(readLimit, writeLimit uint16) Option {
+	return func(cfg *Config) { cfg.SeparateReadWrite(readLimit, writeLimit) }
+}
+
+// WithForensicLogAfter enables a one-time forensic log for clients reaching the given number of violations (see Config.ForensicLogAfter).
+func WithForensicLogAfter(violations uint16, redactHeaders []string) Option {
+	return func(cfg *Config) { cfg.ForensicLogAfter(violations, redactHeaders) }
+}
+
+// WithOnSuspiciousHeaders sets the detector flagging requests with suspicious headers (see Config.OnSuspiciousHeaders).
+func WithOnSuspiciousHeaders(detector func(*gin.Context) bool) Option {
+	return func(cfg *Config) { cfg.OnSuspiciousHeaders(detector) }
+}
+
+// WithSuspiciousLimit sets the stricter limit applied to suspicious requests (see Config.SuspiciousLimit).
+func WithSuspiciousLimit(limit uint16) Option {
+	return func(cfg *Config) { cfg.SuspiciousLimit(limit) }
+}
+
+// WithAutoWorkers sizes the worker pool for the given number of expected clients (see Config.AutoWorkers).
+func WithAutoWorkers(expectedClients uint16) Option {
+	return func(cfg *Config) { cfg.AutoWorkers(expectedClients) }
+}
+
+// WithLazyWorkers starts the worker goroutines on demand (see Config.LazyWorkers).
+func WithLazyWorkers(enabled bool) Option {
+	return func(cfg *Config) { cfg.LazyWorkers(enabled) }
+}
+
+// WithWorkerIdleTimeout sets how long a worker started on demand waits for an entry before exiting (see Config.WorkerIdleTimeout).
+func WithWorkerIdleTimeout(timeout time.Duration) Option {
+	return func(cfg *Config) { cfg.WorkerIdleTimeout(timeout) }
+}
+
+// WithAllowlist sets the clients that bypass limiting (see Config.Allowlist).
+func WithAllowlist(entries []string) Option {
+	return func(cfg *Config) { cfg.Allowlist(entries) }
+}
+
+// WithDenylist sets the clients that are rejected regardless of their request count (see Config.Denylist).
+func WithDenylist(entries []string) Option {
+	return func(cfg *Config) { cfg.Denylist(entries) }
+}
+
+// WithDeniedHandler sets the handler of denylisted clients (see Config.DeniedHandler).
+func WithDeniedHandler(handler gin.HandlerFunc) Option {
+	return func(cfg *Config) { cfg.DeniedHandler(handler) }
+}
+
+// WithOnlyAnonymous limits unauthenticated requests only (see Config.OnlyAnonymous).
+func WithOnlyAnonymous(isAuthenticated func(*gin.Context) bool) Option {
+	return func(cfg *Config) { cfg.OnlyAnonymous(isAuthenticated) }
+}
+
+// WithIdSelectorE sets a selector that can reject a request at selection time (see Config.IdSelectorE).
+func WithIdSelectorE(idSelector IDSelectorE) Option {
+	return func(cfg *Config) { cfg.IdSelectorE(idSelector) }
+}
+
+// WithInvalidIDHandler sets the handler of requests rejected by the IdSelectorE (see Config.InvalidIDHandler).
+func WithInvalidIDHandler(handler gin.HandlerFunc) Option {
+	return func(cfg *Config) { cfg.InvalidIDHandler(handler) }
+}
+
+// WithMessages sets the localized rejection messages of the default handler (see Config.Messages).
+func WithMessages(messages map[string]string) Option {
+	return func(cfg *Config) { cfg.Messages(messages) }
+}
+
+// WithOnStorageError sets the handler executed if the storage fails while a request is checked (see Config.OnStorageError).
+func WithOnStorageError(handler StorageErrorHandler) Option {
+	return func(cfg *Config) { cfg.OnStorageError(handler) }
+}
+
+// WithFailClosed sets whether requests are rejected when the storage fails (see Config.FailClosed).
+func WithFailClosed(enabled bool) Option {
+	return func(cfg *Config) { cfg.FailClosed(enabled) }
+}
+
+// WithClock sets the function used to read the current time (see Config.Clock).
+func WithClock(clock func() time.Time) Option {
+	return func(cfg *Config) { cfg.Clock(clock) }
+}
+
+// WithKeyPrefix sets the prefix the keys of the storage are namespaced under (see Config.KeyPrefix).
+func WithKeyPrefix(prefix string) Option {
+	return func(cfg *Config) { cfg.KeyPrefix(prefix) }
+}
+
+// WithCleanupJitter randomly shifts the first full cleanup within ±fraction of the rotation (see Config.CleanupJitter).
+func WithCleanupJitter(fraction float64) Option {
+	return func(cfg *Config) { cfg.CleanupJitter(fraction) }
+}
+
+// WithCleanupTrigger sets a channel triggering a full cleanup on demand (see Config.CleanupTrigger).
+func WithCleanupTrigger(trigger <-chan struct{}) Option {
+	return func(cfg *Config) { cfg.CleanupTrigger(trigger) }
+}
+
+// WithMaxIdle sets the duration after which the counters of idle ids are swept (see Config.MaxIdle).
+func WithMaxIdle(maxIdle time.Duration) Option {
+	return func(cfg *Config) { cfg.MaxIdle(maxIdle) }
+}
+
+// WithoutFullCleanup disables the full cleanup rotation (see Config.DisableFullCleanup).
+func WithoutFullCleanup() Option {
+	return func(cfg *Config) { cfg.DisableFullCleanup() }
+}
+
+// WithContext ties the lifetime of the middleware to ctx (see Config.Context).
+func WithContext(ctx context.Context) Option {
+	return func(cfg *Config) { cfg.Context(ctx) }
+}
+
+// WithTracer sets the OpenTelemetry tracer provider (see Config.Tracer).
+func WithTracer(provider trace.TracerProvider) Option {
+	return func(cfg *Config) { cfg.Tracer(provider) }
+}
+
+// WithConfig applies an arbitrary builder call, e.g. a shared function setting several options at once:
+// WithConfig(func(cfg *Config) *Config { return cfg.Limit(10).Timeout(time.Minute) }).
+func WithConfig(configure func(cfg *Config) *Config) Option {
+	return func(cfg *Config) { configure(cfg) }
+}
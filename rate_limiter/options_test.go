@@ -0,0 +1,347 @@
+package ratelimiter
+
+import (
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"net/http"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// valuesEqual reports whether two values are equal, so two configurations built independently compare equal if they
+// were given the same settings: functions are compared by name (see funcName), as copies of a closure inlined at
+// different call sites differ by code pointer, channels by their capacity, and pointers and
+// interfaces are followed up to the given depth (values deeper than that are assumed equal).
+func valuesEqual(a, b reflect.Value, depth int) bool {
+	if a.Kind() != b.Kind() {
+		return false
+	}
+	switch a.Kind() {
+	case reflect.Bool:
+		return a.Bool() == b.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() == b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() == b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() == b.Float()
+	case reflect.String:
+		return a.String() == b.String()
+	case reflect.Func:
+		return a.IsNil() == b.IsNil() && (a.IsNil() || funcName(a) == funcName(b))
+	case reflect.Chan:
+		return a.IsNil() == b.IsNil() && (a.IsNil() || a.Cap() == b.Cap())
+	case reflect.Pointer, reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		if a.Kind() == reflect.Interface && a.Elem().Type() != b.Elem().Type() {
+			return false
+		}
+		return depth == 0 || valuesEqual(a.Elem(), b.Elem(), depth-1)
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if !valuesEqual(a.Field(i), b.Field(i), depth) {
+				return false
+			}
+		}
+		return true
+	case reflect.Slice, reflect.Array:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !valuesEqual(a.Index(i), b.Index(i), depth) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		if a.Len() != b.Len() {
+			return false
+		}
+		for _, key := range a.MapKeys() {
+			value := b.MapIndex(key)
+			if !value.IsValid() || !valuesEqual(a.MapIndex(key), value, depth) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a.IsZero() == b.IsZero()
+	}
+}
+
+// funcName returns the name of the given function, naming closures the same way whether they were inlined or not
+// (e.g. JSONHandler.1 rather than JSONHandler.func1).
+func funcName(fn reflect.Value) string {
+	return strings.ReplaceAll(runtime.FuncForPC(fn.Pointer()).Name(), ".func", ".")
+}
+
+// fieldsDiffer returns the names of the fields of the configurations that differ (see valuesEqual).
+func fieldsDiffer(a, b *Config) []string {
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	var differ []string
+	for i := 0; i < va.NumField(); i++ {
+		if !valuesEqual(va.Field(i), vb.Field(i), 3) {
+			differ = append(differ, va.Type().Field(i).Name)
+		}
+	}
+	return differ
+}
+
+// optionFunctions returns the names of the With… functions declared in options.go.
+func optionFunctions(t *testing.T) []string {
+	t.Helper()
+	file, err := parser.ParseFile(token.NewFileSet(), "options.go", nil, 0)
+	if err != nil {
+		t.Fatalf("failed to parse options.go: %v", err)
+	}
+	var names []string
+	for _, decl := range file.Decls {
+		if fn, ok := decl.(*ast.FuncDecl); ok && fn.Recv == nil && strings.HasPrefix(fn.Name.Name, "With") {
+			names = append(names, fn.Name.Name)
+		}
+	}
+	return names
+}
+
+// builderMethods returns the names of the builder methods of Config (the exported methods returning *Config)
+// declared in the non-test files of the package, except Apply.
+func builderMethods(t *testing.T) []string {
+	t.Helper()
+	packages, err := parser.ParseDir(token.NewFileSet(), ".", func(info fs.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatalf("failed to parse the package: %v", err)
+	}
+	var names []string
+	for _, file := range packages["ratelimiter"].Files {
+		for _, decl := range file.Decls {
+			fn, ok := decl.(*ast.FuncDecl)
+			if !ok || fn.Recv == nil || !fn.Name.IsExported() || fn.Name.Name == "Apply" || fn.Type.Results == nil || len(fn.Type.Results.List) != 1 {
+				continue
+			}
+			if star, ok := fn.Type.Results.List[0].Type.(*ast.StarExpr); ok {
+				if ident, ok := star.X.(*ast.Ident); ok && ident.Name == "Config" {
+					names = append(names, fn.Name.Name)
+				}
+			}
+		}
+	}
+	return names
+}
+
+func TestOptionsMatchBuilderMethods(t *testing.T) {
+	storage := rlstorage.NewHashMapStorage(discardLogger())
+	logger := discardLogger()
+	handler := func(*gin.Context) {}
+	predicate := func(*gin.Context) bool { return true }
+	selector := func(*gin.Context) string { return "id" }
+	hook := func(*gin.Context, string, uint16) {}
+	trigger := make(chan struct{})
+	registry := prometheus.NewRegistry()
+	provider := sdktrace.NewTracerProvider()
+	clock := newFakeClock(time.Unix(1000, 0))
+	// Function literals are shared between the options and the builder methods, as each literal is a distinct function
+	limitResolver := func(*gin.Context) uint16 { return 1 }
+	export := func([]uint64) {}
+	sink := func(AuditEvent) {}
+	metadata := func(*gin.Context) map[string]string { return nil }
+	onRelease := func(string, map[string]string) {}
+	statusWeight := func(int) uint16 { return 1 }
+	penalty := func(uint16) float64 { return 2 }
+	priority := func(*gin.Context) Priority { return PriorityHigh }
+	cost := func(*gin.Context) uint16 { return 2 }
+	selectorE := func(*gin.Context) (string, error) { return "id", nil }
+	policy := func(cfg *Config) *Config { return cfg.Policy("default") }
+	lifetime, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	tests := map[string]struct {
+		option  Option
+		builder func(cfg *Config) *Config
+	}{
+		"WithLogger":              {WithLogger(logger), func(cfg *Config) *Config { return cfg.Logger(logger) }},
+		"WithLimit":               {WithLimit(3), func(cfg *Config) *Config { return cfg.Limit(3) }},
+		"WithTimeout":             {WithTimeout(time.Hour), func(cfg *Config) *Config { return cfg.Timeout(time.Hour) }},
+		"WithTolerance":           {WithTolerance(time.Second), func(cfg *Config) *Config { return cfg.Tolerance(time.Second) }},
+		"WithStorage":             {WithStorage(storage), func(cfg *Config) *Config { return cfg.Storage(storage) }},
+		"WithWorkerCount":         {WithWorkerCount(7), func(cfg *Config) *Config { return cfg.WorkerCount(7) }},
+		"WithIdSelector":          {WithIdSelector(selector), func(cfg *Config) *Config { return cfg.IdSelector(selector) }},
+		"WithHandler":             {WithHandler(handler), func(cfg *Config) *Config { return cfg.Handler(handler) }},
+		"WithRejectionJSON":       {WithRejectionJSON(gin.H{}), func(cfg *Config) *Config { return cfg.RejectionJSON(gin.H{}) }},
+		"WithStatusCode":          {WithStatusCode(http.StatusServiceUnavailable), func(cfg *Config) *Config { return cfg.StatusCode(http.StatusServiceUnavailable) }},
+		"WithHeaders":             {WithHeaders(true), func(cfg *Config) *Config { return cfg.Headers(true) }},
+		"WithSkip":                {WithSkip(predicate), func(cfg *Config) *Config { return cfg.Skip(predicate) }},
+		"WithAlgorithm":           {WithAlgorithm(SlidingWindow), func(cfg *Config) *Config { return cfg.Algorithm(SlidingWindow) }},
+		"WithQueueTimeout":        {WithQueueTimeout(time.Second), func(cfg *Config) *Config { return cfg.QueueTimeout(time.Second) }},
+		"WithFullCleanupRotation": {WithFullCleanupRotation(time.Hour), func(cfg *Config) *Config { return cfg.FullCleanupRotation(time.Hour) }},
+		"WithLimitRamp":           {WithLimitRamp(time.Minute), func(cfg *Config) *Config { return cfg.LimitRamp(time.Minute) }},
+		"WithTokenBucket":         {WithTokenBucket(2, 5), func(cfg *Config) *Config { return cfg.TokenBucket(2, 5) }},
+		"WithEmissionInterval":    {WithEmissionInterval(time.Second), func(cfg *Config) *Config { return cfg.EmissionInterval(time.Second) }},
+		"WithBurst":               {WithBurst(5), func(cfg *Config) *Config { return cfg.Burst(5) }},
+		"WithLimitResolver":       {WithLimitResolver(limitResolver), func(cfg *Config) *Config { return cfg.LimitResolver(limitResolver) }},
+		"WithClaimLimit":          {WithClaimLimit("claims", "limit"), func(cfg *Config) *Config { return cfg.ClaimLimit("claims", "limit") }},
+		"WithRouteLimit":          {WithRouteLimit("/api/*", 5), func(cfg *Config) *Config { return cfg.RouteLimit("/api/*", 5) }},
+		"WithDimension":           {WithDimension("tenant", selector, 5), func(cfg *Config) *Config { return cfg.Dimension("tenant", selector, 5) }},
+		"WithReportViolations":    {WithReportViolations(ReportAll), func(cfg *Config) *Config { return cfg.ReportViolations(ReportAll) }},
+		"WithSchedule": {WithSchedule([]ScheduleEntry{{End: time.Hour, Limit: 5}}), func(cfg *Config) *Config {
+			return cfg.Schedule([]ScheduleEntry{{End: time.Hour, Limit: 5}})
+		}},
+		"WithRejectionDetails":  {WithRejectionDetails("ip"), func(cfg *Config) *Config { return cfg.RejectionDetails("ip") }},
+		"WithMetricsRegisterer": {WithMetricsRegisterer(registry), func(cfg *Config) *Config { return cfg.MetricsRegisterer(registry) }},
+		"WithSelfProfiling":     {WithSelfProfiling(true), func(cfg *Config) *Config { return cfg.SelfProfiling(true) }},
+		"WithRejectionLogSuppression": {WithRejectionLogSuppression(3, time.Hour), func(cfg *Config) *Config {
+			return cfg.RejectionLogSuppression(3, time.Hour)
+		}},
+		"WithExportHistogram": {WithExportHistogram(time.Minute, export), func(cfg *Config) *Config { return cfg.ExportHistogram(time.Minute, export) }},
+		"WithAuditSink":       {WithAuditSink(sink), func(cfg *Config) *Config { return cfg.AuditSink(sink) }},
+		"WithWebhook": {WithWebhook("http://example.com", 10, time.Second), func(cfg *Config) *Config {
+			return cfg.Webhook("http://example.com", 10, time.Second)
+		}},
+		"WithOverloadHandler":   {WithOverloadHandler(handler), func(cfg *Config) *Config { return cfg.OverloadHandler(handler) }},
+		"WithQueueSize":         {WithQueueSize(8), func(cfg *Config) *Config { return cfg.QueueSize(8) }},
+		"WithDropWhenQueueFull": {WithDropWhenQueueFull(true), func(cfg *Config) *Config { return cfg.DropWhenQueueFull(true) }},
+		"WithMetadata":          {WithMetadata(metadata), func(cfg *Config) *Config { return cfg.Metadata(metadata) }},
+		"WithOnAllowed":         {WithOnAllowed(hook), func(cfg *Config) *Config { return cfg.OnAllowed(hook) }},
+		"WithOnBlocked":         {WithOnBlocked(hook), func(cfg *Config) *Config { return cfg.OnBlocked(hook) }},
+		"WithOnRelease":         {WithOnRelease(onRelease), func(cfg *Config) *Config { return cfg.OnRelease(onRelease) }},
+		"WithStatusWeight":      {WithStatusWeight(statusWeight), func(cfg *Config) *Config { return cfg.StatusWeight(statusWeight) }},
+		"WithPenaltyMultiplier": {WithPenaltyMultiplier(penalty), func(cfg *Config) *Config { return cfg.PenaltyMultiplier(penalty) }},
+		"WithHeaderNames": {WithHeaderNames(HeaderNames{Limit: "Limit"}), func(cfg *Config) *Config {
+			return cfg.HeaderNames(HeaderNames{Limit: "Limit"})
+		}},
+		"WithPolicy":             {WithPolicy("default"), func(cfg *Config) *Config { return cfg.Policy("default") }},
+		"WithPriorityFunc":       {WithPriorityFunc(priority), func(cfg *Config) *Config { return cfg.PriorityFunc(priority) }},
+		"WithPriorityMultiplier": {WithPriorityMultiplier(PriorityHigh, 3), func(cfg *Config) *Config { return cfg.PriorityMultiplier(PriorityHigh, 3) }},
+		"WithDedup":              {WithDedup(time.Second, 1024), func(cfg *Config) *Config { return cfg.Dedup(time.Second, 1024) }},
+		"WithStaggerRelease":     {WithStaggerRelease(time.Second), func(cfg *Config) *Config { return cfg.StaggerRelease(time.Second) }},
+		"WithTrailers":           {WithTrailers(true), func(cfg *Config) *Config { return cfg.Trailers(true) }},
+		"WithExactHeaderCase":    {WithExactHeaderCase(true), func(cfg *Config) *Config { return cfg.ExactHeaderCase(true) }},
+		"WithSamplingRate":       {WithSamplingRate(4), func(cfg *Config) *Config { return cfg.SamplingRate(4) }},
+		"WithRejectGrace":        {WithRejectGrace(2), func(cfg *Config) *Config { return cfg.RejectGrace(2) }},
+		"WithCost":               {WithCost(cost), func(cfg *Config) *Config { return cfg.Cost(cost) }},
+		"WithPerMethod":          {WithPerMethod(true), func(cfg *Config) *Config { return cfg.PerMethod(true) }},
+		"WithTreatHeadAsGet":     {WithTreatHeadAsGet(true), func(cfg *Config) *Config { return cfg.TreatHeadAsGet(true) }},
+		"WithMethodLimit":        {WithMethodLimit(http.MethodPost, 5), func(cfg *Config) *Config { return cfg.MethodLimit(http.MethodPost, 5) }},
+		"WithSeparateReadWrite":  {WithSeparateReadWrite(10, 2), func(cfg *Config) *Config { return cfg.SeparateReadWrite(10, 2) }},
+		"WithForensicLogAfter": {WithForensicLogAfter(3, []string{"X-Api-Key"}), func(cfg *Config) *Config {
+			return cfg.ForensicLogAfter(3, []string{"X-Api-Key"})
+		}},
+		"WithOnSuspiciousHeaders": {WithOnSuspiciousHeaders(predicate), func(cfg *Config) *Config { return cfg.OnSuspiciousHeaders(predicate) }},
+		"WithSuspiciousLimit":     {WithSuspiciousLimit(2), func(cfg *Config) *Config { return cfg.SuspiciousLimit(2) }},
+		"WithAutoWorkers":         {WithAutoWorkers(100), func(cfg *Config) *Config { return cfg.AutoWorkers(100) }},
+		"WithLazyWorkers":         {WithLazyWorkers(true), func(cfg *Config) *Config { return cfg.LazyWorkers(true) }},
+		"WithWorkerIdleTimeout":   {WithWorkerIdleTimeout(time.Minute), func(cfg *Config) *Config { return cfg.WorkerIdleTimeout(time.Minute) }},
+		"WithAllowlist":           {WithAllowlist([]string{"10.0.0.0/8"}), func(cfg *Config) *Config { return cfg.Allowlist([]string{"10.0.0.0/8"}) }},
+		"WithDenylist":            {WithDenylist([]string{"192.0.2.1"}), func(cfg *Config) *Config { return cfg.Denylist([]string{"192.0.2.1"}) }},
+		"WithDeniedHandler":       {WithDeniedHandler(handler), func(cfg *Config) *Config { return cfg.DeniedHandler(handler) }},
+		"WithOnlyAnonymous":       {WithOnlyAnonymous(predicate), func(cfg *Config) *Config { return cfg.OnlyAnonymous(predicate) }},
+		"WithIdSelectorE":         {WithIdSelectorE(selectorE), func(cfg *Config) *Config { return cfg.IdSelectorE(selectorE) }},
+		"WithInvalidIDHandler":    {WithInvalidIDHandler(handler), func(cfg *Config) *Config { return cfg.InvalidIDHandler(handler) }},
+		"WithMessages": {WithMessages(map[string]string{"de": "Zu viele Anfragen"}), func(cfg *Config) *Config {
+			return cfg.Messages(map[string]string{"de": "Zu viele Anfragen"})
+		}},
+		"WithOnStorageError": {WithOnStorageError(failOpen), func(cfg *Config) *Config { return cfg.OnStorageError(failOpen) }},
+		"WithFailClosed":     {WithFailClosed(true), func(cfg *Config) *Config { return cfg.FailClosed(true) }},
+		"WithClock":          {WithClock(clock.Now), func(cfg *Config) *Config { return cfg.Clock(clock.Now) }},
+		"WithKeyPrefix":      {WithKeyPrefix("tenant:"), func(cfg *Config) *Config { return cfg.KeyPrefix("tenant:") }},
+		"WithCleanupJitter":  {WithCleanupJitter(0.5), func(cfg *Config) *Config { return cfg.CleanupJitter(0.5) }},
+		"WithCleanupTrigger": {WithCleanupTrigger(trigger), func(cfg *Config) *Config { return cfg.CleanupTrigger(trigger) }},
+		"WithMaxIdle":        {WithMaxIdle(time.Hour), func(cfg *Config) *Config { return cfg.MaxIdle(time.Hour) }},
+		"WithoutFullCleanup": {WithoutFullCleanup(), (*Config).DisableFullCleanup},
+		"WithContext":        {WithContext(lifetime), func(cfg *Config) *Config { return cfg.Context(lifetime) }},
+		"WithTracer":         {WithTracer(provider), func(cfg *Config) *Config { return cfg.Tracer(provider) }},
+		"WithConfig":         {WithConfig(policy), policy},
+	}
+
+	for _, name := range optionFunctions(t) {
+		if _, ok := tests[name]; !ok {
+			t.Errorf("%s is not compared with its builder method", name)
+		}
+	}
+	for _, method := range builderMethods(t) {
+		option := "With" + method
+		if method == "DisableFullCleanup" {
+			option = "WithoutFullCleanup"
+		}
+		if _, ok := tests[option]; !ok {
+			t.Errorf("builder method %s has no option", method)
+		}
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			fromOption := NewConfigBuilder().Apply(test.option)
+			fromBuilder := test.builder(NewConfigBuilder())
+			if differ := fieldsDiffer(fromOption, fromBuilder); differ != nil {
+				t.Errorf("fields %v differ between the option and the builder method", differ)
+			}
+			if differ := fieldsDiffer(fromOption, NewConfigBuilder()); len(differ) == 0 {
+				t.Error("the option did not change the defaults")
+			}
+		})
+	}
+}
+
+func TestNewBehavesLikeBuild(t *testing.T) {
+	handler, err := New(WithLogger(discardLogger()), WithLimit(1), WithHeaders(true), WithConfig((*Config).DisableFullCleanup))
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	router := gin.New()
+	router.Use(handler)
+	router.GET("/", func(ctx *gin.Context) { ctx.String(http.StatusOK, "ok") })
+
+	recorder := serve(router, http.MethodGet, "/")
+	expectStatus(t, recorder, http.StatusOK)
+	if got := recorder.Header().Get("X-RateLimit-Limit"); got != "1" {
+		t.Errorf("limit header = %q, want 1", got)
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+}
+
+func TestNewValidatesLikeBuild(t *testing.T) {
+	_, optionsErr := New(WithLogger(discardLogger()), WithTimeout(time.Second), WithTolerance(time.Second))
+	_, builderErr := NewConfigBuilder().Logger(discardLogger()).Timeout(time.Second).Tolerance(time.Second).Build()
+	if optionsErr == nil || builderErr == nil || optionsErr.Error() != builderErr.Error() {
+		t.Errorf("New() error = %v, Build() error = %v, want the same validation error", optionsErr, builderErr)
+	}
+}
+
+func TestApplyMixesWithBuilderMethods(t *testing.T) {
+	cfg := NewConfigBuilder().Limit(5).Apply(WithLimit(2)).Timeout(time.Minute)
+	if cfg.limit != 2 || cfg.timeout != time.Minute {
+		t.Errorf("limit = %d and timeout = %s, want options and builder methods applied in order", cfg.limit, cfg.timeout)
+	}
+}
+
+func TestWithRejectionJSONRejectsWithJSON(t *testing.T) {
+	handler, err := New(WithLogger(discardLogger()), WithLimit(1), WithRejectionJSON(gin.H{"error": "limited"}),
+		WithConfig((*Config).DisableFullCleanup))
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	router := gin.New()
+	router.Use(handler)
+	router.GET("/", func(ctx *gin.Context) { ctx.String(http.StatusOK, "ok") })
+
+	serve(router, http.MethodGet, "/")
+	recorder := serve(router, http.MethodGet, "/")
+	expectStatus(t, recorder, http.StatusTooManyRequests)
+	if got, want := recorder.Body.String(), `{"error":"limited"}`; got != want {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,70 @@
+// Package presets provides ready-made IDSelectors for clients served through common CDNs.
+//
+// The headers read by these selectors can be spoofed by any client that reaches the
+// server directly, so they should only be used when all traffic arrives through the CDN.
+package presets
+
+import (
+	"net/netip"
+	"strings"
+
+	ratelimiter "github.com/FMotalleb/gin_testfield/rate_limiter"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	cloudflareHeader = "CF-Connecting-IP"          // Set by Cloudflare to the connecting client IP
+	fastlyHeader     = "Fastly-Client-IP"          // Set by Fastly to the connecting client IP
+	cloudFrontHeader = "CloudFront-Viewer-Address" // Set by AWS CloudFront to the viewer "ip:port"
+)
+
+// CloudflareSelector returns an IDSelector that reads the client IP from the `CF-Connecting-IP` header.
+// It falls back to the gin client IP if the header is missing or not a valid IP address.
+func CloudflareSelector() ratelimiter.IDSelector {
+	return headerSelector(cloudflareHeader, parseIP)
+}
+
+// FastlySelector returns an IDSelector that reads the client IP from the `Fastly-Client-IP` header.
+// It falls back to the gin client IP if the header is missing or not a valid IP address.
+func FastlySelector() ratelimiter.IDSelector {
+	return headerSelector(fastlyHeader, parseIP)
+}
+
+// CloudFrontSelector returns an IDSelector that reads the client IP from the `CloudFront-Viewer-Address` header.
+// The header carries an "ip:port" pair (IPv6 addresses are not bracketed), the port is stripped.
+// It falls back to the gin client IP if the header is missing or not a valid address.
+func CloudFrontSelector() ratelimiter.IDSelector {
+	return headerSelector(cloudFrontHeader, parseViewerAddress)
+}
+
+// headerSelector builds an IDSelector reading the given header using the given parser,
+// falling back to the normalized gin client IP when the parser rejects the value.
+func headerSelector(header string, parse func(string) (string, bool)) ratelimiter.IDSelector {
+	return func(ctx *gin.Context) string {
+		if ip, ok := parse(ctx.GetHeader(header)); ok {
+			return ip
+		}
+		return ratelimiter.NormalizeIP(ctx.ClientIP())
+	}
+}
+
+// parseIP validates and normalizes a plain IP address value.
+func parseIP(value string) (string, bool) {
+	if value == "" {
+		return "", false
+	}
+	ip := ratelimiter.NormalizeIP(value)
+	if _, err := netip.ParseAddr(ip); err != nil {
+		return "", false
+	}
+	return ip, true
+}
+
+// parseViewerAddress validates and normalizes an "ip:port" value with an unbracketed IPv6 address.
+func parseViewerAddress(value string) (string, bool) {
+	separator := strings.LastIndexByte(value, ':')
+	if separator < 0 {
+		return "", false
+	}
+	return parseIP(value[:separator])
+}
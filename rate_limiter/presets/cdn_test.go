@@ -0,0 +1,51 @@
+package presets
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ratelimiter "github.com/FMotalleb/gin_testfield/rate_limiter"
+	"github.com/gin-gonic/gin"
+)
+
+// selectFrom runs the given selector on a request from 192.0.2.1 carrying the given headers.
+func selectFrom(selector ratelimiter.IDSelector, headers map[string]string) string {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = req
+	return selector(ctx)
+}
+
+func TestPresets(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector ratelimiter.IDSelector
+		headers  map[string]string
+		want     string
+	}{
+		{"cloudflare ipv4", CloudflareSelector(), map[string]string{"CF-Connecting-IP": "203.0.113.7"}, "203.0.113.7"},
+		{"cloudflare ipv6", CloudflareSelector(), map[string]string{"CF-Connecting-IP": "2001:db8::7"}, "2001:db8::7"},
+		{"cloudflare mapped", CloudflareSelector(), map[string]string{"CF-Connecting-IP": "::ffff:203.0.113.7"}, "203.0.113.7"},
+		{"cloudflare invalid", CloudflareSelector(), map[string]string{"CF-Connecting-IP": "not-an-ip"}, "192.0.2.1"},
+		{"cloudflare missing", CloudflareSelector(), nil, "192.0.2.1"},
+		{"fastly", FastlySelector(), map[string]string{"Fastly-Client-IP": "198.51.100.3"}, "198.51.100.3"},
+		{"fastly ignores other providers", FastlySelector(), map[string]string{"CF-Connecting-IP": "203.0.113.7"}, "192.0.2.1"},
+		{"fastly invalid", FastlySelector(), map[string]string{"Fastly-Client-IP": "1.2.3"}, "192.0.2.1"},
+		{"cloudfront ipv4", CloudFrontSelector(), map[string]string{"CloudFront-Viewer-Address": "198.51.100.9:46532"}, "198.51.100.9"},
+		{"cloudfront ipv6", CloudFrontSelector(), map[string]string{"CloudFront-Viewer-Address": "2001:db8:cafe::17:46532"}, "2001:db8:cafe::17"},
+		{"cloudfront without port", CloudFrontSelector(), map[string]string{"CloudFront-Viewer-Address": "198.51.100.9"}, "192.0.2.1"},
+		{"cloudfront missing", CloudFrontSelector(), nil, "192.0.2.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := selectFrom(test.selector, test.headers); got != test.want {
+				t.Fatalf("selected %q, want %q", got, test.want)
+			}
+		})
+	}
+}
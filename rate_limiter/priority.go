@@ -0,0 +1,59 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Priority is the priority tier of a request, as classified by the PriorityFunc.
+type Priority uint8
+
+const (
+	PriorityNormal Priority = iota // The limit applies as is (multiplier 1 by default)
+	PriorityBypass                 // The request skips limiting entirely
+	PriorityHigh                   // The limit is scaled up (multiplier 2 by default)
+	PriorityLow                    // The limit is scaled down (multiplier 0.5 by default)
+)
+
+// defaultPriorityMultipliers are the limit multipliers of the priority tiers unless configured otherwise.
+var defaultPriorityMultipliers = map[Priority]float64{
+	PriorityNormal: 1,
+	PriorityHigh:   2,
+	PriorityLow:    0.5,
+}
+
+// String returns the name of the priority tier.
+func (p Priority) String() string {
+	switch p {
+	case PriorityNormal:
+		return "normal"
+	case PriorityBypass:
+		return "bypass"
+	case PriorityHigh:
+		return "high"
+	case PriorityLow:
+		return "low"
+	default:
+		return fmt.Sprintf("Priority(%d)", uint8(p))
+	}
+}
+
+// requestPriority returns the priority tier of the request, normal if no PriorityFunc is set.
+func (cfg *Config) requestPriority(ctx *gin.Context) Priority {
+	if cfg.priority == nil {
+		return PriorityNormal
+	}
+	return cfg.priority(ctx)
+}
+
+// scaleLimit scales the given limit by the multiplier of the given priority tier. Scaled limits are
+// rounded down but never below 1 (a limit of 0 still bans the request), and capped at math.MaxUint16.
+func (cfg *Config) scaleLimit(limit uint16, priority Priority) uint16 {
+	multiplier, ok := cfg.priorityMultipliers[priority]
+	if !ok || multiplier == 1 || limit == 0 {
+		return limit
+	}
+	return uint16(max(min(float64(limit)*multiplier, math.MaxUint16), 1))
+}
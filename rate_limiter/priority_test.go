@@ -0,0 +1,99 @@
+package ratelimiter
+
+import (
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// headerPriority classifies requests by their X-Priority header.
+func headerPriority(ctx *gin.Context) Priority {
+	switch ctx.GetHeader("X-Priority") {
+	case "bypass":
+		return PriorityBypass
+	case "high":
+		return PriorityHigh
+	case "low":
+		return PriorityLow
+	default:
+		return PriorityNormal
+	}
+}
+
+// allowedRequests serves requests from a single client until one is rejected, returning the number allowed.
+func allowedRequests(t *testing.T, router http.Handler, modifiers ...func(*http.Request)) int {
+	t.Helper()
+	for allowed := 0; allowed < 100; allowed++ {
+		if serve(router, http.MethodGet, "/", modifiers...).Code == http.StatusTooManyRequests {
+			return allowed
+		}
+	}
+	t.Fatal("no request was rejected")
+	return 0
+}
+
+func TestPriorityTiersScaleLimit(t *testing.T) {
+	tests := map[string]int{"high": 8, "normal": 4, "low": 2}
+	for tier, want := range tests {
+		t.Run(tier, func(t *testing.T) {
+			router := newRouter(t, newTestConfig().Limit(4).PriorityFunc(headerPriority).WorkerCount(16))
+			if got := allowedRequests(t, router, withHeader("X-Priority", tier)); got != want {
+				t.Errorf("allowed %d requests, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestPriorityBypassSkipsLimiting(t *testing.T) {
+	storage := newCountingStorage()
+	router := newRouter(t, newTestConfig().Storage(storage).Limit(1).PriorityFunc(headerPriority))
+
+	for i := 0; i < 5; i++ {
+		expectStatus(t, serve(router, http.MethodGet, "/", withHeader("X-Priority", "bypass")), http.StatusOK)
+	}
+	if calls := storage.calls(); calls != 0 {
+		t.Errorf("storage called %d times for bypassed requests, want 0", calls)
+	}
+}
+
+func TestPriorityTiersShareCounter(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(2).PriorityFunc(headerPriority).WorkerCount(8))
+
+	expectStatus(t, serve(router, http.MethodGet, "/", withHeader("X-Priority", "high")), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/", withHeader("X-Priority", "high")), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/", withHeader("X-Priority", "low")), http.StatusTooManyRequests)
+	expectStatus(t, serve(router, http.MethodGet, "/", withHeader("X-Priority", "high")), http.StatusOK)
+}
+
+func TestScaleLimit(t *testing.T) {
+	cfg := newTestConfig().PriorityMultiplier(PriorityLow, 0.1).PriorityMultiplier(PriorityHigh, 1000)
+	tests := []struct {
+		limit    uint16
+		priority Priority
+		want     uint16
+	}{
+		{10, PriorityNormal, 10},
+		{10, PriorityLow, 1},
+		{1, PriorityLow, 1},
+		{0, PriorityHigh, 0},
+		{1000, PriorityHigh, math.MaxUint16},
+	}
+	for _, test := range tests {
+		if got := cfg.scaleLimit(test.limit, test.priority); got != test.want {
+			t.Errorf("scaleLimit(%d, %s) = %d, want %d", test.limit, test.priority, got, test.want)
+		}
+	}
+}
+
+func TestInvalidPriorityMultiplierIsRejected(t *testing.T) {
+	for _, multiplier := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+		if err := newTestConfig().PriorityMultiplier(PriorityHigh, multiplier).Validate(); err == nil {
+			t.Errorf("Validate() accepted the multiplier %v", multiplier)
+		}
+	}
+	if err := newTestConfig().PriorityMultiplier(PriorityBypass, 0).Validate(); err != nil {
+		t.Errorf("Validate() rejected the ignored bypass multiplier: %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package ratelimiter
+
+import (
+	"time"
+)
+
+// stopwatch accumulates the time spent in the middleware body, excluding the time
+// spent in downstream handlers. A nil stopwatch is valid and measures nothing.
+type stopwatch struct {
+	started time.Time     // The time the current measurement started
+	elapsed time.Duration // The time accumulated by previous measurements
+}
+
+// startStopwatch creates a new running stopwatch.
+func startStopwatch() *stopwatch {
+	return &stopwatch{started: time.Now()}
+}
+
+// resume starts a new measurement.
+func (sw *stopwatch) resume() {
+	if sw != nil {
+		sw.started = time.Now()
+	}
+}
+
+// pause ends the current measurement, accumulating its duration.
+func (sw *stopwatch) pause() {
+	if sw != nil {
+		sw.elapsed += time.Since(sw.started)
+	}
+}
+
+// observeDuration reports the time spent in the middleware body for a single request, either to
+// the `ratelimiter_middleware_duration_seconds` histogram or, without metrics, as a debug log.
+func (cfg *Config) observeDuration(sw *stopwatch) {
+	if cfg.metrics != nil {
+		cfg.metrics.duration.Observe(sw.elapsed.Seconds())
+		return
+	}
+	cfg.logger.Debug("middleware duration",
+		"scope", "rate-limiter",
+		"ratelimiter_middleware_duration_seconds", sw.elapsed.Seconds(),
+	)
+}
@@ -0,0 +1,61 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// durationHistogram gathers the middleware duration histogram of the registry, nil if it was not registered.
+func durationHistogram(t *testing.T, registry *prometheus.Registry) *dto.Histogram {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() == "ratelimiter_middleware_duration_seconds" {
+			return family.GetMetric()[0].GetHistogram()
+		}
+	}
+	return nil
+}
+
+func TestSelfProfilingExcludesDownstreamHandlers(t *testing.T) {
+	const downstream = 50 * time.Millisecond
+	registry := prometheus.NewRegistry()
+	router := gin.New()
+	router.Use(build(t, newTestConfig().SelfProfiling(true).MetricsRegisterer(registry)))
+	router.GET("/", func(ctx *gin.Context) {
+		time.Sleep(downstream)
+		ctx.String(http.StatusOK, "ok")
+	})
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+
+	histogram := durationHistogram(t, registry)
+	if histogram == nil {
+		t.Fatal("duration histogram not gathered")
+	}
+	if histogram.GetSampleCount() != 2 {
+		t.Errorf("observed %d durations, want 2", histogram.GetSampleCount())
+	}
+	if sum := time.Duration(histogram.GetSampleSum() * float64(time.Second)); sum >= downstream {
+		t.Errorf("observed %v in the middleware, want less than the %v spent downstream", sum, downstream)
+	}
+}
+
+func TestSelfProfilingDisabledObservesNothing(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	router := newRouter(t, newTestConfig().MetricsRegisterer(registry))
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+
+	if histogram := durationHistogram(t, registry); histogram.GetSampleCount() != 0 {
+		t.Errorf("observed %d durations with self profiling disabled, want 0", histogram.GetSampleCount())
+	}
+}
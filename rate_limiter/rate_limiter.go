@@ -1,9 +1,15 @@
 package ratelimiter
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
 	"time"
 
+	rllog "github.com/FMotalleb/gin_testfield/rate_limiter/logging"
+	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
 	"github.com/gin-gonic/gin"
 )
 
@@ -11,71 +17,693 @@ import (
 // It takes a *gin.Context and returns a string identifier.
 type IDSelector func(*gin.Context) string
 
+// IDSelectorE is a variant of IDSelector that can reject a request at selection time
+// (e.g. no usable identity or a malformed token) by returning an error, instead of
+// bucketing it under a shared key.
+type IDSelectorE func(*gin.Context) (string, error)
+
+// MetadataSelector is a function type that selects metadata to attach to the rate entry of a request,
+// handed to the ReleaseHook once the entry is released.
+type MetadataSelector func(*gin.Context) map[string]string
+
+// ReleaseHook is a function type that is executed after a rate entry has been released.
+// It receives the ID and the metadata of the released entry.
+type ReleaseHook func(id string, metadata map[string]string)
+
+// DecisionHook is a function type that is executed when the middleware allows or blocks a request.
+// It receives the selected (scoped) ID and the client's current count.
+type DecisionHook func(ctx *gin.Context, id string, current uint16)
+
+// StatusWeight is a function type that returns the number of units a request with
+// the given response status counts as against the rate limit.
+type StatusWeight func(status int) uint16
+
+// Logger is the structured logger used by the middleware, see rllog.NewSlog and rllogrus.New.
+type Logger = rllog.Logger
+
+// StorageErrorHandler is a function type that is called when the storage fails while a request is checked.
+// The request fails open (proceeds as if it was allowed) unless the handler aborts it.
+type StorageErrorHandler func(ctx *gin.Context, err error)
+
+// PenaltyMultiplier is a function type that returns the factor by which the release timeout
+// of a client is scaled, given the number of violations recorded for that client.
+type PenaltyMultiplier func(violations uint16) float64
+
+// keySeparator separates the parts of a scoped rate limiting key.
+const keySeparator = "|"
+
+const (
+	maxMetadataEntries     = 8   // The maximum number of metadata entries kept per rate entry
+	maxMetadataValueLength = 128 // The maximum length (in bytes) of a metadata value
+)
+
+// decision represents the outcome of checking a request against the rate limiter.
+type decision uint8
+
+const (
+	allowed    decision = iota // The request is allowed to proceed
+	limited                    // The client exceeded its rate limit
+	overloaded                 // The limiter itself is saturated and cannot account for the request
+)
+
+// result holds the outcome of checking a request against the rate limiter.
+type result struct {
+	decision   decision  // The decision made for the request
+	limit      uint16    // The limit applied to the request
+	count      uint16    // The client's count once the request was accounted for
+	cost       uint16    // The number of units charged to the storage for the request
+	resetAt    time.Time // The time at which the client's count resets (zero if unknown)
+	violations uint16    // The client's violation count, if violations are tracked and the request was limited
+	err        error     // The storage error encountered while checking the request, if any
+}
+
 // rateEntry represents an entry in the rate limiting queue.
 type rateEntry struct {
-	userID      string    // The user ID or identifier
-	releaseTime time.Time // The time when the rate limiting entry should be released
+	userID      string            // The user ID or identifier
+	releaseTime time.Time         // The time when the rate limiting entry should be released
+	weight      uint16            // The number of units to release
+	metadata    map[string]string // Optional metadata attached to the entry (bounded)
 }
 
 // defaultIdSelector is the default implementation of the IDSelector function.
-// It selects the client IP address as the identifier.
+// It selects the client IP address as the identifier, normalized using NormalizeIP
+// so IPv4-mapped IPv6 and plain IPv4 forms of the same client share a key.
 func defaultIdSelector(ctx *gin.Context) string {
-	return ctx.ClientIP()
+	return NormalizeIP(ctx.ClientIP())
+}
+
+// neverSkip is the default Skip predicate, it never exempts a request from limiting.
+func neverSkip(*gin.Context) bool {
+	return false
 }
 
 // defaultHandler is the default handler function that is called when the rate limit is exceeded.
-// It aborts the request with a [429]"Too Many Requests" status code and an error message.
+// It aborts the request with a [429]"Too Many Requests" status code (or the one set using Config.StatusCode) and an error message,
+// localized according to the Accept-Language header if messages are set. The `Retry-After` header
+// tells the client after how many seconds it may retry.
+// If rejection details are enabled, the error is sent as a structured JSON body including them.
 func defaultHandler(ctx *gin.Context) {
-	ctx.AbortWithError(429, errors.New("too many requests"))
+	message := defaultRejectionMessage
+	if localized, ok := ctx.Value(RejectionMessageKey).(string); ok {
+		message = localized
+	}
+	err := errors.New(message)
+	status := rejectionStatus(ctx)
+	if retryAfter := RetryAfter(ctx); retryAfter > 0 {
+		ctx.Header("Retry-After", retryAfterSeconds(retryAfter))
+	}
+	if details, ok := ctx.Value(RejectionDetailsKey).(RejectionDetails); ok {
+		ctx.Error(err)
+		ctx.AbortWithStatusJSON(status, rejectionBody{Error: err.Error(), RejectionDetails: details})
+		return
+	}
+	ctx.AbortWithError(status, err)
+}
+
+// defaultOverloadHandler is the default handler function that is called when the limiter is saturated.
+// It aborts the request with a [503]"Service Unavailable" status code and an error message.
+func defaultOverloadHandler(ctx *gin.Context) {
+	ctx.AbortWithError(503, errors.New("service overloaded"))
+}
+
+// defaultInvalidIDHandler is the default handler function that is called when an IDSelectorE rejects a request.
+// It aborts the request with a [400]"Bad Request" status code and an error message.
+func defaultInvalidIDHandler(ctx *gin.Context) {
+	ctx.AbortWithError(400, errors.New("unidentifiable client"))
+}
+
+// defaultStorageErrorHandler is the default handler function that is called when the storage fails.
+// A storage timeout (see isTimeout) means the limiter cannot keep up, so the request is handed to the
+// overload handler ([503] by default). Other errors are attached to the request context, failing open.
+func (cfg *Config) defaultStorageErrorHandler(ctx *gin.Context, err error) {
+	if isTimeout(err) {
+		ctx.Error(err)
+		cfg.overloadHandler(ctx)
+		return
+	}
+	failOpen(ctx, err)
+}
+
+// failOpen attaches the given storage error to the request context and lets the request proceed.
+func failOpen(ctx *gin.Context, err error) {
+	ctx.Error(err)
+}
+
+// isTimeout reports whether the given storage error is a timeout: an expired deadline of the request context
+// (context.DeadlineExceeded), or an error reporting a timeout such as a network timeout of the Redis client.
+func isTimeout(err error) bool {
+	var timeout interface{ Timeout() bool }
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &timeout) && timeout.Timeout()
+}
+
+// retryAfter returns how long the client of a rejected request should wait before retrying: until the reset time
+// of the result if the storage or the algorithm reported one, the timeout otherwise.
+func (cfg *Config) retryAfter(res result) time.Duration {
+	if res.resetAt.IsZero() {
+		return cfg.timeout
+	}
+	return max(res.resetAt.Sub(cfg.clock()), 0)
 }
 
 // rlWorker is a worker goroutine that processes rate limiting entries in the queue.
-// It frees (decreases) the rate limiting entries when their release time is reached.
-func rlWorker(cfg *Config, workerID uint16) {
-	log := cfg.logger.
-		WithField("scope", "rate-limiter").
-		WithField("worker_id", workerID)
-	log.Infoln("starting")
-
-	for toFree := range cfg.queue {
-		duration := toFree.releaseTime.Sub(time.Now())
-		log := log.WithField("user_id", toFree.userID)
+// It frees (decreases) the rate limiting entries when their release time is reached,
+// until the middleware is shut down. Once the middleware is closed, entries are freed right away
+// and the worker exits as soon as the queue is empty. Workers started on demand are given their
+// first entry directly (pending), and exit once they have been idle for the workerIdleTimeout.
+func rlWorker(cfg *Config, workerID uint16, pending *rateEntry) {
+	defer cfg.workers.Done()
+	defer cfg.running.Add(-1)
+	log := cfg.logger.With("scope", "rate-limiter", "worker_id", workerID)
+	log.Debug("starting")
+
+	for {
+		var toFree rateEntry
+		idle, stopIdle := cfg.idleTimeout()
+		if pending != nil {
+			toFree, pending = *pending, nil
+		} else {
+			select {
+			case toFree = <-cfg.queue:
+			case <-idle:
+				log.Debug("idle, stopping")
+				return
+			case <-cfg.draining:
+				select {
+				case <-cfg.stop:
+					log.Debug("stopping")
+					return
+				case toFree = <-cfg.queue:
+				default:
+					log.Debug("drained")
+					return
+				}
+			case <-cfg.stop:
+				log.Debug("stopping")
+				return
+			}
+		}
+		stopIdle()
+		duration := toFree.releaseTime.Sub(cfg.clock())
 		if duration >= cfg.tolerance {
-			log.WithField("timeout", duration).Debugln("waiting for timeout")
-			time.Sleep(duration)
+			log.Debug("waiting for timeout", "user_id", toFree.userID, "timeout", duration)
+			if !cfg.sleep(toFree.releaseTime) {
+				log.Debug("stopping")
+				return
+			}
 		}
-		cfg.storage.Decrease(toFree.userID)
+		release(cfg, log, toFree)
 	}
 }
 
+// runDecisionHook runs the given decision hook (if set), recovering and logging a panic
+// inside the hook so it never crashes the request.
+func (cfg *Config) runDecisionHook(name string, hook DecisionHook, ctx *gin.Context, id string, current uint16) {
+	if hook == nil {
+		return
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			cfg.logger.Error(fmt.Sprintf("recovered from a panic in the %s hook: %v", name, recovered), "user_id", id)
+		}
+	}()
+	hook(ctx, id, current)
+}
+
+// release frees the units of the given entry and runs the release hook.
+func release(cfg *Config, log rllog.Logger, toFree rateEntry) {
+	for i := uint16(0); i < toFree.weight; i++ {
+		if err := cfg.storage.Decrease(toFree.userID); err != nil {
+			log.Warn("failed to release entry", "user_id", toFree.userID, "error", err)
+			break
+		}
+	}
+	if cfg.staggerer != nil {
+		cfg.staggerer.released(toFree.userID, toFree.releaseTime)
+	}
+	if cfg.onRelease != nil {
+		cfg.onRelease(toFree.userID, toFree.metadata)
+	}
+}
+
+// sleep waits until the given time of the clock, returning false if the middleware was shut down in the meantime.
+// It returns early (true) if the middleware is being closed, so the entry is released right away.
+func (cfg *Config) sleep(until time.Time) bool {
+	fired, stop := cfg.startTimer(until)
+	defer stop()
+	select {
+	case <-fired:
+		return true
+	case <-cfg.draining:
+		select {
+		case <-cfg.stop:
+			return false
+		default:
+			return true
+		}
+	case <-cfg.stop:
+		return false
+	}
+}
+
+// timerFunc starts a timer firing at the given time of the clock, returning its channel and its stop function.
+type timerFunc func(until time.Time) (<-chan time.Time, func() bool)
+
+// startTimer starts a timer firing at the given time of the clock, returning its channel and its stop function.
+func (cfg *Config) startTimer(until time.Time) (<-chan time.Time, func() bool) {
+	if cfg.timer != nil {
+		return cfg.timer(until)
+	}
+	timer := time.NewTimer(until.Sub(cfg.clock()))
+	return timer.C, timer.Stop
+}
+
+// boundMetadata copies the given metadata while keeping at most maxMetadataEntries
+// entries and truncating values longer than maxMetadataValueLength bytes.
+func boundMetadata(metadata map[string]string) map[string]string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	bounded := make(map[string]string, min(len(metadata), maxMetadataEntries))
+	for key, value := range metadata {
+		if len(bounded) == maxMetadataEntries {
+			break
+		}
+		if len(value) > maxMetadataValueLength {
+			value = value[:maxMetadataValueLength]
+		}
+		bounded[key] = value
+	}
+	return bounded
+}
+
 // RateLimitWith creates a new rate limiting middleware handler based on the provided configuration.
 func RateLimitWith(cfg *Config) gin.HandlerFunc {
-	cfg.logger.Infof("booting up RateLimiter with %d requests per user per %s, with %d worker goroutines", cfg.limit, cfg.timeout, cfg.workerCount)
+	cfg.logger.Info(fmt.Sprintf("booting up RateLimiter with %d requests per user per %s, with %d worker goroutines", cfg.effectiveLimit(), cfg.timeout, cfg.workerCount))
 
-	// Start the worker goroutines
-	for i := cfg.workerCount; i > 0; i-- {
-		go rlWorker(cfg, i)
+	// Start the worker goroutines, unless they are started on demand
+	if !cfg.lazyWorkers {
+		cfg.workers.Add(int(cfg.workerCount))
+		cfg.running.Add(int32(cfg.workerCount))
+		for i := cfg.workerCount; i > 0; i-- {
+			go rlWorker(cfg, i, nil)
+		}
 	}
 
 	return func(ctx *gin.Context) {
-		id := cfg.idSelector(ctx)
-		blocked := isBlocked(cfg, id)
-		if blocked {
+		if cfg.skip(ctx) || cfg.closed() {
+			ctx.Next()
+			return
+		}
+		// Access lists are checked before anything else is built for the request, so allowlisted
+		// traffic (often the bulk of it) passes through without allocating or touching the storage
+		if len(cfg.allowlist) > 0 || len(cfg.denylist) > 0 {
+			ip, valid := clientIP(ctx)
+			if valid && containsIP(cfg.denylist, ip) {
+				cfg.observeBlocked(ctx, reasonDenied)
+				cfg.deniedHandler(ctx)
+				return
+			}
+			if valid && containsIP(cfg.allowlist, ip) {
+				ctx.Next()
+				return
+			}
+		}
+		if cfg.isAuthenticated != nil && cfg.isAuthenticated(ctx) {
+			ctx.Next()
+			return
+		}
+		priority := cfg.requestPriority(ctx)
+		if priority == PriorityBypass {
+			ctx.Next()
+			return
+		}
+		var sw *stopwatch
+		if cfg.selfProfiling {
+			sw = startStopwatch()
+			defer func() { cfg.observeDuration(sw) }()
+		}
+
+		id, err := cfg.selectID(ctx)
+		if err != nil {
+			ctx.Error(err)
+			cfg.observeBlocked(ctx, reasonInvalidID)
+			sw.pause()
+			cfg.invalidIDHandler(ctx)
+			return
+		}
+		route, routed := cfg.matchRoute(ctx)
+		if routed {
+			id += keySeparator + route.pattern
+		}
+		if cfg.separateReadWrite {
+			id += keySeparator + methodClass(ctx.Request.Method)
+		}
+		if cfg.perMethod {
+			id += keySeparator + cfg.requestMethod(ctx)
+		}
+		var metadata map[string]string
+		if cfg.metadataSelector != nil {
+			metadata = boundMetadata(cfg.metadataSelector(ctx))
+		}
+		cost := uint16(1)
+		if cfg.cost != nil {
+			cost = cfg.cost(ctx)
+		}
+		var requestKey dedupKey
+		deduplicate, repeat := false, false
+		if cfg.deduper != nil {
+			if requestKey, deduplicate = cfg.deduper.key(ctx, id); deduplicate && cfg.deduper.seen(requestKey, cfg.clock()) {
+				repeat = true // A repetition of a request counted within the dedup window
+				deduplicate = false
+			}
+		}
+		if cfg.limitResolver != nil {
+			ctx.Set(IDKey, id)
+		}
+		checkCtx, span := cfg.startCheckSpan(ctx.Request.Context(), id)
+		limit := cfg.resolveLimit(ctx, route, routed, priority)
+		var res result
+		var reported []dimensionResult
+		if repeat {
+			res, reported = cfg.checkRequest(checkCtx, ctx, id, limit, 0, metadata)
+		}
+		// Repetitions are only free while the client is under its limit, so retrying cannot get past it
+		if !repeat || res.decision == allowed && res.err == nil && res.remaining() == 0 {
+			res, reported = cfg.checkRequest(checkCtx, ctx, id, limit, cost, metadata)
+		}
+		endCheckSpan(span, res)
+		if res.err != nil {
+			cfg.logger.Warn("storage failure while checking request", "user_id", id, "error", res.err)
+			sw.pause()
+			cfg.storageErrorHandler(ctx, res.err)
+			if ctx.IsAborted() {
+				cfg.observeBlocked(ctx, reasonStorageError)
+				return
+			}
+			sw.resume()
+		}
+		trailers := cfg.headers && cfg.trailers && res.decision == allowed
+		policy := cfg.policyName(route, routed)
+		switch {
+		case trailers:
+			cfg.declareTrailers(ctx, policy, reported != nil)
+		case cfg.headers:
+			cfg.writeHeaders(ctx, res, policy)
+			if reported != nil {
+				cfg.writeDimensionHeaders(ctx, reported)
+			}
+		}
+		if cfg.auditor != nil || cfg.webhook != nil {
+			event := AuditEvent{
+				Time:    cfg.clock(),
+				Key:     id,
+				Outcome: res.decision.String(),
+				Count:   res.count,
+				Limit:   res.limit,
+			}
+			if cfg.auditor != nil {
+				cfg.auditor.record(event)
+			}
+			if cfg.webhook != nil {
+				cfg.webhook.record(event)
+			}
+		}
+		switch res.decision {
+		case limited:
+			cfg.observeBlocked(ctx, reasonLimited)
+			if cfg.rejectionLogger != nil {
+				cfg.rejectionLogger.record(id, res.limit)
+			}
+			if cfg.forensics != nil {
+				cfg.forensics.record(cfg, ctx, id, res.violations)
+			}
+			ctx.Set(RetryAfterKey, cfg.retryAfter(res))
+			ctx.Set(statusCodeKey, cfg.statusCode)
+			if cfg.messages != nil {
+				ctx.Set(RejectionMessageKey, cfg.rejectionMessage(ctx))
+			}
+			if cfg.rejectionScope != "" {
+				ctx.Set(RejectionDetailsKey, RejectionDetails{
+					Limit:         res.limit,
+					WindowSeconds: cfg.timeout.Seconds(),
+					Scope:         cfg.rejectionScope,
+				})
+			}
+			sw.pause()
+			cfg.runDecisionHook("OnBlocked", cfg.onBlocked, ctx, id, res.count)
 			cfg.handler(ctx)
 			return
+		case overloaded:
+			cfg.observeBlocked(ctx, reasonOverloaded)
+			sw.pause()
+			cfg.runDecisionHook("OnBlocked", cfg.onBlocked, ctx, id, res.count)
+			cfg.overloadHandler(ctx)
+			return
+		}
+		if deduplicate && res.cost > 0 {
+			cfg.deduper.remember(requestKey, cfg.clock())
 		}
+		cfg.observeAllowed(ctx)
+		sw.pause()
+		cfg.runDecisionHook("OnAllowed", cfg.onAllowed, ctx, id, res.count)
 		ctx.Next()
+		if trailers {
+			cfg.writeHeaders(ctx, res, policy)
+			if reported != nil {
+				cfg.writeDimensionHeaders(ctx, reported)
+			}
+		}
+		if cfg.statusWeight != nil && res.cost > 0 {
+			sw.resume()
+			settle(cfg, id, res.cost, ctx.Writer.Status(), metadata)
+			sw.pause()
+		}
 	}
 }
 
-// isBlocked checks if the current request should be blocked based on the rate limiting configuration.
-// It returns true if the request should be blocked, and false otherwise.
-func isBlocked(cfg *Config, id string) bool {
-	currentState := cfg.storage.Get(id)
-	if currentState >= cfg.limit {
-		return true
+// check checks if the current request should be blocked based on the rate limiting configuration.
+// Its decision is limited if the client is over the given limit (or the limit is 0), overloaded if the request could not be
+// queued for release in time (its increment is rolled back), and allowed otherwise.
+//
+// Storages implementing rlstorage.CheckAndIncrementer (or rlstorage.WeightedCheckAndIncrementer for
+// requests costing more than one unit) are checked and incremented in a single atomic operation,
+// otherwise the count is read before being increased while holding a per-id lock, so concurrent requests
+// of the same client cannot all pass the check before any of them is counted. The lock only covers this
+// process; storages shared across instances should implement both interfaces.
+//
+// If the storage fails, the error is set on the result and the request is allowed without being charged.
+// Storage reads and increases are bound to ctx, so a cancelled request does not wait on a slow storage.
+func check(ctx context.Context, cfg *Config, id string, limit, cost uint16, metadata map[string]string) result {
+	res, stored, release := charge(ctx, cfg, id, limit, cost)
+	if release {
+		res = cfg.queueRelease(id, res, stored, metadata)
+	}
+	return res
+}
+
+// checkRequest checks the request against the limit of the given ID and, if any, the configured dimensions.
+// The dimension results are only returned if dimensions are configured (see checkDimensions).
+func (cfg *Config) checkRequest(checkCtx context.Context, ctx *gin.Context, id string, limit, cost uint16, metadata map[string]string) (result, []dimensionResult) {
+	if len(cfg.dimensions) > 0 {
+		return cfg.checkDimensions(checkCtx, ctx, id, limit, cost, metadata)
+	}
+	return check(checkCtx, cfg, id, limit, cost, metadata), nil
+}
+
+// charge works like check, but leaves queueing the release of the charged units to the caller: release
+// reports whether res.cost units were added to the count of the ID (stored once charged, as read from the
+// storage) and must be queued for release (see queueRelease) or rolled back (see rollback). It is false if
+// nothing was charged, or the units are released by other means (by settle or by the algorithm itself).
+func charge(ctx context.Context, cfg *Config, id string, limit, cost uint16) (res result, stored uint16, release bool) {
+	res = result{limit: limit}
+	if limit == 0 {
+		// The request is banned, there is no need to look at the storage
+		return reject(cfg, id, res), 0, false
+	}
+	threshold := cfg.threshold(limit)
+	// Requests that are not sampled are checked against the storage but never written to it
+	sampled := cfg.samplingRate <= 1 || rand.IntN(int(cfg.samplingRate)) == 0
+
+	if storage, ok := cfg.tokenBucket(); ok {
+		return checkTokenBucket(cfg, storage, id, cost, res), 0, false
+	}
+	if storage, ok := cfg.slidingWindow(); ok {
+		return checkSlidingWindow(cfg, storage, id, threshold, cost, res), 0, false
+	}
+	if storage, ok := cfg.gcra(); ok {
+		return checkGCRA(cfg, storage, id, limit, cost, res), 0, false
+	}
+
+	var count uint16
+	if ok, allowed, atomicCount, resetAt, err := cfg.checkAndIncrement(ctx, id, threshold, cost, sampled); ok {
+		count, res.resetAt, res.err = atomicCount, resetAt, err
+		if res.err != nil {
+			return res, 0, false
+		}
+		res.count = cfg.estimateCount(count)
+		if !allowed {
+			return reject(cfg, id, res), 0, false
+		}
+	} else {
+		var over bool
+		count, cost, over, res.err = cfg.readAndIncrease(ctx, id, threshold, cost, sampled)
+		res.count = cfg.estimateCount(count)
+		switch {
+		case over:
+			return reject(cfg, id, res), 0, false
+		case !sampled, res.err != nil && cost == 0:
+			return res, 0, false
+		}
+		count += cost
+		res.count = cfg.estimateCount(count)
+	}
+	res.cost = cost
+
+	// With a StatusWeight, the release is queued by settle once the response status is known.
+	// A null storage never holds the units, so there is nothing to release (nor to wait for a worker for)
+	return res, count, cost > 0 && cfg.statusWeight == nil && !rlstorage.IsNullStorage(cfg.storage)
+}
+
+// queueRelease queues the release of the units charged for the given result (see charge). If they cannot
+// be queued in time, they are rolled back and the decision becomes overloaded, unless the middleware was
+// closed in the meantime, in which case the request passes through (see Close).
+func (cfg *Config) queueRelease(id string, res result, stored uint16, metadata map[string]string) result {
+	if !cfg.addToReleaseQueue(id, res.cost, metadata) {
+		res = cfg.rollback(id, res, stored)
+		if !cfg.closed() {
+			res.decision = overloaded
+		}
+	}
+	return res
+}
+
+// rollback decreases the count of the given ID by the units charged for the given result (see charge),
+// returning the result with nothing charged.
+func (cfg *Config) rollback(id string, res result, stored uint16) result {
+	cfg.decrease(id, res.cost)
+	res.count = cfg.estimateCount(stored - res.cost)
+	res.cost = 0
+	return res
+}
+
+// checkAndIncrement checks and increments the count of the given ID by cost in a single atomic operation of
+// the storage, if it supports one for the given cost. ok is false if it does not (or the request is not sampled),
+// in which case the count must be read and increased under the lock of the ID instead.
+func (cfg *Config) checkAndIncrement(ctx context.Context, id string, threshold, cost uint16, sampled bool) (ok, allowed bool, count uint16, resetAt time.Time, err error) {
+	if !sampled {
+		return false, false, 0, time.Time{}, nil
+	}
+	if weighted, isWeighted := rlstorage.As[rlstorage.WeightedCheckAndIncrementer](cfg.storage); isWeighted && cost > 1 {
+		allowed, count, resetAt, err = rlstorage.CheckAndIncrementByContext(ctx, weighted, id, threshold, cost)
+		return true, allowed, count, resetAt, err
+	}
+	if atomic, isAtomic := rlstorage.As[rlstorage.CheckAndIncrementer](cfg.storage); isAtomic && cost == 1 {
+		allowed, count, resetAt, err = rlstorage.CheckAndIncrementContext(ctx, atomic, id, threshold)
+		return true, allowed, count, resetAt, err
+	}
+	return false, false, 0, time.Time{}, nil
+}
+
+// readAndIncrease reads the count of the given ID and, unless the request is over the threshold or
+// is not sampled, increases it by cost, all while holding the lock of the ID. It returns the count read,
+// the number of units increased (fewer than cost if the storage failed) and whether the request is over the threshold.
+func (cfg *Config) readAndIncrease(ctx context.Context, id string, threshold, cost uint16, sampled bool) (count, increased uint16, over bool, err error) {
+	unlock := cfg.checkLocks.lock(id)
+	defer unlock()
+	if count, err = rlstorage.GetContext(ctx, cfg.storage, id); err != nil {
+		return 0, 0, false, err
+	}
+	if uint32(count)+uint32(cost) > uint32(threshold) {
+		return count, 0, true, nil
+	}
+	if !sampled {
+		return count, 0, false, nil
+	}
+	// Only the units increased are queued for release, should the storage fail midway
+	increased, err = rlstorage.IncreaseByContext(ctx, cfg.storage, id, cost)
+	return count, increased, false, err
+}
+
+// reject marks the given result as limited, recording a violation for the client if violations are tracked.
+func reject(cfg *Config, id string, res result) result {
+	if cfg.tracksViolations() {
+		res.violations, res.err = cfg.addViolation(id)
+	}
+	res.decision = limited
+	return res
+}
+
+// threshold returns the storage count above which requests are rejected for the given limit.
+// Requests are only rejected once the grace band above the limit is exhausted.
+func (cfg *Config) threshold(limit uint16) uint16 {
+	return cfg.sampledLimit(uint16(min(uint32(limit)+uint32(cfg.rejectGrace), math.MaxUint16)))
+}
+
+// sampledLimit returns the threshold the sampled storage count is compared against,
+// which is the limit divided by the sampling rate (at least 1).
+func (cfg *Config) sampledLimit(limit uint16) uint16 {
+	if cfg.samplingRate <= 1 {
+		return limit
+	}
+	return max(limit/cfg.samplingRate, 1)
+}
+
+// estimateCount scales a sampled storage count back up to an estimate of the real request count.
+func (cfg *Config) estimateCount(count uint16) uint16 {
+	if cfg.samplingRate <= 1 {
+		return count
+	}
+	return uint16(min(uint32(count)*uint32(cfg.samplingRate), math.MaxUint16))
+}
+
+// addViolation records a violation for the given ID in the violation keyspace of the storage
+// and returns its violation count. Validate ensures the storage tracks violations if they are needed.
+func (cfg *Config) addViolation(id string) (uint16, error) {
+	tracker, _ := rlstorage.As[rlstorage.ViolationTracker](cfg.storage)
+	return tracker.AddViolation(id)
+}
+
+// violations returns the violation count of the given ID.
+func (cfg *Config) violations(id string) (uint16, error) {
+	tracker, _ := rlstorage.As[rlstorage.ViolationTracker](cfg.storage)
+	return tracker.Violations(id)
+}
+
+// hasViolationTracker reports whether the storage keeps violations in a keyspace of their own.
+func (cfg *Config) hasViolationTracker() bool {
+	_, ok := rlstorage.As[rlstorage.ViolationTracker](cfg.storage)
+	return ok
+}
+
+// settle adjusts the units charged by check to the weight of the response status
+// and queues the release of the charged units.
+func settle(cfg *Config, id string, charged uint16, status int, metadata map[string]string) {
+	weight := cfg.statusWeight(status)
+	if charged > weight {
+		cfg.decrease(id, charged-weight)
+	}
+	for ; charged < weight; charged++ {
+		if err := cfg.storage.Increase(id); err != nil {
+			cfg.logger.Warn("failed to settle request weight", "user_id", id, "error", err)
+			break
+		}
+	}
+	weight = min(weight, charged)
+	if weight == 0 || rlstorage.IsNullStorage(cfg.storage) {
+		return
+	}
+	if !cfg.addToReleaseQueue(id, weight, metadata) {
+		// The response is already written, so roll back the charge instead of leaking it
+		cfg.decrease(id, weight)
+	}
+}
+
+// decrease decreases the count of the given ID by the given number of units, logging storage failures.
+func (cfg *Config) decrease(id string, units uint16) {
+	for i := uint16(0); i < units; i++ {
+		if err := cfg.storage.Decrease(id); err != nil {
+			cfg.logger.Warn("failed to roll back request", "user_id", id, "error", err)
+			return
+		}
 	}
-	cfg.storage.Increase(id)
-	cfg.addToReleaseQueue(id)
-	return false
 }
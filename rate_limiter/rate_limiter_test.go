@@ -0,0 +1,703 @@
+package ratelimiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	rllog "github.com/FMotalleb/gin_testfield/rate_limiter/logging"
+	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// discardLogger returns a logger dropping every entry, keeping the test output readable.
+func discardLogger() Logger {
+	return rllog.NewSlog(slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// newTestConfig returns a builder with the defaults of NewConfigBuilder, a discarding logger
+// and the full cleanup rotation disabled.
+func newTestConfig() *Config {
+	return NewConfigBuilder().Logger(discardLogger()).DisableFullCleanup()
+}
+
+// build builds the given configuration, failing the test on error, and shuts the middleware down
+// once the test ends.
+func build(t testing.TB, cfg *Config) gin.HandlerFunc {
+	t.Helper()
+	handler, err := cfg.Build()
+	if err != nil {
+		t.Fatalf("Build() failed: %v", err)
+	}
+	t.Cleanup(cfg.Shutdown)
+	return handler
+}
+
+// newRouter builds the given configuration and returns a router serving every method on "/"
+// (and the given extra routes) behind the middleware, answering 200 "ok".
+func newRouter(t testing.TB, cfg *Config, routes ...string) *gin.Engine {
+	t.Helper()
+	router := gin.New()
+	router.Use(build(t, cfg))
+	ok := func(ctx *gin.Context) { ctx.String(http.StatusOK, "ok") }
+	for _, route := range append([]string{"/"}, routes...) {
+		router.Any(route, ok)
+	}
+	return router
+}
+
+// testContext returns a gin context for the given request, with a recorder as its writer.
+func testContext(req *http.Request) *gin.Context {
+	ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ctx.Request = req
+	return ctx
+}
+
+// serve sends a request with the given method and target to handler, after applying the given
+// modifiers to it, and returns the recorded response.
+func serve(handler http.Handler, method, target string, modifiers ...func(*http.Request)) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for _, modify := range modifiers {
+		modify(req)
+	}
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// fromIP sets the remote address of a request to the given IP.
+func fromIP(ip string) func(*http.Request) {
+	return func(req *http.Request) { req.RemoteAddr = ip + ":1234" }
+}
+
+// withHeader sets a header of a request.
+func withHeader(name, value string) func(*http.Request) {
+	return func(req *http.Request) { req.Header.Set(name, value) }
+}
+
+// logEntry is an entry recorded by a recordingLogger.
+type logEntry struct {
+	msg  string
+	args []any
+}
+
+// attr returns the value of the given key within the entry's key-value pairs.
+func (entry logEntry) attr(key string) any {
+	for i := 0; i+1 < len(entry.args); i += 2 {
+		if entry.args[i] == key {
+			return entry.args[i+1]
+		}
+	}
+	return nil
+}
+
+// recordingLogger is a Logger recording its entries by level, safe for concurrent use.
+type recordingLogger struct {
+	lock     *sync.Mutex
+	debugs   *[]logEntry
+	infos    *[]logEntry
+	warnings *[]logEntry
+	errors   *[]logEntry
+}
+
+// newRecordingLogger returns an empty recording logger.
+func newRecordingLogger() recordingLogger {
+	return recordingLogger{lock: new(sync.Mutex), debugs: new([]logEntry), infos: new([]logEntry), warnings: new([]logEntry), errors: new([]logEntry)}
+}
+
+func (l recordingLogger) With(...any) Logger { return l }
+
+func (l recordingLogger) Debug(msg string, args ...any) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	*l.debugs = append(*l.debugs, logEntry{msg: msg, args: args})
+}
+
+func (l recordingLogger) Info(msg string, args ...any) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	*l.infos = append(*l.infos, logEntry{msg: msg, args: args})
+}
+
+func (l recordingLogger) Warn(msg string, args ...any) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	*l.warnings = append(*l.warnings, logEntry{msg: msg, args: args})
+}
+
+func (l recordingLogger) Error(msg string, args ...any) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	*l.errors = append(*l.errors, logEntry{msg: msg, args: args})
+}
+
+// debugsWith returns the logged debug entries containing the given text.
+func (l recordingLogger) debugsWith(text string) []logEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return entriesWith(*l.debugs, text)
+}
+
+// infosWith returns the logged infos containing the given text.
+func (l recordingLogger) infosWith(text string) []logEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return entriesWith(*l.infos, text)
+}
+
+// warned reports whether a warning containing the given text was logged.
+func (l recordingLogger) warned(text string) bool {
+	return len(l.warningsWith(text)) > 0
+}
+
+// warningsWith returns the logged warnings containing the given text.
+func (l recordingLogger) warningsWith(text string) []logEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return entriesWith(*l.warnings, text)
+}
+
+// errorsWith returns the logged errors containing the given text.
+func (l recordingLogger) errorsWith(text string) []logEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return entriesWith(*l.errors, text)
+}
+
+// entriesWith returns the entries whose message contains the given text.
+func entriesWith(entries []logEntry, text string) []logEntry {
+	var found []logEntry
+	for _, entry := range entries {
+		if strings.Contains(entry.msg, text) {
+			found = append(found, entry)
+		}
+	}
+	return found
+}
+
+// countingStorage wraps a storage, counting the calls of its methods. It only exposes the RLStorage
+// methods, so the middleware falls back to separate reads and writes.
+type countingStorage struct {
+	rlstorage.RLStorage
+	gets, increases, decreases atomic.Int64
+}
+
+// newCountingStorage returns a counting storage wrapping an in-memory HashMap storage.
+func newCountingStorage() *countingStorage {
+	return &countingStorage{RLStorage: rlstorage.NewHashMapStorage(discardLogger())}
+}
+
+func (s *countingStorage) Get(id string) (uint16, error) {
+	s.gets.Add(1)
+	return s.RLStorage.Get(id)
+}
+
+func (s *countingStorage) Increase(id string) error {
+	s.increases.Add(1)
+	return s.RLStorage.Increase(id)
+}
+
+func (s *countingStorage) Decrease(id string) error {
+	s.decreases.Add(1)
+	return s.RLStorage.Decrease(id)
+}
+
+// calls returns the total number of Get, Increase and Decrease calls.
+func (s *countingStorage) calls() int64 {
+	return s.gets.Load() + s.increases.Load() + s.decreases.Load()
+}
+
+// fakeClock is a manually advanced clock, safe for concurrent use.
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]struct{}
+}
+
+// fakeTimer is a timer of a fakeClock, firing once the clock reaches its deadline.
+type fakeTimer struct {
+	deadline time.Time
+	fired    chan time.Time
+}
+
+// newFakeClock returns a fake clock starting at the given time.
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+// Now returns the current time of the clock.
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	c.fire()
+}
+
+// Set moves the clock to the given time.
+func (c *fakeClock) Set(now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = now
+	c.fire()
+}
+
+// Timer starts a timer firing once the clock reaches the given deadline, returning its channel and stop function.
+// It follows the signature of Config.timer, so the workers of a config release their entries as the clock advances.
+func (c *fakeClock) Timer(deadline time.Time) (<-chan time.Time, func() bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	timer := &fakeTimer{deadline: deadline, fired: make(chan time.Time, 1)}
+	if c.timers == nil {
+		c.timers = make(map[*fakeTimer]struct{})
+	}
+	c.timers[timer] = struct{}{}
+	c.fire()
+	stop := func() bool {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		_, pending := c.timers[timer]
+		delete(c.timers, timer)
+		return pending
+	}
+	return timer.fired, stop
+}
+
+// fire fires the timers whose deadline has been reached. The lock must be held.
+func (c *fakeClock) fire() {
+	for timer := range c.timers {
+		if !c.now.Before(timer.deadline) {
+			timer.fired <- c.now
+			delete(c.timers, timer)
+		}
+	}
+}
+
+// waitForTimers waits until n timers of the clock are pending, e.g. once the workers wait for it.
+func (c *fakeClock) waitForTimers(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.lock.Lock()
+		pending := len(c.timers)
+		c.lock.Unlock()
+		if pending >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d timers pending, want %d", pending, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// drive makes the given config read the time from the clock and release its entries as the clock advances.
+func (c *fakeClock) drive(cfg *Config) *Config {
+	cfg.timer = c.Timer
+	return cfg.Clock(c.Now)
+}
+
+// errStorageDown is the error returned by a failingStorage.
+var errStorageDown = errors.New("storage down")
+
+// failingStorage is a storage whose reads and writes fail with errStorageDown.
+type failingStorage struct {
+	rlstorage.RLStorage
+}
+
+func (failingStorage) Get(string) (uint16, error) { return 0, errStorageDown }
+func (failingStorage) Increase(string) error      { return errStorageDown }
+func (failingStorage) Decrease(string) error      { return errStorageDown }
+
+// expectStatus fails the test if the status of the given response is not want.
+func expectStatus(t testing.TB, recorder *httptest.ResponseRecorder, want int) {
+	t.Helper()
+	if recorder.Code != want {
+		t.Fatalf("status = %d, want %d (body %q)", recorder.Code, want, recorder.Body.String())
+	}
+}
+
+func TestDefaultSelectorCollapsesMappedIPv4(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(1))
+
+	expectStatus(t, serve(router, http.MethodGet, "/", func(req *http.Request) { req.RemoteAddr = "[::ffff:1.2.3.4]:5678" }), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/", fromIP("1.2.3.4")), http.StatusTooManyRequests)
+}
+
+func TestOverLimitIsRejectedWith429(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(2))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+}
+
+func TestSaturatedReleaseQueueIsRejectedWith503(t *testing.T) {
+	// The only worker holds the first entry for the whole timeout, so the unbuffered queue cannot take another one
+	cfg := newTestConfig().Limit(10).WorkerCount(1).QueueTimeout(10 * time.Millisecond)
+	router := newRouter(t, cfg)
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusServiceUnavailable)
+	if remaining, err := cfg.Remaining("192.0.2.1"); err != nil || remaining != 9 {
+		t.Fatalf("Remaining() = %d, %v, want the overloaded request rolled back (9)", remaining, err)
+	}
+}
+
+func TestOverloadAndLimitHandlersAreDistinct(t *testing.T) {
+	var limitedCalls, overloadedCalls int
+	cfg := newTestConfig().
+		Limit(1).
+		WorkerCount(1).
+		QueueTimeout(10 * time.Millisecond).
+		Handler(func(ctx *gin.Context) { limitedCalls++; ctx.AbortWithStatus(http.StatusTooManyRequests) }).
+		OverloadHandler(func(ctx *gin.Context) { overloadedCalls++; ctx.AbortWithStatus(http.StatusServiceUnavailable) })
+	router := newRouter(t, cfg)
+
+	expectStatus(t, serve(router, http.MethodGet, "/", fromIP("10.0.0.1")), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/", fromIP("10.0.0.1")), http.StatusTooManyRequests)
+	expectStatus(t, serve(router, http.MethodGet, "/", fromIP("10.0.0.2")), http.StatusServiceUnavailable)
+	if limitedCalls != 1 || overloadedCalls != 1 {
+		t.Fatalf("limited handler called %d times, overload handler %d times, want 1 each", limitedCalls, overloadedCalls)
+	}
+}
+
+func TestMetadataSurvivesReleaseRoundTrip(t *testing.T) {
+	released := make(chan map[string]string, 1)
+	cfg := newTestConfig().
+		Timeout(20 * time.Millisecond).
+		Tolerance(time.Millisecond).
+		Metadata(func(ctx *gin.Context) map[string]string {
+			return map[string]string{"route": ctx.Request.URL.Path}
+		}).
+		OnRelease(func(id string, metadata map[string]string) { released <- metadata })
+	router := newRouter(t, cfg, "/orders")
+
+	expectStatus(t, serve(router, http.MethodGet, "/orders"), http.StatusOK)
+	select {
+	case metadata := <-released:
+		if metadata["route"] != "/orders" {
+			t.Fatalf("released metadata = %v, want route /orders", metadata)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the entry was not released")
+	}
+}
+
+func TestBoundMetadata(t *testing.T) {
+	if got := boundMetadata(nil); got != nil {
+		t.Fatalf("boundMetadata(nil) = %v, want nil", got)
+	}
+	metadata := make(map[string]string)
+	for i := 0; i < 2*maxMetadataEntries; i++ {
+		metadata[strconv.Itoa(i)] = strings.Repeat("x", 2*maxMetadataValueLength)
+	}
+	bounded := boundMetadata(metadata)
+	if len(bounded) != maxMetadataEntries {
+		t.Fatalf("bounded metadata has %d entries, want %d", len(bounded), maxMetadataEntries)
+	}
+	for key, value := range bounded {
+		if len(value) != maxMetadataValueLength {
+			t.Fatalf("value of %q has %d bytes, want %d", key, len(value), maxMetadataValueLength)
+		}
+	}
+	if len(metadata["0"]) != 2*maxMetadataValueLength {
+		t.Fatal("boundMetadata modified its input")
+	}
+}
+
+func TestStatusWeightAdjustsCount(t *testing.T) {
+	cfg := newTestConfig().Limit(4).StatusWeight(func(status int) uint16 {
+		switch {
+		case status == http.StatusNotModified:
+			return 0
+		case status >= 500:
+			return 2
+		}
+		return 1
+	})
+	router := gin.New()
+	router.Use(build(t, cfg))
+	router.GET("/cached", func(ctx *gin.Context) { ctx.Status(http.StatusNotModified) })
+	router.GET("/fail", func(ctx *gin.Context) { ctx.Status(http.StatusBadGateway) })
+	router.GET("/ok", func(ctx *gin.Context) { ctx.Status(http.StatusOK) })
+
+	for i := 0; i < 10; i++ {
+		expectStatus(t, serve(router, http.MethodGet, "/cached"), http.StatusNotModified)
+	}
+	if remaining, _ := cfg.Remaining("192.0.2.1"); remaining != 4 {
+		t.Fatalf("remaining after 304 responses = %d, want 4 (refunded)", remaining)
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/fail"), http.StatusBadGateway)
+	if remaining, _ := cfg.Remaining("192.0.2.1"); remaining != 2 {
+		t.Fatalf("remaining after a 502 response = %d, want 2", remaining)
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/ok"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/ok"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/ok"), http.StatusTooManyRequests)
+}
+
+func TestSamplingRateReducesStorageWrites(t *testing.T) {
+	storage := newCountingStorage()
+	router := newRouter(t, newTestConfig().Limit(1000).WorkerCount(1000).SamplingRate(4).Storage(storage))
+
+	for i := 0; i < 400; i++ {
+		expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	}
+	// 1 in 4 requests is written, the binomial spread stays well within these bounds
+	if writes := storage.increases.Load(); writes < 50 || writes > 150 {
+		t.Fatalf("%d storage writes for 400 requests, want about 100", writes)
+	}
+}
+
+func TestSamplingRateLimitsApproximately(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(40).SamplingRate(4))
+
+	accepted := 0
+	for i := 0; i < 400; i++ {
+		if serve(router, http.MethodGet, "/").Code == http.StatusOK {
+			accepted++
+		}
+	}
+	// The sampled limit is 10 writes, reached after about 40 requests
+	if accepted < 15 || accepted > 100 {
+		t.Fatalf("%d of 400 requests accepted with a limit of 40, want about 40", accepted)
+	}
+}
+
+// atomicStorage wraps a counting storage, exposing the CheckAndIncrementer of the HashMap storage.
+type atomicStorage struct {
+	*countingStorage
+	checks atomic.Int64
+}
+
+func (s *atomicStorage) CheckAndIncrement(id string, limit uint16) (bool, uint16, time.Time, error) {
+	s.checks.Add(1)
+	return s.RLStorage.(rlstorage.CheckAndIncrementer).CheckAndIncrement(id, limit)
+}
+
+func TestCheckAndIncrementIsPreferred(t *testing.T) {
+	storage := &atomicStorage{countingStorage: newCountingStorage()}
+	router := newRouter(t, newTestConfig().Limit(2).Storage(storage))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+	if checks := storage.checks.Load(); checks != 3 {
+		t.Fatalf("%d atomic checks, want 3", checks)
+	}
+	if gets, increases := storage.gets.Load(), storage.increases.Load(); gets != 0 || increases != 0 {
+		t.Fatalf("%d reads and %d increases besides the atomic checks, want none", gets, increases)
+	}
+}
+
+func TestTreatHeadAsGetSharesCounter(t *testing.T) {
+	separate := newRouter(t, newTestConfig().Limit(1).PerMethod(true))
+	expectStatus(t, serve(separate, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(separate, http.MethodHead, "/"), http.StatusOK)
+
+	shared := newRouter(t, newTestConfig().Limit(1).PerMethod(true).TreatHeadAsGet(true))
+	expectStatus(t, serve(shared, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(shared, http.MethodHead, "/"), http.StatusTooManyRequests)
+	expectStatus(t, serve(shared, http.MethodPost, "/"), http.StatusOK)
+}
+
+func TestTreatHeadAsGetUsesGetMethodLimit(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(10).MethodLimit(http.MethodGet, 1).PerMethod(true).TreatHeadAsGet(true))
+
+	expectStatus(t, serve(router, http.MethodHead, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodHead, "/"), http.StatusTooManyRequests)
+}
+
+func TestMillisecondWindowIsEnforced(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := newFakeClock(start)
+	released := make(chan time.Time, 2)
+	cfg := clock.drive(newTestConfig().
+		Limit(2).
+		Timeout(50 * time.Millisecond).
+		Tolerance(0).
+		OnRelease(func(string, map[string]string) { released <- clock.Now() }))
+	router := newRouter(t, cfg)
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+
+	// One millisecond short of the window, the entries are still held
+	clock.Advance(49 * time.Millisecond)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+
+	clock.Advance(time.Millisecond)
+	for i := 0; i < 2; i++ {
+		select {
+		case at := <-released:
+			if want := start.Add(50 * time.Millisecond); !at.Equal(want) {
+				t.Fatalf("entry released at %s, want %s", at.Sub(start), want.Sub(start))
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the entries were not released")
+		}
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+}
+
+func TestSubMillisecondTimeoutIsValid(t *testing.T) {
+	if err := newTestConfig().Timeout(500 * time.Microsecond).Tolerance(0).Validate(); err != nil {
+		t.Fatalf("Validate() of a 500µs timeout failed: %v", err)
+	}
+}
+
+func TestStorageErrorFailsOpenWithAttachedError(t *testing.T) {
+	var attached []string
+	router := gin.New()
+	router.Use(build(t, newTestConfig().Limit(1).Storage(failingStorage{rlstorage.NewNullStorage()})))
+	router.GET("/", func(ctx *gin.Context) {
+		attached = ctx.Errors.Errors()
+		ctx.String(http.StatusOK, "ok")
+	})
+
+	for i := 0; i < 3; i++ {
+		expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	}
+	if len(attached) != 1 || !strings.Contains(attached[0], errStorageDown.Error()) {
+		t.Errorf("attached errors = %v, want the storage error", attached)
+	}
+}
+
+// timeoutStorage is a storage whose reads fail with the given error.
+type timeoutStorage struct {
+	rlstorage.RLStorage
+	err error
+}
+
+func (s timeoutStorage) Get(string) (uint16, error) { return 0, s.err }
+
+// netTimeoutError is an error reporting a timeout, like a network timeout of the Redis client.
+type netTimeoutError struct{}
+
+func (netTimeoutError) Error() string { return "i/o timeout" }
+func (netTimeoutError) Timeout() bool { return true }
+
+func TestStorageTimeoutIsRejectedWith503(t *testing.T) {
+	for name, err := range map[string]error{
+		"deadline exceeded": fmt.Errorf("failed to get value: %w", context.DeadlineExceeded),
+		"network timeout":   fmt.Errorf("failed to get value: %w", netTimeoutError{}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			storage := timeoutStorage{rlstorage.NewNullStorage(), err}
+			expectStatus(t, serve(newRouter(t, newTestConfig().Storage(storage)), http.MethodGet, "/"), http.StatusServiceUnavailable)
+
+			var overloaded int
+			cfg := newTestConfig().Storage(storage).OverloadHandler(func(ctx *gin.Context) {
+				overloaded++
+				ctx.AbortWithStatus(http.StatusTeapot)
+			})
+			expectStatus(t, serve(newRouter(t, cfg), http.MethodGet, "/"), http.StatusTeapot)
+			if overloaded != 1 {
+				t.Fatalf("overload handler called %d times, want once", overloaded)
+			}
+		})
+	}
+}
+
+func TestOnStorageErrorCanAbort(t *testing.T) {
+	var handled error
+	router := newRouter(t, newTestConfig().Storage(failingStorage{rlstorage.NewNullStorage()}).OnStorageError(func(ctx *gin.Context, err error) {
+		handled = err
+		ctx.AbortWithStatus(http.StatusServiceUnavailable)
+	}))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusServiceUnavailable)
+	if !errors.Is(handled, errStorageDown) {
+		t.Errorf("handled error = %v, want %v", handled, errStorageDown)
+	}
+}
+
+func TestCancelledRequestSkipsStorage(t *testing.T) {
+	storage := newCountingStorage()
+	var handled error
+	router := newRouter(t, newTestConfig().Storage(storage).OnStorageError(func(_ *gin.Context, err error) {
+		handled = err
+	}))
+	cancelled := func(req *http.Request) {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancel()
+		*req = *req.WithContext(ctx)
+	}
+
+	expectStatus(t, serve(router, http.MethodGet, "/", cancelled), http.StatusOK)
+	if !errors.Is(handled, context.Canceled) {
+		t.Errorf("storage error = %v, want %v", handled, context.Canceled)
+	}
+	if calls := storage.calls(); calls != 0 {
+		t.Errorf("storage called %d times for a cancelled request, want 0", calls)
+	}
+}
+
+func TestFailClosedRejectsOnStorageError(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	router := newRouter(t, newTestConfig().Storage(failingStorage{rlstorage.NewNullStorage()}).FailClosed(true).MetricsRegisterer(registry))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusServiceUnavailable)
+	metrics := blockedCounter(t, registry)
+	if len(metrics) != 1 || labelValues(metrics[0])["reason"] != reasonStorageError {
+		t.Errorf("blocked series = %v, want one storage error", metrics)
+	}
+}
+
+func TestFailClosedDisabledRestoresFailOpen(t *testing.T) {
+	router := newRouter(t, newTestConfig().Storage(failingStorage{rlstorage.NewNullStorage()}).FailClosed(true).FailClosed(false))
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+}
+
+// newMiniredis starts an in-memory Redis server for the duration of the test and returns it
+// with a client connected to it.
+func newMiniredis(t testing.TB) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return server, client
+}
+
+func TestFailClosedOnUnreachableRedis(t *testing.T) {
+	server, client := newMiniredis(t)
+	router := newRouter(t, newTestConfig().Storage(rlstorage.NewRedisStorage(client, time.Minute, discardLogger())).FailClosed(true))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	server.Close()
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusServiceUnavailable)
+}
+
+func TestFailClosedOnMatchingErrorsOnly(t *testing.T) {
+	errOther := errors.New("other")
+	router := newRouter(t, newTestConfig().Storage(failingStorage{rlstorage.NewNullStorage()}).OnStorageError(FailClosedOn(errOther)))
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+
+	router = newRouter(t, newTestConfig().Storage(failingStorage{rlstorage.NewNullStorage()}).OnStorageError(FailClosedOn(errOther, errStorageDown)))
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusServiceUnavailable)
+}
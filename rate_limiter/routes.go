@@ -0,0 +1,82 @@
+package ratelimiter
+
+import (
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// routeLimit is a limit override for the routes matching a pattern.
+type routeLimit struct {
+	pattern  string   // The pattern as registered, also used to scope the keys of the matching routes
+	segments []string // The path segments of the pattern
+	literals int      // The number of literal (non-wildcard) segments, used to rank matches by specificity
+	limit    uint16   // The limit applied to the matching routes
+}
+
+// newRouteLimit parses the given pattern into a routeLimit.
+func newRouteLimit(pattern string, limit uint16) routeLimit {
+	route := routeLimit{
+		pattern:  pattern,
+		segments: splitPath(pattern),
+		limit:    limit,
+	}
+	for _, segment := range route.segments {
+		if !isWildcard(segment) {
+			route.literals++
+		}
+	}
+	return route
+}
+
+// matches reports whether the given route path matches the pattern. A `:name` (or `*`) segment
+// matches any single segment, while a trailing `*name` segment matches one or more remaining segments.
+func (route routeLimit) matches(segments []string) bool {
+	for i, segment := range route.segments {
+		if i == len(route.segments)-1 && len(segment) > 1 && segment[0] == '*' {
+			return len(segments) > i // Catch-all
+		}
+		if i >= len(segments) || !isWildcard(segment) && segment != segments[i] {
+			return false
+		}
+	}
+	return len(segments) == len(route.segments)
+}
+
+// moreSpecific reports whether the route is more specific than the other one: it has more literal
+// segments, or as many literal segments and more segments overall.
+func (route routeLimit) moreSpecific(other routeLimit) bool {
+	if route.literals != other.literals {
+		return route.literals > other.literals
+	}
+	return len(route.segments) > len(other.segments)
+}
+
+// isWildcard reports whether the given pattern segment is a wildcard.
+func isWildcard(segment string) bool {
+	return strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*")
+}
+
+// splitPath splits a path into its non-empty segments.
+func splitPath(path string) []string {
+	return strings.FieldsFunc(path, func(r rune) bool { return r == '/' })
+}
+
+// matchRoute returns the most specific route limit matching the route of the request (its gin route
+// template, see gin.Context.FullPath). Requests that matched no gin route never match a route limit.
+// Among equally specific matches, the first registered wins.
+func (cfg *Config) matchRoute(ctx *gin.Context) (routeLimit, bool) {
+	fullPath := ctx.FullPath()
+	if len(cfg.routeLimits) == 0 || fullPath == "" {
+		return routeLimit{}, false
+	}
+	segments := splitPath(fullPath)
+	var best routeLimit
+	found := false
+	for _, route := range cfg.routeLimits {
+		if route.matches(segments) && (!found || route.moreSpecific(best)) {
+			best, found = route, true
+		}
+	}
+	return best, found
+}
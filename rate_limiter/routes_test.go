@@ -0,0 +1,59 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRouteLimitMatches(t *testing.T) {
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"/auth/login", "/auth/login", true},
+		{"/auth/login", "/auth/logout", false},
+		{"/users/:id", "/users/:id", true},
+		{"/users/*", "/users/:id", true},
+		{"/users/:id", "/users/:id/posts", false},
+		{"/public/*path", "/public/*filepath", true},
+		{"/public/*path", "/public/css/*filepath", true},
+		{"/public/*path", "/public", false},
+		{"/", "/", true},
+	}
+	for _, test := range tests {
+		if got := newRouteLimit(test.pattern, 1).matches(splitPath(test.path)); got != test.want {
+			t.Errorf("%q matches %q = %t, want %t", test.pattern, test.path, got, test.want)
+		}
+	}
+}
+
+func TestRouteLimitPrefersMostSpecificPattern(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(10).RouteLimit("/api/*rest", 3).RouteLimit("/api/login", 1),
+		"/api/login", "/api/items")
+
+	expectStatus(t, serve(router, http.MethodPost, "/api/login"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodPost, "/api/login"), http.StatusTooManyRequests)
+	for i := 0; i < 3; i++ {
+		expectStatus(t, serve(router, http.MethodGet, "/api/items"), http.StatusOK)
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/api/items"), http.StatusTooManyRequests)
+}
+
+func TestRouteLimitCountsRoutesSeparately(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(2).RouteLimit("/login", 1), "/login", "/home")
+
+	expectStatus(t, serve(router, http.MethodGet, "/login"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/login"), http.StatusTooManyRequests)
+	// Unmatched routes share the global limit, untouched by the login traffic
+	expectStatus(t, serve(router, http.MethodGet, "/home"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/home"), http.StatusTooManyRequests)
+	// Requests matching no gin route never match a route limit
+	expectStatus(t, serve(router, http.MethodGet, "/missing"), http.StatusTooManyRequests)
+}
+
+func TestRouteLimitValidation(t *testing.T) {
+	if err := newTestConfig().RouteLimit("/login", 0).Validate(); err == nil {
+		t.Error("Validate() = nil for a zero route limit, want an error")
+	}
+}
@@ -0,0 +1,56 @@
+package ratelimiter
+
+import (
+	"errors"
+	"time"
+)
+
+// day is the length of the daily cycle schedule entries repeat over.
+const day = 24 * time.Hour
+
+// ScheduleEntry defines the limit applied during a daily time range.
+// Start and End are wall-clock offsets from midnight (e.g. 9*time.Hour for 09:00) in the location
+// of the times returned by the clock, so ranges follow the local time of day across DST changes. A range whose End is before its Start wraps past
+// midnight (e.g. 22:00 to 06:00).
+type ScheduleEntry struct {
+	Start time.Duration // The offset from midnight at which the range starts (inclusive)
+	End   time.Duration // The offset from midnight at which the range ends (exclusive)
+	Limit uint16        // The limit applied during the range
+}
+
+// contains reports whether the given offset from midnight falls within the entry's range.
+func (entry ScheduleEntry) contains(offset time.Duration) bool {
+	if entry.Start <= entry.End {
+		return offset >= entry.Start && offset < entry.End
+	}
+	return offset >= entry.Start || offset < entry.End
+}
+
+// validate checks that the entry's range lies within a day and that its limit is not 0.
+func (entry ScheduleEntry) validate() error {
+	switch {
+	case entry.Start < 0 || entry.Start >= day || entry.End < 0 || entry.End >= day:
+		return errors.New("`Schedule` ranges must lie within a day")
+	case entry.Limit == 0:
+		return errors.New("`Schedule` limits cannot be 0")
+	}
+	return nil
+}
+
+// scheduledLimit returns the limit of the first schedule entry containing the current time
+// of the clock, falling back to the effective (static) limit outside every range.
+func (cfg *Config) scheduledLimit() uint16 {
+	if len(cfg.schedule) == 0 {
+		return cfg.effectiveLimit()
+	}
+	now := cfg.clock()
+	// The wall-clock time of day, unlike the time elapsed since midnight, which is off by an hour on DST days
+	offset := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute +
+		time.Duration(now.Second())*time.Second + time.Duration(now.Nanosecond())
+	for _, entry := range cfg.schedule {
+		if entry.contains(offset) {
+			return entry.Limit
+		}
+	}
+	return cfg.effectiveLimit()
+}
@@ -0,0 +1,70 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"testing"
+	"time"
+	_ "time/tzdata" // The DST tests must not depend on the zoneinfo of the host
+)
+
+// businessHours is a schedule raising the limit from 09:00 to 17:00 and lowering it overnight.
+var businessHours = []ScheduleEntry{
+	{Start: 9 * time.Hour, End: 17 * time.Hour, Limit: 100},
+	{Start: 22 * time.Hour, End: 6 * time.Hour, Limit: 5},
+}
+
+func TestScheduledLimit(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatalf("load location: %v", err)
+	}
+	tests := []struct {
+		name string
+		now  time.Time
+		want uint16
+	}{
+		{"before business hours", time.Date(2024, 1, 2, 8, 59, 59, 0, time.UTC), 10},
+		{"start is inclusive", time.Date(2024, 1, 2, 9, 0, 0, 0, time.UTC), 100},
+		{"end is exclusive", time.Date(2024, 1, 2, 17, 0, 0, 0, time.UTC), 10},
+		{"overnight before midnight", time.Date(2024, 1, 2, 23, 0, 0, 0, time.UTC), 5},
+		{"overnight after midnight", time.Date(2024, 1, 2, 5, 59, 0, 0, time.UTC), 5},
+		// 7 hours elapsed since midnight when the clocks spring forward, but it is 08:30 on the wall clock
+		{"spring forward", time.Date(2024, 3, 10, 8, 30, 0, 0, newYork), 10},
+		{"spring forward business hours", time.Date(2024, 3, 10, 9, 30, 0, 0, newYork), 100},
+		// 17 hours elapsed since midnight when the clocks fall back, but it is 16:30 on the wall clock
+		{"fall back business hours", time.Date(2024, 11, 3, 16, 30, 0, 0, newYork), 100},
+		{"fall back evening", time.Date(2024, 11, 3, 17, 30, 0, 0, newYork), 10},
+	}
+	for _, test := range tests {
+		cfg := newTestConfig().Limit(10).Schedule(businessHours).Clock(func() time.Time { return test.now })
+		if got := cfg.scheduledLimit(); got != test.want {
+			t.Errorf("%s: scheduledLimit() at %s = %d, want %d", test.name, test.now, got, test.want)
+		}
+	}
+}
+
+func TestScheduleAppliesPerRequest(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 2, 23, 0, 0, 0, time.UTC))
+	router := newRouter(t, newTestConfig().Limit(10).Schedule(businessHours).Clock(clock.Now).WorkerCount(20))
+
+	for i := 0; i < 5; i++ {
+		expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+
+	clock.Set(time.Date(2024, 1, 3, 10, 0, 0, 0, time.UTC))
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+}
+
+func TestScheduleValidation(t *testing.T) {
+	invalid := map[string]ScheduleEntry{
+		"negative start": {Start: -time.Hour, End: time.Hour, Limit: 1},
+		"end past a day": {Start: time.Hour, End: day, Limit: 1},
+		"zero limit":     {Start: time.Hour, End: 2 * time.Hour},
+	}
+	for name, entry := range invalid {
+		if err := newTestConfig().Schedule([]ScheduleEntry{entry}).Validate(); err == nil {
+			t.Errorf("%s: Validate() = nil, want an error", name)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package ratelimiter
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// EndpointClass maps request paths matching Pattern to the coarse endpoint class Name.
+type EndpointClass struct {
+	Name    string         // The name of the endpoint class
+	Pattern *regexp.Regexp // The pattern matched against the request path
+}
+
+// NormalizeIP canonicalizes an IP address so that equivalent forms of the same
+// client collapse to a single rate limiting key.
+//
+// It trims a trailing port (as found in `RemoteAddr`-derived values such as
+// "1.2.3.4:5678" or "[::1]:5678"), strips IPv6 brackets and unmaps
+// IPv4-mapped IPv6 addresses ("::ffff:1.2.3.4" becomes "1.2.3.4").
+// Values that are not valid IP addresses are returned trimmed but otherwise untouched.
+func NormalizeIP(ip string) string {
+	ip = strings.TrimSpace(ip)
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	ip = strings.TrimSuffix(strings.TrimPrefix(ip, "["), "]")
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	return addr.Unmap().String()
+}
+
+// TenantEndpointSelector returns an IDSelector that keys requests by `{tenant}|{endpoint-class}`,
+// where the tenant is selected by the given selector and the endpoint class is the Name of the
+// first class whose Pattern matches the request path (or fallbackClass if none matches).
+//
+// Grouping paths into a small, fixed set of classes keeps the number of keys bounded
+// (tenants times classes), unlike keying by the full path.
+func TenantEndpointSelector(tenant IDSelector, classes []EndpointClass, fallbackClass string) IDSelector {
+	return func(ctx *gin.Context) string {
+		class := fallbackClass
+		for _, candidate := range classes {
+			if candidate.Pattern.MatchString(ctx.Request.URL.Path) {
+				class = candidate.Name
+				break
+			}
+		}
+		return tenant(ctx) + keySeparator + class
+	}
+}
+
+// compositeEscaper escapes the separator (and the escape character itself) within the parts of composite keys.
+var compositeEscaper = strings.NewReplacer(`\`, `\\`, keySeparator, `\`+keySeparator)
+
+// CompositeSelector returns an IDSelector that keys requests by the results of all the given selectors,
+// joined with `|`, e.g. the client IP and the `Authorization` header, so two users behind the same NAT
+// are counted separately. A `|` (or `\`) within a part is escaped with a `\`, so parts containing the
+// separator cannot collide with other combinations, e.g. ("a|b", "c") and ("a", "b|c").
+func CompositeSelector(selectors ...IDSelector) IDSelector {
+	return func(ctx *gin.Context) string {
+		parts := make([]string, len(selectors))
+		for i, selector := range selectors {
+			parts[i] = compositeEscaper.Replace(selector(ctx))
+		}
+		return strings.Join(parts, keySeparator)
+	}
+}
+
+// HeaderSelector returns an IDSelector that keys requests by the value of the given header
+// (e.g. "X-API-Key"), falling back to the client IP (as the default selector) if the header is empty.
+// Values are keyed as `header:{name}:{value}` (with the canonical header name), so a client cannot
+// share the key of another client's IP, or of a value selected from elsewhere, by sending it as is.
+func HeaderSelector(name string) IDSelector {
+	prefix := "header:" + http.CanonicalHeaderKey(name) + ":"
+	return func(ctx *gin.Context) string {
+		if value := ctx.GetHeader(name); value != "" {
+			return prefix + value
+		}
+		return defaultIdSelector(ctx)
+	}
+}
+
+// QuerySelector returns an IDSelector that keys requests by the value of the given query parameter
+// (e.g. "api_key"), falling back to the client IP (as the default selector) if the parameter is empty.
+// Values are keyed as `query:{name}:{value}`, see HeaderSelector.
+func QuerySelector(name string) IDSelector {
+	prefix := "query:" + name + ":"
+	return func(ctx *gin.Context) string {
+		if value := ctx.Query(name); value != "" {
+			return prefix + value
+		}
+		return defaultIdSelector(ctx)
+	}
+}
+
+// PathSelector returns an IDSelector that keys requests by their path (without the query).
+// Keying by the full path makes the number of keys unbounded, see TenantEndpointSelector for a bounded alternative.
+func PathSelector() IDSelector {
+	return func(ctx *gin.Context) string {
+		return ctx.Request.URL.Path
+	}
+}
+
+// XForwardedForSelector returns an IDSelector that keys requests by the client IP found in the
+// `X-Forwarded-For` chain, for services behind depth trusted reverse proxies (e.g. 1 behind a single nginx).
+// Each proxy appends the address it received the request from, so the client IP is the depth-th entry
+// from the right; entries further left are ignored. Requests with a shorter (or no) chain, or with an
+// invalid entry at that position, fall back to the address of the direct peer (gin.Context.RemoteIP).
+// The selected IP is normalized (see NormalizeIP).
+//
+// Security: the `X-Forwarded-For` header is set by the client and can be spoofed. Only the entries
+// appended by proxies you control can be trusted, so depth must match the number of proxies exactly:
+// a depth too high lets clients pick their own key (and evade the limit) by prepending fake entries,
+// a depth too low keys every client by the address of a proxy. The service must not be reachable
+// without going through the proxies. For a depth below 1, the peer address is always used.
+func XForwardedForSelector(depth int) IDSelector {
+	return func(ctx *gin.Context) string {
+		if depth > 0 {
+			var chain []string
+			for _, header := range ctx.Request.Header.Values("X-Forwarded-For") {
+				chain = append(chain, strings.Split(header, ",")...)
+			}
+			if len(chain) >= depth {
+				if addr, err := netip.ParseAddr(strings.TrimSpace(chain[len(chain)-depth])); err == nil {
+					return addr.Unmap().String()
+				}
+			}
+		}
+		return NormalizeIP(ctx.RemoteIP())
+	}
+}
@@ -0,0 +1,237 @@
+package ratelimiter
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestNormalizeIP(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"1.2.3.4", "1.2.3.4"},
+		{"::ffff:1.2.3.4", "1.2.3.4"},
+		{"[::ffff:1.2.3.4]:443", "1.2.3.4"},
+		{"1.2.3.4:5678", "1.2.3.4"},
+		{"[::1]:5678", "::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{" 10.0.0.1 ", "10.0.0.1"},
+		{"not-an-ip", "not-an-ip"},
+	}
+	for _, test := range tests {
+		if got := NormalizeIP(test.in); got != test.want {
+			t.Errorf("NormalizeIP(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeIPCollapsesMappedAndPlainForms(t *testing.T) {
+	if mapped, plain := NormalizeIP("::ffff:192.168.0.7"), NormalizeIP("192.168.0.7"); mapped != plain {
+		t.Fatalf("mapped form %q and plain form %q do not collapse to one key", mapped, plain)
+	}
+}
+
+// endpointClasses group the paths of a multi-tenant API into a few endpoint classes.
+var endpointClasses = []EndpointClass{
+	{Name: "auth", Pattern: regexp.MustCompile(`^/auth/`)},
+	{Name: "orders", Pattern: regexp.MustCompile(`^/orders(/|$)`)},
+}
+
+func TestTenantEndpointSelectorMapsPathsToClasses(t *testing.T) {
+	selector := TenantEndpointSelector(HeaderSelector("X-Tenant"), endpointClasses, "other")
+	tests := map[string]string{
+		"/auth/login":   "auth",
+		"/auth/refresh": "auth",
+		"/orders":       "orders",
+		"/orders/42":    "orders",
+		"/ordersx":      "other",
+		"/health":       "other",
+	}
+	for path, class := range tests {
+		ctx := testContext(httptest.NewRequest(http.MethodGet, path, nil))
+		ctx.Request.Header.Set("X-Tenant", "acme")
+		want := HeaderSelector("X-Tenant")(ctx) + keySeparator + class
+		if got := selector(ctx); got != want {
+			t.Errorf("key of %s = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestTenantEndpointSelectorSharesCountWithinClass(t *testing.T) {
+	cfg := newTestConfig().Limit(2).IdSelector(TenantEndpointSelector(HeaderSelector("X-Tenant"), endpointClasses, "other"))
+	router := newRouter(t, cfg, "/orders", "/orders/:id", "/auth/login")
+	acme := withHeader("X-Tenant", "acme")
+
+	expectStatus(t, serve(router, http.MethodGet, "/orders", acme), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/orders/1", acme), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/orders/2", acme), http.StatusTooManyRequests)
+	expectStatus(t, serve(router, http.MethodGet, "/auth/login", acme), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/orders/3", withHeader("X-Tenant", "globex")), http.StatusOK)
+}
+
+// tokenSelector identifies requests by their Authorization header, rejecting requests without one.
+func tokenSelector(ctx *gin.Context) (string, error) {
+	if token := ctx.GetHeader("Authorization"); token != "" {
+		return token, nil
+	}
+	return "", errMissingToken
+}
+
+var errMissingToken = errors.New("missing token")
+
+func TestIdSelectorERejectsBeforeCounting(t *testing.T) {
+	storage := newCountingStorage()
+	var attached []string
+	router := newRouter(t, newTestConfig().Storage(storage).IdSelectorE(tokenSelector).InvalidIDHandler(func(ctx *gin.Context) {
+		attached = ctx.Errors.ByType(gin.ErrorTypeAny).Errors()
+		ctx.AbortWithStatus(http.StatusUnauthorized)
+	}))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusUnauthorized)
+	if len(attached) != 1 || attached[0] != errMissingToken.Error() {
+		t.Errorf("attached errors = %v, want the selector error", attached)
+	}
+	if calls := storage.calls(); calls != 0 {
+		t.Errorf("storage called %d times for a rejected request, want 0", calls)
+	}
+}
+
+func TestIdSelectorEKeysAcceptedRequests(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(1).IdSelectorE(tokenSelector))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusBadRequest)
+	expectStatus(t, serve(router, http.MethodGet, "/", withHeader("Authorization", "a")), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/", withHeader("Authorization", "a")), http.StatusTooManyRequests)
+	expectStatus(t, serve(router, http.MethodGet, "/", withHeader("Authorization", "b")), http.StatusOK)
+}
+
+func TestCompositeSelectorJoinsParts(t *testing.T) {
+	ctx := testContext(httptest.NewRequest(http.MethodGet, "/", nil))
+	ctx.Request.Header.Set("Authorization", "token")
+	selector := CompositeSelector(defaultIdSelector, HeaderSelector("Authorization"))
+
+	if got, want := selector(ctx), "192.0.2.1"+keySeparator+"header:Authorization:token"; got != want {
+		t.Errorf("key = %q, want %q", got, want)
+	}
+}
+
+func TestCompositeSelectorSeparatesUsersBehindNAT(t *testing.T) {
+	cfg := newTestConfig().Limit(1).IdSelector(CompositeSelector(defaultIdSelector, HeaderSelector("Authorization")))
+	router := newRouter(t, cfg)
+
+	expectStatus(t, serve(router, http.MethodGet, "/", withHeader("Authorization", "alice")), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/", withHeader("Authorization", "bob")), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/", withHeader("Authorization", "alice")), http.StatusTooManyRequests)
+}
+
+func TestHeaderSelectorFallsBackToClientIP(t *testing.T) {
+	selector := HeaderSelector("X-API-Key")
+	ctx := testContext(httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := selector(ctx); got != "192.0.2.1" {
+		t.Errorf("key without the header = %q, want the client IP", got)
+	}
+	ctx.Request.Header.Set("X-API-Key", "key")
+	if got := selector(ctx); got != "header:X-Api-Key:key" {
+		t.Errorf("key = %q, want the prefixed header value", got)
+	}
+}
+
+func TestCompositeSelectorEscapesSeparator(t *testing.T) {
+	ctx := testContext(httptest.NewRequest(http.MethodGet, "/", nil))
+	constant := func(value string) IDSelector {
+		return func(*gin.Context) string { return value }
+	}
+	keys := map[string]bool{}
+	for _, parts := range [][]string{{"a|b", "c"}, {"a", "b|c"}, {`a\`, "b|c"}, {`a\|b`, "c"}} {
+		key := CompositeSelector(constant(parts[0]), constant(parts[1]))(ctx)
+		if keys[key] {
+			t.Errorf("parts %q collide on the key %q", parts, key)
+		}
+		keys[key] = true
+	}
+	if got, want := CompositeSelector(constant("a|b"), constant(`c\`))(ctx), `a\|b|c\\`; got != want {
+		t.Errorf("key = %q, want %q", got, want)
+	}
+}
+
+func TestHeaderAndQuerySelectorsCannotSpoofOtherKeys(t *testing.T) {
+	cfg := newTestConfig().Limit(1).IdSelector(CompositeSelector(HeaderSelector("X-API-Key"), QuerySelector("api_key")))
+	router := newRouter(t, cfg)
+
+	expectStatus(t, serve(router, http.MethodGet, "/?api_key=k"), http.StatusOK)
+	// The same value sent in the header, or the IP other requests fall back to, is keyed separately
+	expectStatus(t, serve(router, http.MethodGet, "/", withHeader("X-API-Key", "k"), fromIP("192.0.2.9")), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/?api_key=k", withHeader("X-API-Key", "192.0.2.1")), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/?api_key=k"), http.StatusTooManyRequests)
+}
+
+func TestQuerySelectorPrefixesValue(t *testing.T) {
+	selector := QuerySelector("api_key")
+	if got := selector(testContext(httptest.NewRequest(http.MethodGet, "/?api_key=key", nil))); got != "query:api_key:key" {
+		t.Errorf("key = %q, want the prefixed query value", got)
+	}
+	if got := selector(testContext(httptest.NewRequest(http.MethodGet, "/", nil))); got != "192.0.2.1" {
+		t.Errorf("key without the parameter = %q, want the client IP", got)
+	}
+}
+
+func TestHeaderSelectorCanonicalizesName(t *testing.T) {
+	ctx := testContext(httptest.NewRequest(http.MethodGet, "/", nil))
+	ctx.Request.Header.Set("X-API-Key", "key")
+	if lower, canonical := HeaderSelector("x-api-key")(ctx), HeaderSelector("X-Api-Key")(ctx); lower != canonical {
+		t.Errorf("keys %q and %q differ by the casing of the header name", lower, canonical)
+	}
+}
+
+func TestPathSelectorIgnoresQuery(t *testing.T) {
+	selector := PathSelector()
+	first := selector(testContext(httptest.NewRequest(http.MethodGet, "/items?page=1", nil)))
+	second := selector(testContext(httptest.NewRequest(http.MethodGet, "/items?page=2", nil)))
+	if first != "/items" || second != first {
+		t.Errorf("keys = %q and %q, want both /items", first, second)
+	}
+}
+
+func TestXForwardedForSelector(t *testing.T) {
+	tests := []struct {
+		name   string
+		depth  int
+		chains []string
+		want   string
+	}{
+		{"single proxy", 1, []string{"203.0.113.7"}, "203.0.113.7"},
+		{"spoofed entries are ignored", 1, []string{"10.6.6.6, 203.0.113.7"}, "203.0.113.7"},
+		{"two proxies", 2, []string{"203.0.113.7, 198.51.100.2"}, "203.0.113.7"},
+		{"chain split across headers", 2, []string{"203.0.113.7", "198.51.100.2"}, "203.0.113.7"},
+		{"mapped address", 1, []string{"::ffff:203.0.113.7"}, "203.0.113.7"},
+		{"short chain", 2, []string{"203.0.113.7"}, "192.0.2.1"},
+		{"no chain", 1, nil, "192.0.2.1"},
+		{"invalid entry", 1, []string{"unknown"}, "192.0.2.1"},
+		{"depth zero", 0, []string{"203.0.113.7"}, "192.0.2.1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := testContext(httptest.NewRequest(http.MethodGet, "/", nil))
+			for _, chain := range test.chains {
+				ctx.Request.Header.Add("X-Forwarded-For", chain)
+			}
+			if got := XForwardedForSelector(test.depth)(ctx); got != test.want {
+				t.Errorf("key = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestXForwardedForSelectorLimitsClientsBehindProxy(t *testing.T) {
+	router := newRouter(t, newTestConfig().Limit(1).IdSelector(XForwardedForSelector(1)))
+	proxy := fromIP("198.51.100.2")
+
+	expectStatus(t, serve(router, http.MethodGet, "/", proxy, withHeader("X-Forwarded-For", "203.0.113.7")), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/", proxy, withHeader("X-Forwarded-For", "203.0.113.8")), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/", proxy, withHeader("X-Forwarded-For", "1.1.1.1, 203.0.113.7")), http.StatusTooManyRequests)
+}
@@ -0,0 +1,45 @@
+package ratelimiter
+
+import (
+	"sync"
+	"time"
+)
+
+// staggerer spaces out the release times of the entries of each client, so a burst of requests
+// is released gradually instead of all at once.
+type staggerer struct {
+	spacing time.Duration        // The minimum time between two releases of a client, per released unit
+	lock    sync.Mutex           // A mutex lock to ensure thread-safe access to the release times
+	last    map[string]time.Time // The latest scheduled release time of each client
+}
+
+// newStaggerer creates a staggerer spacing releases of a client at least spacing apart.
+func newStaggerer(spacing time.Duration) *staggerer {
+	return &staggerer{
+		spacing: spacing,
+		last:    make(map[string]time.Time),
+	}
+}
+
+// schedule returns the release time of an entry of the given ID and weight that would be released at,
+// delaying it until the previous release of the ID plus spacing per unit if it would otherwise be sooner.
+func (s *staggerer) schedule(id string, at time.Time, weight uint16) time.Time {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+	if previous, ok := s.last[id]; ok {
+		if earliest := previous.Add(s.spacing * time.Duration(weight)); at.Before(earliest) {
+			at = earliest
+		}
+	}
+	s.last[id] = at
+	return at
+}
+
+// released forgets the release time of the given ID if the entry released at was its latest one.
+func (s *staggerer) released(id string, at time.Time) {
+	defer s.lock.Unlock()
+	s.lock.Lock()
+	if last, ok := s.last[id]; ok && last.Equal(at) {
+		delete(s.last, id)
+	}
+}
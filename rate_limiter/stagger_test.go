@@ -0,0 +1,92 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestStaggererSpacesReleasesPerUnit(t *testing.T) {
+	s := newStaggerer(time.Second)
+	start := time.Unix(1000, 0)
+
+	if at := s.schedule("a", start, 1); !at.Equal(start) {
+		t.Fatalf("first release = %s, want %s", at, start)
+	}
+	if at := s.schedule("a", start, 2); !at.Equal(start.Add(2 * time.Second)) {
+		t.Fatalf("second release = %s, want two units after the first", at)
+	}
+	if at := s.schedule("b", start, 1); !at.Equal(start) {
+		t.Fatalf("release of another client = %s, want %s", at, start)
+	}
+	if later := start.Add(time.Minute); !s.schedule("a", later, 1).Equal(later) {
+		t.Fatal("a release past the spacing was delayed")
+	}
+}
+
+func TestStaggererForgetsOnlyLatestRelease(t *testing.T) {
+	s := newStaggerer(time.Second)
+	start := time.Unix(1000, 0)
+	first := s.schedule("a", start, 1)
+	second := s.schedule("a", start, 1)
+
+	s.released("a", first)
+	if _, ok := s.last["a"]; !ok {
+		t.Fatal("releasing an older entry forgot the latest release time")
+	}
+	s.released("a", second)
+	if _, ok := s.last["a"]; ok {
+		t.Fatal("releasing the latest entry kept its release time")
+	}
+}
+
+func TestStaggerReleaseRecoversBudgetGradually(t *testing.T) {
+	// allowance sends a burst of 4 requests, then advances the clock second by second,
+	// returning the budget the client has recovered after each second
+	allowance := func(spacing time.Duration, releases []int) []uint16 {
+		start := time.Unix(1000, 0)
+		clock := newFakeClock(start)
+		released := make(chan time.Time, 4)
+		cfg := clock.drive(newTestConfig().Limit(4).Timeout(time.Second).Tolerance(0).StaggerRelease(spacing).WorkerCount(4).
+			OnRelease(func(string, map[string]string) { released <- clock.Now() }))
+		router := newRouter(t, cfg)
+
+		for i := 0; i < 4; i++ {
+			expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+		}
+		var recovered []uint16
+		for _, count := range releases {
+			clock.Advance(time.Second)
+			for i := 0; i < count; i++ {
+				select {
+				case at := <-released:
+					if !at.Equal(clock.Now()) {
+						t.Fatalf("entry released at %s, want %s", at.Sub(start), clock.Now().Sub(start))
+					}
+				case <-time.After(time.Second):
+					t.Fatalf("%d of %d entries were released after %s", i, count, clock.Now().Sub(start))
+				}
+			}
+			used, _ := cfg.storage.Get("192.0.2.1")
+			recovered = append(recovered, 4-used)
+		}
+		return recovered
+	}
+
+	// Without staggering the whole burst is released after the timeout,
+	// with a 1s spacing one entry of the burst is released every second
+	if got, want := allowance(0, []int{4, 0, 0, 0}), []uint16{4, 4, 4, 4}; !slices.Equal(got, want) {
+		t.Errorf("budget recovered without staggering = %v, want %v", got, want)
+	}
+	if got, want := allowance(time.Second, []int{1, 1, 1, 1}), []uint16{1, 2, 3, 4}; !slices.Equal(got, want) {
+		t.Errorf("budget recovered with staggering = %v, want %v", got, want)
+	}
+}
+
+func TestStaggerReleaseDisabledBySpacingZero(t *testing.T) {
+	cfg := newTestConfig().StaggerRelease(time.Second).StaggerRelease(0)
+	if cfg.staggerer != nil {
+		t.Fatal("a spacing of 0 kept staggering enabled")
+	}
+}
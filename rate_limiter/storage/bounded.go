@@ -0,0 +1,180 @@
+package rlstorage
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	rllog "github.com/FMotalleb/gin_testfield/rate_limiter/logging"
+)
+
+// boundedEntryOverhead is the estimated memory used by an entry of the bounded storage besides its
+// id bytes: the map bucket slot, the string header, the list element and the entry itself.
+const boundedEntryOverhead = 128
+
+// boundedEntry holds the count of an id within the bounded storage.
+type boundedEntry struct {
+	id    string // The id the count belongs to
+	count uint16 // The current count of the id
+}
+
+// boundedStorage is an in-memory storage that keeps its estimated memory use under a budget,
+// evicting the least recently used ids when it is exceeded.
+type boundedStorage struct {
+	entries   map[string]*list.Element // The elements of the recency list, by id
+	recency   *list.List               // The entries, most recently used first
+	maxBytes  int64                    // The memory budget in bytes
+	usedBytes int64                    // The estimated memory used by the entries
+	evictions atomic.Uint64            // The number of ids evicted to stay within the budget
+	lock      sync.Mutex               // A mutex lock to ensure thread-safe access to the storage
+	logger    rllog.Logger             // Logger instance for logging messages
+}
+
+// NewBoundedStorage creates a new instance of RLStorage that keeps its counters in memory within
+// a rough memory budget of maxBytes. The memory of each id is estimated as its length plus a fixed
+// overhead (boundedEntryOverhead), and the least recently used ids are evicted once the estimate
+// exceeds the budget, so the storage has a hard memory ceiling regardless of the number of clients.
+//
+// An evicted client starts over with a fresh count, so the budget should comfortably fit the
+// expected number of active clients; Evictions reports how often the budget forced an eviction.
+// The most recently used id is never evicted.
+func NewBoundedStorage(maxBytes int64, logger rllog.Logger) RLStorage {
+	return &boundedStorage{
+		entries:  make(map[string]*list.Element),
+		recency:  list.New(),
+		maxBytes: maxBytes,
+		logger:   logger,
+	}
+}
+
+// entrySize returns the estimated memory used by the entry of the given id.
+func entrySize(id string) int64 {
+	return int64(len(id)) + boundedEntryOverhead
+}
+
+// Decrease decrements the count for the given id, removing the id once it reaches 0.
+func (b *boundedStorage) Decrease(id string) error {
+	defer b.lock.Unlock() // Unlock the mutex when the function returns
+	b.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	element, ok := b.entries[id]
+	if !ok {
+		return nil // The id was evicted or freed in the meantime
+	}
+	entry := element.Value.(*boundedEntry)
+	if entry.count <= 1 {
+		b.remove(element)
+		return nil
+	}
+	entry.count--
+	return nil
+}
+
+// Free removes the given id from the storage.
+func (b *boundedStorage) Free(id string) error {
+	defer b.lock.Unlock() // Unlock the mutex when the function returns
+	b.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	if element, ok := b.entries[id]; ok {
+		b.remove(element)
+	}
+	b.logger.Debug("Freed ID from storage", "id", id)
+	return nil
+}
+
+// Get retrieves the count for the given id, marking it as recently used.
+func (b *boundedStorage) Get(id string) (uint16, error) {
+	defer b.lock.Unlock() // Unlock the mutex when the function returns
+	b.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	element, ok := b.entries[id]
+	if !ok {
+		return 0, nil
+	}
+	b.recency.MoveToFront(element)
+	return element.Value.(*boundedEntry).count, nil
+}
+
+// Increase increments the count for the given id, evicting the least recently used ids if a new id
+// pushes the storage over its budget.
+func (b *boundedStorage) Increase(id string) error {
+	defer b.lock.Unlock() // Unlock the mutex when the function returns
+	b.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	b.entry(id).count++
+	return nil
+}
+
+// FreeAll removes all entries from the storage.
+func (b *boundedStorage) FreeAll() error {
+	defer b.lock.Unlock() // Unlock the mutex when the function returns
+	b.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	b.entries = make(map[string]*list.Element)
+	b.recency.Init()
+	b.usedBytes = 0
+	b.logger.Info("Freed all entries from storage")
+	return nil
+}
+
+// CheckAndIncrement increments the count for the given id under a single lock if it is below limit.
+// The reset time is unknown to this storage (counts are released by the middleware), so it is always zero.
+func (b *boundedStorage) CheckAndIncrement(id string, limit uint16) (bool, uint16, time.Time, error) {
+	defer b.lock.Unlock() // Unlock the mutex when the function returns
+	b.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	if element, ok := b.entries[id]; ok && element.Value.(*boundedEntry).count >= limit {
+		b.recency.MoveToFront(element)
+		return false, element.Value.(*boundedEntry).count, time.Time{}, nil
+	}
+	if limit == 0 {
+		return false, 0, time.Time{}, nil
+	}
+	entry := b.entry(id)
+	entry.count++
+	return true, entry.count, time.Time{}, nil
+}
+
+// Len returns the number of ids in the storage.
+func (b *boundedStorage) Len() (int, error) {
+	defer b.lock.Unlock() // Unlock the mutex when the function returns
+	b.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	return len(b.entries), nil
+}
+
+// Snapshot returns a copy of the current counts.
+func (b *boundedStorage) Snapshot() (map[string]uint16, error) {
+	defer b.lock.Unlock() // Unlock the mutex when the function returns
+	b.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	snapshot := make(map[string]uint16, len(b.entries))
+	for id, element := range b.entries {
+		snapshot[id] = element.Value.(*boundedEntry).count
+	}
+	return snapshot, nil
+}
+
+// Evictions returns the number of ids evicted so far to stay within the memory budget.
+func (b *boundedStorage) Evictions() uint64 {
+	return b.evictions.Load()
+}
+
+// entry returns the entry of the given id marked as recently used, creating it (and evicting the least
+// recently used ids while over budget) if needed. The caller must hold the lock.
+func (b *boundedStorage) entry(id string) *boundedEntry {
+	if element, ok := b.entries[id]; ok {
+		b.recency.MoveToFront(element)
+		return element.Value.(*boundedEntry)
+	}
+	entry := &boundedEntry{id: id}
+	b.entries[id] = b.recency.PushFront(entry)
+	b.usedBytes += entrySize(id)
+	for b.usedBytes > b.maxBytes && b.recency.Len() > 1 {
+		evicted := b.recency.Back()
+		b.remove(evicted)
+		b.evictions.Add(1)
+		b.logger.Debug("Evicted ID to stay within the memory budget", "id", evicted.Value.(*boundedEntry).id)
+	}
+	return entry
+}
+
+// remove removes the given element from the storage. The caller must hold the lock.
+func (b *boundedStorage) remove(element *list.Element) {
+	entry := b.recency.Remove(element).(*boundedEntry)
+	delete(b.entries, entry.id)
+	b.usedBytes -= entrySize(entry.id)
+}
@@ -0,0 +1,61 @@
+package rlstorage
+
+import "testing"
+
+func TestBoundedStorageEvictsLeastRecentlyUsed(t *testing.T) {
+	// Room for exactly two single byte ids
+	storage := NewBoundedStorage(2*entrySize("a"), discardLogger())
+	for _, id := range []string{"a", "b"} {
+		if err := storage.Increase(id); err != nil {
+			t.Fatalf("Increase(%q) error = %v", id, err)
+		}
+	}
+	expectCount(t, storage, "a", 1) // Marks a as recently used, so b is evicted next
+
+	if err := storage.Increase("c"); err != nil {
+		t.Fatalf("Increase(%q) error = %v", "c", err)
+	}
+	expectCount(t, storage, "a", 1)
+	expectCount(t, storage, "b", 0)
+	expectCount(t, storage, "c", 1)
+	if evictions := storage.(EvictionCounter).Evictions(); evictions != 1 {
+		t.Errorf("Evictions() = %d, want 1", evictions)
+	}
+	if keys, _ := storage.(KeyCounter).Len(); keys != 2 {
+		t.Errorf("Len() = %d, want 2", keys)
+	}
+}
+
+func TestBoundedStorageKeepsMostRecentlyUsedId(t *testing.T) {
+	storage := NewBoundedStorage(1, discardLogger())
+	for _, id := range []string{"a", "b", "b"} {
+		if err := storage.Increase(id); err != nil {
+			t.Fatalf("Increase(%q) error = %v", id, err)
+		}
+	}
+	expectCount(t, storage, "b", 2)
+	expectCount(t, storage, "a", 0)
+}
+
+func TestBoundedStorageReleasesBudget(t *testing.T) {
+	storage := NewBoundedStorage(2*entrySize("a"), discardLogger())
+	for _, id := range []string{"a", "b"} {
+		if err := storage.Increase(id); err != nil {
+			t.Fatalf("Increase(%q) error = %v", id, err)
+		}
+	}
+	if err := storage.Decrease("a"); err != nil {
+		t.Fatalf("Decrease() error = %v", err)
+	}
+	if err := storage.Free("b"); err != nil {
+		t.Fatalf("Free() error = %v", err)
+	}
+	for _, id := range []string{"c", "d"} {
+		if err := storage.Increase(id); err != nil {
+			t.Fatalf("Increase(%q) error = %v", id, err)
+		}
+	}
+	if evictions := storage.(EvictionCounter).Evictions(); evictions != 0 {
+		t.Errorf("Evictions() = %d after releasing ids, want 0", evictions)
+	}
+}
@@ -0,0 +1,150 @@
+package rlstorage
+
+import (
+	"context"
+	"time"
+)
+
+// ContextStorage is implemented by storages whose operations can be bound to a context,
+// so that a cancelled request or an expired deadline does not wait on a slow storage.
+type ContextStorage interface {
+	// GetCtx works like Get, but returns early with the context's error once ctx is done.
+	GetCtx(ctx context.Context, id string) (uint16, error)
+	// IncreaseCtx works like Increase, but returns early with the context's error once ctx is done.
+	IncreaseCtx(ctx context.Context, id string) error
+	// DecreaseCtx works like Decrease, but returns early with the context's error once ctx is done.
+	DecreaseCtx(ctx context.Context, id string) error
+	// FreeCtx works like Free, but returns early with the context's error once ctx is done.
+	FreeCtx(ctx context.Context, id string) error
+}
+
+// ContextCheckAndIncrementer is implemented by CheckAndIncrementers whose atomic check can be bound to a context.
+type ContextCheckAndIncrementer interface {
+	// CheckAndIncrementCtx works like CheckAndIncrement, but returns early with the context's error once ctx is done.
+	CheckAndIncrementCtx(ctx context.Context, id string, limit uint16) (bool, uint16, time.Time, error)
+}
+
+// ContextWeightedCheckAndIncrementer is implemented by WeightedCheckAndIncrementers whose atomic check can be bound to a context.
+type ContextWeightedCheckAndIncrementer interface {
+	// CheckAndIncrementByCtx works like CheckAndIncrementBy, but returns early with the context's error once ctx is done.
+	CheckAndIncrementByCtx(ctx context.Context, id string, limit, cost uint16) (bool, uint16, time.Time, error)
+}
+
+// GetContext retrieves the value of id from storage, honoring ctx.
+// Storages not implementing ContextStorage are only called if ctx is not done yet.
+func GetContext(ctx context.Context, storage RLStorage, id string) (uint16, error) {
+	if s, ok := storage.(ContextStorage); ok {
+		return s.GetCtx(ctx, id)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return storage.Get(id)
+}
+
+// IncreaseContext increments the value of id in storage, honoring ctx.
+// Storages not implementing ContextStorage are only called if ctx is not done yet.
+func IncreaseContext(ctx context.Context, storage RLStorage, id string) error {
+	if s, ok := storage.(ContextStorage); ok {
+		return s.IncreaseCtx(ctx, id)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return storage.Increase(id)
+}
+
+// DecreaseContext decrements the value of id in storage, honoring ctx.
+// Storages not implementing ContextStorage are only called if ctx is not done yet.
+func DecreaseContext(ctx context.Context, storage RLStorage, id string) error {
+	if s, ok := storage.(ContextStorage); ok {
+		return s.DecreaseCtx(ctx, id)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return storage.Decrease(id)
+}
+
+// FreeContext frees the value of id in storage, honoring ctx.
+// Storages not implementing ContextStorage are only called if ctx is not done yet.
+func FreeContext(ctx context.Context, storage RLStorage, id string) error {
+	if s, ok := storage.(ContextStorage); ok {
+		return s.FreeCtx(ctx, id)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return storage.Free(id)
+}
+
+// IncreaseByContext increments the value of id in storage by n, honoring ctx, and returns the number of
+// units increased. Storages implementing IncreaserBy are increased in a single call (all or nothing),
+// other storages are increased unit by unit, stopping at the first error.
+func IncreaseByContext(ctx context.Context, storage RLStorage, id string, n uint16) (uint16, error) {
+	if s, ok := As[IncreaserBy](storage); ok && n > 1 {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if err := s.IncreaseBy(id, n); err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+	for increased := uint16(0); increased < n; increased++ {
+		if err := IncreaseContext(ctx, storage, id); err != nil {
+			return increased, err
+		}
+	}
+	return n, nil
+}
+
+// CheckAndIncrementContext runs CheckAndIncrement on storage, honoring ctx.
+// Storages not implementing ContextCheckAndIncrementer are only called if ctx is not done yet.
+func CheckAndIncrementContext(ctx context.Context, storage CheckAndIncrementer, id string, limit uint16) (bool, uint16, time.Time, error) {
+	if s, ok := storage.(ContextCheckAndIncrementer); ok {
+		return s.CheckAndIncrementCtx(ctx, id, limit)
+	}
+	if err := ctx.Err(); err != nil {
+		return false, 0, time.Time{}, err
+	}
+	return storage.CheckAndIncrement(id, limit)
+}
+
+// CheckAndIncrementByContext checks and increments the value of id in storage by cost, honoring ctx.
+// Storages not implementing ContextWeightedCheckAndIncrementer are only called if ctx is not done yet.
+func CheckAndIncrementByContext(ctx context.Context, storage WeightedCheckAndIncrementer, id string, limit, cost uint16) (bool, uint16, time.Time, error) {
+	if s, ok := storage.(ContextWeightedCheckAndIncrementer); ok {
+		return s.CheckAndIncrementByCtx(ctx, id, limit, cost)
+	}
+	if err := ctx.Err(); err != nil {
+		return false, 0, time.Time{}, err
+	}
+	return storage.CheckAndIncrementBy(id, limit, cost)
+}
+
+// runContext runs op in its own goroutine and returns its result, or the context's error if
+// ctx is done first. go-redis v6 does not abort in-flight commands on cancellation, so an
+// abandoned op still runs to completion, bounded by the client's read/write timeouts.
+func runContext[T any](ctx context.Context, op func() (T, error)) (T, error) {
+	if err := ctx.Err(); err != nil {
+		var zero T
+		return zero, err
+	}
+	type outcome struct {
+		value T
+		err   error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		value, err := op()
+		done <- outcome{value, err}
+	}()
+	select {
+	case out := <-done:
+		return out.value, out.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
@@ -0,0 +1,135 @@
+package rlstorage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestContextHelpersSkipDoneContexts(t *testing.T) {
+	storage := NewSyncMapStorage(discardLogger()) // Implements no context-bound operations
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := IncreaseContext(ctx, storage, "a"); !errors.Is(err, context.Canceled) {
+		t.Errorf("IncreaseContext() = %v, want %v", err, context.Canceled)
+	}
+	if _, err := GetContext(ctx, storage, "a"); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetContext() = %v, want %v", err, context.Canceled)
+	}
+	if _, _, _, err := CheckAndIncrementContext(ctx, storage.(CheckAndIncrementer), "a", 5); !errors.Is(err, context.Canceled) {
+		t.Errorf("CheckAndIncrementContext() = %v, want %v", err, context.Canceled)
+	}
+	expectCount(t, storage, "a", 0)
+
+	if err := IncreaseContext(context.Background(), storage, "a"); err != nil {
+		t.Fatalf("IncreaseContext() = %v", err)
+	}
+	expectCount(t, storage, "a", 1)
+}
+
+func TestRunContextReturnsOnDeadline(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := runContext(ctx, func() (int, error) {
+		<-release
+		return 1, nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("runContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("runContext() returned after %v, want right after the deadline", elapsed)
+	}
+
+	value, err := runContext(context.Background(), func() (int, error) { return 7, nil })
+	if value != 7 || err != nil {
+		t.Errorf("runContext() = %d, %v, want the result of the operation", value, err)
+	}
+}
+
+func TestRedisContextOperations(t *testing.T) {
+	storage := newRedisStorage(t, time.Minute).(ContextStorage)
+	ctx := context.Background()
+	if err := storage.IncreaseCtx(ctx, "a"); err != nil {
+		t.Fatalf("IncreaseCtx() = %v", err)
+	}
+	if count, err := storage.GetCtx(ctx, "a"); count != 1 || err != nil {
+		t.Fatalf("GetCtx() = %d, %v, want 1", count, err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := storage.IncreaseCtx(cancelled, "a"); !errors.Is(err, context.Canceled) {
+		t.Errorf("IncreaseCtx() = %v with a cancelled context, want %v", err, context.Canceled)
+	}
+	if count, _ := storage.GetCtx(ctx, "a"); count != 1 {
+		t.Errorf("count = %d after a cancelled increase, want 1", count)
+	}
+}
+
+// unitStorage exposes only the RLStorage methods of a storage, failing every Increase after the first limit ones.
+type unitStorage struct {
+	RLStorage
+	limit, increases int
+}
+
+func (s *unitStorage) Increase(id string) error {
+	if s.increases == s.limit {
+		return errUnavailable
+	}
+	s.increases++
+	return s.RLStorage.Increase(id)
+}
+
+func TestIncreaseByContext(t *testing.T) {
+	for _, name := range []string{"hashmap", "syncmap", "redis"} {
+		t.Run(name, func(t *testing.T) {
+			storage := checkAndIncrementBackends[name](t)
+			if _, ok := storage.(IncreaserBy); !ok {
+				t.Fatal("the storage does not implement IncreaserBy")
+			}
+			if increased, err := IncreaseByContext(context.Background(), storage, "a", 5); increased != 5 || err != nil {
+				t.Fatalf("IncreaseByContext() = %d, %v, want 5 units increased", increased, err)
+			}
+			expectCount(t, storage, "a", 5)
+		})
+	}
+}
+
+func TestIncreaseByContextFallsBackToIncrease(t *testing.T) {
+	storage := &unitStorage{RLStorage: NewHashMapStorage(discardLogger()), limit: 3}
+	if increased, err := IncreaseByContext(context.Background(), storage, "a", 2); increased != 2 || err != nil {
+		t.Fatalf("IncreaseByContext() = %d, %v, want 2 units increased", increased, err)
+	}
+	if increased, err := IncreaseByContext(context.Background(), storage, "a", 2); increased != 1 || !errors.Is(err, errUnavailable) {
+		t.Fatalf("IncreaseByContext() = %d, %v, want 1 unit increased before the error", increased, err)
+	}
+	expectCount(t, storage, "a", 3)
+}
+
+func TestIncreaseByContextSkipsDoneContext(t *testing.T) {
+	storage := NewHashMapStorage(discardLogger())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if increased, err := IncreaseByContext(ctx, storage, "a", 5); increased != 0 || !errors.Is(err, context.Canceled) {
+		t.Errorf("IncreaseByContext() = %d, %v, want nothing increased", increased, err)
+	}
+	expectCount(t, storage, "a", 0)
+}
+
+func TestRedisIncreaseBySetsTTL(t *testing.T) {
+	server, client := newMiniredis(t)
+	storage := NewRedisStorage(client, time.Minute, discardLogger()).(IncreaserBy)
+	if err := storage.IncreaseBy("a", 3); err != nil {
+		t.Fatalf("IncreaseBy() error = %v", err)
+	}
+	if ttl := server.TTL(DefaultRedisKeyPrefix + countKeyPrefix + "a"); ttl <= 0 {
+		t.Errorf("the counter has no TTL (%s)", ttl)
+	}
+}
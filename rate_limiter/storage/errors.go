@@ -0,0 +1,21 @@
+package rlstorage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrOutOfMemory is wrapped by the errors of storages that rejected a write because they ran
+// out of memory (e.g. Redis reaching `maxmemory` with the noeviction policy), so callers can
+// tell this failure mode apart using errors.Is.
+var ErrOutOfMemory = errors.New("storage out of memory")
+
+// redisError wraps the given Redis error with ErrOutOfMemory if Redis rejected the command
+// because it reached its memory limit, and returns other errors as is.
+func redisError(err error) error {
+	if err != nil && strings.HasPrefix(err.Error(), "OOM ") {
+		return fmt.Errorf("%w: %w", ErrOutOfMemory, err)
+	}
+	return err
+}
@@ -0,0 +1,152 @@
+package rlstorage
+
+import (
+	"sync"
+	"time"
+
+	rllog "github.com/FMotalleb/gin_testfield/rate_limiter/logging"
+)
+
+// fixedWindowEntry holds the count of an id together with the start of the window it belongs to.
+type fixedWindowEntry struct {
+	count       uint16    // The number of requests counted within the window
+	windowStart time.Time // The start of the window the count belongs to
+}
+
+// fixedWindowStorage is a struct that represents an in-memory fixed-window storage implementation.
+// Counts are reset automatically once a new window begins.
+type fixedWindowStorage struct {
+	storage map[string]fixedWindowEntry // The underlying hash map to store the entries
+	window  time.Duration               // The length of a single window
+	lock    sync.Mutex                  // A mutex lock to ensure thread-safe access to the storage
+	logger  rllog.Logger                // Logger instance for logging messages
+	clock   func() time.Time            // The function used to read the current time
+}
+
+// NewFixedWindowStorage creates a new instance of RLStorage that counts requests in fixed windows
+// of the given length. Each id stores its count with the start of its window, and the count is
+// reset atomically (under lock) the first time the id is touched in a new window.
+//
+// Since counts reset at window boundaries, Decrease is a no-op for this storage.
+func NewFixedWindowStorage(window time.Duration, logger rllog.Logger) RLStorage {
+	return NewFixedWindowStorageWithClock(window, time.Now, logger)
+}
+
+// NewFixedWindowStorageWithClock works like NewFixedWindowStorage, but reads the current time
+// from the given clock (e.g. the one passed to Config.Clock, or a fake clock in tests).
+//
+// Windows are half-open: a request at exactly the start of a window (a multiple of the window
+// length since the zero time) belongs to the new window, so it is counted against a fresh count.
+func NewFixedWindowStorageWithClock(window time.Duration, clock func() time.Time, logger rllog.Logger) RLStorage {
+	return &fixedWindowStorage{
+		storage: make(map[string]fixedWindowEntry), // Initialize the hash map storage
+		window:  window,                            // Set the window length
+		clock:   clock,                             // Set the clock
+		lock:    sync.Mutex{},                      // Initialize the mutex lock
+		logger:  logger,                            // Set the logger instance
+	}
+}
+
+// currentWindow returns the start of the window the current time belongs to.
+// The monotonic clock reading is dropped, so window starts compare by wall time.
+func (f *fixedWindowStorage) currentWindow() time.Time {
+	return f.clock().Round(0).Truncate(f.window)
+}
+
+// Decrease does nothing, counts are reset when a new window begins.
+func (f *fixedWindowStorage) Decrease(id string) error {
+	return nil
+}
+
+// Free removes the given id from the storage.
+func (f *fixedWindowStorage) Free(id string) error {
+	defer f.lock.Unlock() // Unlock the mutex when the function returns
+	f.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	delete(f.storage, id) // Remove the id from the storage
+	f.logger.Debug("Freed ID from storage", "id", id)
+	return nil
+}
+
+// Get retrieves the count for the given id within the current window.
+func (f *fixedWindowStorage) Get(id string) (uint16, error) {
+	defer f.lock.Unlock() // Unlock the mutex when the function returns
+	f.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	entry := f.storage[id]
+	if !entry.windowStart.Equal(f.currentWindow()) {
+		return 0, nil // The stored count belongs to a previous window
+	}
+	f.logger.Debug("Got count for ID", "id", id, "count", entry.count)
+	return entry.count, nil
+}
+
+// Increase increments the count for the given id, resetting it first if a new window has begun.
+func (f *fixedWindowStorage) Increase(id string) error {
+	defer f.lock.Unlock() // Unlock the mutex when the function returns
+	f.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	window := f.currentWindow()
+	entry := f.storage[id]
+	if !entry.windowStart.Equal(window) {
+		entry = fixedWindowEntry{windowStart: window} // Start counting in the new window
+	}
+	entry.count++
+	f.storage[id] = entry
+	f.logger.Debug("Increased count for ID", "id", id, "count", entry.count)
+	return nil
+}
+
+// FreeAll removes all entries from the storage.
+func (f *fixedWindowStorage) FreeAll() error {
+	defer f.lock.Unlock() // Unlock the mutex when the function returns
+	f.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	f.storage = make(map[string]fixedWindowEntry)
+	f.logger.Info("Freed all entries from storage")
+	return nil
+}
+
+// CheckAndIncrement increments the count for the given id under a single lock if it is below limit
+// within the current window. The count resets at the end of the current window.
+func (f *fixedWindowStorage) CheckAndIncrement(id string, limit uint16) (bool, uint16, time.Time, error) {
+	defer f.lock.Unlock() // Unlock the mutex when the function returns
+	f.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	window := f.currentWindow()
+	resetAt := window.Add(f.window)
+	entry := f.storage[id]
+	if !entry.windowStart.Equal(window) {
+		entry = fixedWindowEntry{windowStart: window} // Start counting in the new window
+	}
+	if entry.count >= limit {
+		return false, entry.count, resetAt, nil
+	}
+	entry.count++
+	f.storage[id] = entry
+	f.logger.Debug("Increased count for ID", "id", id, "count", entry.count)
+	return true, entry.count, resetAt, nil
+}
+
+// Snapshot returns a copy of the counts within the current window.
+func (f *fixedWindowStorage) Snapshot() (map[string]uint16, error) {
+	defer f.lock.Unlock() // Unlock the mutex when the function returns
+	f.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	window := f.currentWindow()
+	snapshot := make(map[string]uint16, len(f.storage))
+	for id, entry := range f.storage {
+		if entry.count > 0 && entry.windowStart.Equal(window) {
+			snapshot[id] = entry.count
+		}
+	}
+	return snapshot, nil
+}
+
+// Len returns the number of ids counted within the current window.
+func (f *fixedWindowStorage) Len() (int, error) {
+	defer f.lock.Unlock() // Unlock the mutex when the function returns
+	f.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	window := f.currentWindow()
+	count := 0
+	for _, entry := range f.storage {
+		if entry.count > 0 && entry.windowStart.Equal(window) {
+			count++
+		}
+	}
+	return count, nil
+}
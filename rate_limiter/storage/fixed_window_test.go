@@ -0,0 +1,95 @@
+package rlstorage
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	rllog "github.com/FMotalleb/gin_testfield/rate_limiter/logging"
+)
+
+// discardLogger returns a logger dropping every entry.
+func discardLogger() rllog.Logger {
+	return rllog.NewSlog(slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// expectCount fails the test if the count of the given id in storage is not want.
+func expectCount(t testing.TB, storage RLStorage, id string, want uint16) {
+	t.Helper()
+	count, err := storage.Get(id)
+	if err != nil {
+		t.Fatalf("Get(%q) failed: %v", id, err)
+	}
+	if count != want {
+		t.Fatalf("Get(%q) = %d, want %d", id, count, want)
+	}
+}
+
+func TestFixedWindowStorageResetsOncePerWindow(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	storage := NewFixedWindowStorageWithClock(time.Minute, func() time.Time { return now }, discardLogger())
+
+	for i := 0; i < 3; i++ {
+		if err := storage.Increase("a"); err != nil {
+			t.Fatalf("Increase() failed: %v", err)
+		}
+	}
+	storage.Increase("b")
+	expectCount(t, storage, "a", 3)
+
+	now = now.Add(59 * time.Second)
+	storage.Increase("a")
+	expectCount(t, storage, "a", 4)
+
+	// The window boundary is half-open: the first request at the boundary starts a fresh count
+	now = now.Add(time.Second)
+	expectCount(t, storage, "a", 0)
+	expectCount(t, storage, "b", 0)
+	storage.Increase("a")
+	storage.Increase("a")
+	expectCount(t, storage, "a", 2)
+	expectCount(t, storage, "b", 0)
+}
+
+func TestFixedWindowStorageCheckAndIncrement(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 30, 0, time.UTC)
+	storage := NewFixedWindowStorageWithClock(time.Minute, func() time.Time { return now }, discardLogger()).(CheckAndIncrementer)
+
+	for i := uint16(1); i <= 2; i++ {
+		allowed, count, resetAt, err := storage.CheckAndIncrement("a", 2)
+		if err != nil || !allowed || count != i {
+			t.Fatalf("CheckAndIncrement() = %t, %d, %v, want allowed with count %d", allowed, count, err, i)
+		}
+		if want := time.Date(2024, 1, 1, 12, 1, 0, 0, time.UTC); !resetAt.Equal(want) {
+			t.Fatalf("resetAt = %s, want %s", resetAt, want)
+		}
+	}
+	if allowed, count, _, _ := storage.CheckAndIncrement("a", 2); allowed || count != 2 {
+		t.Fatalf("CheckAndIncrement() over the limit = %t, %d, want rejected with count 2", allowed, count)
+	}
+	now = now.Add(30 * time.Second)
+	if allowed, count, _, _ := storage.CheckAndIncrement("a", 2); !allowed || count != 1 {
+		t.Fatalf("CheckAndIncrement() in the next window = %t, %d, want allowed with count 1", allowed, count)
+	}
+}
+
+func TestFixedWindowStorageDecreaseIsNoOp(t *testing.T) {
+	storage := NewFixedWindowStorage(time.Minute, discardLogger())
+	storage.Increase("a")
+	storage.Decrease("a")
+	expectCount(t, storage, "a", 1)
+}
+
+func TestFixedWindowStorageIgnoresLocationAndMonotonicReading(t *testing.T) {
+	base := time.Now().Truncate(time.Hour).Add(time.Minute) // Carries a monotonic clock reading
+	tehran := time.FixedZone("IRST", 3*3600+1800)
+	times := []time.Time{base, base.In(tehran), base.Round(0).Add(time.Second).In(time.UTC)}
+	current := 0
+	storage := NewFixedWindowStorageWithClock(time.Hour, func() time.Time { return times[current] }, discardLogger())
+
+	for current = range times {
+		storage.Increase("a")
+	}
+	expectCount(t, storage, "a", uint16(len(times)))
+}
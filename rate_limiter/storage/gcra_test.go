@@ -0,0 +1,66 @@
+package rlstorage
+
+import (
+	"testing"
+	"time"
+)
+
+// gcraBackends are the storages implementing GCRAStorage, by name.
+var gcraBackends = map[string]func(t testing.TB) RLStorage{
+	"hashmap": func(testing.TB) RLStorage { return NewHashMapStorage(discardLogger()) },
+	"redis":   func(t testing.TB) RLStorage { return newRedisStorage(t, time.Hour) },
+}
+
+func TestUpdateTAT(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	steps := []struct {
+		id      string
+		at      time.Duration
+		cost    uint16
+		allowed bool
+		tat     time.Duration
+	}{
+		{"a", 0, 1, true, time.Second},
+		{"a", 0, 1, true, 2 * time.Second},
+		{"a", 0, 1, false, 2 * time.Second}, // A third request would lie more than the tolerance ahead
+		{"a", time.Second, 1, true, 3 * time.Second},
+		{"a", 10 * time.Second, 2, true, 12 * time.Second}, // The TAT caught up with time while idle
+		{"b", 0, 3, false, 0},
+	}
+	for name, newStorage := range gcraBackends {
+		t.Run(name, func(t *testing.T) {
+			storage, ok := newStorage(t).(GCRAStorage)
+			if !ok {
+				t.Fatal("the storage does not implement GCRAStorage")
+			}
+			for _, step := range steps {
+				allowed, tat, err := storage.UpdateTAT(step.id, start.Add(step.at), time.Second, 2*time.Second, step.cost)
+				if err != nil || allowed != step.allowed || !tat.Equal(start.Add(step.tat)) {
+					t.Fatalf("UpdateTAT(%q) at %v = %t, %v, %v, want %t, %v",
+						step.id, step.at, allowed, tat.Sub(start), err, step.allowed, step.tat)
+				}
+			}
+		})
+	}
+}
+
+func TestFreeResetsTAT(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for name, newStorage := range gcraBackends {
+		t.Run(name, func(t *testing.T) {
+			storage := newStorage(t)
+			gcra := storage.(GCRAStorage)
+			gcra.UpdateTAT("a", now, time.Second, time.Second, 1)
+			if allowed, _, _ := gcra.UpdateTAT("a", now, time.Second, time.Second, 1); allowed {
+				t.Fatal("UpdateTAT() beyond the tolerance allowed")
+			}
+
+			if err := storage.Free("a"); err != nil {
+				t.Fatalf("Free() error = %v", err)
+			}
+			if allowed, _, err := gcra.UpdateTAT("a", now, time.Second, time.Second, 1); err != nil || !allowed {
+				t.Fatalf("UpdateTAT() after Free = %t, %v, want allowed", allowed, err)
+			}
+		})
+	}
+}
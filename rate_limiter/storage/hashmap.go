@@ -1,69 +1,320 @@
 package rlstorage
 
 import (
+	"math"
 	"sync"
+	"time"
 
-	"github.com/sirupsen/logrus"
+	rllog "github.com/FMotalleb/gin_testfield/rate_limiter/logging"
 )
 
+// tokenBucket holds the state of a token bucket.
+type tokenBucket struct {
+	tokens     float64   // The (fractional) number of tokens available
+	lastRefill time.Time // The last time the bucket was refilled
+}
+
 // hashMapStorage is a struct that represents a storage implementation using a hash map.
 type hashMapStorage struct {
-	storage map[string]uint16 // The underlying hash map to store the key-value pairs
-	lock    sync.Mutex        // A mutex lock to ensure thread-safe access to the storage
-	logger  *logrus.Logger    // Logger instance for logging messages
+	storage    map[string]uint16       // The underlying hash map to store the key-value pairs
+	buckets    map[string]*tokenBucket // The token buckets, kept apart from the counters
+	lock       sync.Mutex              // A mutex lock to ensure thread-safe access to the storage
+	logger     rllog.Logger            // Logger instance for logging messages
+	violations map[string]uint16       // The violation counters, kept apart from the request counters
+	lastAccess map[string]time.Time    // The last time each id was accessed, used to sweep idle ids
+	windows    map[string][]time.Time  // The sliding window logs of request timestamps (oldest first), kept apart from the counters
+	tats       map[string]time.Time    // The theoretical arrival times of the GCRA, kept apart from the counters
+	clock      func() time.Time        // The function used to read the current time
 }
 
 // Decrease decrements the count for the given id in the storage.
 // If the count becomes 0 or less, the id is removed from the storage.
-func (h *hashMapStorage) Decrease(id string) {
+func (h *hashMapStorage) Decrease(id string) error {
 	defer h.lock.Unlock()  // Unlock the mutex when the function returns
 	h.lock.Lock()          // Lock the mutex to ensure exclusive access to the storage
 	count := h.storage[id] // Get the current count for the id
+	h.touch(id)
 	if count <= 1 {
-		h.Free(id) // If the count is 1 or less, remove the id from the storage
+		h.drop(id) // If the count is 1 or less, remove the id from the storage
 	} else {
 		h.storage[id] = count - 1 // Otherwise, decrement the count by 1
 	}
+	return nil
 }
 
 // Free removes the given id from the storage.
-func (h *hashMapStorage) Free(id string) {
+func (h *hashMapStorage) Free(id string) error {
 	defer h.lock.Unlock() // Unlock the mutex when the function returns
 	h.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	h.free(id)
+	return nil
+}
+
+// free removes every state of the given id from the storage, including its token bucket and violation
+// counter, the caller must hold the lock.
+func (h *hashMapStorage) free(id string) {
+	delete(h.buckets, id)
+	delete(h.violations, id)
+	h.drop(id)
+}
+
+// drop removes the count of the given id from the storage, keeping its token bucket and violation counter,
+// the caller must hold the lock.
+func (h *hashMapStorage) drop(id string) {
 	delete(h.storage, id) // Remove the id from the storage
-	h.logger.Debugf("Freed ID '%s' from storage", id)
+	delete(h.lastAccess, id)
+	delete(h.windows, id)
+	delete(h.tats, id)
+	h.logger.Debug("Freed ID from storage", "id", id)
 }
 
 // Get retrieves the count for the given id from the storage.
-func (h *hashMapStorage) Get(id string) uint16 {
+func (h *hashMapStorage) Get(id string) (uint16, error) {
 	defer h.lock.Unlock() // Unlock the mutex when the function returns
 	h.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
 	count := h.storage[id]
-	h.logger.Debugf("Got count %d for ID '%s'", count, id)
-	return count // Return the count for the id (returns 0 if id doesn't exist)
+	if count > 0 {
+		h.touch(id)
+	}
+	h.logger.Debug("Got count for ID", "id", id, "count", count)
+	return count, nil // Return the count for the id (returns 0 if id doesn't exist)
 }
 
 // Increase increments the count for the given id in the storage.
-func (h *hashMapStorage) Increase(id string) {
+func (h *hashMapStorage) Increase(id string) error {
 	defer h.lock.Unlock() // Unlock the mutex when the function returns
 	h.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
 	h.storage[id]++       // Increment the count for the id by 1
-	h.logger.Debugf("Increased count to %d for ID '%s'", h.storage[id], id)
+	h.touch(id)
+	h.logger.Debug("Increased count for ID", "id", id, "count", h.storage[id])
+	return nil
 }
 
 // NewHashMapStorage creates a new instance of RLStorage using hashMapStorage.
-func NewHashMapStorage(logger *logrus.Logger) RLStorage {
+func NewHashMapStorage(logger rllog.Logger) RLStorage {
+	return NewHashMapStorageWithClock(time.Now, logger)
+}
+
+// NewHashMapStorageWithClock works like NewHashMapStorage, but reads the current time from the given clock
+// (e.g. the one passed to Config.Clock, or a fake clock in tests) to refill token buckets and sweep idle ids.
+func NewHashMapStorageWithClock(clock func() time.Time, logger rllog.Logger) RLStorage {
 	return &hashMapStorage{
-		storage: make(map[string]uint16), // Initialize the hash map storage
-		lock:    sync.Mutex{},            // Initialize the mutex lock
-		logger:  logger,                  // Set the logger instance
+		storage:    make(map[string]uint16),       // Initialize the hash map storage
+		buckets:    make(map[string]*tokenBucket), // Initialize the token buckets
+		violations: make(map[string]uint16),       // Initialize the violation counters
+		lastAccess: make(map[string]time.Time),    // Initialize the last access timestamps
+		windows:    make(map[string][]time.Time),  // Initialize the sliding window logs
+		tats:       make(map[string]time.Time),    // Initialize the theoretical arrival times
+		clock:      clock,                         // Set the clock
+		lock:       sync.Mutex{},                  // Initialize the mutex lock
+		logger:     logger,                        // Set the logger instance
 	}
 }
 
 // FreeAll removes all entries from the storage.
-func (h *hashMapStorage) FreeAll() {
+func (h *hashMapStorage) FreeAll() error {
 	defer h.lock.Unlock() // Unlock the mutex when the function returns
 	h.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
 	h.storage = make(map[string]uint16)
+	h.buckets = make(map[string]*tokenBucket)
+	h.violations = make(map[string]uint16)
+	h.lastAccess = make(map[string]time.Time)
+	h.windows = make(map[string][]time.Time)
+	h.tats = make(map[string]time.Time)
 	h.logger.Info("Freed all entries from storage")
+	return nil
+}
+
+// TakeTokens refills the token bucket of the given id and takes n tokens if that many are available.
+func (h *hashMapStorage) TakeTokens(id string, n uint16, rate float64, burst uint16) (bool, float64, error) {
+	defer h.lock.Unlock() // Unlock the mutex when the function returns
+	h.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	now := h.clock()
+	bucket, ok := h.buckets[id]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(burst), lastRefill: now} // New buckets start full
+		h.buckets[id] = bucket
+	}
+	elapsed := now.Sub(bucket.lastRefill).Seconds()
+	bucket.tokens = math.Min(float64(burst), bucket.tokens+elapsed*rate)
+	bucket.lastRefill = now
+
+	if bucket.tokens < float64(n) {
+		h.logger.Debug("Not enough tokens left for ID", "id", id, "tokens", bucket.tokens, "wanted", n)
+		return false, bucket.tokens, nil
+	}
+	bucket.tokens -= float64(n)
+	h.logger.Debug("Took tokens for ID", "id", id, "taken", n, "tokens", bucket.tokens)
+	return true, bucket.tokens, nil
+}
+
+// CheckAndIncrement increments the count for the given id under a single lock if it is below limit.
+// The reset time is unknown to this storage (counts are released by the middleware), so it is always zero.
+func (h *hashMapStorage) CheckAndIncrement(id string, limit uint16) (bool, uint16, time.Time, error) {
+	return h.CheckAndIncrementBy(id, limit, 1)
+}
+
+// CheckAndIncrementBy increments the count for the given id by cost under a single lock
+// if the result does not exceed limit.
+func (h *hashMapStorage) CheckAndIncrementBy(id string, limit, cost uint16) (bool, uint16, time.Time, error) {
+	defer h.lock.Unlock() // Unlock the mutex when the function returns
+	h.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	count := h.storage[id]
+	if uint32(count)+uint32(cost) > uint32(limit) {
+		h.logger.Debug("Count for ID reached limit", "id", id, "count", count, "limit", limit)
+		return false, count, time.Time{}, nil
+	}
+	h.storage[id] = count + cost
+	h.touch(id)
+	h.logger.Debug("Increased count for ID", "id", id, "count", count+cost)
+	return true, count + cost, time.Time{}, nil
+}
+
+// Transfer moves the count of the from id onto the to id under a single lock.
+func (h *hashMapStorage) Transfer(from, to string) (uint16, error) {
+	defer h.lock.Unlock() // Unlock the mutex when the function returns
+	h.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	count := h.storage[from]
+	if count == 0 {
+		return 0, nil
+	}
+	delete(h.storage, from)
+	delete(h.lastAccess, from)
+	h.touch(to)
+	h.storage[to] = uint16(min(uint32(h.storage[to])+uint32(count), math.MaxUint16))
+	h.logger.Debug("Transferred count between IDs", "from", from, "to", to, "count", count)
+	return count, nil
+}
+
+// AddViolation increments the violation counter for the given id and returns the new count.
+func (h *hashMapStorage) AddViolation(id string) (uint16, error) {
+	defer h.lock.Unlock() // Unlock the mutex when the function returns
+	h.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	if h.violations[id] < math.MaxUint16 {
+		h.violations[id]++
+	}
+	return h.violations[id], nil
+}
+
+// Violations retrieves the violation counter for the given id.
+func (h *hashMapStorage) Violations(id string) (uint16, error) {
+	defer h.lock.Unlock() // Unlock the mutex when the function returns
+	h.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	return h.violations[id], nil
+}
+
+// touch records the current time as the last access of the given id. The lock must be held.
+func (h *hashMapStorage) touch(id string) {
+	h.lastAccess[id] = h.clock()
+}
+
+// SweepIdle removes the counters, buckets, violations, window logs and TATs of all ids that were not accessed
+// within maxIdle and returns the number of removed ids. Buckets and TATs of ids never touched otherwise are
+// swept once they are idle too (a bucket once its last refill is older than maxIdle, a TAT once it is past).
+func (h *hashMapStorage) SweepIdle(maxIdle time.Duration) int {
+	defer h.lock.Unlock() // Unlock the mutex when the function returns
+	h.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	now := h.clock()
+	deadline := now.Add(-maxIdle)
+	swept := 0
+	for id, lastAccess := range h.lastAccess {
+		if lastAccess.Before(deadline) {
+			delete(h.storage, id)
+			delete(h.lastAccess, id)
+			delete(h.buckets, id)
+			delete(h.violations, id)
+			delete(h.windows, id)
+			delete(h.tats, id)
+			swept++
+		}
+	}
+	for id, bucket := range h.buckets {
+		if bucket.lastRefill.Before(deadline) {
+			delete(h.buckets, id)
+		}
+	}
+	for id, tat := range h.tats {
+		if tat.Before(now) {
+			delete(h.tats, id) // The TAT lies in the past, so it is equivalent to a missing one
+		}
+	}
+	if swept > 0 {
+		h.logger.Info("Swept idle entries from storage", "swept", swept)
+	}
+	return swept
+}
+
+// CheckAndRecord drops the timestamps of the given id that left the window, then records cost
+// timestamps at now if the request fits within limit.
+func (h *hashMapStorage) CheckAndRecord(id string, now time.Time, window time.Duration, limit, cost uint16) (bool, uint16, time.Time, error) {
+	defer h.lock.Unlock() // Unlock the mutex when the function returns
+	h.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	log := h.windows[id]
+	start := now.Add(-window)
+	expired := 0
+	for expired < len(log) && !log[expired].After(start) {
+		expired++
+	}
+	log = log[expired:]
+	allowed := len(log)+int(cost) <= int(limit)
+	if allowed {
+		for i := uint16(0); i < cost; i++ {
+			log = append(log, now)
+		}
+	}
+	if len(log) == 0 {
+		delete(h.windows, id)
+		return allowed, 0, time.Time{}, nil
+	}
+	h.windows[id] = log
+	h.touch(id)
+	return allowed, uint16(min(len(log), math.MaxUint16)), log[0].Add(window), nil
+}
+
+// Snapshot returns a copy of the current counts.
+func (h *hashMapStorage) Snapshot() (map[string]uint16, error) {
+	defer h.lock.Unlock() // Unlock the mutex when the function returns
+	h.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	snapshot := make(map[string]uint16, len(h.storage))
+	for id, count := range h.storage {
+		if count > 0 {
+			snapshot[id] = count
+		}
+	}
+	return snapshot, nil
+}
+
+// Len returns the number of ids in the storage.
+func (h *hashMapStorage) Len() (int, error) {
+	defer h.lock.Unlock() // Unlock the mutex when the function returns
+	h.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	return len(h.storage), nil
+}
+
+// IncreaseBy increments the count for the given id by n, saturating at math.MaxUint16.
+func (h *hashMapStorage) IncreaseBy(id string, n uint16) error {
+	defer h.lock.Unlock() // Unlock the mutex when the function returns
+	h.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	h.storage[id] = uint16(min(uint32(h.storage[id])+uint32(n), math.MaxUint16))
+	h.touch(id)
+	h.logger.Debug("Increased count for ID", "id", id, "count", h.storage[id])
+	return nil
+}
+
+// UpdateTAT advances the TAT of the given id by cost emission intervals under a single lock,
+// unless it would lie more than tolerance after now.
+func (h *hashMapStorage) UpdateTAT(id string, now time.Time, emission, tolerance time.Duration, cost uint16) (bool, time.Time, error) {
+	defer h.lock.Unlock() // Unlock the mutex when the function returns
+	h.lock.Lock()         // Lock the mutex to ensure exclusive access to the storage
+	tat := h.tats[id]
+	if tat.Before(now) {
+		tat = now
+	}
+	next := tat.Add(time.Duration(cost) * emission)
+	if next.Sub(now) > tolerance {
+		h.logger.Debug("TAT for ID exceeds the tolerance", "id", id, "tat", next)
+		return false, tat, nil
+	}
+	h.tats[id] = next
+	return true, next, nil
 }
@@ -0,0 +1,112 @@
+package rlstorage
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHashMapTakeTokensAccountsFractionalTokens(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	storage := NewHashMapStorageWithClock(func() time.Time { return now }, discardLogger()).(BucketStorage)
+
+	for want := 1.0; want >= 0; want-- {
+		taken, tokens, err := storage.TakeTokens("a", 1, 10, 2)
+		if err != nil || !taken || tokens != want {
+			t.Fatalf("TakeTokens() = %t, %f, %v, want a token taken with %f left", taken, tokens, err, want)
+		}
+	}
+	if taken, _, _ := storage.TakeTokens("a", 1, 10, 2); taken {
+		t.Fatal("TakeTokens() took a token from an empty bucket")
+	}
+	now = now.Add(150 * time.Millisecond)
+	taken, tokens, _ := storage.TakeTokens("a", 1, 10, 2)
+	if !taken || math.Abs(tokens-0.5) > 1e-9 {
+		t.Fatalf("TakeTokens() after a refill = %t, %f, want a token taken with 0.5 left", taken, tokens)
+	}
+}
+
+func TestHashMapSweepIdleSweepsEveryState(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	storage := NewHashMapStorageWithClock(func() time.Time { return now }, discardLogger()).(*hashMapStorage)
+	storage.Increase("idle")
+	storage.AddViolation("idle")
+	storage.TakeTokens("idle", 1, 1, 5)
+	storage.CheckAndRecord("idle", now, time.Hour, 10, 1)
+	storage.UpdateTAT("idle", now, time.Hour, 2*time.Hour, 1)
+
+	now = now.Add(30 * time.Second)
+	storage.Increase("active")
+	if swept := storage.SweepIdle(time.Minute); swept != 0 {
+		t.Fatalf("SweepIdle() = %d before the idle time, want 0", swept)
+	}
+
+	now = now.Add(45 * time.Second)
+	if swept := storage.SweepIdle(time.Minute); swept != 1 {
+		t.Fatalf("SweepIdle() = %d, want 1", swept)
+	}
+	expectCount(t, storage, "idle", 0)
+	expectCount(t, storage, "active", 1)
+	if violations, _ := storage.Violations("idle"); violations != 0 {
+		t.Errorf("violations = %d after the sweep, want 0", violations)
+	}
+	if len(storage.buckets) != 0 || len(storage.windows) != 0 || len(storage.tats) != 0 {
+		t.Errorf("buckets, windows and TATs = %v, %v, %v after the sweep, want none", storage.buckets, storage.windows, storage.tats)
+	}
+}
+
+func TestHashMapTransfer(t *testing.T) {
+	storage := NewHashMapStorage(discardLogger())
+	storage.Increase("from")
+	storage.Increase("from")
+	storage.Increase("to")
+
+	moved, err := storage.(Transferer).Transfer("from", "to")
+	if err != nil || moved != 2 {
+		t.Fatalf("Transfer() = %d, %v, want 2 units moved", moved, err)
+	}
+	expectCount(t, storage, "from", 0)
+	expectCount(t, storage, "to", 3)
+}
+
+func TestHashMapDecreaseReleasesLastUnit(t *testing.T) {
+	storage := NewHashMapStorage(discardLogger())
+	storage.Increase("a")
+
+	done := make(chan error)
+	go func() { done <- storage.Decrease("a") }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Decrease() = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Decrease() of the last unit deadlocked")
+	}
+	expectCount(t, storage, "a", 0)
+	if keys, _ := storage.(KeyCounter).Len(); keys != 0 {
+		t.Errorf("Len() = %d after releasing the last unit, want 0", keys)
+	}
+}
+
+func TestHashMapConcurrentAccess(t *testing.T) {
+	storage := NewHashMapStorage(discardLogger())
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				storage.Increase(id)
+				storage.Get(id)
+				storage.Decrease(id)
+			}
+		}(strconv.Itoa(i % 5))
+	}
+	wg.Wait()
+	for i := 0; i < 5; i++ {
+		expectCount(t, storage, strconv.Itoa(i), 0)
+	}
+}
@@ -0,0 +1,43 @@
+package rlstorage
+
+// nullStorage is a storage that never counts anything.
+type nullStorage struct{}
+
+// NewNullStorage creates a new instance of RLStorage that never counts anything: Get always returns 0
+// and the other methods do nothing, so the middleware never limits a request. It is useful to exercise
+// the middleware wiring in tests, or to disable limiting in an environment without removing the middleware.
+// As there is nothing to release, the middleware never queues the requests it allows for release.
+func NewNullStorage() RLStorage {
+	return nullStorage{}
+}
+
+// IsNullStorage reports whether the given storage is a null storage (see NewNullStorage).
+func IsNullStorage(storage RLStorage) bool {
+	_, ok := storage.(nullStorage)
+	return ok
+}
+
+// Decrease does nothing.
+func (nullStorage) Decrease(string) error {
+	return nil
+}
+
+// Free does nothing.
+func (nullStorage) Free(string) error {
+	return nil
+}
+
+// Get always returns 0.
+func (nullStorage) Get(string) (uint16, error) {
+	return 0, nil
+}
+
+// Increase does nothing.
+func (nullStorage) Increase(string) error {
+	return nil
+}
+
+// FreeAll does nothing.
+func (nullStorage) FreeAll() error {
+	return nil
+}
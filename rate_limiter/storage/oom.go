@@ -0,0 +1,333 @@
+package rlstorage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// oomFallbackStorage is a struct that implements the RLStorage interface by forwarding operations to
+// a primary storage, switching to a fallback storage for a while once the primary runs out of memory.
+type oomFallbackStorage struct {
+	primary  RLStorage         // The storage used while it has memory left
+	fallback RLStorage         // The storage used while the primary is out of memory
+	cooldown time.Duration     // How long the fallback is used before the primary is tried again
+	onOOM    func(error)       // An optional function called whenever the primary runs out of memory
+	fallenAt atomic.Int64      // The time (unix nanoseconds) of the last switch to the fallback, 0 if on the primary
+	charged  map[string]uint16 // The units charged on the fallback and not released yet, per id
+	lock     sync.Mutex        // A mutex lock guarding charged
+}
+
+// NewOOMFallbackStorage creates a new instance of RLStorage that forwards every operation to the primary
+// storage until one fails with ErrOutOfMemory. The failed operation is then retried on the fallback
+// (e.g. an in-memory storage), onOOM (if set) is called so the condition can be alerted on, and the
+// fallback serves every operation for the cooldown duration before the primary is tried again.
+//
+// Counts are not carried over between the storages, so clients get a fresh budget on each switch.
+// Units are released from the storage that charged them: the units charged on the fallback are
+// released from it even after the cooldown, instead of being decreased from the primary.
+// To fail closed instead, keep the primary and reject requests whose storage error wraps ErrOutOfMemory
+// (see Config.OnStorageError).
+//
+// The optional interfaces (atomic checks, token buckets, sliding windows, GCRA, violations, snapshots and
+// idle sweeping) are only supported if both storages support them (see As), since either may serve them.
+// The TTL, the key prefix and the tracer are forwarded to both storages.
+func NewOOMFallbackStorage(primary, fallback RLStorage, cooldown time.Duration, onOOM func(error)) RLStorage {
+	return &oomFallbackStorage{
+		primary:  primary,
+		fallback: fallback,
+		cooldown: cooldown,
+		onOOM:    onOOM,
+		charged:  make(map[string]uint16),
+	}
+}
+
+// current returns the storage operations are currently forwarded to.
+func (o *oomFallbackStorage) current() RLStorage {
+	fallenAt := o.fallenAt.Load()
+	if fallenAt != 0 && time.Since(time.Unix(0, fallenAt)) < o.cooldown {
+		return o.fallback
+	}
+	return o.primary
+}
+
+// handle switches to the fallback if the given error of the given storage is an out of memory error,
+// and reports whether the operation should be retried on the fallback.
+func (o *oomFallbackStorage) handle(storage RLStorage, err error) bool {
+	if storage != o.primary || !errors.Is(err, ErrOutOfMemory) {
+		return false
+	}
+	o.fallenAt.Store(time.Now().UnixNano())
+	if o.onOOM != nil {
+		o.onOOM(err)
+	}
+	return true
+}
+
+// Get retrieves the count for the given id from the current storage.
+func (o *oomFallbackStorage) Get(id string) (count uint16, err error) {
+	err = o.apply(func(storage RLStorage) error {
+		count, err = storage.Get(id)
+		return err
+	})
+	return count, err
+}
+
+// Increase increments the count for the given id on the current storage.
+func (o *oomFallbackStorage) Increase(id string) error {
+	return o.increase(id, 1, func(storage RLStorage) error { return storage.Increase(id) })
+}
+
+// Decrease decrements the count for the given id on the storage that charged it.
+func (o *oomFallbackStorage) Decrease(id string) error {
+	return o.release(id, func(storage RLStorage) error { return storage.Decrease(id) })
+}
+
+// Free removes the given id from both storages.
+func (o *oomFallbackStorage) Free(id string) error {
+	o.forget(id)
+	return errors.Join(o.primary.Free(id), o.fallback.Free(id))
+}
+
+// FreeAll removes all entries from both storages.
+func (o *oomFallbackStorage) FreeAll() error {
+	o.lock.Lock()
+	o.charged = make(map[string]uint16)
+	o.lock.Unlock()
+	return errors.Join(o.primary.FreeAll(), o.fallback.FreeAll())
+}
+
+// GetCtx works like Get, but returns early with the context's error once ctx is done.
+func (o *oomFallbackStorage) GetCtx(ctx context.Context, id string) (count uint16, err error) {
+	err = o.apply(func(storage RLStorage) error {
+		count, err = GetContext(ctx, storage, id)
+		return err
+	})
+	return count, err
+}
+
+// IncreaseCtx works like Increase, but returns early with the context's error once ctx is done.
+func (o *oomFallbackStorage) IncreaseCtx(ctx context.Context, id string) error {
+	return o.increase(id, 1, func(storage RLStorage) error { return IncreaseContext(ctx, storage, id) })
+}
+
+// DecreaseCtx works like Decrease, but returns early with the context's error once ctx is done.
+func (o *oomFallbackStorage) DecreaseCtx(ctx context.Context, id string) error {
+	return o.release(id, func(storage RLStorage) error { return DecreaseContext(ctx, storage, id) })
+}
+
+// FreeCtx works like Free, but returns early with the context's error once ctx is done.
+func (o *oomFallbackStorage) FreeCtx(ctx context.Context, id string) error {
+	o.forget(id)
+	return errors.Join(FreeContext(ctx, o.primary, id), FreeContext(ctx, o.fallback, id))
+}
+
+// IncreaseBy increments the count for the given id by n on the current storage.
+func (o *oomFallbackStorage) IncreaseBy(id string, n uint16) error {
+	return o.increase(id, n, func(storage RLStorage) error { return storage.(IncreaserBy).IncreaseBy(id, n) })
+}
+
+// CheckAndIncrement runs the atomic check for the given id on the current storage.
+func (o *oomFallbackStorage) CheckAndIncrement(id string, limit uint16) (bool, uint16, time.Time, error) {
+	return o.check(id, 1, func(storage RLStorage) (bool, uint16, time.Time, error) {
+		return storage.(CheckAndIncrementer).CheckAndIncrement(id, limit)
+	})
+}
+
+// CheckAndIncrementBy runs the weighted atomic check for the given id on the current storage.
+func (o *oomFallbackStorage) CheckAndIncrementBy(id string, limit, cost uint16) (bool, uint16, time.Time, error) {
+	return o.check(id, cost, func(storage RLStorage) (bool, uint16, time.Time, error) {
+		return storage.(WeightedCheckAndIncrementer).CheckAndIncrementBy(id, limit, cost)
+	})
+}
+
+// CheckAndIncrementCtx works like CheckAndIncrement, but returns early with the context's error once ctx is done.
+func (o *oomFallbackStorage) CheckAndIncrementCtx(ctx context.Context, id string, limit uint16) (bool, uint16, time.Time, error) {
+	return o.check(id, 1, func(storage RLStorage) (bool, uint16, time.Time, error) {
+		return CheckAndIncrementContext(ctx, storage.(CheckAndIncrementer), id, limit)
+	})
+}
+
+// CheckAndIncrementByCtx works like CheckAndIncrementBy, but returns early with the context's error once ctx is done.
+func (o *oomFallbackStorage) CheckAndIncrementByCtx(ctx context.Context, id string, limit, cost uint16) (bool, uint16, time.Time, error) {
+	return o.check(id, cost, func(storage RLStorage) (bool, uint16, time.Time, error) {
+		return CheckAndIncrementByContext(ctx, storage.(WeightedCheckAndIncrementer), id, limit, cost)
+	})
+}
+
+// TakeTokens takes n tokens from the token bucket of the given id on the current storage.
+func (o *oomFallbackStorage) TakeTokens(id string, n uint16, rate float64, burst uint16) (taken bool, tokens float64, err error) {
+	err = o.apply(func(storage RLStorage) error {
+		taken, tokens, err = storage.(BucketStorage).TakeTokens(id, n, rate, burst)
+		return err
+	})
+	return taken, tokens, err
+}
+
+// CheckAndRecord runs the sliding window check for the given id on the current storage.
+// The recorded requests leave the window on their own, so they are not charged for a release.
+func (o *oomFallbackStorage) CheckAndRecord(id string, now time.Time, window time.Duration, limit, cost uint16) (bool, uint16, time.Time, error) {
+	return o.check(id, 0, func(storage RLStorage) (bool, uint16, time.Time, error) {
+		return storage.(SlidingWindowStorage).CheckAndRecord(id, now, window, limit, cost)
+	})
+}
+
+// UpdateTAT advances the theoretical arrival time of the given id on the current storage.
+func (o *oomFallbackStorage) UpdateTAT(id string, now time.Time, emission, tolerance time.Duration, cost uint16) (allowed bool, tat time.Time, err error) {
+	err = o.apply(func(storage RLStorage) error {
+		allowed, tat, err = storage.(GCRAStorage).UpdateTAT(id, now, emission, tolerance, cost)
+		return err
+	})
+	return allowed, tat, err
+}
+
+// AddViolation records a violation for the given id on the current storage.
+func (o *oomFallbackStorage) AddViolation(id string) (count uint16, err error) {
+	err = o.apply(func(storage RLStorage) error {
+		count, err = storage.(ViolationTracker).AddViolation(id)
+		return err
+	})
+	return count, err
+}
+
+// Violations retrieves the violation count of the given id from the current storage.
+func (o *oomFallbackStorage) Violations(id string) (count uint16, err error) {
+	err = o.apply(func(storage RLStorage) error {
+		count, err = storage.(ViolationTracker).Violations(id)
+		return err
+	})
+	return count, err
+}
+
+// Len returns the number of ids tracked by the current storage.
+func (o *oomFallbackStorage) Len() (count int, err error) {
+	err = o.apply(func(storage RLStorage) error {
+		count, err = storage.(KeyCounter).Len()
+		return err
+	})
+	return count, err
+}
+
+// Snapshot returns the counts of the current storage.
+func (o *oomFallbackStorage) Snapshot() (counts map[string]uint16, err error) {
+	err = o.apply(func(storage RLStorage) error {
+		counts, err = storage.(Snapshotter).Snapshot()
+		return err
+	})
+	return counts, err
+}
+
+// SweepIdle removes the ids idle for longer than maxIdle from both storages and returns the number of removed ids.
+func (o *oomFallbackStorage) SweepIdle(maxIdle time.Duration) int {
+	return o.primary.(IdleSweeper).SweepIdle(maxIdle) + o.fallback.(IdleSweeper).SweepIdle(maxIdle)
+}
+
+// Evictions returns the number of ids evicted by both storages.
+func (o *oomFallbackStorage) Evictions() uint64 {
+	return o.primary.(EvictionCounter).Evictions() + o.fallback.(EvictionCounter).Evictions()
+}
+
+// TTL returns the shortest TTL of both storages, 0 if any of them is unset.
+func (o *oomFallbackStorage) TTL() time.Duration {
+	return shortestTTL(o.primary, o.fallback)
+}
+
+// SetTTL sets the TTL of both storages.
+func (o *oomFallbackStorage) SetTTL(ttl time.Duration) {
+	setTTL(ttl, o.primary, o.fallback)
+}
+
+// SetKeyPrefix sets the key prefix of both storages.
+func (o *oomFallbackStorage) SetKeyPrefix(prefix string) {
+	setKeyPrefix(prefix, o.primary, o.fallback)
+}
+
+// SetTracer sets the tracer of both storages.
+func (o *oomFallbackStorage) SetTracer(tracer trace.Tracer) {
+	setTracer(tracer, o.primary, o.fallback)
+}
+
+// Unwrap returns the primary and the fallback, which may both serve the optional interfaces.
+func (o *oomFallbackStorage) Unwrap() []RLStorage {
+	return []RLStorage{o.primary, o.fallback}
+}
+
+// check runs the given atomic check on the current storage, retrying it on the fallback
+// if the primary ran out of memory, and charges cost units to the storage that allowed it.
+func (o *oomFallbackStorage) check(id string, cost uint16, check func(RLStorage) (bool, uint16, time.Time, error)) (allowed bool, count uint16, resetAt time.Time, err error) {
+	storage, err := o.serve(func(storage RLStorage) error {
+		allowed, count, resetAt, err = check(storage)
+		return err
+	})
+	if err == nil && allowed {
+		o.charge(storage, id, cost)
+	}
+	return allowed, count, resetAt, err
+}
+
+// increase runs the given increase of the given id by n units on the current storage, retrying it on
+// the fallback if the primary ran out of memory, and charges the units to the storage that served it.
+func (o *oomFallbackStorage) increase(id string, n uint16, increase func(RLStorage) error) error {
+	storage, err := o.serve(increase)
+	if err == nil {
+		o.charge(storage, id, n)
+	}
+	return err
+}
+
+// charge records n units of the given id charged on the given storage, if it is the fallback.
+func (o *oomFallbackStorage) charge(storage RLStorage, id string, n uint16) {
+	if storage != o.fallback || n == 0 {
+		return
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.charged[id] += n
+}
+
+// release runs the given decrease of the given id on the storage that charged the unit:
+// the fallback while it holds units of the id, the primary otherwise.
+func (o *oomFallbackStorage) release(id string, decrease func(RLStorage) error) error {
+	o.lock.Lock()
+	charged := o.charged[id]
+	if charged > 1 {
+		o.charged[id] = charged - 1
+	} else {
+		delete(o.charged, id)
+	}
+	o.lock.Unlock()
+	if charged > 0 {
+		return decrease(o.fallback)
+	}
+	return decrease(o.primary)
+}
+
+// forget drops the units of the given id charged on the fallback.
+func (o *oomFallbackStorage) forget(id string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	delete(o.charged, id)
+}
+
+// apply runs the given operation on the current storage, retrying it on the fallback
+// if the primary ran out of memory.
+func (o *oomFallbackStorage) apply(operation func(RLStorage) error) error {
+	_, err := o.serve(operation)
+	return err
+}
+
+// serve runs the given operation on the current storage, retrying it on the fallback
+// if the primary ran out of memory, and returns the storage that served it.
+func (o *oomFallbackStorage) serve(operation func(RLStorage) error) (RLStorage, error) {
+	storage := o.current()
+	err := operation(storage)
+	if o.handle(storage, err) {
+		storage = o.fallback
+		err = operation(storage)
+	}
+	return storage, err
+}
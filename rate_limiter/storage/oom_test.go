@@ -0,0 +1,103 @@
+package rlstorage
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// oomMessage is the error Redis replies with once it reached maxmemory.
+const oomMessage = "OOM command not allowed when used memory > 'maxmemory'."
+
+func TestRedisOutOfMemoryErrorsWrapErrOutOfMemory(t *testing.T) {
+	server, client := newMiniredis(t)
+	storage := NewRedisStorage(client, time.Minute, discardLogger())
+
+	server.SetError(oomMessage)
+	if err := storage.Increase("a"); !errors.Is(err, ErrOutOfMemory) {
+		t.Errorf("Increase() = %v, want an error wrapping ErrOutOfMemory", err)
+	}
+	server.SetError("ERR something else")
+	if err := storage.Increase("a"); err == nil || errors.Is(err, ErrOutOfMemory) {
+		t.Errorf("Increase() = %v, want an error not wrapping ErrOutOfMemory", err)
+	}
+}
+
+func TestOOMFallbackSwitchesForCooldown(t *testing.T) {
+	server, client := newMiniredis(t)
+	primary := NewRedisStorage(client, time.Minute, discardLogger())
+	fallback := NewHashMapStorage(discardLogger())
+	var reported []error
+	storage := NewOOMFallbackStorage(primary, fallback, 50*time.Millisecond, func(err error) {
+		reported = append(reported, err)
+	})
+
+	storage.Increase("a")
+	expectCount(t, primary, "a", 1)
+
+	server.SetError(oomMessage)
+	if err := storage.Increase("a"); err != nil {
+		t.Fatalf("Increase() = %v, want the write retried on the fallback", err)
+	}
+	if len(reported) != 1 || !errors.Is(reported[0], ErrOutOfMemory) {
+		t.Fatalf("reported errors = %v, want a single out of memory error", reported)
+	}
+	storage.Increase("a")
+	expectCount(t, fallback, "a", 2)
+	if len(reported) != 1 {
+		t.Errorf("reported %d errors during the cooldown, want the primary left alone", len(reported))
+	}
+
+	server.SetError("")
+	time.Sleep(60 * time.Millisecond)
+	expectCount(t, storage, "a", 1) // Back on the primary
+}
+
+func TestOOMFallbackReleasesUnitsWhereTheyWereCharged(t *testing.T) {
+	server, client := newMiniredis(t)
+	primary := NewRedisStorage(client, time.Minute, discardLogger())
+	fallback := NewHashMapStorage(discardLogger())
+	storage := NewOOMFallbackStorage(primary, fallback, 50*time.Millisecond, nil)
+
+	storage.Increase("a")
+	server.SetError(oomMessage)
+	storage.Increase("a")
+	storage.(CheckAndIncrementer).CheckAndIncrement("a", 5)
+	server.SetError("")
+	expectCount(t, primary, "a", 1)
+	expectCount(t, fallback, "a", 2)
+
+	// The units charged during the cooldown are released from the fallback after it
+	time.Sleep(60 * time.Millisecond)
+	storage.Decrease("a")
+	storage.Decrease("a")
+	expectCount(t, primary, "a", 1)
+	expectCount(t, fallback, "a", 0)
+	storage.Decrease("a")
+	expectCount(t, primary, "a", 0)
+}
+
+func TestOOMFallbackKeepsOtherErrors(t *testing.T) {
+	server, client := newMiniredis(t)
+	fallback := NewHashMapStorage(discardLogger())
+	storage := NewOOMFallbackStorage(NewRedisStorage(client, time.Minute, discardLogger()), fallback, time.Minute, nil)
+
+	server.SetError("ERR unavailable")
+	if err := storage.Increase("a"); err == nil {
+		t.Error("Increase() = nil, want the primary's error")
+	}
+	expectCount(t, fallback, "a", 0)
+}
+
+func TestOOMFallbackRetriesChecksOnFallback(t *testing.T) {
+	server, client := newMiniredis(t)
+	fallback := NewHashMapStorage(discardLogger())
+	storage := NewOOMFallbackStorage(NewRedisStorage(client, time.Minute, discardLogger()), fallback, time.Minute, nil)
+
+	server.SetError(oomMessage)
+	allowed, count, _, err := storage.(CheckAndIncrementer).CheckAndIncrement("a", 2)
+	if err != nil || !allowed || count != 1 {
+		t.Fatalf("CheckAndIncrement() = %t, %d, %v, want the check retried on the fallback", allowed, count, err)
+	}
+	expectCount(t, fallback, "a", 1)
+}
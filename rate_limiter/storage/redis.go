@@ -1,86 +1,648 @@
 package rlstorage
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
 	"strconv"
+	"strings"
 	"time"
 
+	rllog "github.com/FMotalleb/gin_testfield/rate_limiter/logging"
 	"github.com/go-redis/redis"
-	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// DefaultRedisKeyPrefix is the prefix every key of the Redis storages is namespaced under by default.
+const DefaultRedisKeyPrefix = "rl:"
+
+// The Redis keyspace used by the Redis storages, every kind of state lives under its own prefix
+// (following the key prefix of the storage).
+const (
+	countKeyPrefix       = "count:"      // The prefix of the keys holding request counters
+	violationsKeyPrefix  = "violations:" // The prefix of the keys holding violation counters
+	bucketKeyPrefix      = "bucket:"     // The prefix of the keys holding token buckets
+	windowKeyPrefix      = "window:"     // The prefix of the keys holding sliding window logs
+	fixedWindowKeyPrefix = "fixed:"      // The prefix of the keys holding fixed window counters
+	tatKeyPrefix         = "tat:"        // The prefix of the keys holding GCRA theoretical arrival times
+)
+
+// defaultViolationTTL is the TTL of violation counters, which outlive the request window
+// so that a client's offense history survives window resets.
+const defaultViolationTTL = 24 * time.Hour
+
+// takeTokenScript refills the token bucket hash at KEYS[1] at ARGV[1] tokens per second
+// (capped at ARGV[2] tokens) based on the time elapsed until ARGV[3] (milliseconds since the epoch),
+// then takes ARGV[4] tokens if that many are available (and none otherwise). Fractional token counts are stored as strings,
+// and the bucket expires once it would be full again.
+var takeTokenScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local taken = 0
+if tokens >= n then
+	tokens = tokens - n
+	taken = 1
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1)
+return {taken, tostring(tokens)}
+`)
+
+// checkAndIncrementScript increments the counter at KEYS[1] by ARGV[3] if the result does not exceed ARGV[1],
+// refreshing its TTL to ARGV[2] milliseconds. It returns {allowed, count, ttl in milliseconds}.
+var checkAndIncrementScript = redis.NewScript(`
+local count = tonumber(redis.call('GET', KEYS[1]) or '0')
+if count + tonumber(ARGV[3]) > tonumber(ARGV[1]) then
+	return {0, count, redis.call('PTTL', KEYS[1])}
+end
+count = redis.call('INCRBY', KEYS[1], ARGV[3])
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return {1, count, tonumber(ARGV[2])}
+`)
+
+// increaseScript increments the counter at KEYS[1] by ARGV[2] and sets its TTL to ARGV[1] milliseconds
+// when the key is created (or has no TTL), so a key never exists without a TTL. It returns the new count.
+var increaseScript = redis.NewScript(`
+local count = redis.call('INCRBY', KEYS[1], ARGV[2])
+if count == tonumber(ARGV[2]) or redis.call('PTTL', KEYS[1]) == -1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return count
+`)
+
+// decreaseScript decrements the counter at KEYS[1] unless it is already at (or below) zero,
+// in which case the key is deleted, so counters never go negative. It returns the new count.
+var decreaseScript = redis.NewScript(`
+local count = tonumber(redis.call('GET', KEYS[1]) or '0')
+if count <= 0 then
+	redis.call('DEL', KEYS[1])
+	return 0
+end
+return redis.call('DECR', KEYS[1])
+`)
+
+// transferScript moves the counter at KEYS[1] onto KEYS[2], refreshing the TTL of KEYS[2]
+// to ARGV[1] milliseconds. It returns the number of units moved.
+var transferScript = redis.NewScript(`
+local count = tonumber(redis.call('GET', KEYS[1]) or '0')
+if count <= 0 then
+	return 0
+end
+redis.call('DEL', KEYS[1])
+redis.call('INCRBY', KEYS[2], count)
+redis.call('PEXPIRE', KEYS[2], ARGV[1])
+return count
+`)
+
+// checkAndRecordScript drops the entries of the sorted set at KEYS[1] scored at or before ARGV[1] - ARGV[2]
+// (microseconds since the epoch and window in microseconds), then adds ARGV[4] entries scored ARGV[1]
+// (named after the unique token ARGV[5]) if the remaining count plus ARGV[4] does not exceed ARGV[3].
+// It returns {allowed, count, score of the oldest entry (empty if none)}.
+var checkAndRecordScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count + cost <= limit then
+	for i = 1, cost do
+		redis.call('ZADD', KEYS[1], now, ARGV[5] .. ':' .. i)
+	end
+	count = count + cost
+	allowed = 1
+	redis.call('PEXPIRE', KEYS[1], math.ceil(window / 1000))
+end
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+return {allowed, count, oldest[2] or ''}
+`)
+
+// updateTATScript advances the theoretical arrival time at KEYS[1] (or ARGV[1], if it lies in the past) by
+// ARGV[4] emission intervals of ARGV[2], unless it would lie more than ARGV[3] after ARGV[1] (all times in
+// microseconds since the epoch). The key expires once the TAT has passed. It returns {allowed, tat}.
+var updateTATScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local emission = tonumber(ARGV[2])
+local tolerance = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+local tat = tonumber(redis.call('GET', KEYS[1]) or '0')
+if tat < now then
+	tat = now
+end
+local new_tat = tat + cost * emission
+if new_tat - now > tolerance then
+	return {0, tat}
+end
+if new_tat > now then
+	redis.call('SET', KEYS[1], string.format('%d', new_tat), 'PX', math.ceil((new_tat - now) / 1000))
+end
+return {1, new_tat}
+`)
+
 // rlRedisStorage is a struct that implements the RLStorage interface
 // and uses Redis as the underlying storage mechanism for rate limiting.
 type rlRedisStorage struct {
-	client *redis.Client  // Redis client instance
-	ttl    time.Duration  // Time-to-live (TTL) for rate limiting keys
-	logger *logrus.Logger // Logger instance for logging messages
+	client       redis.UniversalClient // Redis client instance (standalone, cluster or failover)
+	ttl          time.Duration         // Time-to-live (TTL) for rate limiting keys
+	violationTTL time.Duration         // Time-to-live (TTL) for violation keys
+	prefix       string                // The prefix every key is namespaced under
+	tracer       trace.Tracer          // An optional tracer the context-bound calls create spans with
+	logger       rllog.Logger          // Logger instance for logging messages
 }
 
 // NewRedisStorage creates a new instance of rlRedisStorage with the provided
 // Redis client, TTL duration, and logger instance.
-func NewRedisStorage(client *redis.Client, ttl time.Duration, logger *logrus.Logger) RLStorage {
+//
+// Request counters are stored under `rl:count:{id}` with the given TTL, while violations are
+// stored under `rl:violations:{id}` with a longer TTL (defaultViolationTTL). Sliding window logs
+// are stored under `rl:window:{id}` and expire once their newest entry leaves the window.
+// The `rl:` namespace (DefaultRedisKeyPrefix) can be changed through KeyPrefixer.
+//
+// A TTL of 0 is derived from the middleware when the storage is passed to Config.Storage: at Build it
+// is set to the timeout plus the tolerance, so counters expire right after their releases are due.
+func NewRedisStorage(client *redis.Client, ttl time.Duration, logger rllog.Logger) RLStorage {
+	return NewRedisUniversalStorage(client, ttl, logger)
+}
+
+// NewRedisUniversalStorage works like NewRedisStorage, but accepts any redis.UniversalClient,
+// so the same storage works on standalone (*redis.Client), Sentinel-managed failover
+// (redis.NewFailoverClient) and cluster (*redis.ClusterClient) deployments.
+//
+// Every script touches a single key, so counters work under cluster hashing as is;
+// only Transfer and Free need all of their keys in the same slot (see Transfer and Free).
+func NewRedisUniversalStorage(client redis.UniversalClient, ttl time.Duration, logger rllog.Logger) RLStorage {
+	return NewRedisPrefixedStorage(client, DefaultRedisKeyPrefix, ttl, logger)
+}
+
+// NewRedisPrefixedStorage works like NewRedisUniversalStorage, but namespaces every key under the given
+// prefix instead of DefaultRedisKeyPrefix (e.g. `billing:count:{id}` for the prefix `billing:`), so several
+// services sharing a Redis instance neither see each other's counts nor clear them on FreeAll.
+func NewRedisPrefixedStorage(client redis.UniversalClient, prefix string, ttl time.Duration, logger rllog.Logger) RLStorage {
 	return &rlRedisStorage{
-		client: client,
-		ttl:    ttl,
-		logger: logger,
+		client:       client,
+		ttl:          ttl,
+		violationTTL: defaultViolationTTL,
+		prefix:       prefix,
+		logger:       logger,
 	}
 }
 
-// Decrease decrements the value associated with the given ID in Redis.
-func (r *rlRedisStorage) Decrease(id string) {
-	err := r.client.Decr(id).Err()
-	if err != nil {
-		r.logger.Warnf("Failed to Decrease value for ID '%s': %v", id, err)
+// Decrease decrements the value associated with the given ID in Redis, never below zero.
+func (r *rlRedisStorage) Decrease(id string) error {
+	return r.decrease(r.client, id)
+}
+
+// DecreaseCtx works like Decrease, but returns early with the context's error once ctx is done.
+func (r *rlRedisStorage) DecreaseCtx(ctx context.Context, id string) error {
+	ctx, span := startSpan(ctx, r.tracer, "ratelimit.redis.decrease", id)
+	_, err := runContext(ctx, func() (struct{}, error) {
+		return struct{}{}, r.decrease(withContext(ctx, r.client), id)
+	})
+	endSpan(span, err)
+	return err
+}
+
+// decrease decrements the value associated with the given ID using the given client.
+func (r *rlRedisStorage) decrease(client redis.UniversalClient, id string) error {
+	if err := decreaseScript.Run(client, []string{r.countKey(id)}).Err(); err != nil {
+		return fmt.Errorf("failed to decrease value for ID '%s': %w", id, redisError(err))
 	}
+	return nil
 }
 
-// Free sets the value associated with the given ID in Redis to 0.
-func (r *rlRedisStorage) Free(id string) {
-	err := r.client.Set(id, 0, 0).Err()
-	if err != nil {
-		r.logger.Warnf("Failed to Free value for ID '%s': %v", id, err)
+// Free drops every key of the given ID in a single DEL: its counter, GCRA arrival time, token bucket,
+// violation counter and sliding window log, so no zeroed counter is left behind without a TTL.
+// On Redis Cluster all of them must hash to the same slot (e.g. by a hash tag in the ID).
+func (r *rlRedisStorage) Free(id string) error {
+	return r.free(r.client, id)
+}
+
+// FreeCtx works like Free, but returns early with the context's error once ctx is done.
+func (r *rlRedisStorage) FreeCtx(ctx context.Context, id string) error {
+	ctx, span := startSpan(ctx, r.tracer, "ratelimit.redis.free", id)
+	_, err := runContext(ctx, func() (struct{}, error) {
+		return struct{}{}, r.free(withContext(ctx, r.client), id)
+	})
+	endSpan(span, err)
+	return err
+}
+
+// free frees the value associated with the given ID using the given client.
+func (r *rlRedisStorage) free(client redis.UniversalClient, id string) error {
+	keys := []string{r.countKey(id), r.tatKey(id), r.bucketKey(id), r.violationsKey(id), r.windowKey(id)}
+	if err := client.Del(keys...).Err(); err != nil {
+		return fmt.Errorf("failed to free value for ID '%s': %w", id, redisError(err))
 	}
+	return nil
 }
 
 // Get retrieves the value associated with the given ID from Redis and
-// returns it as a uint16.
-func (r *rlRedisStorage) Get(id string) uint16 {
-	val, err := r.client.Get(id).Result()
+// returns it as a uint16. A missing key is reported as 0 without an error.
+func (r *rlRedisStorage) Get(id string) (uint16, error) {
+	return r.get(r.client, id)
+}
+
+// GetCtx works like Get, but returns early with the context's error once ctx is done.
+func (r *rlRedisStorage) GetCtx(ctx context.Context, id string) (uint16, error) {
+	ctx, span := startSpan(ctx, r.tracer, "ratelimit.redis.get", id)
+	count, err := runContext(ctx, func() (uint16, error) {
+		return r.get(withContext(ctx, r.client), id)
+	})
+	if span != nil {
+		span.SetAttributes(attribute.Int("ratelimit.count", int(count)))
+	}
+	endSpan(span, err)
+	return count, err
+}
+
+// get retrieves the value associated with the given ID using the given client.
+func (r *rlRedisStorage) get(client redis.UniversalClient, id string) (uint16, error) {
+	val, err := client.Get(r.countKey(id)).Result()
+	if err == redis.Nil {
+		return 0, nil
+	}
 	if err != nil {
-		r.logger.Warnf("Failed to Get value for ID '%s': %v", id, err)
-		return 0
+		return 0, fmt.Errorf("failed to get value for ID '%s': %w", id, redisError(err))
 	}
 
 	result, err := strconv.Atoi(val)
 	if err != nil {
-		r.logger.Warnf("Failed to convert value for ID '%s': %v", id, err)
-		return 0
+		return 0, fmt.Errorf("failed to convert value for ID '%s': %w", id, err)
+	}
+
+	return uint16(result), nil
+}
+
+// Increase increments the value associated with the given ID in Redis and sets a TTL (Time-to-Live)
+// for the key (with millisecond precision) when it is created, atomically in a single Lua script.
+func (r *rlRedisStorage) Increase(id string) error {
+	return r.increase(r.client, id)
+}
+
+// IncreaseCtx works like Increase, but returns early with the context's error once ctx is done.
+func (r *rlRedisStorage) IncreaseCtx(ctx context.Context, id string) error {
+	ctx, span := startSpan(ctx, r.tracer, "ratelimit.redis.increase", id)
+	_, err := runContext(ctx, func() (struct{}, error) {
+		return struct{}{}, r.increase(withContext(ctx, r.client), id)
+	})
+	endSpan(span, err)
+	return err
+}
+
+// increase increments the value associated with the given ID using the given client.
+func (r *rlRedisStorage) increase(client redis.UniversalClient, id string) error {
+	return r.increaseBy(client, id, 1)
+}
+
+// IncreaseBy increments the value associated with the given ID by n in a single Lua script,
+// setting the TTL as Increase does.
+func (r *rlRedisStorage) IncreaseBy(id string, n uint16) error {
+	return r.increaseBy(r.client, id, n)
+}
+
+// increaseBy increments the value associated with the given ID by n using the given client.
+func (r *rlRedisStorage) increaseBy(client redis.UniversalClient, id string, n uint16) error {
+	if err := increaseScript.Run(client, []string{r.countKey(id)}, ttlMillis(r.ttl), n).Err(); err != nil {
+		return fmt.Errorf("failed to increase value for ID '%s': %w", id, redisError(err))
+	}
+	return nil
+}
+
+// FreeAll deletes every key under the key prefix of the storage (counters, violations, buckets and
+// sliding window logs) using SCAN and DEL, leaving unrelated data in the same database untouched.
+func (r *rlRedisStorage) FreeAll() error {
+	deleted, err := deleteKeys(r.client, r.prefix)
+	if err != nil {
+		return err
+	}
+	r.logger.Info("Freed all entries from storage", "keys", deleted)
+	return nil
+}
+
+// TTL returns the TTL of the request counters.
+func (r *rlRedisStorage) TTL() time.Duration {
+	return r.ttl
+}
+
+// SetTTL sets the TTL of the request counters.
+func (r *rlRedisStorage) SetTTL(ttl time.Duration) {
+	r.ttl = ttl
+}
+
+// SetTracer sets the tracer the context-bound calls of the storage create their spans with (see TracedStorage).
+func (r *rlRedisStorage) SetTracer(tracer trace.Tracer) {
+	r.tracer = tracer
+}
+
+// SetKeyPrefix sets the prefix every key of the storage is namespaced under (DefaultRedisKeyPrefix by default).
+func (r *rlRedisStorage) SetKeyPrefix(prefix string) {
+	r.prefix = prefix
+}
+
+// TakeTokens refills the token bucket of the given ID and takes n tokens if that many are available.
+// The refill math runs atomically in a Lua script, so buckets can be shared across instances.
+func (r *rlRedisStorage) TakeTokens(id string, n uint16, rate float64, burst uint16) (bool, float64, error) {
+	result, err := takeTokenScript.Run(
+		r.client,
+		[]string{r.bucketKey(id)},
+		rate,
+		burst,
+		time.Now().UnixMilli(),
+		n,
+	).Result()
+	if err != nil {
+		return false, 0, fmt.Errorf("failed to take tokens for ID '%s': %w", id, redisError(err))
+	}
+
+	values, _ := result.([]interface{})
+	if len(values) != 2 {
+		return false, 0, fmt.Errorf("unexpected TakeTokens result for ID '%s': %v", id, result)
+	}
+	taken, _ := values[0].(int64)
+	tokens, _ := values[1].(string)
+	remaining, err := strconv.ParseFloat(tokens, 64)
+	if err != nil {
+		r.logger.Warn("Failed to convert tokens for ID", "id", id, "error", err)
+	}
+	return taken == 1, remaining, nil
+}
+
+// CheckAndIncrement increments the value associated with the given ID if it is below limit,
+// atomically in a single Lua script. The reset time is derived from the key's TTL.
+func (r *rlRedisStorage) CheckAndIncrement(id string, limit uint16) (bool, uint16, time.Time, error) {
+	res, err := r.checkAndIncrement(r.client, id, limit, 1)
+	return res.allowed, res.count, res.resetAt, err
+}
+
+// CheckAndIncrementBy increments the value associated with the given ID by cost if the result does not
+// exceed limit, atomically in a single Lua script, so instances sharing the storage share one quota.
+func (r *rlRedisStorage) CheckAndIncrementBy(id string, limit, cost uint16) (bool, uint16, time.Time, error) {
+	res, err := r.checkAndIncrement(r.client, id, limit, cost)
+	return res.allowed, res.count, res.resetAt, err
+}
+
+// CheckAndIncrementByCtx works like CheckAndIncrementBy, but returns early with the context's error once ctx is done.
+func (r *rlRedisStorage) CheckAndIncrementByCtx(ctx context.Context, id string, limit, cost uint16) (bool, uint16, time.Time, error) {
+	ctx, span := startSpan(ctx, r.tracer, "ratelimit.redis.check_and_increment", id)
+	res, err := runContext(ctx, func() (checkResult, error) {
+		return r.checkAndIncrement(withContext(ctx, r.client), id, limit, cost)
+	})
+	endCheckSpan(span, res.allowed, res.count, err)
+	return res.allowed, res.count, res.resetAt, err
+}
+
+// CheckAndIncrementCtx works like CheckAndIncrement, but returns early with the context's error once ctx is done.
+func (r *rlRedisStorage) CheckAndIncrementCtx(ctx context.Context, id string, limit uint16) (bool, uint16, time.Time, error) {
+	return r.CheckAndIncrementByCtx(ctx, id, limit, 1)
+}
+
+// checkResult holds the outcome of a CheckAndIncrement call.
+type checkResult struct {
+	allowed bool
+	count   uint16
+	resetAt time.Time
+}
+
+// checkAndIncrement checks and increments the value associated with the given ID by cost using the given client.
+func (r *rlRedisStorage) checkAndIncrement(client redis.UniversalClient, id string, limit, cost uint16) (checkResult, error) {
+	result, err := checkAndIncrementScript.Run(
+		client,
+		[]string{r.countKey(id)},
+		limit,
+		ttlMillis(r.ttl),
+		cost,
+	).Result()
+	if err != nil {
+		return checkResult{}, fmt.Errorf("failed to check and increment value for ID '%s': %w", id, redisError(err))
+	}
+
+	values, _ := result.([]interface{})
+	if len(values) != 3 {
+		return checkResult{}, fmt.Errorf("unexpected CheckAndIncrement result for ID '%s': %v", id, result)
+	}
+	allowed, _ := values[0].(int64)
+	count, _ := values[1].(int64)
+	ttl, _ := values[2].(int64)
+	var resetAt time.Time
+	if ttl > 0 {
+		resetAt = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+	}
+	return checkResult{allowed: allowed == 1, count: uint16(count), resetAt: resetAt}, nil
+}
+
+// CheckAndRecord drops the timestamps of the given ID that left the window, then records cost timestamps
+// at now if the request fits within limit, atomically in a single Lua script. The log is kept in a sorted set
+// scored by timestamp, expiring once its newest entry leaves the window.
+func (r *rlRedisStorage) CheckAndRecord(id string, now time.Time, window time.Duration, limit, cost uint16) (bool, uint16, time.Time, error) {
+	result, err := checkAndRecordScript.Run(
+		r.client,
+		[]string{r.windowKey(id)},
+		now.UnixMicro(),
+		window.Microseconds(),
+		limit,
+		cost,
+		strconv.FormatUint(rand.Uint64(), 36),
+	).Result()
+	if err != nil {
+		return false, 0, time.Time{}, fmt.Errorf("failed to check and record request for ID '%s': %w", id, redisError(err))
+	}
+
+	values, _ := result.([]interface{})
+	if len(values) != 3 {
+		return false, 0, time.Time{}, fmt.Errorf("unexpected CheckAndRecord result for ID '%s': %v", id, result)
+	}
+	allowed, _ := values[0].(int64)
+	count, _ := values[1].(int64)
+	var resetAt time.Time
+	if oldest, _ := values[2].(string); oldest != "" {
+		if score, err := strconv.ParseFloat(oldest, 64); err == nil {
+			resetAt = time.UnixMicro(int64(score)).Add(window)
+		}
+	}
+	return allowed == 1, uint16(count), resetAt, nil
+}
+
+// UpdateTAT advances the GCRA theoretical arrival time of the given ID by cost emission intervals,
+// atomically in a single Lua script, so the TAT can be shared across instances.
+func (r *rlRedisStorage) UpdateTAT(id string, now time.Time, emission, tolerance time.Duration, cost uint16) (bool, time.Time, error) {
+	result, err := updateTATScript.Run(
+		r.client,
+		[]string{r.tatKey(id)},
+		now.UnixMicro(),
+		emission.Microseconds(),
+		tolerance.Microseconds(),
+		cost,
+	).Result()
+	if err != nil {
+		return false, time.Time{}, fmt.Errorf("failed to update TAT for ID '%s': %w", id, redisError(err))
+	}
+
+	values, _ := result.([]interface{})
+	if len(values) != 2 {
+		return false, time.Time{}, fmt.Errorf("unexpected UpdateTAT result for ID '%s': %v", id, result)
+	}
+	allowed, _ := values[0].(int64)
+	tat, _ := values[1].(int64)
+	return allowed == 1, time.UnixMicro(tat), nil
+}
+
+// ttlMillis converts a TTL into whole milliseconds for PEXPIRE, rounding up so that
+// sub-millisecond TTLs never become 0 (which would delete the key right away).
+func ttlMillis(ttl time.Duration) int64 {
+	return max((ttl + time.Millisecond - 1).Milliseconds(), 1)
+}
+
+// Transfer moves the value associated with the from ID onto the to ID atomically in a single Lua script.
+// On Redis Cluster both keys must hash to the same slot (e.g. by sharing a hash tag).
+func (r *rlRedisStorage) Transfer(from, to string) (uint16, error) {
+	count, err := transferScript.Run(
+		r.client,
+		[]string{r.countKey(from), r.countKey(to)},
+		ttlMillis(r.ttl),
+	).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("failed to transfer value from ID '%s' to ID '%s': %w", from, to, redisError(err))
 	}
+	return uint16(count), nil
+}
+
+// lenScanCount is the number of keys Len asks Redis to inspect per SCAN call.
+const lenScanCount = 1000
 
-	return uint16(result)
+// Len counts the request counter keys (`{prefix}count:*`) by iterating over the keyspace with SCAN,
+// so it does not block Redis, but takes O(keys) time and may miss or double count keys that
+// change while it runs. On Redis Cluster it only covers the node the client routes SCAN to.
+func (r *rlRedisStorage) Len() (int, error) {
+	var cursor uint64
+	count := 0
+	for {
+		keys, next, err := r.client.Scan(cursor, matchPrefix(r.prefix+countKeyPrefix), lenScanCount).Result()
+		if err != nil {
+			return count, fmt.Errorf("failed to scan counter keys: %w", redisError(err))
+		}
+		count += len(keys)
+		if next == 0 {
+			return count, nil
+		}
+		cursor = next
+	}
 }
 
-// Increase increments the value associated with the given ID in Redis
-// and sets a TTL (Time-to-Live) for the key.
-func (r *rlRedisStorage) Increase(id string) {
-	err := r.client.Incr(id).Err()
+// AddViolation increments the violation counter of the given ID and returns the new count.
+// The violation counter has its own key and TTL, so it outlives the request window.
+func (r *rlRedisStorage) AddViolation(id string) (uint16, error) {
+	key := r.violationsKey(id)
+	count, err := r.client.Incr(key).Result()
 	if err != nil {
-		r.logger.Warnf("Failed to Increase value for ID '%s': %v", id, err)
-		return
+		return 0, fmt.Errorf("failed to add violation for ID '%s': %w", id, redisError(err))
+	}
+
+	if err := r.client.PExpire(key, r.violationTTL).Err(); err != nil {
+		return uint16(count), fmt.Errorf("failed to set TTL for violations of ID '%s': %w", id, redisError(err))
 	}
+	return uint16(count), nil
+}
 
-	err = r.client.Expire(id, r.ttl).Err()
+// Violations retrieves the violation counter of the given ID.
+func (r *rlRedisStorage) Violations(id string) (uint16, error) {
+	count, err := r.client.Get(r.violationsKey(id)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
 	if err != nil {
-		r.logger.Warnf("Failed to SetTTL for ID '%s': %v", id, err)
+		return 0, fmt.Errorf("failed to get violations for ID '%s': %w", id, redisError(err))
 	}
+	return uint16(count), nil
+}
+
+// countKey returns the key of the request counter of the given ID.
+func (r *rlRedisStorage) countKey(id string) string {
+	return r.prefix + countKeyPrefix + id
 }
 
-// FreeAll does nothing on Redis. (its managed by ttl value)
-func (r *rlRedisStorage) FreeAll() {
-	// err := r.client.FlushAll().Err()
-	// if err != nil {
-	// 	r.logger.Warnf("Failed to flush Redis database: %v", err)
-	// } else {
-	// 	r.logger.Info("Flushed Redis database")
-	// }
+// violationsKey returns the key of the violation counter of the given ID.
+func (r *rlRedisStorage) violationsKey(id string) string {
+	return r.prefix + violationsKeyPrefix + id
+}
+
+// bucketKey returns the key of the token bucket of the given ID.
+func (r *rlRedisStorage) bucketKey(id string) string {
+	return r.prefix + bucketKeyPrefix + id
+}
+
+// tatKey returns the key of the GCRA theoretical arrival time of the given ID.
+func (r *rlRedisStorage) tatKey(id string) string {
+	return r.prefix + tatKeyPrefix + id
+}
+
+// windowKey returns the key of the sliding window log of the given ID.
+func (r *rlRedisStorage) windowKey(id string) string {
+	return r.prefix + windowKeyPrefix + id
+}
+
+// matchPrefix returns a SCAN pattern matching every key starting with prefix,
+// escaping the glob characters within the prefix.
+func matchPrefix(prefix string) string {
+	var pattern strings.Builder
+	for _, c := range prefix {
+		if strings.ContainsRune(`*?[]\`, c) {
+			pattern.WriteByte('\\')
+		}
+		pattern.WriteRune(c)
+	}
+	pattern.WriteByte('*')
+	return pattern.String()
+}
+
+// deleteKeys deletes every key starting with prefix, scanning lenScanCount keys at a time,
+// and returns the number of deleted keys. An empty prefix is rejected, as it would wipe the database.
+// On Redis Cluster it only covers the node the client routes SCAN to.
+func deleteKeys(client redis.UniversalClient, prefix string) (int64, error) {
+	if prefix == "" {
+		return 0, errors.New("refusing to delete every key without a key prefix")
+	}
+	var cursor uint64
+	var deleted int64
+	for {
+		keys, next, err := client.Scan(cursor, matchPrefix(prefix), lenScanCount).Result()
+		if err != nil {
+			return deleted, fmt.Errorf("failed to scan keys: %w", redisError(err))
+		}
+		if len(keys) > 0 {
+			n, err := client.Del(keys...).Result()
+			if err != nil {
+				return deleted, fmt.Errorf("failed to delete keys: %w", redisError(err))
+			}
+			deleted += n
+		}
+		if next == 0 {
+			return deleted, nil
+		}
+		cursor = next
+	}
+}
+
+// withContext binds the given client to ctx, for the client types supporting it.
+// Other clients are returned as is, the caller still returns early once ctx is done.
+func withContext(ctx context.Context, client redis.UniversalClient) redis.UniversalClient {
+	switch client := client.(type) {
+	case *redis.Client:
+		return client.WithContext(ctx)
+	case *redis.ClusterClient:
+		return client.WithContext(ctx)
+	}
+	return client
 }
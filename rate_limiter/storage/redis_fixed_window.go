@@ -0,0 +1,158 @@
+package rlstorage
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	rllog "github.com/FMotalleb/gin_testfield/rate_limiter/logging"
+	"github.com/go-redis/redis"
+)
+
+// fixedWindowIncreaseScript increments the count stored in the hash at KEYS[1],
+// resetting it first if the stored window start differs from ARGV[1].
+// The key expires ARGV[2] milliseconds after the last increment.
+var fixedWindowIncreaseScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'start') ~= ARGV[1] then
+	redis.call('HMSET', KEYS[1], 'start', ARGV[1], 'count', 0)
+end
+local count = redis.call('HINCRBY', KEYS[1], 'count', 1)
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return count
+`)
+
+// fixedWindowCheckAndIncrementScript works like fixedWindowIncreaseScript, but only increments
+// the count if it is below ARGV[3]. It returns {allowed, count}.
+var fixedWindowCheckAndIncrementScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'start') ~= ARGV[1] then
+	redis.call('HMSET', KEYS[1], 'start', ARGV[1], 'count', 0)
+end
+local count = tonumber(redis.call('HGET', KEYS[1], 'count'))
+if count >= tonumber(ARGV[3]) then
+	return {0, count}
+end
+count = redis.call('HINCRBY', KEYS[1], 'count', 1)
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+return {1, count}
+`)
+
+// rlRedisFixedWindowStorage is a struct that implements the RLStorage interface using Redis
+// hashes holding `{count, start}` per key, counting requests in fixed windows.
+type rlRedisFixedWindowStorage struct {
+	client *redis.Client // Redis client instance
+	window time.Duration // The length of a single window
+	prefix string        // The prefix every key is namespaced under
+	logger rllog.Logger  // Logger instance for logging messages
+}
+
+// NewRedisFixedWindowStorage creates a new instance of RLStorage that counts requests in fixed
+// windows of the given length using Redis. The count is reset atomically (via a Lua script)
+// the first time a key is incremented in a new window, and keys expire after a window.
+//
+// Counters are stored under `rl:fixed:{id}` (the `rl:` namespace can be changed through KeyPrefixer).
+// Since counts reset at window boundaries, Decrease is a no-op for this storage.
+func NewRedisFixedWindowStorage(client *redis.Client, window time.Duration, logger rllog.Logger) RLStorage {
+	return &rlRedisFixedWindowStorage{
+		client: client,
+		window: window,
+		prefix: DefaultRedisKeyPrefix,
+		logger: logger,
+	}
+}
+
+// currentWindow returns the start of the current window as microseconds since the epoch.
+func (r *rlRedisFixedWindowStorage) currentWindow() string {
+	return strconv.FormatInt(time.Now().Truncate(r.window).UnixMicro(), 10)
+}
+
+// Decrease does nothing, counts are reset when a new window begins.
+func (r *rlRedisFixedWindowStorage) Decrease(id string) error {
+	return nil
+}
+
+// Free removes the window hash associated with the given ID from Redis.
+func (r *rlRedisFixedWindowStorage) Free(id string) error {
+	if err := r.client.Del(r.key(id)).Err(); err != nil {
+		return fmt.Errorf("failed to free value for ID '%s': %w", id, redisError(err))
+	}
+	return nil
+}
+
+// Get retrieves the count associated with the given ID within the current window.
+func (r *rlRedisFixedWindowStorage) Get(id string) (uint16, error) {
+	values, err := r.client.HMGet(r.key(id), "start", "count").Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get value for ID '%s': %w", id, redisError(err))
+	}
+	if start, _ := values[0].(string); start != r.currentWindow() {
+		return 0, nil // The stored count belongs to a previous window (or does not exist)
+	}
+
+	count, _ := values[1].(string)
+	result, err := strconv.Atoi(count)
+	if err != nil {
+		return 0, fmt.Errorf("failed to convert value for ID '%s': %w", id, err)
+	}
+
+	return uint16(result), nil
+}
+
+// Increase increments the count associated with the given ID in the current window.
+func (r *rlRedisFixedWindowStorage) Increase(id string) error {
+	err := fixedWindowIncreaseScript.Run(
+		r.client,
+		[]string{r.key(id)},
+		r.currentWindow(),
+		ttlMillis(r.window),
+	).Err()
+	if err != nil {
+		return fmt.Errorf("failed to increase value for ID '%s': %w", id, redisError(err))
+	}
+	return nil
+}
+
+// FreeAll deletes every key under the key prefix of the storage using SCAN and DEL,
+// leaving unrelated data in the same database untouched.
+func (r *rlRedisFixedWindowStorage) FreeAll() error {
+	deleted, err := deleteKeys(r.client, r.prefix)
+	if err != nil {
+		return err
+	}
+	r.logger.Info("Freed all entries from storage", "keys", deleted)
+	return nil
+}
+
+// SetKeyPrefix sets the prefix every key of the storage is namespaced under (DefaultRedisKeyPrefix by default).
+func (r *rlRedisFixedWindowStorage) SetKeyPrefix(prefix string) {
+	r.prefix = prefix
+}
+
+// key returns the key of the window hash of the given ID.
+func (r *rlRedisFixedWindowStorage) key(id string) string {
+	return r.prefix + fixedWindowKeyPrefix + id
+}
+
+// CheckAndIncrement increments the count associated with the given ID if it is below limit within
+// the current window, atomically in a single Lua script. The count resets at the end of the current window.
+func (r *rlRedisFixedWindowStorage) CheckAndIncrement(id string, limit uint16) (bool, uint16, time.Time, error) {
+	window := time.Now().Truncate(r.window)
+	resetAt := window.Add(r.window)
+	result, err := fixedWindowCheckAndIncrementScript.Run(
+		r.client,
+		[]string{r.key(id)},
+		strconv.FormatInt(window.UnixMicro(), 10),
+		ttlMillis(r.window),
+		limit,
+	).Result()
+	if err != nil {
+		return false, 0, resetAt, fmt.Errorf("failed to check and increment value for ID '%s': %w", id, redisError(err))
+	}
+
+	values, _ := result.([]interface{})
+	if len(values) != 2 {
+		return false, 0, resetAt, fmt.Errorf("unexpected CheckAndIncrement result for ID '%s': %v", id, result)
+	}
+	allowed, _ := values[0].(int64)
+	count, _ := values[1].(int64)
+	return allowed == 1, uint16(count), resetAt, nil
+}
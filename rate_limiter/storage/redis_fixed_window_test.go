@@ -0,0 +1,88 @@
+package rlstorage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+)
+
+// newMiniredis starts an in-memory Redis server for the duration of the test and returns it
+// with a client connected to it.
+func newMiniredis(t testing.TB) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return server, client
+}
+
+// waitForNextWindow sleeps until shortly after the start of the next window of the given length.
+func waitForNextWindow(window time.Duration) {
+	now := time.Now()
+	time.Sleep(now.Truncate(window).Add(window).Sub(now) + window/20)
+}
+
+func TestRedisFixedWindowStorageResetsOncePerWindow(t *testing.T) {
+	_, client := newMiniredis(t)
+	window := 200 * time.Millisecond
+	storage := NewRedisFixedWindowStorage(client, window, discardLogger())
+
+	waitForNextWindow(window)
+	for i := 0; i < 3; i++ {
+		if err := storage.Increase("a"); err != nil {
+			t.Fatalf("Increase() failed: %v", err)
+		}
+	}
+	expectCount(t, storage, "a", 3)
+
+	waitForNextWindow(window)
+	expectCount(t, storage, "a", 0)
+	storage.Increase("a")
+	expectCount(t, storage, "a", 1)
+}
+
+func TestRedisFixedWindowStorageCheckAndIncrement(t *testing.T) {
+	server, client := newMiniredis(t)
+	window := 200 * time.Millisecond
+	storage := NewRedisFixedWindowStorage(client, window, discardLogger()).(CheckAndIncrementer)
+
+	waitForNextWindow(window)
+	for i := uint16(1); i <= 2; i++ {
+		if allowed, count, _, err := storage.CheckAndIncrement("a", 2); err != nil || !allowed || count != i {
+			t.Fatalf("CheckAndIncrement() = %t, %d, %v, want allowed with count %d", allowed, count, err, i)
+		}
+	}
+	if allowed, count, _, _ := storage.CheckAndIncrement("a", 2); allowed || count != 2 {
+		t.Fatalf("CheckAndIncrement() over the limit = %t, %d, want rejected with count 2", allowed, count)
+	}
+	if ttl := server.TTL(DefaultRedisKeyPrefix + fixedWindowKeyPrefix + "a"); ttl <= 0 || ttl > window {
+		t.Fatalf("TTL of the window hash = %s, want within (0, %s]", ttl, window)
+	}
+
+	waitForNextWindow(window)
+	if allowed, count, _, _ := storage.CheckAndIncrement("a", 2); !allowed || count != 1 {
+		t.Fatalf("CheckAndIncrement() in the next window = %t, %d, want allowed with count 1", allowed, count)
+	}
+}
+
+func TestRedisFixedWindowStorageFreeAllOnlyDeletesPrefixedKeys(t *testing.T) {
+	server, client := newMiniredis(t)
+	storage := NewRedisFixedWindowStorage(client, time.Minute, discardLogger())
+	storage.(KeyPrefixer).SetKeyPrefix("api:")
+	server.Set("unrelated", "1")
+	if err := storage.Increase("a"); err != nil {
+		t.Fatalf("Increase() error = %v", err)
+	}
+	if !server.Exists("api:" + fixedWindowKeyPrefix + "a") {
+		t.Fatalf("keys = %v, want the window under the api: prefix", server.Keys())
+	}
+
+	if err := storage.FreeAll(); err != nil {
+		t.Fatalf("FreeAll() error = %v", err)
+	}
+	if keys := server.Keys(); len(keys) != 1 || keys[0] != "unrelated" {
+		t.Errorf("keys left after FreeAll = %v, want only the unrelated key", keys)
+	}
+}
@@ -0,0 +1,335 @@
+package rlstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis"
+)
+
+// newRedisStorage returns a Redis storage backed by an in-memory Redis server, with the given TTL.
+func newRedisStorage(t testing.TB, ttl time.Duration) RLStorage {
+	t.Helper()
+	_, client := newMiniredis(t)
+	return NewRedisStorage(client, ttl, discardLogger())
+}
+
+func TestRedisTakeTokensAccountsFractionalTokens(t *testing.T) {
+	server, client := newMiniredis(t)
+	storage := NewRedisStorage(client, time.Minute, discardLogger()).(BucketStorage)
+
+	for want := 2.0; want >= 0; want-- {
+		taken, tokens, err := storage.TakeTokens("a", 1, 10, 3)
+		if err != nil || !taken {
+			t.Fatalf("TakeTokens() = %t, %v, want a token taken", taken, err)
+		}
+		if math.Abs(tokens-want) > 0.2 {
+			t.Fatalf("tokens left = %f, want about %f", tokens, want)
+		}
+	}
+	taken, tokens, err := storage.TakeTokens("a", 1, 10, 3)
+	if err != nil || taken {
+		t.Fatalf("TakeTokens() on an empty bucket = %t, %v, want no token", taken, err)
+	}
+	if tokens >= 1 {
+		t.Fatalf("tokens left in an empty bucket = %f, want less than 1", tokens)
+	}
+	if ttl := server.TTL(DefaultRedisKeyPrefix + bucketKeyPrefix + "a"); ttl <= 0 {
+		t.Fatalf("the bucket has no TTL (%s)", ttl)
+	}
+
+	// 150ms at 10 tokens per second refill 1.5 tokens, the half token is kept after taking one
+	time.Sleep(150 * time.Millisecond)
+	taken, tokens, err = storage.TakeTokens("a", 1, 10, 3)
+	if err != nil || !taken {
+		t.Fatalf("TakeTokens() after a refill = %t, %v, want a token taken", taken, err)
+	}
+	if tokens < 0.3 || tokens > 0.9 {
+		t.Fatalf("tokens left after a refill = %f, want about 0.5", tokens)
+	}
+}
+
+func TestRedisTakeTokensRefillIsCappedAtBurst(t *testing.T) {
+	storage := newRedisStorage(t, time.Minute).(BucketStorage)
+
+	storage.TakeTokens("a", 1, 1000, 2)
+	time.Sleep(20 * time.Millisecond)
+	if _, tokens, _ := storage.TakeTokens("a", 1, 1000, 2); tokens > 1 {
+		t.Fatalf("tokens left = %f, want at most burst - 1", tokens)
+	}
+}
+
+func TestTTLMillisRoundsUp(t *testing.T) {
+	tests := []struct {
+		ttl  time.Duration
+		want int64
+	}{
+		{50 * time.Millisecond, 50},
+		{50*time.Millisecond + time.Microsecond, 51},
+		{time.Microsecond, 1},
+		{0, 1},
+	}
+	for _, test := range tests {
+		if got := ttlMillis(test.ttl); got != test.want {
+			t.Errorf("ttlMillis(%s) = %d, want %d", test.ttl, got, test.want)
+		}
+	}
+}
+
+func TestRedisCountersExpireWithMillisecondTTL(t *testing.T) {
+	server, client := newMiniredis(t)
+	storage := NewRedisStorage(client, 50*time.Millisecond, discardLogger())
+
+	if err := storage.Increase("a"); err != nil {
+		t.Fatalf("Increase() failed: %v", err)
+	}
+	if ttl := server.TTL(DefaultRedisKeyPrefix + countKeyPrefix + "a"); ttl != 50*time.Millisecond {
+		t.Fatalf("TTL of the counter = %s, want 50ms", ttl)
+	}
+	server.FastForward(50 * time.Millisecond)
+	expectCount(t, storage, "a", 0)
+}
+
+func TestRedisTransfer(t *testing.T) {
+	server, client := newMiniredis(t)
+	storage := NewRedisStorage(client, time.Minute, discardLogger())
+	storage.Increase("from")
+	storage.Increase("from")
+	storage.Increase("to")
+
+	moved, err := storage.(Transferer).Transfer("from", "to")
+	if err != nil || moved != 2 {
+		t.Fatalf("Transfer() = %d, %v, want 2 units moved", moved, err)
+	}
+	expectCount(t, storage, "from", 0)
+	expectCount(t, storage, "to", 3)
+	if server.Exists(DefaultRedisKeyPrefix + countKeyPrefix + "from") {
+		t.Fatal("the source key still exists")
+	}
+	if ttl := server.TTL(DefaultRedisKeyPrefix + countKeyPrefix + "to"); ttl <= 0 {
+		t.Fatalf("the destination key has no TTL (%s)", ttl)
+	}
+	if moved, _ := storage.(Transferer).Transfer("from", "to"); moved != 0 {
+		t.Fatalf("Transfer() of an empty source moved %d units", moved)
+	}
+}
+
+func TestRedisViolationsOutliveRequestWindow(t *testing.T) {
+	server, client := newMiniredis(t)
+	storage := NewRedisStorage(client, time.Minute, discardLogger())
+	tracker := storage.(ViolationTracker)
+
+	storage.Increase("a")
+	for want := uint16(1); want <= 2; want++ {
+		if count, err := tracker.AddViolation("a"); err != nil || count != want {
+			t.Fatalf("AddViolation() = %d, %v, want %d", count, err, want)
+		}
+	}
+	if !server.Exists("rl:count:a") || !server.Exists("rl:violations:a") {
+		t.Fatalf("keys = %v, want rl:count:a and rl:violations:a", server.Keys())
+	}
+	if ttl := server.TTL("rl:violations:a"); ttl != defaultViolationTTL {
+		t.Fatalf("TTL of the violations = %s, want %s", ttl, defaultViolationTTL)
+	}
+
+	server.FastForward(2 * time.Minute)
+	expectCount(t, storage, "a", 0)
+	if count, err := tracker.Violations("a"); err != nil || count != 2 {
+		t.Fatalf("Violations() after the request window = %d, %v, want 2", count, err)
+	}
+	server.FastForward(defaultViolationTTL)
+	if count, _ := tracker.Violations("a"); count != 0 {
+		t.Fatalf("Violations() after the violation TTL = %d, want 0", count)
+	}
+}
+
+func TestRedisUniversalStorageOnClusterClient(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{server.Addr()}})
+	t.Cleanup(func() { client.Close() })
+	storage := NewRedisUniversalStorage(client, time.Minute, discardLogger())
+
+	for i := 0; i < 3; i++ {
+		if err := storage.Increase("a"); err != nil {
+			t.Fatalf("Increase() error = %v", err)
+		}
+	}
+	if err := storage.Decrease("a"); err != nil {
+		t.Fatalf("Decrease() error = %v", err)
+	}
+	expectCount(t, storage, "a", 2)
+	if ttl := server.TTL(DefaultRedisKeyPrefix + countKeyPrefix + "a"); ttl <= 0 {
+		t.Errorf("the counter has no TTL (%s)", ttl)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := storage.(ContextStorage).IncreaseCtx(ctx, "a"); !errors.Is(err, context.Canceled) {
+		t.Errorf("IncreaseCtx() with a cancelled context error = %v, want context.Canceled", err)
+	}
+	expectCount(t, storage, "a", 2)
+}
+
+func TestRedisStorageDelegatesToUniversalStorage(t *testing.T) {
+	_, client := newMiniredis(t)
+	standalone := NewRedisStorage(client, time.Minute, discardLogger())
+	universal := NewRedisUniversalStorage(client, time.Minute, discardLogger())
+
+	if err := standalone.Increase("a"); err != nil {
+		t.Fatalf("Increase() error = %v", err)
+	}
+	expectCount(t, universal, "a", 1)
+}
+
+func TestRedisFreeDropsEveryKeyInOneCommand(t *testing.T) {
+	server, client := newMiniredis(t)
+	storage := NewRedisStorage(client, time.Minute, discardLogger())
+	now := time.Now()
+
+	if err := storage.Increase("a"); err != nil {
+		t.Fatalf("Increase() error = %v", err)
+	}
+	if _, _, err := storage.(BucketStorage).TakeTokens("a", 1, 1, 5); err != nil {
+		t.Fatalf("TakeTokens() error = %v", err)
+	}
+	if _, err := storage.(ViolationTracker).AddViolation("a"); err != nil {
+		t.Fatalf("AddViolation() error = %v", err)
+	}
+	if _, _, _, err := storage.(SlidingWindowStorage).CheckAndRecord("a", now, time.Minute, 5, 1); err != nil {
+		t.Fatalf("CheckAndRecord() error = %v", err)
+	}
+	if _, _, err := storage.(GCRAStorage).UpdateTAT("a", now, time.Second, time.Second, 1); err != nil {
+		t.Fatalf("UpdateTAT() error = %v", err)
+	}
+	if keys := server.Keys(); len(keys) != 5 {
+		t.Fatalf("keys before Free = %v, want one per state", keys)
+	}
+
+	commands := server.CommandCount()
+	if err := storage.Free("a"); err != nil {
+		t.Fatalf("Free() error = %v", err)
+	}
+	if sent := server.CommandCount() - commands; sent != 1 {
+		t.Errorf("Free() sent %d commands, want a single DEL", sent)
+	}
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Errorf("keys left after Free = %v, want none", keys)
+	}
+}
+
+func TestRedisLenIgnoresOtherKeys(t *testing.T) {
+	server, client := newMiniredis(t)
+	storage := NewRedisStorage(client, time.Minute, discardLogger())
+	server.Set("unrelated", "1")
+	if _, err := storage.(ViolationTracker).AddViolation("a"); err != nil {
+		t.Fatalf("AddViolation() error = %v", err)
+	}
+	for i := 0; i < 30; i++ {
+		if err := storage.Increase(fmt.Sprint(i)); err != nil {
+			t.Fatalf("Increase() error = %v", err)
+		}
+	}
+
+	if keys, err := storage.(KeyCounter).Len(); err != nil || keys != 30 {
+		t.Errorf("Len() = %d, %v, want only the 30 counters", keys, err)
+	}
+}
+
+func TestRedisFreeAllOnlyDeletesPrefixedKeys(t *testing.T) {
+	server, client := newMiniredis(t)
+	storage := NewRedisStorage(client, time.Minute, discardLogger())
+	server.Set("unrelated", "1")
+	for i := 0; i < 30; i++ {
+		if err := storage.Increase(fmt.Sprint(i)); err != nil {
+			t.Fatalf("Increase() error = %v", err)
+		}
+	}
+
+	if err := storage.FreeAll(); err != nil {
+		t.Fatalf("FreeAll() error = %v", err)
+	}
+	if keys := server.Keys(); len(keys) != 1 || keys[0] != "unrelated" {
+		t.Errorf("keys left after FreeAll = %v, want only the unrelated key", keys)
+	}
+}
+
+func TestRedisSetKeyPrefix(t *testing.T) {
+	server, client := newMiniredis(t)
+	storage := NewRedisStorage(client, time.Minute, discardLogger())
+	storage.(KeyPrefixer).SetKeyPrefix("api:")
+
+	if err := storage.Increase("a"); err != nil {
+		t.Fatalf("Increase() error = %v", err)
+	}
+	if !server.Exists("api:" + countKeyPrefix + "a") {
+		t.Fatalf("keys = %v, want the counter under the api: prefix", server.Keys())
+	}
+	expectCount(t, storage, "a", 1)
+}
+
+func TestRedisFreeAllRefusesEmptyPrefix(t *testing.T) {
+	server, client := newMiniredis(t)
+	storage := NewRedisStorage(client, time.Minute, discardLogger())
+	server.Set("unrelated", "1")
+	storage.(KeyPrefixer).SetKeyPrefix("")
+
+	if err := storage.FreeAll(); err == nil {
+		t.Fatal("FreeAll() without a key prefix succeeded")
+	}
+	if !server.Exists("unrelated") {
+		t.Fatal("FreeAll() without a key prefix deleted unrelated keys")
+	}
+}
+
+func TestMatchPrefixEscapesGlobCharacters(t *testing.T) {
+	if got, want := matchPrefix(`a*b?[c]\`), `a\*b\?\[c\]\\*`; got != want {
+		t.Fatalf("matchPrefix() = %q, want %q", got, want)
+	}
+}
+
+func TestRedisFreeAllTreatsPrefixLiterally(t *testing.T) {
+	server, client := newMiniredis(t)
+	storage := NewRedisStorage(client, time.Minute, discardLogger())
+	storage.(KeyPrefixer).SetKeyPrefix("a*")
+	server.Set("ab", "1")
+	if err := storage.Increase("a"); err != nil {
+		t.Fatalf("Increase() error = %v", err)
+	}
+
+	if err := storage.FreeAll(); err != nil {
+		t.Fatalf("FreeAll() error = %v", err)
+	}
+	if keys := server.Keys(); len(keys) != 1 || keys[0] != "ab" {
+		t.Errorf("keys left after FreeAll = %v, want only ab", keys)
+	}
+}
+
+func TestRedisPrefixedStoragesAreIsolated(t *testing.T) {
+	server, client := newMiniredis(t)
+	billing := NewRedisPrefixedStorage(client, "billing:", time.Minute, discardLogger())
+	search := NewRedisPrefixedStorage(client, "search:", time.Minute, discardLogger())
+	for i := 0; i < 2; i++ {
+		if err := billing.Increase("a"); err != nil {
+			t.Fatalf("Increase() error = %v", err)
+		}
+	}
+	if err := search.Increase("a"); err != nil {
+		t.Fatalf("Increase() error = %v", err)
+	}
+	if !server.Exists("billing:" + countKeyPrefix + "a") {
+		t.Fatalf("keys = %v, want the counter under the billing: prefix", server.Keys())
+	}
+	expectCount(t, billing, "a", 2)
+	expectCount(t, search, "a", 1)
+
+	if err := billing.FreeAll(); err != nil {
+		t.Fatalf("FreeAll() error = %v", err)
+	}
+	expectCount(t, billing, "a", 0)
+	expectCount(t, search, "a", 1)
+}
@@ -0,0 +1,187 @@
+package rlstorage
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// readReplicaStorage is a struct that implements the RLStorage interface by routing
+// reads to a set of replica storages and all mutations to a primary storage.
+type readReplicaStorage struct {
+	primary  RLStorage     // The storage receiving all mutations
+	replicas []RLStorage   // The storages serving reads (round-robin)
+	next     atomic.Uint32 // The index of the replica serving the next read
+}
+
+// NewReadReplicaStorage creates a new instance of RLStorage that routes Get to the given replicas
+// (round-robin) and Increase, Decrease, Free and FreeAll to the primary. If no replica is given,
+// reads are served by the primary as well.
+//
+// Reads are only as fresh as the replication: with replication lag, recent increments may not be
+// visible yet, letting clients exceed the limit by roughly the number of requests they make during
+// the lag. The optional interfaces of the primary (atomic checks, token buckets, sliding windows, GCRA,
+// violations, snapshots and idle sweeping) are served by the primary, and only supported if the primary
+// supports them (see As). The TTL, the key prefix and the tracer are forwarded to every storage.
+func NewReadReplicaStorage(primary RLStorage, replicas ...RLStorage) RLStorage {
+	return &readReplicaStorage{
+		primary:  primary,
+		replicas: replicas,
+	}
+}
+
+// Get retrieves the count for the given id from the next replica.
+func (r *readReplicaStorage) Get(id string) (uint16, error) {
+	return r.reader().Get(id)
+}
+
+// Increase increments the count for the given id on the primary.
+func (r *readReplicaStorage) Increase(id string) error {
+	return r.primary.Increase(id)
+}
+
+// Decrease decrements the count for the given id on the primary.
+func (r *readReplicaStorage) Decrease(id string) error {
+	return r.primary.Decrease(id)
+}
+
+// Free removes the given id from the primary.
+func (r *readReplicaStorage) Free(id string) error {
+	return r.primary.Free(id)
+}
+
+// FreeAll removes all entries from the primary.
+func (r *readReplicaStorage) FreeAll() error {
+	return r.primary.FreeAll()
+}
+
+// GetCtx works like Get, but returns early with the context's error once ctx is done.
+func (r *readReplicaStorage) GetCtx(ctx context.Context, id string) (uint16, error) {
+	return GetContext(ctx, r.reader(), id)
+}
+
+// IncreaseCtx works like Increase, but returns early with the context's error once ctx is done.
+func (r *readReplicaStorage) IncreaseCtx(ctx context.Context, id string) error {
+	return IncreaseContext(ctx, r.primary, id)
+}
+
+// DecreaseCtx works like Decrease, but returns early with the context's error once ctx is done.
+func (r *readReplicaStorage) DecreaseCtx(ctx context.Context, id string) error {
+	return DecreaseContext(ctx, r.primary, id)
+}
+
+// FreeCtx works like Free, but returns early with the context's error once ctx is done.
+func (r *readReplicaStorage) FreeCtx(ctx context.Context, id string) error {
+	return FreeContext(ctx, r.primary, id)
+}
+
+// IncreaseBy increments the count for the given id by n on the primary.
+func (r *readReplicaStorage) IncreaseBy(id string, n uint16) error {
+	return r.primary.(IncreaserBy).IncreaseBy(id, n)
+}
+
+// CheckAndIncrement runs the atomic check of the primary for the given id.
+func (r *readReplicaStorage) CheckAndIncrement(id string, limit uint16) (bool, uint16, time.Time, error) {
+	return r.primary.(CheckAndIncrementer).CheckAndIncrement(id, limit)
+}
+
+// CheckAndIncrementCtx works like CheckAndIncrement, but returns early with the context's error once ctx is done.
+func (r *readReplicaStorage) CheckAndIncrementCtx(ctx context.Context, id string, limit uint16) (bool, uint16, time.Time, error) {
+	return CheckAndIncrementContext(ctx, r.primary.(CheckAndIncrementer), id, limit)
+}
+
+// CheckAndIncrementBy runs the weighted atomic check of the primary for the given id.
+func (r *readReplicaStorage) CheckAndIncrementBy(id string, limit, cost uint16) (bool, uint16, time.Time, error) {
+	return r.primary.(WeightedCheckAndIncrementer).CheckAndIncrementBy(id, limit, cost)
+}
+
+// CheckAndIncrementByCtx works like CheckAndIncrementBy, but returns early with the context's error once ctx is done.
+func (r *readReplicaStorage) CheckAndIncrementByCtx(ctx context.Context, id string, limit, cost uint16) (bool, uint16, time.Time, error) {
+	return CheckAndIncrementByContext(ctx, r.primary.(WeightedCheckAndIncrementer), id, limit, cost)
+}
+
+// TakeTokens takes n tokens from the token bucket of the given id on the primary.
+func (r *readReplicaStorage) TakeTokens(id string, n uint16, rate float64, burst uint16) (bool, float64, error) {
+	return r.primary.(BucketStorage).TakeTokens(id, n, rate, burst)
+}
+
+// CheckAndRecord runs the sliding window check of the primary for the given id.
+func (r *readReplicaStorage) CheckAndRecord(id string, now time.Time, window time.Duration, limit, cost uint16) (bool, uint16, time.Time, error) {
+	return r.primary.(SlidingWindowStorage).CheckAndRecord(id, now, window, limit, cost)
+}
+
+// UpdateTAT advances the theoretical arrival time of the given id on the primary.
+func (r *readReplicaStorage) UpdateTAT(id string, now time.Time, emission, tolerance time.Duration, cost uint16) (bool, time.Time, error) {
+	return r.primary.(GCRAStorage).UpdateTAT(id, now, emission, tolerance, cost)
+}
+
+// AddViolation records a violation for the given id on the primary.
+func (r *readReplicaStorage) AddViolation(id string) (uint16, error) {
+	return r.primary.(ViolationTracker).AddViolation(id)
+}
+
+// Violations retrieves the violation count of the given id from the primary.
+func (r *readReplicaStorage) Violations(id string) (uint16, error) {
+	return r.primary.(ViolationTracker).Violations(id)
+}
+
+// Len returns the number of ids tracked by the primary.
+func (r *readReplicaStorage) Len() (int, error) {
+	return r.primary.(KeyCounter).Len()
+}
+
+// Snapshot returns the counts of the primary.
+func (r *readReplicaStorage) Snapshot() (map[string]uint16, error) {
+	return r.primary.(Snapshotter).Snapshot()
+}
+
+// SweepIdle removes the ids of the primary idle for longer than maxIdle.
+func (r *readReplicaStorage) SweepIdle(maxIdle time.Duration) int {
+	return r.primary.(IdleSweeper).SweepIdle(maxIdle)
+}
+
+// Evictions returns the number of ids evicted by the primary.
+func (r *readReplicaStorage) Evictions() uint64 {
+	return r.primary.(EvictionCounter).Evictions()
+}
+
+// TTL returns the shortest TTL of the primary and the replicas, 0 if any of them is unset.
+func (r *readReplicaStorage) TTL() time.Duration {
+	return shortestTTL(r.storages()...)
+}
+
+// SetTTL sets the TTL of the primary and the replicas.
+func (r *readReplicaStorage) SetTTL(ttl time.Duration) {
+	setTTL(ttl, r.storages()...)
+}
+
+// SetKeyPrefix sets the key prefix of the primary and the replicas, so reads find the keys written to the primary.
+func (r *readReplicaStorage) SetKeyPrefix(prefix string) {
+	setKeyPrefix(prefix, r.storages()...)
+}
+
+// SetTracer sets the tracer of the primary and the replicas.
+func (r *readReplicaStorage) SetTracer(tracer trace.Tracer) {
+	setTracer(tracer, r.storages()...)
+}
+
+// Unwrap returns the primary, which serves the optional interfaces.
+func (r *readReplicaStorage) Unwrap() []RLStorage {
+	return []RLStorage{r.primary}
+}
+
+// reader returns the storage serving the next read: the next replica, or the primary if there is none.
+func (r *readReplicaStorage) reader() RLStorage {
+	if len(r.replicas) == 0 {
+		return r.primary
+	}
+	index := (r.next.Add(1) - 1) % uint32(len(r.replicas))
+	return r.replicas[index]
+}
+
+// storages returns the primary followed by the replicas.
+func (r *readReplicaStorage) storages() []RLStorage {
+	return append([]RLStorage{r.primary}, r.replicas...)
+}
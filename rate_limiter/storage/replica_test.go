@@ -0,0 +1,60 @@
+package rlstorage
+
+import "testing"
+
+func TestReadReplicaStorageRoutesReadsToReplicas(t *testing.T) {
+	primary := NewHashMapStorage(discardLogger())
+	replicaA := NewHashMapStorage(discardLogger())
+	replicaB := NewHashMapStorage(discardLogger())
+	replicaA.Increase("a")
+	replicaB.Increase("a")
+	replicaB.Increase("a")
+	storage := NewReadReplicaStorage(primary, replicaA, replicaB)
+
+	// Reads alternate between the replicas (round-robin)
+	for _, want := range []uint16{1, 2, 1, 2} {
+		expectCount(t, storage, "a", want)
+	}
+}
+
+func TestReadReplicaStorageRoutesWritesToPrimary(t *testing.T) {
+	primary := NewHashMapStorage(discardLogger())
+	replica := NewHashMapStorage(discardLogger())
+	storage := NewReadReplicaStorage(primary, replica)
+
+	storage.Increase("a")
+	storage.Increase("a")
+	storage.Increase("b")
+	storage.Decrease("a")
+	expectCount(t, primary, "a", 1)
+	expectCount(t, replica, "a", 0)
+	expectCount(t, storage, "a", 0) // Served by the (lagging) replica
+
+	storage.Free("a")
+	expectCount(t, primary, "a", 0)
+	storage.FreeAll()
+	expectCount(t, primary, "b", 0)
+}
+
+func TestReadReplicaStorageWithoutReplicasReadsPrimary(t *testing.T) {
+	primary := NewHashMapStorage(discardLogger())
+	storage := NewReadReplicaStorage(primary)
+
+	storage.Increase("a")
+	expectCount(t, storage, "a", 1)
+}
+
+func TestReadReplicaStorageChecksOnPrimary(t *testing.T) {
+	primary := NewHashMapStorage(discardLogger())
+	replica := NewHashMapStorage(discardLogger())
+	storage := NewReadReplicaStorage(primary, replica)
+
+	for i := 0; i < 2; i++ {
+		storage.(CheckAndIncrementer).CheckAndIncrement("a", 2)
+	}
+	// The (lagging) replica would allow the request, the primary rejects it
+	if allowed, count, _, _ := storage.(CheckAndIncrementer).CheckAndIncrement("a", 2); allowed || count != 2 {
+		t.Fatalf("CheckAndIncrement() over the limit = %t, %d, want rejected with count 2", allowed, count)
+	}
+	expectCount(t, replica, "a", 0)
+}
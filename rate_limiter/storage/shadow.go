@@ -0,0 +1,251 @@
+package rlstorage
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Mismatch describes an operation on which the primary and the shadow storage of a
+// shadow compare storage diverged.
+type Mismatch struct {
+	Op         string // The name of the operation (e.g. "Get" or "Increase")
+	ID         string // The ID the operation was applied to (empty for FreeAll)
+	Primary    uint16 // The value returned by the primary (0 for operations without a value)
+	Shadow     uint16 // The value returned by the shadow (0 for operations without a value)
+	PrimaryErr error  // The error returned by the primary, if any
+	ShadowErr  error  // The error returned by the shadow, if any
+}
+
+// shadowCompareStorage is a struct that implements the RLStorage interface by forwarding
+// every operation to a primary and a shadow storage, enforcing based on the primary.
+type shadowCompareStorage struct {
+	primary    RLStorage      // The storage whose results are returned
+	shadow     RLStorage      // The storage being validated against the primary
+	onMismatch func(Mismatch) // The function called whenever the two storages diverge
+}
+
+// NewShadowCompareStorage creates a new instance of RLStorage that forwards all operations to both
+// the primary and the shadow storage and calls onMismatch whenever their results diverge, e.g. to
+// validate a new backend against the current one in production. Only the primary's results are
+// returned, so the shadow never affects enforcement.
+//
+// A mismatch is reported when a read (Get or Violations), an atomic check (including the token bucket, sliding
+// window and GCRA checks) or AddViolation return different counts (or decisions), or when only one of the storages
+// fails. The optional interfaces are only supported if both storages support them (see As), otherwise the
+// middleware falls back to a separate read and write, which are both compared. Len, Snapshot and Evictions are
+// served by the primary alone. The TTL, the key prefix and the tracer are forwarded to both storages.
+func NewShadowCompareStorage(primary, shadow RLStorage, onMismatch func(Mismatch)) RLStorage {
+	return &shadowCompareStorage{
+		primary:    primary,
+		shadow:     shadow,
+		onMismatch: onMismatch,
+	}
+}
+
+// Get retrieves the count for the given id from both storages and returns the primary's count.
+func (s *shadowCompareStorage) Get(id string) (uint16, error) {
+	primary, primaryErr := s.primary.Get(id)
+	shadow, shadowErr := s.shadow.Get(id)
+	return s.compareValue("Get", id, primary, shadow, primaryErr, shadowErr)
+}
+
+// Increase increments the count for the given id on both storages.
+func (s *shadowCompareStorage) Increase(id string) error {
+	return s.compare("Increase", id, s.primary.Increase(id), s.shadow.Increase(id))
+}
+
+// Decrease decrements the count for the given id on both storages.
+func (s *shadowCompareStorage) Decrease(id string) error {
+	return s.compare("Decrease", id, s.primary.Decrease(id), s.shadow.Decrease(id))
+}
+
+// Free removes the given id from both storages.
+func (s *shadowCompareStorage) Free(id string) error {
+	return s.compare("Free", id, s.primary.Free(id), s.shadow.Free(id))
+}
+
+// FreeAll removes all entries from both storages.
+func (s *shadowCompareStorage) FreeAll() error {
+	return s.compare("FreeAll", "", s.primary.FreeAll(), s.shadow.FreeAll())
+}
+
+// GetCtx works like Get, but returns early with the context's error once ctx is done.
+func (s *shadowCompareStorage) GetCtx(ctx context.Context, id string) (uint16, error) {
+	primary, primaryErr := GetContext(ctx, s.primary, id)
+	shadow, shadowErr := GetContext(ctx, s.shadow, id)
+	return s.compareValue("Get", id, primary, shadow, primaryErr, shadowErr)
+}
+
+// IncreaseCtx works like Increase, but returns early with the context's error once ctx is done.
+func (s *shadowCompareStorage) IncreaseCtx(ctx context.Context, id string) error {
+	return s.compare("Increase", id, IncreaseContext(ctx, s.primary, id), IncreaseContext(ctx, s.shadow, id))
+}
+
+// DecreaseCtx works like Decrease, but returns early with the context's error once ctx is done.
+func (s *shadowCompareStorage) DecreaseCtx(ctx context.Context, id string) error {
+	return s.compare("Decrease", id, DecreaseContext(ctx, s.primary, id), DecreaseContext(ctx, s.shadow, id))
+}
+
+// FreeCtx works like Free, but returns early with the context's error once ctx is done.
+func (s *shadowCompareStorage) FreeCtx(ctx context.Context, id string) error {
+	return s.compare("Free", id, FreeContext(ctx, s.primary, id), FreeContext(ctx, s.shadow, id))
+}
+
+// IncreaseBy increments the count for the given id by n on both storages.
+func (s *shadowCompareStorage) IncreaseBy(id string, n uint16) error {
+	return s.compare("IncreaseBy", id, s.primary.(IncreaserBy).IncreaseBy(id, n), s.shadow.(IncreaserBy).IncreaseBy(id, n))
+}
+
+// CheckAndIncrement runs the atomic check for the given id on both storages and returns the primary's result.
+func (s *shadowCompareStorage) CheckAndIncrement(id string, limit uint16) (bool, uint16, time.Time, error) {
+	allowed, count, resetAt, err := s.primary.(CheckAndIncrementer).CheckAndIncrement(id, limit)
+	shadowAllowed, shadowCount, _, shadowErr := s.shadow.(CheckAndIncrementer).CheckAndIncrement(id, limit)
+	s.compareCheck("CheckAndIncrement", id, allowed, shadowAllowed, count, shadowCount, err, shadowErr)
+	return allowed, count, resetAt, err
+}
+
+// CheckAndIncrementBy runs the weighted atomic check for the given id on both storages and returns the primary's result.
+func (s *shadowCompareStorage) CheckAndIncrementBy(id string, limit, cost uint16) (bool, uint16, time.Time, error) {
+	allowed, count, resetAt, err := s.primary.(WeightedCheckAndIncrementer).CheckAndIncrementBy(id, limit, cost)
+	shadowAllowed, shadowCount, _, shadowErr := s.shadow.(WeightedCheckAndIncrementer).CheckAndIncrementBy(id, limit, cost)
+	s.compareCheck("CheckAndIncrementBy", id, allowed, shadowAllowed, count, shadowCount, err, shadowErr)
+	return allowed, count, resetAt, err
+}
+
+// CheckAndIncrementCtx works like CheckAndIncrement, but returns early with the context's error once ctx is done.
+func (s *shadowCompareStorage) CheckAndIncrementCtx(ctx context.Context, id string, limit uint16) (bool, uint16, time.Time, error) {
+	allowed, count, resetAt, err := CheckAndIncrementContext(ctx, s.primary.(CheckAndIncrementer), id, limit)
+	shadowAllowed, shadowCount, _, shadowErr := CheckAndIncrementContext(ctx, s.shadow.(CheckAndIncrementer), id, limit)
+	s.compareCheck("CheckAndIncrement", id, allowed, shadowAllowed, count, shadowCount, err, shadowErr)
+	return allowed, count, resetAt, err
+}
+
+// CheckAndIncrementByCtx works like CheckAndIncrementBy, but returns early with the context's error once ctx is done.
+func (s *shadowCompareStorage) CheckAndIncrementByCtx(ctx context.Context, id string, limit, cost uint16) (bool, uint16, time.Time, error) {
+	allowed, count, resetAt, err := CheckAndIncrementByContext(ctx, s.primary.(WeightedCheckAndIncrementer), id, limit, cost)
+	shadowAllowed, shadowCount, _, shadowErr := CheckAndIncrementByContext(ctx, s.shadow.(WeightedCheckAndIncrementer), id, limit, cost)
+	s.compareCheck("CheckAndIncrementBy", id, allowed, shadowAllowed, count, shadowCount, err, shadowErr)
+	return allowed, count, resetAt, err
+}
+
+// TakeTokens takes n tokens from the token bucket of the given id on both storages and returns the primary's result.
+// The tokens left are compared rounded down.
+func (s *shadowCompareStorage) TakeTokens(id string, n uint16, rate float64, burst uint16) (bool, float64, error) {
+	taken, tokens, err := s.primary.(BucketStorage).TakeTokens(id, n, rate, burst)
+	shadowTaken, shadowTokens, shadowErr := s.shadow.(BucketStorage).TakeTokens(id, n, rate, burst)
+	s.compareCheck("TakeTokens", id, taken, shadowTaken, uint16(math.Floor(tokens)), uint16(math.Floor(shadowTokens)), err, shadowErr)
+	return taken, tokens, err
+}
+
+// CheckAndRecord runs the sliding window check for the given id on both storages and returns the primary's result.
+func (s *shadowCompareStorage) CheckAndRecord(id string, now time.Time, window time.Duration, limit, cost uint16) (bool, uint16, time.Time, error) {
+	allowed, count, resetAt, err := s.primary.(SlidingWindowStorage).CheckAndRecord(id, now, window, limit, cost)
+	shadowAllowed, shadowCount, _, shadowErr := s.shadow.(SlidingWindowStorage).CheckAndRecord(id, now, window, limit, cost)
+	s.compareCheck("CheckAndRecord", id, allowed, shadowAllowed, count, shadowCount, err, shadowErr)
+	return allowed, count, resetAt, err
+}
+
+// UpdateTAT advances the theoretical arrival time of the given id on both storages and returns the primary's result.
+func (s *shadowCompareStorage) UpdateTAT(id string, now time.Time, emission, tolerance time.Duration, cost uint16) (bool, time.Time, error) {
+	allowed, tat, err := s.primary.(GCRAStorage).UpdateTAT(id, now, emission, tolerance, cost)
+	shadowAllowed, _, shadowErr := s.shadow.(GCRAStorage).UpdateTAT(id, now, emission, tolerance, cost)
+	s.compareCheck("UpdateTAT", id, allowed, shadowAllowed, 0, 0, err, shadowErr)
+	return allowed, tat, err
+}
+
+// AddViolation records a violation for the given id on both storages and returns the primary's count.
+func (s *shadowCompareStorage) AddViolation(id string) (uint16, error) {
+	primary, primaryErr := s.primary.(ViolationTracker).AddViolation(id)
+	shadow, shadowErr := s.shadow.(ViolationTracker).AddViolation(id)
+	return s.compareValue("AddViolation", id, primary, shadow, primaryErr, shadowErr)
+}
+
+// Violations retrieves the violation count of the given id from both storages and returns the primary's count.
+func (s *shadowCompareStorage) Violations(id string) (uint16, error) {
+	primary, primaryErr := s.primary.(ViolationTracker).Violations(id)
+	shadow, shadowErr := s.shadow.(ViolationTracker).Violations(id)
+	return s.compareValue("Violations", id, primary, shadow, primaryErr, shadowErr)
+}
+
+// Len returns the number of ids tracked by the primary.
+func (s *shadowCompareStorage) Len() (int, error) {
+	return s.primary.(KeyCounter).Len()
+}
+
+// Snapshot returns the counts of the primary.
+func (s *shadowCompareStorage) Snapshot() (map[string]uint16, error) {
+	return s.primary.(Snapshotter).Snapshot()
+}
+
+// SweepIdle removes the ids idle for longer than maxIdle from both storages
+// and returns the number of ids removed from the primary.
+func (s *shadowCompareStorage) SweepIdle(maxIdle time.Duration) int {
+	s.shadow.(IdleSweeper).SweepIdle(maxIdle)
+	return s.primary.(IdleSweeper).SweepIdle(maxIdle)
+}
+
+// Evictions returns the number of ids evicted by the primary.
+func (s *shadowCompareStorage) Evictions() uint64 {
+	return s.primary.(EvictionCounter).Evictions()
+}
+
+// TTL returns the shortest TTL of both storages, 0 if any of them is unset.
+func (s *shadowCompareStorage) TTL() time.Duration {
+	return shortestTTL(s.primary, s.shadow)
+}
+
+// SetTTL sets the TTL of both storages.
+func (s *shadowCompareStorage) SetTTL(ttl time.Duration) {
+	setTTL(ttl, s.primary, s.shadow)
+}
+
+// SetKeyPrefix sets the key prefix of both storages.
+func (s *shadowCompareStorage) SetKeyPrefix(prefix string) {
+	setKeyPrefix(prefix, s.primary, s.shadow)
+}
+
+// SetTracer sets the tracer of both storages.
+func (s *shadowCompareStorage) SetTracer(tracer trace.Tracer) {
+	setTracer(tracer, s.primary, s.shadow)
+}
+
+// Unwrap returns the primary and the shadow, which both serve the optional interfaces.
+func (s *shadowCompareStorage) Unwrap() []RLStorage {
+	return []RLStorage{s.primary, s.shadow}
+}
+
+// compareValue reports a mismatch if the storages returned different values for the given operation,
+// or if only one of them failed it, and returns the primary's result.
+func (s *shadowCompareStorage) compareValue(op, id string, primary, shadow uint16, primaryErr, shadowErr error) (uint16, error) {
+	if primary != shadow || (primaryErr == nil) != (shadowErr == nil) {
+		s.report(Mismatch{Op: op, ID: id, Primary: primary, Shadow: shadow, PrimaryErr: primaryErr, ShadowErr: shadowErr})
+	}
+	return primary, primaryErr
+}
+
+// compareCheck reports a mismatch if the storages took different decisions or returned different counts
+// for an atomic check, or if only one of them failed it.
+func (s *shadowCompareStorage) compareCheck(op, id string, primaryAllowed, shadowAllowed bool, primary, shadow uint16, primaryErr, shadowErr error) {
+	if primaryAllowed != shadowAllowed || primary != shadow || (primaryErr == nil) != (shadowErr == nil) {
+		s.report(Mismatch{Op: op, ID: id, Primary: primary, Shadow: shadow, PrimaryErr: primaryErr, ShadowErr: shadowErr})
+	}
+}
+
+// compare reports a mismatch if only one of the storages failed the given operation,
+// and returns the primary's error.
+func (s *shadowCompareStorage) compare(op, id string, primaryErr, shadowErr error) error {
+	if (primaryErr == nil) != (shadowErr == nil) {
+		s.report(Mismatch{Op: op, ID: id, PrimaryErr: primaryErr, ShadowErr: shadowErr})
+	}
+	return primaryErr
+}
+
+// report calls the mismatch hook, if set.
+func (s *shadowCompareStorage) report(mismatch Mismatch) {
+	if s.onMismatch != nil {
+		s.onMismatch(mismatch)
+	}
+}
@@ -0,0 +1,87 @@
+package rlstorage
+
+import (
+	"errors"
+	"testing"
+)
+
+// errUnavailable is the error returned by an unavailableStorage.
+var errUnavailable = errors.New("unavailable")
+
+// unavailableStorage is a storage failing every operation with errUnavailable.
+type unavailableStorage struct{}
+
+func (unavailableStorage) Get(string) (uint16, error) { return 0, errUnavailable }
+func (unavailableStorage) Increase(string) error      { return errUnavailable }
+func (unavailableStorage) Decrease(string) error      { return errUnavailable }
+func (unavailableStorage) Free(string) error          { return errUnavailable }
+func (unavailableStorage) FreeAll() error             { return errUnavailable }
+
+func TestShadowCompareAgreeingStoragesReportNothing(t *testing.T) {
+	var mismatches []Mismatch
+	storage := NewShadowCompareStorage(NewHashMapStorage(discardLogger()), NewHashMapStorage(discardLogger()), func(m Mismatch) {
+		mismatches = append(mismatches, m)
+	})
+	storage.Increase("a")
+	storage.Increase("a")
+	storage.Decrease("a")
+	expectCount(t, storage, "a", 1)
+	storage.FreeAll()
+	expectCount(t, storage, "a", 0)
+	if len(mismatches) != 0 {
+		t.Errorf("mismatches = %v, want none", mismatches)
+	}
+}
+
+func TestShadowCompareReportsDivergentCounts(t *testing.T) {
+	var mismatches []Mismatch
+	shadow := NewHashMapStorage(discardLogger())
+	storage := NewShadowCompareStorage(NewHashMapStorage(discardLogger()), shadow, func(m Mismatch) {
+		mismatches = append(mismatches, m)
+	})
+	storage.Increase("a")
+	shadow.Increase("a")
+
+	expectCount(t, storage, "a", 1)
+	want := Mismatch{Op: "Get", ID: "a", Primary: 1, Shadow: 2}
+	if len(mismatches) != 1 || mismatches[0] != want {
+		t.Errorf("mismatches = %+v, want %+v", mismatches, want)
+	}
+}
+
+func TestShadowCompareFailingShadowNeverAffectsPrimary(t *testing.T) {
+	var mismatches []Mismatch
+	storage := NewShadowCompareStorage(NewHashMapStorage(discardLogger()), unavailableStorage{}, func(m Mismatch) {
+		mismatches = append(mismatches, m)
+	})
+	if err := storage.Increase("a"); err != nil {
+		t.Fatalf("Increase() = %v, want the primary's result", err)
+	}
+	expectCount(t, storage, "a", 1)
+	if len(mismatches) != 2 {
+		t.Fatalf("got %d mismatches, want the Increase and the Get", len(mismatches))
+	}
+	for _, mismatch := range mismatches {
+		if mismatch.PrimaryErr != nil || !errors.Is(mismatch.ShadowErr, errUnavailable) {
+			t.Errorf("mismatch = %+v, want only the shadow failing", mismatch)
+		}
+	}
+}
+
+func TestShadowCompareReportsDivergingChecks(t *testing.T) {
+	var mismatches []Mismatch
+	shadow := NewHashMapStorage(discardLogger())
+	storage := NewShadowCompareStorage(NewHashMapStorage(discardLogger()), shadow, func(m Mismatch) {
+		mismatches = append(mismatches, m)
+	})
+	shadow.Increase("a")
+
+	allowed, count, _, err := storage.(WeightedCheckAndIncrementer).CheckAndIncrementBy("a", 2, 2)
+	if err != nil || !allowed || count != 2 {
+		t.Fatalf("CheckAndIncrementBy() = %t, %d, %v, want the primary's result (allowed with count 2)", allowed, count, err)
+	}
+	want := Mismatch{Op: "CheckAndIncrementBy", ID: "a", Primary: 2, Shadow: 1}
+	if len(mismatches) != 1 || mismatches[0] != want {
+		t.Fatalf("mismatches = %+v, want [%+v]", mismatches, want)
+	}
+}
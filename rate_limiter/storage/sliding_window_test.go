@@ -0,0 +1,46 @@
+package rlstorage
+
+import (
+	"testing"
+	"time"
+)
+
+// slidingWindowBackends are the storages implementing SlidingWindowStorage, by name.
+var slidingWindowBackends = map[string]func(t testing.TB) RLStorage{
+	"hashmap": func(testing.TB) RLStorage { return NewHashMapStorage(discardLogger()) },
+	"redis":   func(t testing.TB) RLStorage { return newRedisStorage(t, time.Hour) },
+}
+
+func TestCheckAndRecord(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	steps := []struct {
+		at      time.Duration
+		cost    uint16
+		allowed bool
+		count   uint16
+		resetAt time.Duration
+	}{
+		{0, 1, true, 1, time.Minute},
+		{30 * time.Second, 1, true, 2, time.Minute},
+		{40 * time.Second, 1, false, 2, time.Minute},
+		{time.Minute, 1, true, 2, 90 * time.Second}, // The first request left the window at its end
+		{61 * time.Second, 1, false, 2, 90 * time.Second},
+		{2 * time.Minute, 2, true, 2, 3 * time.Minute},
+		{2*time.Minute + time.Second, 3, false, 2, 3 * time.Minute},
+	}
+	for name, newStorage := range slidingWindowBackends {
+		t.Run(name, func(t *testing.T) {
+			storage, ok := newStorage(t).(SlidingWindowStorage)
+			if !ok {
+				t.Fatal("the storage does not implement SlidingWindowStorage")
+			}
+			for _, step := range steps {
+				allowed, count, resetAt, err := storage.CheckAndRecord("a", start.Add(step.at), time.Minute, 2, step.cost)
+				if err != nil || allowed != step.allowed || count != step.count || !resetAt.Equal(start.Add(step.resetAt)) {
+					t.Fatalf("CheckAndRecord() at %v = %t, %d, %v, %v, want %t, %d, %v",
+						step.at, allowed, count, resetAt.Sub(start), err, step.allowed, step.count, step.resetAt)
+				}
+			}
+		})
+	}
+}
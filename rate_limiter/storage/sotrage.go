@@ -1,22 +1,157 @@
 package rlstorage
 
+import (
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
 // RLStorage is an interface that defines the contract for a rate limiting storage mechanism.
 // It provides methods for retrieving, incrementing, decrementing, and resetting rate limiting values.
 type RLStorage interface {
 	// Get retrieves the current rate value associated with the given ID.
 	// It returns the value as a uint16 (an unsigned 16-bit integer).
-	Get(string) uint16
+	// An ID that was never increased has a value of 0 and no error, while backend
+	// failures are reported as errors so they are not mistaken for an empty key.
+	Get(string) (uint16, error)
 
 	// Increase increments the rate value associated with the given ID.
-	Increase(string)
+	Increase(string) error
 
 	// Decrease decrements the rate value associated with the given ID.
-	Decrease(string)
+	Decrease(string) error
 
 	// Free resets or frees the rate value associated with the given ID,
 	// typically by setting it to zero or removing it from storage.
-	Free(string)
+	Free(string) error
 
 	// Free resets or frees the rate value of all IDs
-	FreeAll()
+	FreeAll() error
+}
+
+// BucketStorage is an optional interface implemented by storages that can hold
+// fractional token counts, as required by token bucket rate limiting.
+type BucketStorage interface {
+	// TakeTokens refills the token bucket of the given ID at rate tokens per second (capped at burst tokens),
+	// based on the time elapsed since its last refill, then takes n tokens if that many are available,
+	// as a single atomic operation: either all n tokens are taken, or none. New buckets start full.
+	// It returns whether the tokens were taken and the number of tokens left.
+	TakeTokens(id string, n uint16, rate float64, burst uint16) (bool, float64, error)
+}
+
+// CheckAndIncrementer is an optional interface implemented by storages that can check
+// a count against a limit and increment it as a single atomic operation (e.g. a Redis Lua
+// script or a single lock), saving a round trip and avoiding check-then-act races.
+type CheckAndIncrementer interface {
+	// CheckAndIncrement increments the count of the given ID if it is below limit.
+	// It returns whether the count was incremented, the resulting count, and the time at which
+	// the count resets (the zero time if the storage cannot tell).
+	CheckAndIncrement(id string, limit uint16) (allowed bool, count uint16, resetAt time.Time, err error)
+}
+
+// WeightedCheckAndIncrementer is an optional interface implemented by storages that can check a count
+// against a limit and increment it by several units as a single atomic operation, so weighted requests
+// of instances sharing the storage cannot both pass the check.
+type WeightedCheckAndIncrementer interface {
+	// CheckAndIncrementBy increments the count of the given ID by cost if the result does not exceed limit.
+	// It returns the same values as CheckAndIncrement.
+	CheckAndIncrementBy(id string, limit, cost uint16) (allowed bool, count uint16, resetAt time.Time, err error)
+}
+
+// SlidingWindowStorage is an optional interface implemented by storages that can keep a log of
+// request timestamps per ID, counting only the requests within a trailing window.
+type SlidingWindowStorage interface {
+	// CheckAndRecord drops the timestamps of the given ID older than window (relative to now), then
+	// records cost timestamps at now if the remaining count plus cost does not exceed limit, as a
+	// single atomic operation. It returns whether the request was recorded, the resulting count
+	// within the window, and the time at which the oldest recorded request leaves the window.
+	CheckAndRecord(id string, now time.Time, window time.Duration, limit, cost uint16) (allowed bool, count uint16, resetAt time.Time, err error)
+}
+
+// GCRAStorage is an optional interface implemented by storages that can keep a theoretical arrival
+// time (TAT) per ID, as required by the generic cell rate algorithm (GCRA).
+type GCRAStorage interface {
+	// UpdateTAT advances the TAT of the given ID (or now, if it lies in the past) by cost emission intervals,
+	// as a single atomic operation, unless the advanced TAT would lie more than tolerance after now.
+	// It returns whether the TAT was advanced, and the resulting TAT (the unchanged one if it was not).
+	UpdateTAT(id string, now time.Time, emission, tolerance time.Duration, cost uint16) (allowed bool, tat time.Time, err error)
+}
+
+// Snapshotter is an optional interface implemented by storages that can list their current counts.
+type Snapshotter interface {
+	// Snapshot returns a copy of the current (non-zero) count of every ID.
+	Snapshot() (map[string]uint16, error)
+}
+
+// IncreaserBy is an optional interface implemented by storages that can increment a count by
+// several units at once, so weighted requests take a single operation.
+type IncreaserBy interface {
+	// IncreaseBy increments the count of the given ID by n, atomically (all or nothing).
+	IncreaseBy(id string, n uint16) error
+}
+
+// KeyCounter is an optional interface implemented by storages that can count their tracked IDs.
+type KeyCounter interface {
+	// Len returns the number of IDs with an active count.
+	Len() (int, error)
+}
+
+// EvictionCounter is an optional interface implemented by storages that evict IDs to stay within a budget.
+type EvictionCounter interface {
+	// Evictions returns the number of IDs evicted so far.
+	Evictions() uint64
+}
+
+// Transferer is an optional interface implemented by storages that can atomically move
+// the count of one ID to another.
+type Transferer interface {
+	// Transfer moves the count of the from ID onto the to ID, clearing the from ID.
+	// It returns the number of units moved.
+	Transfer(from, to string) (uint16, error)
+}
+
+// ViolationTracker is an optional interface implemented by storages that keep the violation
+// history of clients apart from their request counters (e.g. with a longer TTL), so that
+// a client's offense history outlives a single request window.
+type ViolationTracker interface {
+	// AddViolation records a violation for the given ID and returns its violation count.
+	AddViolation(id string) (uint16, error)
+
+	// Violations retrieves the violation count of the given ID.
+	Violations(id string) (uint16, error)
+}
+
+// IdleSweeper is an optional interface implemented by storages that track the last access
+// of every ID and can remove IDs that have been idle for too long, as a gentler alternative
+// to FreeAll for cleaning up counts leaked by lost releases.
+type IdleSweeper interface {
+	// SweepIdle removes the counters of all IDs not accessed within maxIdle
+	// and returns the number of removed IDs.
+	SweepIdle(maxIdle time.Duration) int
+}
+
+// TTLStorage is an optional interface implemented by storages whose counters expire after a TTL
+// of their own (such as the Redis storage), so the middleware can align it with its timeout.
+type TTLStorage interface {
+	// TTL returns the TTL of the counters, 0 if it is unset.
+	TTL() time.Duration
+
+	// SetTTL sets the TTL of the counters. It must be called before the storage is used.
+	SetTTL(ttl time.Duration)
+}
+
+// TracedStorage is an optional interface implemented by storages doing remote round trips (such as the Redis
+// storage), which create an OpenTelemetry span per context-bound call (see ContextStorage) once given a tracer.
+type TracedStorage interface {
+	// SetTracer sets the tracer the spans of the storage are created with. It must be called before the storage is used.
+	SetTracer(tracer trace.Tracer)
+}
+
+// KeyPrefixer is an optional interface implemented by storages sharing their keyspace with other
+// data (such as the Redis storages), whose keys are namespaced under a prefix. FreeAll only removes
+// the keys under the prefix, so the prefix must not be shared with unrelated data.
+type KeyPrefixer interface {
+	// SetKeyPrefix sets the prefix every key of the storage is namespaced under.
+	// It must be called before the storage is used.
+	SetKeyPrefix(prefix string)
 }
@@ -0,0 +1,147 @@
+package rlstorage
+
+import (
+	"testing"
+	"time"
+)
+
+// checkAndIncrementBackends are the storages implementing CheckAndIncrementer, by name.
+var checkAndIncrementBackends = map[string]func(t testing.TB) RLStorage{
+	"hashmap": func(testing.TB) RLStorage { return NewHashMapStorage(discardLogger()) },
+	"bounded": func(testing.TB) RLStorage { return NewBoundedStorage(1<<20, discardLogger()) },
+	"syncmap": func(testing.TB) RLStorage { return NewSyncMapStorage(discardLogger()) },
+	"fixed":   func(testing.TB) RLStorage { return NewFixedWindowStorage(time.Hour, discardLogger()) },
+	"redis":   func(t testing.TB) RLStorage { return newRedisStorage(t, time.Minute) },
+	"redisfix": func(t testing.TB) RLStorage {
+		_, client := newMiniredis(t)
+		return NewRedisFixedWindowStorage(client, time.Hour, discardLogger())
+	},
+}
+
+func TestCheckAndIncrement(t *testing.T) {
+	for name, newStorage := range checkAndIncrementBackends {
+		t.Run(name, func(t *testing.T) {
+			storage := newStorage(t)
+			atomic, ok := storage.(CheckAndIncrementer)
+			if !ok {
+				t.Fatal("the storage does not implement CheckAndIncrementer")
+			}
+			for want := uint16(1); want <= 3; want++ {
+				allowed, count, _, err := atomic.CheckAndIncrement("a", 3)
+				if err != nil || !allowed || count != want {
+					t.Fatalf("CheckAndIncrement() = %t, %d, %v, want allowed with count %d", allowed, count, err, want)
+				}
+			}
+			allowed, count, _, err := atomic.CheckAndIncrement("a", 3)
+			if err != nil || allowed || count != 3 {
+				t.Fatalf("CheckAndIncrement() at the limit = %t, %d, %v, want rejected with count 3", allowed, count, err)
+			}
+			expectCount(t, storage, "a", 3)
+			if allowed, count, _, _ := atomic.CheckAndIncrement("b", 3); !allowed || count != 1 {
+				t.Fatalf("CheckAndIncrement() of another id = %t, %d, want allowed with count 1", allowed, count)
+			}
+			if allowed, _, _, _ := atomic.CheckAndIncrement("c", 0); allowed {
+				t.Fatal("CheckAndIncrement() with a limit of 0 was allowed")
+			}
+		})
+	}
+}
+
+func TestCheckAndIncrementResetTime(t *testing.T) {
+	if _, _, resetAt, _ := NewHashMapStorage(discardLogger()).(CheckAndIncrementer).CheckAndIncrement("a", 1); !resetAt.IsZero() {
+		t.Fatalf("reset time of the hashmap storage = %s, want zero (unknown)", resetAt)
+	}
+
+	before := time.Now()
+	_, _, resetAt, err := newRedisStorage(t, time.Minute).(CheckAndIncrementer).CheckAndIncrement("a", 1)
+	if err != nil {
+		t.Fatalf("CheckAndIncrement() failed: %v", err)
+	}
+	if resetAt.Before(before.Add(time.Minute)) || resetAt.After(time.Now().Add(time.Minute)) {
+		t.Fatalf("reset time of the redis storage = %s, want a minute from now (the TTL)", resetAt)
+	}
+}
+
+func TestLenCountsTrackedIds(t *testing.T) {
+	for name, newStorage := range checkAndIncrementBackends {
+		t.Run(name, func(t *testing.T) {
+			storage := newStorage(t)
+			counter, ok := storage.(KeyCounter)
+			if !ok {
+				t.Skip("the storage does not implement KeyCounter")
+			}
+			for _, id := range []string{"a", "b", "a"} {
+				if err := storage.Increase(id); err != nil {
+					t.Fatalf("Increase(%q) error = %v", id, err)
+				}
+			}
+			if keys, err := counter.Len(); err != nil || keys != 2 {
+				t.Fatalf("Len() = %d, %v, want 2", keys, err)
+			}
+			if err := storage.Free("a"); err != nil {
+				t.Fatalf("Free() error = %v", err)
+			}
+			if keys, err := counter.Len(); err != nil || keys != 1 {
+				t.Fatalf("Len() after Free = %d, %v, want 1", keys, err)
+			}
+		})
+	}
+}
+
+func TestCheckAndIncrementBy(t *testing.T) {
+	for name, newStorage := range checkAndIncrementBackends {
+		storage := newStorage(t)
+		weighted, ok := storage.(WeightedCheckAndIncrementer)
+		if !ok {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			steps := []struct {
+				cost    uint16
+				allowed bool
+				count   uint16
+			}{
+				{4, true, 4},
+				{4, true, 8},
+				{4, false, 8}, // All or nothing: no unit is taken once the cost exceeds the limit
+				{2, true, 10},
+			}
+			for _, step := range steps {
+				allowed, count, _, err := weighted.CheckAndIncrementBy("a", 10, step.cost)
+				if err != nil || allowed != step.allowed || count != step.count {
+					t.Fatalf("CheckAndIncrementBy() with cost %d = %t, %d, %v, want %t, %d",
+						step.cost, allowed, count, err, step.allowed, step.count)
+				}
+			}
+			expectCount(t, storage, "a", 10)
+		})
+	}
+}
+
+func TestTakeTokensIsAllOrNothing(t *testing.T) {
+	backends := map[string]func(t testing.TB) RLStorage{
+		"hashmap": func(testing.TB) RLStorage { return NewHashMapStorage(discardLogger()) },
+		"redis":   func(t testing.TB) RLStorage { return newRedisStorage(t, time.Minute) },
+	}
+	steps := []struct {
+		n      uint16
+		taken  bool
+		tokens float64
+	}{
+		{4, true, 1},
+		{4, false, 1}, // A rejected take keeps the last token
+		{1, true, 0},
+		{1, false, 0},
+	}
+	for name, newStorage := range backends {
+		t.Run(name, func(t *testing.T) {
+			storage := newStorage(t).(BucketStorage)
+			for _, step := range steps {
+				taken, tokens, err := storage.TakeTokens("a", step.n, 0.001, 5)
+				if err != nil || taken != step.taken || tokens < step.tokens || tokens > step.tokens+0.01 {
+					t.Fatalf("TakeTokens(%d) = %t, %f, %v, want %t with %f left", step.n, taken, tokens, err, step.taken, step.tokens)
+				}
+			}
+		})
+	}
+}
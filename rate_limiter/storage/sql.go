@@ -0,0 +1,224 @@
+package rlstorage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	rllog "github.com/FMotalleb/gin_testfield/rate_limiter/logging"
+)
+
+// DefaultSQLTable is the name of the table the SQL storage keeps its counters in by default.
+const DefaultSQLTable = "rl_counters"
+
+// sqlTableName matches the table names accepted by the SQL storage, which are interpolated into its queries.
+var sqlTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// sqlMigrations are the statements creating the schema of the SQL storage, applied in order
+// (each of them is idempotent) when the storage is created. `%[1]s` is replaced with the table name.
+// Counts are saturated at math.MaxUint16 and expiries are stored as milliseconds since the epoch.
+var sqlMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS %[1]s (
+	id TEXT PRIMARY KEY,
+	count INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL
+)`,
+	`CREATE INDEX IF NOT EXISTS %[1]s_expires_at ON %[1]s (expires_at)`,
+}
+
+// sqlStorage is a struct that implements the RLStorage interface on top of a database/sql database,
+// keeping a row of {id, count, expires_at} per id, so counts survive process restarts.
+type sqlStorage struct {
+	db     *sql.DB          // The database the counters are kept in
+	table  string           // The name of the counters table
+	ttl    time.Duration    // Time-to-live (TTL) of a counter, starting when it is created
+	clock  func() time.Time // The clock the expiries are computed with
+	logger rllog.Logger     // Logger instance for logging messages
+
+	// The queries on the counters table, prepared with its name
+	getQuery       string
+	increaseQuery  string
+	decreaseQuery  string
+	deleteQuery    string
+	freeQuery      string
+	freeAllQuery   string
+	lenQuery       string
+	purgeIdleQuery string
+}
+
+// NewSQLStorage creates a new instance of RLStorage keeping its counters in the given table (DefaultSQLTable
+// if empty) of db, creating the table if it does not exist. It targets single-node deployments that need
+// counts to survive restarts without running Redis, such as SQLite (e.g. through modernc.org/sqlite).
+//
+// The queries use `?` placeholders and `INSERT ... ON CONFLICT` upserts, as supported by SQLite.
+// Counters expire ttl after their creation, like on the Redis storage: expired rows are ignored by Get
+// and reset by the next increase. A TTL of 0 is derived from the middleware at Build (see TTLStorage).
+// FreeAll deletes every row of the table.
+func NewSQLStorage(db *sql.DB, table string, ttl time.Duration, logger rllog.Logger) (RLStorage, error) {
+	if table == "" {
+		table = DefaultSQLTable
+	}
+	if !sqlTableName.MatchString(table) {
+		return nil, fmt.Errorf("invalid table name '%s'", table)
+	}
+	s := &sqlStorage{
+		db:     db,
+		table:  table,
+		ttl:    ttl,
+		clock:  time.Now,
+		logger: logger,
+
+		getQuery: fmt.Sprintf(`SELECT count FROM %s WHERE id = ? AND expires_at > ?`, table),
+		increaseQuery: fmt.Sprintf(`INSERT INTO %[1]s (id, count, expires_at) VALUES (?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET
+	count = CASE WHEN %[1]s.expires_at > ? THEN MIN(%[1]s.count + excluded.count, 65535) ELSE excluded.count END,
+	expires_at = CASE WHEN %[1]s.expires_at > ? THEN %[1]s.expires_at ELSE excluded.expires_at END`, table),
+		decreaseQuery:  fmt.Sprintf(`UPDATE %s SET count = count - 1 WHERE id = ? AND count > 0`, table),
+		deleteQuery:    fmt.Sprintf(`DELETE FROM %s WHERE id = ? AND (count <= 0 OR expires_at <= ?)`, table),
+		freeQuery:      fmt.Sprintf(`DELETE FROM %s WHERE id = ?`, table),
+		freeAllQuery:   fmt.Sprintf(`DELETE FROM %s`, table),
+		lenQuery:       fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE count > 0 AND expires_at > ?`, table),
+		purgeIdleQuery: fmt.Sprintf(`DELETE FROM %s WHERE expires_at <= ?`, table),
+	}
+	if err := s.migrate(context.Background()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrate applies the schema migrations to the database.
+func (s *sqlStorage) migrate(ctx context.Context) error {
+	for _, migration := range sqlMigrations {
+		if _, err := s.db.ExecContext(ctx, fmt.Sprintf(migration, s.table)); err != nil {
+			return fmt.Errorf("failed to migrate table '%s': %w", s.table, err)
+		}
+	}
+	return nil
+}
+
+// now returns the current time as milliseconds since the epoch.
+func (s *sqlStorage) now() int64 {
+	return s.clock().UnixMilli()
+}
+
+// Get retrieves the count for the given id, 0 if it does not exist or expired.
+func (s *sqlStorage) Get(id string) (uint16, error) {
+	return s.GetCtx(context.Background(), id)
+}
+
+// GetCtx works like Get, but is bound to ctx.
+func (s *sqlStorage) GetCtx(ctx context.Context, id string) (uint16, error) {
+	var count int64
+	err := s.db.QueryRowContext(ctx, s.getQuery, id, s.now()).Scan(&count)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get value for ID '%s': %w", id, err)
+	}
+	return uint16(max(count, 0)), nil
+}
+
+// Increase increments the count for the given id in a single upsert, creating (or resetting)
+// the counter with the TTL of the storage if it does not exist or expired.
+func (s *sqlStorage) Increase(id string) error {
+	return s.IncreaseCtx(context.Background(), id)
+}
+
+// IncreaseCtx works like Increase, but is bound to ctx.
+func (s *sqlStorage) IncreaseCtx(ctx context.Context, id string) error {
+	return s.increaseBy(ctx, id, 1)
+}
+
+// IncreaseBy increments the count for the given id by n in a single upsert, saturating at math.MaxUint16.
+func (s *sqlStorage) IncreaseBy(id string, n uint16) error {
+	return s.increaseBy(context.Background(), id, n)
+}
+
+// increaseBy increments the count for the given id by n, bound to ctx.
+func (s *sqlStorage) increaseBy(ctx context.Context, id string, n uint16) error {
+	now := s.now()
+	expiresAt := now + ttlMillis(s.ttl)
+	if _, err := s.db.ExecContext(ctx, s.increaseQuery, id, n, expiresAt, now, now); err != nil {
+		return fmt.Errorf("failed to increase value for ID '%s': %w", id, err)
+	}
+	return nil
+}
+
+// Decrease decrements the count for the given id, never below zero,
+// and removes the row once it reaches zero (or expired).
+func (s *sqlStorage) Decrease(id string) error {
+	return s.DecreaseCtx(context.Background(), id)
+}
+
+// DecreaseCtx works like Decrease, but is bound to ctx.
+func (s *sqlStorage) DecreaseCtx(ctx context.Context, id string) error {
+	if _, err := s.db.ExecContext(ctx, s.decreaseQuery, id); err != nil {
+		return fmt.Errorf("failed to decrease value for ID '%s': %w", id, err)
+	}
+	// Rows increased in the meantime are kept, as the condition is checked again
+	if _, err := s.db.ExecContext(ctx, s.deleteQuery, id, s.now()); err != nil {
+		return fmt.Errorf("failed to delete value for ID '%s': %w", id, err)
+	}
+	return nil
+}
+
+// Free removes the given id from the storage.
+func (s *sqlStorage) Free(id string) error {
+	return s.FreeCtx(context.Background(), id)
+}
+
+// FreeCtx works like Free, but is bound to ctx.
+func (s *sqlStorage) FreeCtx(ctx context.Context, id string) error {
+	if _, err := s.db.ExecContext(ctx, s.freeQuery, id); err != nil {
+		return fmt.Errorf("failed to free value for ID '%s': %w", id, err)
+	}
+	s.logger.Debug("Freed ID from storage", "id", id)
+	return nil
+}
+
+// FreeAll removes every row from the counters table.
+func (s *sqlStorage) FreeAll() error {
+	if _, err := s.db.Exec(s.freeAllQuery); err != nil {
+		return fmt.Errorf("failed to free all values: %w", err)
+	}
+	s.logger.Info("Freed all entries from storage")
+	return nil
+}
+
+// Len returns the number of ids with an active (non-expired) count.
+func (s *sqlStorage) Len() (int, error) {
+	var count int
+	if err := s.db.QueryRow(s.lenQuery, s.now()).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count keys: %w", err)
+	}
+	return count, nil
+}
+
+// SweepIdle removes the rows that expired, which are otherwise only reset by the next increase,
+// and returns the number of removed rows. Since counters expire on their own, maxIdle is not used.
+func (s *sqlStorage) SweepIdle(time.Duration) int {
+	result, err := s.db.Exec(s.purgeIdleQuery, s.now())
+	if err != nil {
+		s.logger.Warn("Failed to sweep expired entries", "error", err)
+		return 0
+	}
+	swept, _ := result.RowsAffected()
+	if swept > 0 {
+		s.logger.Info("Swept expired entries from storage", "swept", swept)
+	}
+	return int(swept)
+}
+
+// TTL returns the TTL of the counters.
+func (s *sqlStorage) TTL() time.Duration {
+	return s.ttl
+}
+
+// SetTTL sets the TTL of the counters.
+func (s *sqlStorage) SetTTL(ttl time.Duration) {
+	s.ttl = ttl
+}
@@ -0,0 +1,155 @@
+package rlstorage
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// newSQLStorage returns a SQL storage backed by an in-memory SQLite database, with the given TTL,
+// and the database itself.
+func newSQLStorage(t testing.TB, ttl time.Duration) (*sqlStorage, *sql.DB) {
+	t.Helper()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open the database: %v", err)
+	}
+	db.SetMaxOpenConns(1) // Every connection to :memory: opens a database of its own
+	t.Cleanup(func() { db.Close() })
+	storage, err := NewSQLStorage(db, "", ttl, discardLogger())
+	if err != nil {
+		t.Fatalf("NewSQLStorage() error = %v", err)
+	}
+	return storage.(*sqlStorage), db
+}
+
+func TestSQLStorageCounts(t *testing.T) {
+	storage, _ := newSQLStorage(t, time.Minute)
+
+	expectCount(t, storage, "a", 0)
+	storage.Increase("a")
+	storage.Increase("a")
+	if err := storage.IncreaseBy("a", 3); err != nil {
+		t.Fatalf("IncreaseBy() error = %v", err)
+	}
+	expectCount(t, storage, "a", 5)
+	storage.Decrease("a")
+	expectCount(t, storage, "a", 4)
+	storage.Free("a")
+	expectCount(t, storage, "a", 0)
+}
+
+func TestSQLStorageDecreaseRemovesEmptyRows(t *testing.T) {
+	storage, db := newSQLStorage(t, time.Minute)
+	storage.Increase("a")
+	storage.Decrease("a")
+	storage.Decrease("a") // Never below zero
+
+	var rows int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM ` + DefaultSQLTable).Scan(&rows); err != nil {
+		t.Fatalf("failed to count rows: %v", err)
+	}
+	if rows != 0 {
+		t.Fatalf("rows after decreasing to zero = %d, want none", rows)
+	}
+	expectCount(t, storage, "a", 0)
+}
+
+func TestSQLStorageIncreaseSaturates(t *testing.T) {
+	storage, _ := newSQLStorage(t, time.Minute)
+	storage.IncreaseBy("a", 65000)
+	storage.IncreaseBy("a", 1000)
+	expectCount(t, storage, "a", 65535)
+}
+
+func TestSQLStorageCountersExpire(t *testing.T) {
+	clock := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	storage, _ := newSQLStorage(t, time.Minute)
+	storage.clock = func() time.Time { return clock }
+	storage.Increase("a")
+	storage.Increase("a")
+
+	clock = clock.Add(time.Minute)
+	expectCount(t, storage, "a", 0)
+	if keys, err := storage.Len(); err != nil || keys != 0 {
+		t.Fatalf("Len() after expiry = %d, %v, want 0", keys, err)
+	}
+	// The next increase resets the expired counter
+	storage.Increase("a")
+	expectCount(t, storage, "a", 1)
+	clock = clock.Add(59 * time.Second)
+	expectCount(t, storage, "a", 1)
+}
+
+func TestSQLStorageSweepIdleRemovesExpiredRows(t *testing.T) {
+	clock := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	storage, _ := newSQLStorage(t, time.Minute)
+	storage.clock = func() time.Time { return clock }
+	storage.Increase("a")
+	clock = clock.Add(30 * time.Second)
+	storage.Increase("b")
+
+	clock = clock.Add(30 * time.Second)
+	if swept := storage.SweepIdle(0); swept != 1 {
+		t.Fatalf("SweepIdle() = %d, want the expired row removed", swept)
+	}
+	expectCount(t, storage, "b", 1)
+}
+
+func TestSQLStorageLenAndFreeAll(t *testing.T) {
+	storage, _ := newSQLStorage(t, time.Minute)
+	storage.Increase("a")
+	storage.Increase("b")
+	if keys, err := storage.Len(); err != nil || keys != 2 {
+		t.Fatalf("Len() = %d, %v, want 2", keys, err)
+	}
+
+	if err := storage.FreeAll(); err != nil {
+		t.Fatalf("FreeAll() error = %v", err)
+	}
+	if keys, err := storage.Len(); err != nil || keys != 0 {
+		t.Fatalf("Len() after FreeAll = %d, %v, want 0", keys, err)
+	}
+}
+
+func TestSQLStorageSurvivesReopening(t *testing.T) {
+	storage, db := newSQLStorage(t, time.Minute)
+	storage.Increase("a")
+
+	// The migrations are idempotent, so a new storage on the same table keeps the counts
+	reopened, err := NewSQLStorage(db, DefaultSQLTable, time.Minute, discardLogger())
+	if err != nil {
+		t.Fatalf("NewSQLStorage() on an existing table error = %v", err)
+	}
+	expectCount(t, reopened, "a", 1)
+}
+
+func TestNewSQLStorageRejectsInvalidTableNames(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open the database: %v", err)
+	}
+	defer db.Close()
+	for _, table := range []string{"1counters", "rl counters", "rl;DROP TABLE x"} {
+		if _, err := NewSQLStorage(db, table, time.Minute, discardLogger()); err == nil {
+			t.Errorf("NewSQLStorage() with table %q succeeded", table)
+		}
+	}
+}
+
+func TestSQLStorageUsesSetTTL(t *testing.T) {
+	clock := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	storage, _ := newSQLStorage(t, 0)
+	storage.clock = func() time.Time { return clock }
+	if ttl := storage.TTL(); ttl != 0 {
+		t.Fatalf("TTL() = %s, want unset", ttl)
+	}
+	storage.SetTTL(time.Second)
+	storage.Increase("a")
+
+	expectCount(t, storage, "a", 1)
+	clock = clock.Add(time.Second)
+	expectCount(t, storage, "a", 0)
+}
@@ -0,0 +1,165 @@
+package rlstorage
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	rllog "github.com/FMotalleb/gin_testfield/rate_limiter/logging"
+)
+
+// deadCounter marks a counter removed from the sync map storage. Dead counters are never
+// modified again, concurrent increases retry on a fresh counter instead.
+const deadCounter = math.MinInt32
+
+// syncMapStorage is a storage implementation using a sync.Map of atomic counters, so reads and
+// writes of independent ids never contend on a shared lock.
+type syncMapStorage struct {
+	counters sync.Map     // The atomic counters (*atomic.Int32), by id
+	logger   rllog.Logger // Logger instance for logging messages
+}
+
+// NewSyncMapStorage creates a new instance of RLStorage keeping its counters in a sync.Map of atomic
+// counters. Unlike NewHashMapStorage, which serializes every operation on a single mutex, reads never
+// block and writes only contend on the same id, which suits read-heavy loads with many distinct clients.
+// It supports CheckAndIncrement, but no token buckets, sliding windows or violation tracking.
+func NewSyncMapStorage(logger rllog.Logger) RLStorage {
+	return &syncMapStorage{logger: logger}
+}
+
+// counter returns the live counter of the given id, creating it if needed.
+func (s *syncMapStorage) counter(id string) *atomic.Int32 {
+	if counter, ok := s.counters.Load(id); ok {
+		return counter.(*atomic.Int32)
+	}
+	counter, _ := s.counters.LoadOrStore(id, new(atomic.Int32))
+	return counter.(*atomic.Int32)
+}
+
+// kill marks the given counter of the given id dead (if it still holds expected) and removes it.
+func (s *syncMapStorage) kill(id string, counter *atomic.Int32, expected int32) bool {
+	if !counter.CompareAndSwap(expected, deadCounter) {
+		return false
+	}
+	s.counters.CompareAndDelete(id, counter)
+	return true
+}
+
+// Decrease decrements the count for the given id, removing the id once it reaches 0.
+func (s *syncMapStorage) Decrease(id string) error {
+	value, ok := s.counters.Load(id)
+	if !ok {
+		return nil
+	}
+	counter := value.(*atomic.Int32)
+	for {
+		count := counter.Load()
+		switch {
+		case count <= 0: // Dead, or freed in the meantime
+			return nil
+		case count == 1:
+			if s.kill(id, counter, 1) {
+				return nil
+			}
+		default:
+			if counter.CompareAndSwap(count, count-1) {
+				return nil
+			}
+		}
+	}
+}
+
+// Free removes the given id from the storage.
+func (s *syncMapStorage) Free(id string) error {
+	if value, ok := s.counters.LoadAndDelete(id); ok {
+		value.(*atomic.Int32).Store(deadCounter)
+	}
+	s.logger.Debug("Freed ID from storage", "id", id)
+	return nil
+}
+
+// Get retrieves the count for the given id (0 if it does not exist).
+func (s *syncMapStorage) Get(id string) (uint16, error) {
+	value, ok := s.counters.Load(id)
+	if !ok {
+		return 0, nil
+	}
+	return uint16(max(value.(*atomic.Int32).Load(), 0)), nil
+}
+
+// Increase increments the count for the given id.
+func (s *syncMapStorage) Increase(id string) error {
+	return s.IncreaseBy(id, 1)
+}
+
+// IncreaseBy increments the count for the given id by n, saturating at math.MaxUint16.
+func (s *syncMapStorage) IncreaseBy(id string, n uint16) error {
+	for {
+		counter := s.counter(id)
+		for {
+			count := counter.Load()
+			if count == deadCounter {
+				break // Removed concurrently, retry on a fresh counter
+			}
+			if counter.CompareAndSwap(count, min(count+int32(n), math.MaxUint16)) {
+				return nil
+			}
+		}
+	}
+}
+
+// FreeAll removes all entries from the storage.
+func (s *syncMapStorage) FreeAll() error {
+	s.counters.Range(func(id, value any) bool {
+		// Only the ranged counter is removed, a fresh counter stored concurrently is kept
+		if s.counters.CompareAndDelete(id, value) {
+			value.(*atomic.Int32).Store(deadCounter)
+		}
+		return true
+	})
+	s.logger.Info("Freed all entries from storage")
+	return nil
+}
+
+// CheckAndIncrement increments the count for the given id atomically if it is below limit.
+// The reset time is unknown to this storage (counts are released by the middleware), so it is always zero.
+func (s *syncMapStorage) CheckAndIncrement(id string, limit uint16) (bool, uint16, time.Time, error) {
+	for {
+		counter := s.counter(id)
+		for {
+			count := counter.Load()
+			if count == deadCounter {
+				break // Removed concurrently, retry on a fresh counter
+			}
+			if count >= int32(limit) {
+				return false, uint16(count), time.Time{}, nil
+			}
+			if counter.CompareAndSwap(count, count+1) {
+				return true, uint16(count + 1), time.Time{}, nil
+			}
+		}
+	}
+}
+
+// Len returns the number of ids in the storage.
+func (s *syncMapStorage) Len() (int, error) {
+	count := 0
+	s.counters.Range(func(_, _ any) bool {
+		count++
+		return true
+	})
+	return count, nil
+}
+
+// Snapshot returns a copy of the current counts.
+func (s *syncMapStorage) Snapshot() (map[string]uint16, error) {
+	snapshot := make(map[string]uint16)
+	s.counters.Range(func(id, value any) bool {
+		if count := value.(*atomic.Int32).Load(); count > 0 {
+			snapshot[id.(string)] = uint16(count)
+		}
+		return true
+	})
+	return snapshot, nil
+}
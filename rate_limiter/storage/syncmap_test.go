@@ -0,0 +1,119 @@
+package rlstorage
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSyncMapStorageRemovesIdsAtZero(t *testing.T) {
+	storage := NewSyncMapStorage(discardLogger())
+	if err := storage.Decrease("a"); err != nil {
+		t.Fatalf("Decrease() of a missing id error = %v", err)
+	}
+	storage.Increase("a")
+	storage.Increase("a")
+	storage.Decrease("a")
+	expectCount(t, storage, "a", 1)
+	storage.Decrease("a")
+	storage.Decrease("a")
+	expectCount(t, storage, "a", 0)
+	if keys, _ := storage.(KeyCounter).Len(); keys != 0 {
+		t.Errorf("Len() = %d after releasing the last unit, want 0", keys)
+	}
+}
+
+func TestSyncMapStorageCountsAgainAfterFree(t *testing.T) {
+	storage := NewSyncMapStorage(discardLogger())
+	storage.Increase("a")
+	storage.Free("a")
+	storage.Increase("a")
+	expectCount(t, storage, "a", 1)
+
+	storage.FreeAll()
+	expectCount(t, storage, "a", 0)
+	if allowed, count, _, _ := storage.(CheckAndIncrementer).CheckAndIncrement("a", 1); !allowed || count != 1 {
+		t.Errorf("CheckAndIncrement() after FreeAll = %t, %d, want allowed with count 1", allowed, count)
+	}
+}
+
+func TestSyncMapStorageSaturates(t *testing.T) {
+	storage := NewSyncMapStorage(discardLogger()).(IncreaserBy)
+	storage.IncreaseBy("a", math.MaxUint16)
+	storage.IncreaseBy("a", 10)
+	expectCount(t, storage.(RLStorage), "a", math.MaxUint16)
+}
+
+func TestSyncMapStorageConcurrentCheckAndIncrement(t *testing.T) {
+	const limit, workers = 100, 1000
+	storage := NewSyncMapStorage(discardLogger())
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, _, _, _ := storage.(CheckAndIncrementer).CheckAndIncrement("a", limit); ok {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := allowed.Load(); got != limit {
+		t.Errorf("%d requests allowed, want %d", got, limit)
+	}
+	expectCount(t, storage, "a", limit)
+}
+
+func TestSyncMapStorageConcurrentIncreaseAndDecrease(t *testing.T) {
+	const workers, rounds = 50, 100
+	storage := NewSyncMapStorage(discardLogger())
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < rounds; j++ {
+				storage.Increase("a")
+				storage.Decrease("a")
+			}
+		}()
+	}
+	wg.Wait()
+	expectCount(t, storage, "a", 0)
+	if keys, _ := storage.(KeyCounter).Len(); keys != 0 {
+		t.Errorf("Len() = %d once every unit was released, want 0", keys)
+	}
+}
+
+// BenchmarkGetHeavy runs a read-heavy load (15 reads per increase and decrease) over 1024 ids in parallel.
+func BenchmarkGetHeavy(b *testing.B) {
+	for name, newStorage := range map[string]func() RLStorage{
+		"hashmap": func() RLStorage { return NewHashMapStorage(discardLogger()) },
+		"syncmap": func() RLStorage { return NewSyncMapStorage(discardLogger()) },
+	} {
+		b.Run(name, func(b *testing.B) {
+			storage := newStorage()
+			ids := make([]string, 1024)
+			for i := range ids {
+				ids[i] = strconv.Itoa(i)
+				storage.Increase(ids[i])
+			}
+			var next atomic.Uint32
+			b.ReportAllocs()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := int(next.Add(1)); pb.Next(); i++ {
+					id := ids[i%len(ids)]
+					if i%16 == 0 {
+						storage.Increase(id)
+						storage.Decrease(id)
+						continue
+					}
+					storage.Get(id)
+				}
+			})
+		})
+	}
+}
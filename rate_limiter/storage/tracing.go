@@ -0,0 +1,45 @@
+package rlstorage
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// startSpan starts a span with the given name for an operation on the given ID as a child of ctx,
+// returning ctx as is and a nil span if tracer is nil.
+func startSpan(ctx context.Context, tracer trace.Tracer, name, id string) (context.Context, trace.Span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("ratelimit.id", id)),
+	)
+}
+
+// endSpan records err (if any) on the given span and ends it, doing nothing if span is nil.
+func endSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// endCheckSpan records the outcome of a check on the given span and ends it, doing nothing if span is nil.
+func endCheckSpan(span trace.Span, allowed bool, count uint16, err error) {
+	if span == nil {
+		return
+	}
+	span.SetAttributes(
+		attribute.Int("ratelimit.count", int(count)),
+		attribute.Bool("ratelimit.allowed", allowed),
+	)
+	endSpan(span, err)
+}
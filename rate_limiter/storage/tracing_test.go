@@ -0,0 +1,53 @@
+package rlstorage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRedisSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	defer provider.Shutdown(context.Background())
+	server, client := newMiniredis(t)
+	storage := NewRedisStorage(client, time.Minute, discardLogger())
+	storage.(TracedStorage).SetTracer(provider.Tracer("test"))
+	ctx := context.Background()
+
+	if _, _, _, err := CheckAndIncrementContext(ctx, storage.(CheckAndIncrementer), "a", 1); err != nil {
+		t.Fatalf("CheckAndIncrementContext() error = %v", err)
+	}
+	server.SetError("ERR unavailable")
+	if _, err := GetContext(ctx, storage, "a"); err == nil {
+		t.Fatal("GetContext() on a failing server succeeded")
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want one per call", len(spans))
+	}
+	if name := spans[0].Name(); name != "ratelimit.redis.check_and_increment" {
+		t.Errorf("span name = %q, want ratelimit.redis.check_and_increment", name)
+	}
+	if status := spans[0].Status(); status.Code == codes.Error {
+		t.Errorf("status of a successful call = %v, want no error", status)
+	}
+	if name := spans[1].Name(); name != "ratelimit.redis.get" {
+		t.Errorf("span name = %q, want ratelimit.redis.get", name)
+	}
+	if status := spans[1].Status(); status.Code != codes.Error {
+		t.Errorf("status of a failed call = %v, want an error", status)
+	}
+}
+
+func TestRedisWithoutTracerCreatesNoSpans(t *testing.T) {
+	if ctx, span := startSpan(context.Background(), nil, "ratelimit.redis.get", "a"); span != nil || ctx == nil {
+		t.Fatal("startSpan() without a tracer started a span")
+	}
+	endSpan(nil, nil) // Ending a nil span does nothing
+}
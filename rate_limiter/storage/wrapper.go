@@ -0,0 +1,86 @@
+package rlstorage
+
+import (
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// wrapper is implemented by the storages wrapping other storages (the read replica, shadow compare
+// and OOM fallback storages). They implement every optional interface, forwarding it to the storages
+// they wrap, but can only serve the ones implemented by every storage returned by Unwrap.
+//
+// ContextStorage, TTLStorage, KeyPrefixer and TracedStorage are served regardless: context-bound calls
+// fall back to checking the context before a plain call, and the TTL, key prefix and tracer are only
+// forwarded to the wrapped storages implementing them.
+type wrapper interface {
+	// Unwrap returns the wrapped storages serving the optional interfaces of the wrapper.
+	Unwrap() []RLStorage
+}
+
+// As reports whether the given storage supports the optional interface T, and returns it as T if so.
+// Unlike a type assertion, it also checks that the storages wrapped by the read replica, shadow compare
+// and OOM fallback storages implement T (recursively), so the middleware falls back to the plain
+// operations instead of calling an optional one the wrapped storages cannot run.
+func As[T any](storage RLStorage) (T, bool) {
+	value, ok := storage.(T)
+	if !ok {
+		return value, false
+	}
+	if w, isWrapper := storage.(wrapper); isWrapper {
+		for _, wrapped := range w.Unwrap() {
+			if _, ok := As[T](wrapped); !ok {
+				var zero T
+				return zero, false
+			}
+		}
+	}
+	return value, true
+}
+
+// shortestTTL returns the shortest TTL of the given storages implementing TTLStorage,
+// 0 if the TTL of any of them is unset (or none of them has one).
+func shortestTTL(storages ...RLStorage) time.Duration {
+	var shortest time.Duration
+	for _, storage := range storages {
+		ttlStorage, ok := storage.(TTLStorage)
+		if !ok {
+			continue
+		}
+		ttl := ttlStorage.TTL()
+		if ttl == 0 {
+			return 0
+		}
+		if shortest == 0 || ttl < shortest {
+			shortest = ttl
+		}
+	}
+	return shortest
+}
+
+// setTTL sets the given TTL on every one of the given storages implementing TTLStorage.
+func setTTL(ttl time.Duration, storages ...RLStorage) {
+	for _, storage := range storages {
+		if ttlStorage, ok := storage.(TTLStorage); ok {
+			ttlStorage.SetTTL(ttl)
+		}
+	}
+}
+
+// setTracer sets the given tracer on every one of the given storages implementing TracedStorage.
+func setTracer(tracer trace.Tracer, storages ...RLStorage) {
+	for _, storage := range storages {
+		if traced, ok := storage.(TracedStorage); ok {
+			traced.SetTracer(tracer)
+		}
+	}
+}
+
+// setKeyPrefix sets the given prefix on every one of the given storages implementing KeyPrefixer.
+func setKeyPrefix(prefix string, storages ...RLStorage) {
+	for _, storage := range storages {
+		if prefixer, ok := storage.(KeyPrefixer); ok {
+			prefixer.SetKeyPrefix(prefix)
+		}
+	}
+}
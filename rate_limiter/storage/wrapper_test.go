@@ -0,0 +1,210 @@
+package rlstorage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// wrappers returns a constructor per wrapper storage, wrapping the given primary storage together with
+// storages returned by newStorage in the other roles.
+func wrappers() map[string]func(primary RLStorage, newStorage func() RLStorage) RLStorage {
+	return map[string]func(RLStorage, func() RLStorage) RLStorage{
+		"replica": func(primary RLStorage, newStorage func() RLStorage) RLStorage {
+			return NewReadReplicaStorage(primary, newStorage())
+		},
+		"shadow": func(primary RLStorage, newStorage func() RLStorage) RLStorage {
+			return NewShadowCompareStorage(primary, newStorage(), nil)
+		},
+		"oom": func(primary RLStorage, newStorage func() RLStorage) RLStorage {
+			return NewOOMFallbackStorage(primary, newStorage(), time.Minute, nil)
+		},
+	}
+}
+
+// capabilities reports, by name, whether the given storage supports each optional interface (see As).
+func capabilities(storage RLStorage) map[string]bool {
+	_, atomic := As[CheckAndIncrementer](storage)
+	_, weighted := As[WeightedCheckAndIncrementer](storage)
+	_, increaser := As[IncreaserBy](storage)
+	_, bucket := As[BucketStorage](storage)
+	_, window := As[SlidingWindowStorage](storage)
+	_, gcra := As[GCRAStorage](storage)
+	_, violations := As[ViolationTracker](storage)
+	_, counter := As[KeyCounter](storage)
+	_, snapshotter := As[Snapshotter](storage)
+	_, sweeper := As[IdleSweeper](storage)
+	_, evictions := As[EvictionCounter](storage)
+	return map[string]bool{
+		"CheckAndIncrementer":         atomic,
+		"WeightedCheckAndIncrementer": weighted,
+		"IncreaserBy":                 increaser,
+		"BucketStorage":               bucket,
+		"SlidingWindowStorage":        window,
+		"GCRAStorage":                 gcra,
+		"ViolationTracker":            violations,
+		"KeyCounter":                  counter,
+		"Snapshotter":                 snapshotter,
+		"IdleSweeper":                 sweeper,
+		"EvictionCounter":             evictions,
+	}
+}
+
+func TestWrappersSupportCapabilitiesOfWrappedStorages(t *testing.T) {
+	for name, wrap := range wrappers() {
+		for _, test := range []struct {
+			storage    string
+			newStorage func() RLStorage
+		}{
+			{"hashmap", func() RLStorage { return NewHashMapStorage(discardLogger()) }},
+			{"redis", func() RLStorage { return newRedisStorage(t, time.Minute) }},
+			{"bounded", func() RLStorage { return NewBoundedStorage(1<<20, discardLogger()) }},
+			{"fixed window", func() RLStorage { return NewFixedWindowStorage(time.Minute, discardLogger()) }},
+			{"unavailable", func() RLStorage { return unavailableStorage{} }},
+		} {
+			want := capabilities(test.newStorage())
+			got := capabilities(wrap(test.newStorage(), test.newStorage))
+			for capability, supported := range want {
+				if got[capability] != supported {
+					t.Errorf("%s over %s: supports %s %t, want %t", name, test.storage, capability, got[capability], supported)
+				}
+			}
+		}
+	}
+}
+
+func TestAsChecksNestedWrappers(t *testing.T) {
+	hashmap := func() RLStorage { return NewHashMapStorage(discardLogger()) }
+	storage := NewReadReplicaStorage(NewShadowCompareStorage(hashmap(), unavailableStorage{}, nil))
+	if _, ok := As[CheckAndIncrementer](storage); ok {
+		t.Fatal("As() reported a check the innermost shadow storage does not implement")
+	}
+	storage = NewReadReplicaStorage(NewShadowCompareStorage(hashmap(), hashmap(), nil))
+	if _, ok := As[CheckAndIncrementer](storage); !ok {
+		t.Fatal("As() did not report a check every wrapped storage implements")
+	}
+}
+
+func TestWrappersForwardCapabilities(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for name, wrap := range wrappers() {
+		t.Run(name, func(t *testing.T) {
+			inner := NewHashMapStorage(discardLogger())
+			storage := wrap(inner, func() RLStorage { return NewHashMapStorage(discardLogger()) })
+
+			if taken, _, err := storage.(BucketStorage).TakeTokens("bucket", 2, 0.001, 2); err != nil || !taken {
+				t.Fatalf("TakeTokens() = %t, %v, want the tokens taken", taken, err)
+			}
+			if taken, _, _ := inner.(BucketStorage).TakeTokens("bucket", 1, 0.001, 2); taken {
+				t.Fatal("TakeTokens() did not take the tokens of the wrapped storage")
+			}
+			storage.(SlidingWindowStorage).CheckAndRecord("window", now, time.Minute, 1, 1)
+			if allowed, _, _, _ := inner.(SlidingWindowStorage).CheckAndRecord("window", now, time.Minute, 1, 1); allowed {
+				t.Fatal("CheckAndRecord() did not record the request on the wrapped storage")
+			}
+			storage.(GCRAStorage).UpdateTAT("tat", now, time.Second, 0, 1)
+			if allowed, _, _ := inner.(GCRAStorage).UpdateTAT("tat", now, time.Second, 0, 1); allowed {
+				t.Fatal("UpdateTAT() did not advance the TAT of the wrapped storage")
+			}
+			storage.(ViolationTracker).AddViolation("violator")
+			if count, err := storage.(ViolationTracker).Violations("violator"); err != nil || count != 1 {
+				t.Fatalf("Violations() = %d, %v, want 1", count, err)
+			}
+			if err := storage.(IncreaserBy).IncreaseBy("a", 3); err != nil {
+				t.Fatalf("IncreaseBy() error = %v", err)
+			}
+			expectCount(t, inner, "a", 3)
+			if count, err := storage.(KeyCounter).Len(); err != nil || count != 1 {
+				t.Fatalf("Len() = %d, %v, want 1", count, err)
+			}
+			if snapshot, err := storage.(Snapshotter).Snapshot(); err != nil || snapshot["a"] != 3 {
+				t.Fatalf("Snapshot() = %v, %v, want a counted 3 times", snapshot, err)
+			}
+			// The replica storage reads from its (empty) replica
+			want, _ := storage.Get("a")
+			if count, err := GetContext(context.Background(), storage, "a"); err != nil || count != want {
+				t.Fatalf("GetContext() = %d, %v, want %d", count, err, want)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if err := IncreaseContext(ctx, storage, "a"); !errors.Is(err, context.Canceled) {
+				t.Fatalf("IncreaseContext() with a cancelled context = %v, want context.Canceled", err)
+			}
+			expectCount(t, inner, "a", 3)
+		})
+	}
+}
+
+func TestWrappersForwardChecks(t *testing.T) {
+	for name, wrap := range wrappers() {
+		t.Run(name, func(t *testing.T) {
+			inner := NewHashMapStorage(discardLogger())
+			storage := wrap(inner, func() RLStorage { return NewHashMapStorage(discardLogger()) })
+
+			if allowed, count, _, err := storage.(CheckAndIncrementer).CheckAndIncrement("a", 2); err != nil || !allowed || count != 1 {
+				t.Fatalf("CheckAndIncrement() = %t, %d, %v, want allowed with count 1", allowed, count, err)
+			}
+			if allowed, count, _, err := storage.(WeightedCheckAndIncrementer).CheckAndIncrementBy("a", 2, 2); err != nil || allowed || count != 1 {
+				t.Fatalf("CheckAndIncrementBy() over the limit = %t, %d, %v, want rejected with count 1", allowed, count, err)
+			}
+			expectCount(t, inner, "a", 1)
+		})
+	}
+}
+
+func TestWrappersForwardTTLAndKeyPrefix(t *testing.T) {
+	for name, wrap := range wrappers() {
+		t.Run(name, func(t *testing.T) {
+			newStorage := func() RLStorage {
+				_, client := newMiniredis(t)
+				return NewRedisStorage(client, 0, discardLogger())
+			}
+			server, client := newMiniredis(t)
+			inner := NewRedisStorage(client, 0, discardLogger())
+			storage := wrap(inner, newStorage)
+
+			ttlStorage, ok := storage.(TTLStorage)
+			if !ok {
+				t.Fatal("the wrapper does not implement TTLStorage")
+			}
+			if ttl := ttlStorage.TTL(); ttl != 0 {
+				t.Fatalf("TTL() = %s, want the unset TTL of the wrapped storage", ttl)
+			}
+			ttlStorage.SetTTL(time.Minute)
+			if ttl := inner.(TTLStorage).TTL(); ttl != time.Minute {
+				t.Fatalf("TTL() of the wrapped storage = %s, want a minute", ttl)
+			}
+
+			storage.(KeyPrefixer).SetKeyPrefix("api:")
+			if err := storage.Increase("a"); err != nil {
+				t.Fatalf("Increase() error = %v", err)
+			}
+			if !server.Exists("api:" + countKeyPrefix + "a") {
+				t.Fatalf("keys = %v, want the counter under the api: prefix", server.Keys())
+			}
+			expectCount(t, inner, "a", 1)
+		})
+	}
+}
+
+func TestShortestTTL(t *testing.T) {
+	_, client := newMiniredis(t)
+	minute := NewRedisStorage(client, time.Minute, discardLogger())
+	second := NewRedisStorage(client, time.Second, discardLogger())
+	unset := NewRedisStorage(client, 0, discardLogger())
+	hashmap := NewHashMapStorage(discardLogger())
+	for _, test := range []struct {
+		name     string
+		storages []RLStorage
+		want     time.Duration
+	}{
+		{"shortest", []RLStorage{minute, hashmap, second}, time.Second},
+		{"unset", []RLStorage{minute, unset}, 0},
+		{"without TTL", []RLStorage{hashmap}, 0},
+	} {
+		if got := shortestTTL(test.storages...); got != test.want {
+			t.Errorf("shortestTTL() of %s = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
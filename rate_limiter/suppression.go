@@ -0,0 +1,94 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	rllog "github.com/FMotalleb/gin_testfield/rate_limiter/logging"
+)
+
+// rejectionLog is the per-client state of the rejection log suppression.
+type rejectionLog struct {
+	logged     uint16 // The number of rejections logged individually in the current window
+	suppressed uint64 // The number of rejections suppressed in the current window
+}
+
+// rejectionLogger logs rejected requests, collapsing the logs of clients with more than threshold
+// rejections within a window into a single periodic summary, to avoid log amplification.
+type rejectionLogger struct {
+	threshold uint16                   // The number of rejections logged individually per client and window
+	window    time.Duration            // The length of a suppression window
+	clients   map[string]*rejectionLog // The suppression state per client
+	lock      sync.Mutex               // A mutex lock guarding the suppression state
+	logger    rllog.Logger             // The logger the rejections are logged to
+}
+
+// newRejectionLogger creates a rejectionLogger with the given threshold and window.
+func newRejectionLogger(threshold uint16, window time.Duration, logger rllog.Logger) *rejectionLogger {
+	return &rejectionLogger{
+		threshold: threshold,
+		window:    window,
+		clients:   make(map[string]*rejectionLog),
+		logger:    logger.With("scope", "rate-limiter"),
+	}
+}
+
+// record logs the rejection of a request of the given client, unless the client exceeded
+// the threshold within the current window, in which case the rejection is only counted.
+func (rl *rejectionLogger) record(id string, limit uint16) {
+	rl.lock.Lock()
+	state, ok := rl.clients[id]
+	if !ok {
+		state = &rejectionLog{}
+		rl.clients[id] = state
+	}
+	suppress := state.logged >= rl.threshold
+	if suppress {
+		state.suppressed++
+	} else {
+		state.logged++
+	}
+	reachedThreshold := !suppress && state.logged == rl.threshold
+	rl.lock.Unlock()
+
+	if suppress {
+		return
+	}
+	rl.logger.Info("rejected request", "user_id", id, "limit", limit)
+	if reachedThreshold {
+		rl.logger.Info(fmt.Sprintf("suppressing further rejection logs of this client for %s", rl.window), "user_id", id)
+	}
+}
+
+// flush emits the summaries of all clients with suppressed rejections and starts a new window.
+func (rl *rejectionLogger) flush() {
+	rl.lock.Lock()
+	clients := rl.clients
+	rl.clients = make(map[string]*rejectionLog)
+	rl.lock.Unlock()
+
+	for id, state := range clients {
+		if state.suppressed == 0 {
+			continue
+		}
+		rejections := uint64(state.logged) + state.suppressed
+		rl.logger.Info(fmt.Sprintf("client %s: %d rejections in last %s", id, rejections, rl.window), "user_id", id, "rejections", rejections)
+	}
+}
+
+// run flushes the rejection logger once per window, until stop is closed.
+func (rl *rejectionLogger) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(rl.window)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			rl.flush()
+		case <-stop:
+			rl.flush()
+			return
+		}
+	}
+}
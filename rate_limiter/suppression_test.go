@@ -0,0 +1,58 @@
+package ratelimiter
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRejectionLoggerSuppressesAboveThreshold(t *testing.T) {
+	logger := newRecordingLogger()
+	rejections := newRejectionLogger(2, time.Minute, logger)
+
+	for i := 0; i < 5; i++ {
+		rejections.record("a", 1)
+	}
+	rejections.record("b", 1)
+	if logged := len(logger.infosWith("rejected request")); logged != 3 {
+		t.Errorf("logged %d rejections, want 2 of a and 1 of b", logged)
+	}
+	if notices := logger.infosWith("suppressing further rejection logs"); len(notices) != 1 || notices[0].attr("user_id") != "a" {
+		t.Errorf("suppression notices = %v, want a single one for a", notices)
+	}
+
+	rejections.flush()
+	summaries := logger.infosWith("rejections in last")
+	if len(summaries) != 1 || summaries[0].msg != "client a: 5 rejections in last 1m0s" {
+		t.Fatalf("summaries = %v, want a single one for the 5 rejections of a", summaries)
+	}
+
+	// The flush starts a new window, so a is logged individually again
+	rejections.record("a", 1)
+	if logged := len(logger.infosWith("rejected request")); logged != 4 {
+		t.Errorf("logged %d rejections after the flush, want 4", logged)
+	}
+}
+
+func TestRejectionLogsDisabledByZeroWindow(t *testing.T) {
+	logger := newRecordingLogger()
+	router := newRouter(t, newTestConfig().Logger(logger).Limit(1).RejectionLogSuppression(10, 0))
+
+	serve(router, http.MethodGet, "/")
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+	if logged := logger.infosWith("rejected request"); len(logged) != 0 {
+		t.Errorf("logged rejections %v with a zero window, want none", logged)
+	}
+}
+
+func TestRejectionsLoggedByMiddleware(t *testing.T) {
+	logger := newRecordingLogger()
+	router := newRouter(t, newTestConfig().Logger(logger).Limit(1))
+
+	serve(router, http.MethodGet, "/")
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+	logged := logger.infosWith("rejected request")
+	if len(logged) != 1 || logged[0].attr("user_id") != "192.0.2.1" {
+		t.Errorf("logged rejections = %v, want one for the client", logged)
+	}
+}
@@ -0,0 +1,53 @@
+package ratelimiter
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the tracer the middleware creates its spans with.
+const tracerName = "github.com/FMotalleb/gin_testfield/rate_limiter"
+
+// checkSpanName is the name of the span covering the rate limit decision of a request.
+const checkSpanName = "ratelimit.check"
+
+// Tracer sets the OpenTelemetry tracer provider the middleware creates its spans with. Every limited request gets a
+// `ratelimit.check` span, a child of the span of the request context (if any), covering the decision and carrying
+// the `ratelimit.id`, `ratelimit.limit`, `ratelimit.count` and `ratelimit.allowed` attributes.
+// Storages implementing rlstorage.TracedStorage (such as the Redis storage) are given the tracer at Build,
+// so their round trips show up as children of the decision span.
+//
+// Tracing is disabled by default, costing nothing beyond a nil check per request.
+func (cfg *Config) Tracer(provider trace.TracerProvider) *Config {
+	cfg.tracer = provider.Tracer(tracerName)
+	return cfg
+}
+
+// startCheckSpan starts the decision span of the request with the given ID as a child of ctx,
+// returning ctx as is and a nil span if tracing is disabled.
+func (cfg *Config) startCheckSpan(ctx context.Context, id string) (context.Context, trace.Span) {
+	if cfg.tracer == nil {
+		return ctx, nil
+	}
+	return cfg.tracer.Start(ctx, checkSpanName, trace.WithAttributes(attribute.String("ratelimit.id", id)))
+}
+
+// endCheckSpan records the outcome of the given result on the decision span and ends it, doing nothing if span is nil.
+func endCheckSpan(span trace.Span, res result) {
+	if span == nil {
+		return
+	}
+	span.SetAttributes(
+		attribute.Int("ratelimit.limit", int(res.limit)),
+		attribute.Int("ratelimit.count", int(res.count)),
+		attribute.Bool("ratelimit.allowed", res.decision == allowed),
+	)
+	if res.err != nil {
+		span.RecordError(res.err)
+		span.SetStatus(codes.Error, "storage failure")
+	}
+	span.End()
+}
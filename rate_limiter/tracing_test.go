@@ -0,0 +1,122 @@
+package ratelimiter
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newSpanRecorder returns a tracer provider recording its ended spans in the returned recorder.
+func newSpanRecorder(t testing.TB) (*sdktrace.TracerProvider, *tracetest.SpanRecorder) {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	t.Cleanup(func() { provider.Shutdown(context.Background()) })
+	return provider, recorder
+}
+
+// spanAttr returns the value of the attribute of the given span with the given key.
+func spanAttr(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, attr := range span.Attributes() {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestCheckSpansCarryDecision(t *testing.T) {
+	provider, recorder := newSpanRecorder(t)
+	router := newRouter(t, newTestConfig().Limit(1).Tracer(provider))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusTooManyRequests)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want one per request", len(spans))
+	}
+	for i, allowed := range []bool{true, false} {
+		span := spans[i]
+		if span.Name() != checkSpanName {
+			t.Errorf("span name = %q, want %q", span.Name(), checkSpanName)
+		}
+		if id := spanAttr(span, "ratelimit.id").AsString(); id != "192.0.2.1" {
+			t.Errorf("ratelimit.id = %q, want 192.0.2.1", id)
+		}
+		if limit := spanAttr(span, "ratelimit.limit").AsInt64(); limit != 1 {
+			t.Errorf("ratelimit.limit = %d, want 1", limit)
+		}
+		if count := spanAttr(span, "ratelimit.count").AsInt64(); count != 1 {
+			t.Errorf("ratelimit.count = %d, want 1", count)
+		}
+		if got := spanAttr(span, "ratelimit.allowed").AsBool(); got != allowed {
+			t.Errorf("ratelimit.allowed of request %d = %t, want %t", i+1, got, allowed)
+		}
+	}
+}
+
+func TestCheckSpanRecordsStorageErrors(t *testing.T) {
+	provider, recorder := newSpanRecorder(t)
+	router := newRouter(t, newTestConfig().Storage(failingStorage{rlstorage.NewNullStorage()}).Tracer(provider))
+
+	serve(router, http.MethodGet, "/")
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("recorded %d spans, want 1", len(spans))
+	}
+	if status := spans[0].Status(); status.Code != codes.Error {
+		t.Errorf("span status = %v, want an error", status)
+	}
+	if events := spans[0].Events(); len(events) == 0 || events[0].Name != "exception" {
+		t.Errorf("span events = %v, want the storage error recorded", events)
+	}
+}
+
+func TestStorageSpansAreChildrenOfCheckSpan(t *testing.T) {
+	provider, recorder := newSpanRecorder(t)
+	_, client := newMiniredis(t)
+	router := newRouter(t, newTestConfig().Storage(rlstorage.NewRedisStorage(client, time.Minute, discardLogger())).Tracer(provider))
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	var check sdktrace.ReadOnlySpan
+	var storageSpans []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == checkSpanName {
+			check = span
+		} else {
+			storageSpans = append(storageSpans, span)
+		}
+	}
+	if check == nil || len(storageSpans) == 0 {
+		t.Fatalf("recorded spans = %d storage spans and check span %v, want both", len(storageSpans), check)
+	}
+	for _, span := range storageSpans {
+		if span.Parent().SpanID() != check.SpanContext().SpanID() {
+			t.Errorf("span %q is not a child of the check span", span.Name())
+		}
+		if id := spanAttr(span, "ratelimit.id").AsString(); id != "192.0.2.1" {
+			t.Errorf("ratelimit.id of %q = %q, want 192.0.2.1", span.Name(), id)
+		}
+	}
+}
+
+func TestTracingDisabledByDefault(t *testing.T) {
+	cfg := newTestConfig()
+	build(t, cfg)
+
+	if cfg.tracer != nil {
+		t.Fatal("tracing is enabled by default")
+	}
+	ctx := context.Background()
+	if spanCtx, span := cfg.startCheckSpan(ctx, "a"); span != nil || spanCtx != ctx {
+		t.Fatal("startCheckSpan() without a tracer started a span")
+	}
+}
@@ -0,0 +1,127 @@
+package ratelimiter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	rllog "github.com/FMotalleb/gin_testfield/rate_limiter/logging"
+)
+
+// The delivery settings of the webhook.
+const (
+	webhookBufferSize  = 4096                   // The number of events buffered before new events are dropped
+	webhookMaxAttempts = 4                      // The number of attempts to deliver a batch before it is dropped
+	webhookBackoff     = 250 * time.Millisecond // The delay before the first retry, doubled on every retry
+	webhookTimeout     = 10 * time.Second       // The timeout of a single delivery attempt
+)
+
+// webhook posts batches of decision events to an HTTP endpoint from its own goroutine,
+// so a slow or failing endpoint never blocks the request path.
+type webhook struct {
+	url           string          // The endpoint the batches are posted to
+	batchSize     int             // The number of events that triggers a delivery
+	flushInterval time.Duration   // The interval after which a partial batch is delivered
+	client        *http.Client    // The HTTP client used to deliver the batches
+	events        chan AuditEvent // The buffered events waiting for delivery
+	dropped       atomic.Uint64   // The number of events dropped because the buffer was full or delivery failed
+	logger        rllog.Logger    // Logger instance for logging delivery failures
+}
+
+// newWebhook creates a webhook posting batches of events to the given URL.
+func newWebhook(url string, batchSize int, flushInterval time.Duration, logger rllog.Logger) *webhook {
+	return &webhook{
+		url:           url,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		client:        &http.Client{Timeout: webhookTimeout},
+		events:        make(chan AuditEvent, webhookBufferSize),
+		logger:        logger.With("scope", "rate-limiter-webhook"),
+	}
+}
+
+// record queues the given event for delivery, dropping (and counting) it if the buffer is full.
+func (w *webhook) record(event AuditEvent) {
+	select {
+	case w.events <- event:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+// run collects the queued events into batches and delivers them whenever a batch is full or the flush
+// interval elapses, until stop is closed. The pending batch is delivered once more (without retries) on stop.
+func (w *webhook) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]AuditEvent, 0, w.batchSize)
+	for {
+		select {
+		case event := <-w.events:
+			batch = append(batch, event)
+			if len(batch) < w.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-stop:
+			if len(batch) > 0 && w.post(batch) != nil {
+				w.dropped.Add(uint64(len(batch)))
+			}
+			return
+		}
+		w.deliver(batch, stop)
+		batch = batch[:0]
+		ticker.Reset(w.flushInterval)
+	}
+}
+
+// deliver posts the given batch, retrying with exponential backoff. The batch is dropped (and counted)
+// once every attempt failed, or if stop is closed while waiting for a retry.
+func (w *webhook) deliver(batch []AuditEvent, stop <-chan struct{}) {
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err := w.post(batch)
+		if err == nil {
+			return
+		}
+		if attempt == webhookMaxAttempts {
+			w.logger.Warn("failed to deliver batch, dropping it", "events", len(batch), "error", err)
+			w.dropped.Add(uint64(len(batch)))
+			return
+		}
+		w.logger.Debug("failed to deliver batch, retrying", "attempt", attempt, "error", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			w.dropped.Add(uint64(len(batch)))
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// post sends the given batch as a JSON array. Responses other than 2xx are reported as errors.
+func (w *webhook) post(batch []AuditEvent) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	response, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package ratelimiter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookServer is an endpoint recording the batches posted to it, answering with the status returned by status.
+func webhookServer(t *testing.T, status func() int) (*httptest.Server, <-chan []AuditEvent) {
+	t.Helper()
+	batches := make(chan []AuditEvent, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", got)
+		}
+		var batch []AuditEvent
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("decoding the batch failed: %v", err)
+		}
+		batches <- batch
+		w.WriteHeader(status())
+	}))
+	t.Cleanup(server.Close)
+	return server, batches
+}
+
+// receiveBatch waits for the next batch posted to the webhook server.
+func receiveBatch(t *testing.T, batches <-chan []AuditEvent) []AuditEvent {
+	t.Helper()
+	select {
+	case batch := <-batches:
+		return batch
+	case <-time.After(5 * time.Second):
+		t.Fatal("no batch delivered")
+		return nil
+	}
+}
+
+func TestWebhookDeliversFullBatches(t *testing.T) {
+	server, batches := webhookServer(t, func() int { return http.StatusNoContent })
+	router := newRouter(t, newTestConfig().Limit(2).Webhook(server.URL, 3, time.Hour).WorkerCount(4))
+
+	for i := 0; i < 6; i++ {
+		serve(router, http.MethodGet, "/")
+	}
+	var outcomes []string
+	for i := 0; i < 2; i++ {
+		batch := receiveBatch(t, batches)
+		if len(batch) != 3 {
+			t.Fatalf("batch %d has %d events, want 3", i+1, len(batch))
+		}
+		for _, event := range batch {
+			outcomes = append(outcomes, event.Outcome)
+		}
+	}
+	want := []string{"allowed", "allowed", "limited", "limited", "limited", "limited"}
+	for i := range want {
+		if outcomes[i] != want[i] {
+			t.Fatalf("outcomes = %v, want %v", outcomes, want)
+		}
+	}
+}
+
+func TestWebhookFlushesPartialBatches(t *testing.T) {
+	server, batches := webhookServer(t, func() int { return http.StatusOK })
+	cfg := newTestConfig().Limit(5).Webhook(server.URL, 100, 50*time.Millisecond)
+	router := newRouter(t, cfg)
+
+	serve(router, http.MethodGet, "/")
+	serve(router, http.MethodGet, "/")
+	if batch := receiveBatch(t, batches); len(batch) != 2 {
+		t.Fatalf("flushed batch has %d events, want 2", len(batch))
+	}
+	if dropped := cfg.WebhookDropped(); dropped != 0 {
+		t.Errorf("WebhookDropped() = %d, want 0", dropped)
+	}
+}
+
+func TestWebhookRetriesFailedDeliveries(t *testing.T) {
+	var attempts atomic.Int32
+	server, batches := webhookServer(t, func() int {
+		if attempts.Add(1) == 1 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	cfg := newTestConfig().Limit(5).Webhook(server.URL, 1, time.Hour)
+	router := newRouter(t, cfg)
+
+	serve(router, http.MethodGet, "/")
+	first, retried := receiveBatch(t, batches), receiveBatch(t, batches)
+	if len(first) != 1 || len(retried) != 1 || first[0] != retried[0] {
+		t.Fatalf("retried batch = %+v, want the failed batch %+v", retried, first)
+	}
+	if dropped := cfg.WebhookDropped(); dropped != 0 {
+		t.Errorf("WebhookDropped() = %d after a successful retry, want 0", dropped)
+	}
+}
+
+func TestWebhookDropsBatchPendingRetryOnStop(t *testing.T) {
+	server, batches := webhookServer(t, func() int { return http.StatusInternalServerError })
+	hook := newWebhook(server.URL, 2, time.Hour, discardLogger())
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		hook.run(stop)
+		close(done)
+	}()
+
+	hook.record(AuditEvent{Key: "a"})
+	hook.record(AuditEvent{Key: "b"})
+	receiveBatch(t, batches)
+	close(stop)
+	<-done
+	if dropped := hook.dropped.Load(); dropped != 2 {
+		t.Errorf("dropped = %d, want the 2 events awaiting a retry", dropped)
+	}
+}
+
+func TestWebhookDropsEventsWhenBufferIsFull(t *testing.T) {
+	hook := newWebhook("http://192.0.2.1", 1, time.Hour, discardLogger())
+	for i := 0; i < webhookBufferSize+3; i++ {
+		hook.record(AuditEvent{})
+	}
+	if dropped := hook.dropped.Load(); dropped != 3 {
+		t.Errorf("dropped = %d, want 3", dropped)
+	}
+}
@@ -0,0 +1,49 @@
+package ratelimiter
+
+import (
+	"math"
+	"time"
+)
+
+// defaultWorkerIdleTimeout is the default duration after which an idle worker started on demand exits.
+const defaultWorkerIdleTimeout = 30 * time.Second
+
+// lowWorkerRatio is the ratio of limit to workerCount above which Build warns about an undersized worker pool.
+const lowWorkerRatio = 4
+
+// autoWorkerCount returns the number of workers needed to hold the requests of expectedClients
+// clients each using their full limit, capped at math.MaxUint16.
+func autoWorkerCount(limit, expectedClients uint16) uint16 {
+	return uint16(min(uint32(limit)*uint32(expectedClients), math.MaxUint16))
+}
+
+// spawnWorker starts a new worker releasing the given entry if workers are started on demand and
+// fewer than workerCount are running. It reports whether a worker was started.
+// It must be called with the lifecycle lock read-held (see enqueue), so the worker is either added to the
+// workers group before the middleware is closed or shut down (and waited for by Close and Shutdown), or not at all.
+func (cfg *Config) spawnWorker(entry rateEntry) bool {
+	if !cfg.lazyWorkers || cfg.closed() {
+		return false
+	}
+	for {
+		running := cfg.running.Load()
+		if running >= int32(cfg.workerCount) {
+			return false
+		}
+		if cfg.running.CompareAndSwap(running, running+1) {
+			cfg.workers.Add(1)
+			go rlWorker(cfg, uint16(running+1), &entry)
+			return true
+		}
+	}
+}
+
+// idleTimeout returns a channel firing once a worker started on demand has been idle for too long,
+// or nil (never firing) if workers are started eagerly.
+func (cfg *Config) idleTimeout() (<-chan time.Time, func()) {
+	if !cfg.lazyWorkers {
+		return nil, func() {}
+	}
+	fired, stop := cfg.startTimer(cfg.clock().Add(cfg.workerIdleTimeout))
+	return fired, func() { stop() }
+}
@@ -0,0 +1,257 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	rlstorage "github.com/FMotalleb/gin_testfield/rate_limiter/storage"
+)
+
+func TestLazyWorkersStartOnDemand(t *testing.T) {
+	cfg := newTestConfig().LazyWorkers(true).WorkerCount(2).Timeout(time.Hour).QueueTimeout(10 * time.Millisecond)
+	router := newRouter(t, cfg)
+	if running := cfg.running.Load(); running != 0 {
+		t.Fatalf("%d workers running after Build, want 0", running)
+	}
+
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	if running := cfg.running.Load(); running != 1 {
+		t.Fatalf("%d workers running after a request, want 1", running)
+	}
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	// Both workers hold an entry until the timeout, and no more are started
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusServiceUnavailable)
+	if running := cfg.running.Load(); running != 2 {
+		t.Errorf("%d workers running, want WorkerCount", running)
+	}
+}
+
+func TestLazyWorkersScaleDownWhenIdle(t *testing.T) {
+	clock := newFakeClock(time.Unix(1000, 0))
+	released := make(chan struct{}, 2)
+	cfg := clock.drive(newTestConfig().LazyWorkers(true).WorkerCount(2).WorkerIdleTimeout(time.Minute).
+		Timeout(time.Second).Tolerance(0).QueueTimeout(10 * time.Millisecond).
+		OnRelease(func(string, map[string]string) { released <- struct{}{} }))
+	router := newRouter(t, cfg)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+
+	clock.waitForTimers(t, 2) // Both workers wait for the release time of their entry
+	clock.Advance(time.Second)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-released:
+		case <-time.After(time.Second):
+			t.Fatal("the entries were not released")
+		}
+	}
+	clock.waitForTimers(t, 2) // Both workers wait for their idle timeout
+	clock.Advance(time.Minute - time.Millisecond)
+	if running := cfg.running.Load(); running != 2 {
+		t.Fatalf("%d workers running before the idle timeout, want 2", running)
+	}
+
+	clock.Advance(time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for cfg.running.Load() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d workers running after the idle timeout, want 0", cfg.running.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// The pool scales back up on demand
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	if running := cfg.running.Load(); running != 1 {
+		t.Errorf("%d workers running after a request, want 1", running)
+	}
+}
+
+func TestLazyWorkersValidation(t *testing.T) {
+	if err := newTestConfig().LazyWorkers(true).QueueSize(10).Validate(); err == nil {
+		t.Error("Validate() = nil for LazyWorkers with QueueSize, want an error")
+	}
+	if err := newTestConfig().LazyWorkers(true).WorkerIdleTimeout(0).Validate(); err == nil {
+		t.Error("Validate() = nil for LazyWorkers without a WorkerIdleTimeout, want an error")
+	}
+}
+
+// waitForIdleQueue waits until the workers picked up every buffered entry of the release queue.
+func waitForIdleQueue(t *testing.T, cfg *Config) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for len(cfg.queue) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d entries still buffered", len(cfg.queue))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQueueSizeBuffersEntriesBeyondWorkers(t *testing.T) {
+	cfg := newTestConfig().Limit(10).Timeout(time.Hour).WorkerCount(1).QueueSize(3).QueueTimeout(time.Hour)
+	router := newRouter(t, cfg)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	waitForIdleQueue(t, cfg) // The only worker holds the first entry
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("buffered requests took %v, want them queued without waiting for a worker", elapsed)
+	}
+	if buffered := len(cfg.queue); buffered != 3 {
+		t.Errorf("%d entries buffered, want 3", buffered)
+	}
+}
+
+func TestDropWhenQueueFullRejectsRightAway(t *testing.T) {
+	storage := newCountingStorage()
+	cfg := newTestConfig().Storage(storage).Limit(10).Timeout(time.Hour).WorkerCount(1).QueueSize(1).DropWhenQueueFull(true)
+	router := newRouter(t, cfg)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	waitForIdleQueue(t, cfg)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+
+	start := time.Now()
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusServiceUnavailable)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the dropped request took %v, want it rejected right away", elapsed)
+	}
+	if count, _ := storage.Get("192.0.2.1"); count != 2 {
+		t.Errorf("count = %d, want the dropped request rolled back", count)
+	}
+}
+
+func TestQueueTimeoutRejectsWhenQueueStaysFull(t *testing.T) {
+	cfg := newTestConfig().Limit(10).Timeout(time.Hour).WorkerCount(1).QueueSize(1).QueueTimeout(20 * time.Millisecond)
+	router := newRouter(t, cfg)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	waitForIdleQueue(t, cfg)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+
+	start := time.Now()
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusServiceUnavailable)
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("the request was rejected after %v, want it to wait for the queue timeout", elapsed)
+	}
+}
+
+func TestNullStorageNeverQueuesReleases(t *testing.T) {
+	configs := map[string]*Config{
+		"counter":       newTestConfig(),
+		"status weight": newTestConfig().StatusWeight(func(int) uint16 { return 1 }),
+	}
+	for name, cfg := range configs {
+		t.Run(name, func(t *testing.T) {
+			router := newRouter(t, cfg.Storage(rlstorage.NewNullStorage()).Limit(1).WorkerCount(2).Timeout(5*time.Second))
+
+			start := time.Now()
+			for i := 0; i < 5; i++ {
+				expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("requests took %v, want none of them waiting for a worker", elapsed)
+			}
+			if buffered := len(cfg.queue); buffered != 0 {
+				t.Errorf("%d entries queued, want none", buffered)
+			}
+		})
+	}
+}
+
+func TestWorkerLifecycleIsLoggedAtDebug(t *testing.T) {
+	logger := newRecordingLogger()
+	cfg := newTestConfig().Logger(logger).WorkerCount(2).Timeout(time.Hour)
+	router := newRouter(t, cfg)
+	expectStatus(t, serve(router, http.MethodGet, "/"), http.StatusOK)
+	waitForIdleQueue(t, cfg)
+	cfg.Shutdown()
+	cfg.Shutdown()
+
+	for _, message := range []string{"starting", "waiting for timeout", "stopping"} {
+		if len(logger.debugsWith(message)) == 0 {
+			t.Errorf("no %q entry logged at debug", message)
+		}
+		if infos := logger.infosWith(message); len(infos) != 0 {
+			t.Errorf("%q logged at info: %v", message, infos)
+		}
+	}
+	if shutdowns := logger.infosWith("shutting down"); len(shutdowns) != 1 {
+		t.Errorf("shutdown logged %d times at info, want once", len(shutdowns))
+	}
+	if waits := logger.debugsWith("waiting for timeout"); waits[0].attr("user_id") != "192.0.2.1" {
+		t.Errorf("release wait logged for %v, want the client", waits[0].attr("user_id"))
+	}
+}
+
+func TestAutoWorkerCount(t *testing.T) {
+	for _, test := range []struct {
+		limit, clients, want uint16
+	}{
+		{60, 1, 60},
+		{60, 10, 600},
+		{1000, 1000, math.MaxUint16},
+	} {
+		if got := autoWorkerCount(test.limit, test.clients); got != test.want {
+			t.Errorf("autoWorkerCount(%d, %d) = %d, want %d", test.limit, test.clients, got, test.want)
+		}
+	}
+}
+
+func TestAutoWorkersOverridesWorkerCount(t *testing.T) {
+	cfg := newTestConfig().Limit(5).WorkerCount(1).AutoWorkers(3)
+	build(t, cfg)
+
+	if cfg.workerCount != 15 {
+		t.Fatalf("workerCount = %d, want limit × expected clients (15)", cfg.workerCount)
+	}
+}
+
+func TestUndersizedWorkerPoolWarns(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		cfg   *Config
+		warns bool
+	}{
+		{"undersized", NewConfigBuilder().Limit(100).WorkerCount(24), true},
+		{"quarter of the limit", NewConfigBuilder().Limit(100).WorkerCount(25), false},
+		{"auto-sized", NewConfigBuilder().Limit(100).WorkerCount(1).AutoWorkers(1), false},
+		{"token bucket", NewConfigBuilder().Limit(100).WorkerCount(1).TokenBucket(1, 10), false},
+	} {
+		logger := newRecordingLogger()
+		build(t, test.cfg.Logger(logger).DisableFullCleanup())
+		if warned := logger.warned("is far lower than `Limit`"); warned != test.warns {
+			t.Errorf("%s: Build() warned %t, want %t", test.name, warned, test.warns)
+		}
+	}
+}
+
+// BenchmarkBurst serves bursts of concurrent requests to a small worker pool, with an unbuffered release
+// queue (requests wait for a free worker) and with a queue buffering a whole burst.
+func BenchmarkBurst(b *testing.B) {
+	const burst, workers = 64, 4
+	for _, size := range []int{0, burst} {
+		b.Run(fmt.Sprintf("QueueSize(%d)", size), func(b *testing.B) {
+			cfg := newTestConfig().Limit(math.MaxUint16).WorkerCount(workers).QueueSize(size).
+				Timeout(time.Millisecond).Tolerance(0)
+			router := newRouter(b, cfg)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				for j := 0; j < burst; j++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						serve(router, http.MethodGet, "/")
+					}()
+				}
+				wg.Wait()
+			}
+		})
+	}
+}